@@ -9,6 +9,6 @@ func main() {
 	f := func(m statsd.Metric) {
 		log.Printf("%s", m)
 	}
-	r := statsd.MetricReceiver{":8125", HanlderFunc(f)}
+	r := statsd.MetricReceiver{Addr: ":8125", Handler: statsd.HandlerFunc(f)}
 	r.ListenAndReceive()
 }
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"../statsd"
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"math/rand"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// bench implements "gostatsd bench", which sends synthetic metrics to a server at a given
+// rate and reports the rate achieved and, given the server's admin API, how many were lost
+func bench(args []string) {
+	fs := flag.NewFlagSet("bench", flag.ExitOnError)
+	addr := fs.String("addr", defaultMetricsAddr, "address of the server to send metrics to")
+	network := fs.String("network", "udp", "network to send over: udp or tcp")
+	adminAddr := fs.String("admin", "", "if set, address of the server's admin API, used to measure loss")
+	buckets := fs.Int("buckets", 1000, "number of distinct buckets")
+	types := fs.String("types", "c,g,ms", "comma separated metric types to send")
+	tags := fs.Int("tags", 0, "number of tags per metric")
+	tagValues := fs.Int("tag-values", 10, "number of distinct values of each tag")
+	rate := fs.Int("rate", 10000, "metrics per second to send")
+	packetSize := fs.Int("packet", 1400, "maximum packet size in bytes")
+	duration := fs.Duration("d", 10*time.Second, "how long to send for")
+	fs.Parse(args)
+
+	typeList := strings.Split(*types, ",")
+	conn, err := net.Dial(*network, *addr)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer conn.Close()
+
+	var before statsd.AggregatorStats
+	if *adminAddr != "" {
+		if before, err = fetchStats(*adminAddr); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	// Send a slice of the rate every tick, packing as many lines as fit in each packet
+	const tick = 10 * time.Millisecond
+	perTick := float64(*rate) * tick.Seconds()
+	ticker := time.NewTicker(tick)
+	defer ticker.Stop()
+	var sent, packets, sendErrors int
+	var bytesSent int64
+	var due float64
+	packet := new(bytes.Buffer)
+	flush := func() {
+		if packet.Len() == 0 {
+			return
+		}
+		n, err := conn.Write(packet.Bytes())
+		if err != nil {
+			sendErrors++
+		}
+		bytesSent += int64(n)
+		packets++
+		packet.Reset()
+	}
+
+	start := time.Now()
+	for time.Since(start) < *duration {
+		<-ticker.C
+		due += perTick
+		for ; due >= 1; due-- {
+			line := benchLine(*buckets, typeList, *tags, *tagValues)
+			if packet.Len()+len(line) > *packetSize {
+				flush()
+			}
+			packet.WriteString(line)
+			sent++
+		}
+		flush()
+	}
+	elapsed := time.Since(start)
+
+	fmt.Printf("sent %d metrics in %d packets (%d bytes) in %s\n", sent, packets, bytesSent, elapsed)
+	fmt.Printf("achieved rate: %.0f metrics/s, %.0f packets/s\n", float64(sent)/elapsed.Seconds(), float64(packets)/elapsed.Seconds())
+	if sendErrors > 0 {
+		fmt.Printf("send errors: %d\n", sendErrors)
+	}
+	if *adminAddr != "" {
+		// Give the server a moment to drain its queue
+		time.Sleep(time.Second)
+		after, err := fetchStats(*adminAddr)
+		if err != nil {
+			log.Fatal(err)
+		}
+		received := after.MetricsReceived - before.MetricsReceived
+		lost := int64(sent) - received
+		if lost < 0 {
+			lost = 0 // the server received metrics from others too
+		}
+		fmt.Printf("received: %d, lost: %d (%.2f%%)\n", received, lost, 100*float64(lost)/float64(sent))
+	}
+}
+
+// benchLine returns a random metric line
+func benchLine(buckets int, types []string, tags, tagValues int) string {
+	typ := types[rand.Intn(len(types))]
+	line := fmt.Sprintf("bench.%s.%d:%d|%s", typ, rand.Intn(buckets), rand.Intn(1000), typ)
+	for i := 0; i < tags; i++ {
+		if i == 0 {
+			line += "|#"
+		} else {
+			line += ","
+		}
+		line += fmt.Sprintf("tag%d:v%d", i, rand.Intn(tagValues))
+	}
+	return line + "\n"
+}
+
+// fetchStats reads the statistics of the aggregator from the admin API at addr
+func fetchStats(addr string) (statsd.AggregatorStats, error) {
+	var stats statsd.AggregatorStats
+	url := "http://" + addr + "/api/stats"
+	resp, err := http.Get(url)
+	if err != nil {
+		return stats, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return stats, fmt.Errorf("%s: %s", url, resp.Status)
+	}
+	err = json.NewDecoder(resp.Body).Decode(&stats)
+	return stats, err
+}
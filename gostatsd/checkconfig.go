@@ -0,0 +1,108 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"sort"
+	"time"
+)
+
+// checkConfig implements "gostatsd check-config", which validates configuration files
+// without starting a server and exits with status 1 if any of them has errors
+func checkConfig(args []string) {
+	fs := flag.NewFlagSet("check-config", flag.ExitOnError)
+	probe := fs.Bool("probe", false, "also check that the hosts of the backends accept connections")
+	timeout := fs.Duration("probe-timeout", 5*time.Second, "how long to wait for each host to accept a connection")
+	fs.Usage = func() {
+		fmt.Fprintln(os.Stderr, "usage: gostatsd check-config [-probe] file...")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if fs.NArg() == 0 {
+		fs.Usage()
+		os.Exit(2)
+	}
+
+	failed := false
+	for _, name := range fs.Args() {
+		var errs []error
+		cfg, err := readConfig(name, true)
+		if err != nil {
+			errs = []error{err}
+		} else {
+			errs = cfg.validate()
+			if len(errs) == 0 && *probe {
+				errs = probeHosts(cfg, *timeout)
+			}
+		}
+		for _, err := range errs {
+			fmt.Printf("%s: %s\n", name, err)
+		}
+		if len(errs) > 0 {
+			failed = true
+		} else {
+			fmt.Printf("%s: ok\n", name)
+		}
+	}
+	if failed {
+		os.Exit(1)
+	}
+}
+
+// probeHosts connects to the hosts of the destinations and event backends of cfg and
+// returns an error for each one that doesn't accept the connection within timeout
+func probeHosts(cfg *config, timeout time.Duration) []error {
+	// Several backends may share a host, which is only probed once
+	hosts := make(map[string]string)
+	for _, d := range cfg.Destinations {
+		what := fmt.Sprintf("destination %q", d.Address)
+		for _, addr := range []string{d.Address, d.Options["url"]} {
+			if host := probeAddr(addr); host != "" {
+				hosts[host] = what
+			}
+		}
+	}
+	if cfg.Events != nil {
+		for name, b := range cfg.Events.Backends {
+			if host := probeAddr(b.Options["url"]); host != "" {
+				hosts[host] = fmt.Sprintf("event backend %q", name)
+			}
+		}
+	}
+
+	var errs []error
+	for host, what := range hosts {
+		conn, err := net.DialTimeout("tcp", host, timeout)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s: %s", what, err))
+			continue
+		}
+		conn.Close()
+	}
+	sort.Slice(errs, func(i, j int) bool { return errs[i].Error() < errs[j].Error() })
+	return errs
+}
+
+// probeAddr returns the host and port to probe for addr, a URL or a host and port, or ""
+// if addr is neither, e.g. a DSN or a command
+func probeAddr(addr string) string {
+	if u, err := url.Parse(addr); err == nil && u.Host != "" {
+		if u.Port() != "" {
+			return u.Host
+		}
+		switch u.Scheme {
+		case "http", "ws":
+			return net.JoinHostPort(u.Hostname(), "80")
+		case "https", "wss":
+			return net.JoinHostPort(u.Hostname(), "443")
+		}
+		return ""
+	}
+	if host, port, err := net.SplitHostPort(addr); err == nil && host != "" && port != "" {
+		return addr
+	}
+	return ""
+}
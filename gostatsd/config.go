@@ -0,0 +1,356 @@
+package main
+
+import (
+	"../statsd"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"os/signal"
+	"sort"
+	"syscall"
+	"time"
+)
+
+// config is the layout of the JSON file given with -config
+type config struct {
+	Settings map[string]json.RawMessage `json:"settings"` // Values of flags, by name without the dash
+
+	Rollups []statsd.RollupRule `json:"rollups"`
+	Alerts  []statsd.AlertRule  `json:"alerts"`
+	Anomaly *anomalyConfig      `json:"anomaly"`
+
+	Tokens map[string][]string `json:"tokens"`
+
+	Quotas []statsd.Quota `json:"quotas"`
+
+	Mappings    []statsd.MappingRule `json:"mappings"`
+	TagPolicies []statsd.TagPolicy   `json:"tag_policies"`
+	TagRollups  []statsd.TagRollup   `json:"tag_rollups"`
+
+	Schema           []statsd.SchemaRule `json:"schema"`
+	SchemaReportOnly bool                `json:"schema_report_only"` // Only report the violations instead of dropping them
+
+	Histograms  []statsd.Histogram     `json:"histograms"`
+	Percentiles []statsd.PercentileSet `json:"percentiles"`
+
+	Metadata []statsd.Metadata `json:"metadata"`
+
+	TenantTag string          `json:"tenant_tag"`
+	Tenants   []statsd.Tenant `json:"tenants"`
+
+	Destinations []destination `json:"destinations"`
+
+	Scrape *scrapeConfig `json:"scrape"`
+
+	Events *eventsConfig `json:"events"`
+
+	Compare *compareConfig `json:"compare"`
+}
+
+// compareConfig configures a candidate aggregator fed the same metrics as the main one,
+// whose flushes are compared with the main one's. Unset settings are those of the main one.
+type compareConfig struct {
+	RoundCounts   *bool                   `json:"round_counts"`
+	GaugeExtremes *bool                   `json:"gauge_extremes"`
+	CounterEvents *bool                   `json:"counter_events"`
+	SetPrecision  *uint8                  `json:"set_precision"`
+	TimerUnit     string                  `json:"timer_unit"`
+	Histograms    *[]statsd.Histogram     `json:"histograms"`
+	Percentiles   *[]statsd.PercentileSet `json:"percentiles"`
+	Tolerance     float64                 `json:"tolerance"` // Relative difference up to which values are equal
+	Report        string                  `json:"report"`    // File the differences are appended to as JSON lines, logged if empty
+
+	timerUnit statsd.TimeUnit
+}
+
+// validate checks the settings of the candidate
+func (c *compareConfig) validate() (err error) {
+	if p := c.SetPrecision; p != nil && *p != 0 && (*p < statsd.MinHLLPrecision || *p > statsd.MaxHLLPrecision) {
+		return fmt.Errorf("compare: set_precision must be between %d and %d", statsd.MinHLLPrecision, statsd.MaxHLLPrecision)
+	}
+	if c.TimerUnit != "" {
+		if c.timerUnit, err = statsd.ParseTimeUnit(c.TimerUnit); err != nil {
+			return fmt.Errorf("compare: %s", err)
+		}
+	}
+	if c.Histograms != nil {
+		for _, h := range *c.Histograms {
+			if err := h.Validate(); err != nil {
+				return fmt.Errorf("compare: %s", err)
+			}
+		}
+	}
+	if c.Percentiles != nil {
+		for _, p := range *c.Percentiles {
+			if err := p.Validate(); err != nil {
+				return fmt.Errorf("compare: %s", err)
+			}
+		}
+	}
+	if c.Tolerance < 0 {
+		return fmt.Errorf("compare: negative tolerance")
+	}
+	return nil
+}
+
+// eventsConfig configures where DogStatsD events are sent
+type eventsConfig struct {
+	Backends map[string]eventBackend `json:"backends"` // By name
+	Routes   []statsd.EventRoute     `json:"routes"`
+}
+
+// eventBackend is an event backend along with its backend specific settings
+type eventBackend struct {
+	Type    string            `json:"type"` // e.g. "webhook"
+	Options map[string]string `json:"options"`
+}
+
+// router returns the EventRouter sending events along the configured routes
+func (c *eventsConfig) router() (*statsd.EventRouter, error) {
+	router := &statsd.EventRouter{Routes: c.Routes, Backends: make(map[string]statsd.EventHandler)}
+	for name, b := range c.Backends {
+		handler, err := statsd.NewEventBackend(b.Type, b.Options)
+		if err != nil {
+			return nil, fmt.Errorf("event backend %q: %s", name, err)
+		}
+		router.Backends[name] = handler
+	}
+	return router, nil
+}
+
+// scrapeConfig configures the scraping of Prometheus endpoints
+type scrapeConfig struct {
+	Targets  []string `json:"targets"`
+	Interval string   `json:"interval"` // Defaults to 15s
+
+	interval time.Duration
+}
+
+// destination sends the metrics of some types, or those carrying a tag, to their own backend,
+// flushed at their own interval
+type destination struct {
+	Types         []string          `json:"types"`          // "counter", "gauge", "timer" or "set", all if empty with a tag
+	Backend       string            `json:"backend"`        // Defaults to "graphite"
+	Address       string            `json:"address"`        // Address of the backend server
+	Options       map[string]string `json:"options"`        // Backend specific settings
+	FlushInterval string            `json:"flush_interval"` // Defaults to the -f flag
+	CounterEvents *bool             `json:"counter_events"` // Defaults to the -counter-events flag
+	TimerUnit     string            `json:"timer_unit"`     // Defaults to the -flush-timer-unit flag
+	Tag           string            `json:"tag"`            // If set, only the metrics carrying this tag, e.g. "team:payments"
+
+	// If any of these are set flushes are queued so a slow backend doesn't hold back the others
+	MaxInFlight int    `json:"max_in_flight"` // Flushes sent concurrently, only 1 is supported
+	SendTimeout string `json:"send_timeout"`  // How long a flush may take before it's given up on
+	QueueLength int    `json:"queue_length"`  // Flushes waiting to be sent, 10 by default
+
+	types       []statsd.MetricType
+	timerUnit   statsd.TimeUnit
+	interval    time.Duration
+	sendTimeout time.Duration
+}
+
+// validate checks the destination and parses its types and durations
+func (d *destination) validate() (err error) {
+	if len(d.Types) == 0 && d.Tag == "" {
+		return fmt.Errorf("destination %q: missing types or tag", d.Address)
+	}
+	d.types = nil
+	for _, s := range d.Types {
+		t, err := statsd.ParseMetricType(s)
+		if err != nil {
+			return fmt.Errorf("destination %q: %s", d.Address, err)
+		}
+		d.types = append(d.types, t)
+	}
+	if d.FlushInterval != "" {
+		if d.interval, err = time.ParseDuration(d.FlushInterval); err != nil || d.interval <= 0 {
+			return fmt.Errorf("destination %q: invalid flush interval %q", d.Address, d.FlushInterval)
+		}
+	}
+	if d.TimerUnit != "" {
+		if d.timerUnit, err = statsd.ParseTimeUnit(d.TimerUnit); err != nil {
+			return fmt.Errorf("destination %q: %s", d.Address, err)
+		}
+	}
+	if d.SendTimeout != "" {
+		if d.sendTimeout, err = time.ParseDuration(d.SendTimeout); err != nil || d.sendTimeout <= 0 {
+			return fmt.Errorf("destination %q: invalid send timeout %q", d.Address, d.SendTimeout)
+		}
+	}
+	if d.MaxInFlight > 1 {
+		return fmt.Errorf("destination %q: backends send one flush at a time, max_in_flight can't be %d", d.Address, d.MaxInFlight)
+	}
+	return nil
+}
+
+// anomalyConfig configures the anomaly detection of flushed series
+type anomalyConfig struct {
+	Metrics []string `json:"metrics"`
+	Alpha   float64  `json:"alpha"`
+	Sigmas  float64  `json:"sigmas"`
+	Warmup  int      `json:"warmup"`
+}
+
+// loadConfig reads and validates the configuration file name
+func loadConfig(name string) (*config, error) {
+	cfg, err := readConfig(name, false)
+	if err != nil {
+		return nil, err
+	}
+	if errs := cfg.validate(); len(errs) > 0 {
+		return nil, errs[0]
+	}
+	return cfg, nil
+}
+
+// readConfig decodes the configuration file name without validating it. If strict is
+// set keys that aren't part of the configuration are errors rather than ignored.
+func readConfig(name string, strict bool) (*config, error) {
+	b, err := ioutil.ReadFile(name)
+	if err != nil {
+		return nil, err
+	}
+	cfg := new(config)
+	dec := json.NewDecoder(bytes.NewReader(b))
+	if strict {
+		dec.DisallowUnknownFields()
+	}
+	if err := dec.Decode(cfg); err != nil {
+		if syntax, ok := err.(*json.SyntaxError); ok {
+			line := 1 + bytes.Count(b[:syntax.Offset], []byte{'\n'})
+			return nil, fmt.Errorf("line %d: %s", line, err)
+		}
+		return nil, err
+	}
+	return cfg, nil
+}
+
+// validate checks the configuration and parses its durations, returning all the errors
+// found rather than only the first
+func (cfg *config) validate() []error {
+	var errs []error
+	check := func(err error) {
+		if err != nil {
+			errs = append(errs, err)
+		}
+	}
+	for _, r := range cfg.Rollups {
+		check(r.Validate())
+	}
+	errs = append(errs, statsd.ValidateAlertRules(cfg.Alerts)...)
+	for _, q := range cfg.Quotas {
+		if q.Policy != "" && q.Policy != statsd.QuotaDrop && q.Policy != statsd.QuotaSample {
+			check(fmt.Errorf("quota %q: unknown policy %q", q.Prefix, q.Policy))
+		}
+	}
+	for _, h := range cfg.Histograms {
+		check(h.Validate())
+	}
+	for _, p := range cfg.Percentiles {
+		check(p.Validate())
+	}
+	for _, m := range cfg.Metadata {
+		check(m.Validate())
+	}
+	for _, r := range cfg.Schema {
+		check(r.Validate())
+	}
+	for _, r := range cfg.Mappings {
+		check(r.Validate())
+	}
+	if s := cfg.Scrape; s != nil && s.Interval != "" {
+		var err error
+		if s.interval, err = time.ParseDuration(s.Interval); err != nil || s.interval <= 0 {
+			check(fmt.Errorf("invalid scrape interval %q", s.Interval))
+		}
+	}
+	if e := cfg.Events; e != nil {
+		for name, b := range e.Backends {
+			if !knownName(statsd.EventBackends(), b.Type) {
+				check(fmt.Errorf("event backend %q: unknown type %q", name, b.Type))
+			}
+		}
+		for _, r := range e.Routes {
+			check(r.Validate())
+			for _, name := range r.Backends {
+				if _, ok := e.Backends[name]; !ok {
+					check(fmt.Errorf("event route to unknown backend %q", name))
+				}
+			}
+		}
+	}
+	if cfg.Compare != nil {
+		check(cfg.Compare.validate())
+	}
+	for i := range cfg.Destinations {
+		d := &cfg.Destinations[i]
+		check(d.validate())
+		if d.Backend != "" && !knownName(statsd.Backends(), d.Backend) {
+			check(fmt.Errorf("destination %q: unknown backend %q", d.Address, d.Backend))
+		}
+	}
+	return errs
+}
+
+// knownName reports whether name is one of the sorted names
+func knownName(names []string, name string) bool {
+	i := sort.SearchStrings(names, name)
+	return i < len(names) && names[i] == name
+}
+
+// secretSenders are the senders of the destinations referring to secrets, created again
+// by rotateSecrets
+var secretSenders []*statsd.SecretSender
+
+// rotateSecrets creates the senders referring to secrets again on SIGHUP, so they pick
+// up rotated secrets, until the program exits
+func rotateSecrets() {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	for _ = range hup {
+		for _, s := range secretSenders {
+			if err := s.Rotate(); err != nil {
+				log.Printf("rotating the secrets of %s %q: %s", s.Backend, s.Address, err)
+			}
+		}
+		log.Printf("rotated the secrets of %d destinations", len(secretSenders))
+	}
+}
+
+// newSender returns the sender of a destination's backend, measuring the latency of
+// canary if set
+func newSender(d destination, canary *statsd.Canary) (statsd.MetricSender, error) {
+	backend := d.Backend
+	if backend == "" {
+		backend = "graphite"
+	}
+	var sender statsd.MetricSender
+	var err error
+	if statsd.HasSecrets(d.Address, d.Options) {
+		var s *statsd.SecretSender
+		if s, err = statsd.NewSecretSender(backend, d.Address, d.Options); err == nil {
+			secretSenders = append(secretSenders, s)
+			sender = s
+		}
+	} else {
+		sender, err = statsd.NewBackend(backend, d.Address, d.Options)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("destination %q: %s", d.Address, err)
+	}
+	if canary != nil {
+		sender = canary.Sender(backend, sender)
+	}
+	if d.MaxInFlight > 0 || d.sendTimeout > 0 || d.QueueLength > 0 {
+		sender = &statsd.SendQueue{
+			Name:    backend + " " + d.Address,
+			Sender:  sender,
+			Timeout: d.sendTimeout,
+			Length:  d.QueueLength,
+		}
+	}
+	return sender, nil
+}
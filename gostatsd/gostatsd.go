@@ -5,49 +5,365 @@ import (
 	// "github.com/fabware/gostatsd/statsd"
 	"../statsd"
 	"log"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
 	"time"
 )
 
 const (
 	defaultMetricsAddr   = "localhost:8125"
 	defaultConsoleAddr   = "localhost:8126"
+	defaultAdminAddr     = "localhost:8127"
 	defaultGraphiteAddr  = "localhost:2003"
 	defaultFlushInterval = 10 * time.Second
 )
 
 func main() {
-	metricsAddr := flag.String("l", defaultMetricsAddr, "address on which to listen for metrics")
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "top":
+			top(os.Args[2:])
+			return
+		case "bench":
+			bench(os.Args[2:])
+			return
+		case "validate-backend":
+			validateBackend(os.Args[2:])
+			return
+		case "check-config":
+			checkConfig(os.Args[2:])
+			return
+		}
+	}
+
+	flag.String("config", "", "if set, read rules and settings from this JSON configuration file")
+	metricsAddr := flag.String("l", defaultMetricsAddr, "comma separated addresses on which to listen for metrics")
+	network := flag.String("network", "udp", "network to listen on: udp4, udp6 or udp for dual-stack")
+	multicastIface := flag.String("multicast-iface", "", "network interface used to join multicast listen addresses")
+	readBuffer := flag.Int("rcvbuf", 0, "if set, the kernel receive buffer size (SO_RCVBUF) of the listening sockets in bytes")
+	busyPoll := flag.Int("busy-poll", 0, "if set, busy poll the listening sockets for this many microseconds (SO_BUSY_POLL, Linux only)")
+	tos := flag.Int("tos", 0, "if set, the type of service (IP_TOS) of the listening sockets")
+	stateFile := flag.String("state", "", "if set, save the aggregator state to this file on shutdown and restore it on startup")
+	walDir := flag.String("wal", "", "if set, journal incoming metrics to this directory and replay unflushed ones on startup")
+	haID := flag.Int("ha-id", 0, "identifier of this instance in a high availability pair, a positive number different from the other's; the lower one wins ties")
+	haAddr := flag.String("ha-listen", "", "if set, address on which to exchange heartbeats with the other instance of a high availability pair")
+	haPeer := flag.String("ha-peer", "", "address of the other instance of a high availability pair")
+	kernelStatsInterval := flag.Duration("kernel-stats", 0, "if set, how often to report kernel packet drops of the listening sockets (Linux only)")
 	graphiteAddr := flag.String("g", defaultGraphiteAddr, "address of the graphite server")
 	flushInterval := flag.Duration("f", defaultFlushInterval, "how often to flush metrics to the graphite server")
+	dnsRefresh := flag.Duration("dns-refresh", statsd.DNSRefreshInterval, "how often to resolve backend host names again and reopen graphite connections")
+	flushJitter := flag.Duration("flush-jitter", 0, "if set, send each flush after a random delay up to this long, so a fleet of servers doesn't hit the backends at once")
+	subInterval := flag.Duration("sub-interval", 0, "if set, send summaries at this resolution with each flush")
+	roundCounts := flag.Bool("round-counts", false, "round the counts of counters to integers when flushing, for backends that only take integers")
+	gaugeExtremes := flag.Bool("gauge-extremes", false, "also flush the min, max and last value of gauges updated during each interval")
+	counterEvents := flag.Bool("counter-events", false, "also flush the number of increments of counters, as stats.counters.events")
+	setPrecision := flag.Uint("set-precision", 0, "if set, estimate sets with HyperLogLogs of 2^n registers, n from 4 to 16, instead of counting them exactly")
+	timerUnit := flag.String("timer-unit", "ms", "unit of the timers sent by clients: s, ms or us")
+	flushTimerUnit := flag.String("flush-timer-unit", "ms", "unit of the flushed timer statistics: s, ms or us")
+	serviceCheckTimeout := flag.Duration("service-check-timeout", 0, "if set, set the gauges of service checks that weren't received for this long to 3, unknown")
+	lateness := flag.Duration("lateness", 0, "if set, flush intervals this long after they end and aggregate the metrics timestamped during them meanwhile with them")
+	keepHistory := flag.Bool("history", false, "keep the flushed metrics of the last day in memory, at decreasing resolutions, for the admin API")
+	snapshots := flag.Int("snapshots", 0, "if set, keep this many of the last flushes in memory as they were sent, for the admin API")
+	memoryBudget := flag.Int64("memory-budget", 0, "if set, the estimated memory in MB the aggregated series may take before metrics are shed")
+	shedPolicy := flag.String("shed-policy", "drop_new", "how metrics are shed once -memory-budget is used up: drop_new drops new series, downsample_timers also samples the values of timers")
+	watchdogQueue := flag.Float64("watchdog-queue", 0, "if set, warn when the aggregation queue is fuller than this fraction of its size, e.g. 0.8")
+	watchdogGoroutines := flag.Int("watchdog-goroutines", 0, "if set, warn when more goroutines than this are running")
+	watchdogFlush := flag.Duration("watchdog-flush-latency", 0, "if set, warn when sending a flush takes longer than this")
+	rejectQueue := flag.Float64("reject-queue", 0, "if set, drop datagrams and refuse HTTP requests while the aggregation queue is fuller than this fraction of its size")
+	rejectGoroutines := flag.Int("reject-goroutines", 0, "if set, drop datagrams and refuse HTTP requests while more goroutines than this are running")
+	canaryInterval := flag.Duration("canary", 0, "if set, inject a canary gauge this often, usually the flush interval, and flush its latency up to each backend as statsd.e2e_latency")
+	duplicateSources := flag.Int("duplicate-sources", 0, "if set, track the sources of each bucket and report the gauges written by at least this many hosts without a host tag")
+	selfMetrics := flag.Bool("self-metrics", false, "report the Go runtime and process statistics of the server as statsd.self.*")
+	perSender := flag.Int("per-sender", 0, "if set, flush the packets, metrics and bytes received from the sources sending the most as statsd.per_sender.*, this many of them")
+	queueSize := flag.Int("queue", 10000, "number of received metrics queued for aggregation")
+	adaptiveSampling := flag.Bool("adaptive-sampling", false, "downsample busy counters and timers while the queue is filling up")
 	webConsoleAddr := flag.String("web", "", "if set, use as the address of the web-based console")
 	consoleAddr := flag.String("console", "", "if set, use as the address of the telnet-based console ")
+	upstreamAddr := flag.String("upstream", "", "if set, send the state of each interval to be merged by the admin API at this address instead of flushing it")
+	adminAddr := flag.String("admin", "", "if set, use as the address of the HTTP admin API")
+	logLevel := flag.String("loglevel", "info", "log level: debug, info or error")
+	dtlsAddr := flag.String("dtls", "", "if set, also listen for DTLS encrypted metrics on this address")
+	dtlsCert := flag.String("dtls-cert", "", "PEM encoded certificate file for the DTLS listener")
+	dtlsKey := flag.String("dtls-key", "", "PEM encoded private key file for the DTLS listener")
+	maxLineLength := flag.Int("max-line-length", 0, "reject lines longer than this many bytes, 65535 if not set")
+	truncateLines := flag.Bool("truncate-long-lines", false, "cut lines longer than -max-line-length after their last tag that fits instead of rejecting them")
+	strictFraming := flag.Bool("strict-framing", false, "drop the last line of a TCP or QUIC stream if it doesn't end with a newline")
+	tcpAddr := flag.String("tcp", "", "if set, also accept newline terminated metrics over TCP on this address")
+	httpAddr := flag.String("http", "", "if set, also accept metrics POSTed to this address over HTTP")
+	quicAddr := flag.String("quic", "", "if set, also listen for metrics over QUIC on this address")
+	quicCert := flag.String("quic-cert", "", "PEM encoded certificate file for the QUIC listener")
+	quicKey := flag.String("quic-key", "", "PEM encoded private key file for the QUIC listener")
+	collectdAddr := flag.String("collectd", "", "if set, also accept collectd's binary network protocol on this address, usually :25826")
+	pipeName := flag.String("pipe", "", `if set, also accept newline terminated metrics on this Windows named pipe, e.g. \\.\pipe\gostatsd`)
+	dockerSocket := flag.String("docker-socket", "", "if set, tag the metrics of local Docker containers with their name and image, listed through the Docker API socket at this path, usually /var/run/docker.sock")
+	dockerLabels := flag.String("docker-labels", "", "comma separated container labels also added as tags with -docker-socket")
+	mirrorAddr := flag.String("mirror", "", "if set, copy the raw datagrams received over UDP and DTLS to the statsd server at this address, e.g. a shadow deployment")
+	serviceName := flag.String("service-name", "gostatsd", "name of the Windows service the server runs as, if started by the service manager")
 	flag.Parse()
-
-	// Start the metric aggregator
-	graphite, err := statsd.NewGraphiteClient(*graphiteAddr)
+	cfg := new(config)
+	if name := lookupConfigFile(flag.CommandLine); name != "" {
+		var err error
+		if cfg, err = loadConfig(name); err != nil {
+			log.Fatal(err)
+		}
+	}
+	settings, err := overlaySettings(flag.CommandLine, cfg.Settings)
+	if err != nil {
+		log.Fatal(err)
+	}
+	level, err := statsd.ParseLogLevel(*logLevel)
 	if err != nil {
 		log.Fatal(err)
 	}
-	aggregator := statsd.NewMetricAggregator(&graphite, *flushInterval)
-	go aggregator.Aggregate()
+	statsd.SetLogLevel(level)
+	statsd.DNSRefreshInterval = *dnsRefresh
+	inputTimerUnit, err := statsd.ParseTimeUnit(*timerUnit)
+	if err != nil {
+		log.Fatalf("-timer-unit: %s", err)
+	}
+	outputTimerUnit, err := statsd.ParseTimeUnit(*flushTimerUnit)
+	if err != nil {
+		log.Fatalf("-flush-timer-unit: %s", err)
+	}
+	if *setPrecision != 0 && (*setPrecision < statsd.MinHLLPrecision || *setPrecision > statsd.MaxHLLPrecision) {
+		log.Fatalf("-set-precision must be between %d and %d", statsd.MinHLLPrecision, statsd.MaxHLLPrecision)
+	}
+	shed, err := statsd.ParseShedPolicy(*shedPolicy)
+	if err != nil {
+		log.Fatalf("-shed-policy: %s", err)
+	}
+	if *stateFile != "" && *walDir != "" {
+		log.Fatal("-state and -wal can't be used together")
+	}
+	if *lateness > 0 && *walDir != "" {
+		log.Fatal("-lateness and -wal can't be used together")
+	}
+	if *upstreamAddr != "" && *walDir != "" {
+		log.Fatal("-upstream and -wal can't be used together")
+	}
 
-	// Start the metric receiver
-	f := func(metric statsd.Metric) {
-		aggregator.MetricChan <- metric
+	for _, m := range cfg.Metadata {
+		statsd.SetMetadata(m)
+	}
+
+	// Build the server
+	var events statsd.EventHandler
+	if cfg.Events != nil {
+		if events, err = cfg.Events.router(); err != nil {
+			log.Fatal(err)
+		}
+	}
+	serverConfig := statsd.Config{
+		Addr:                *metricsAddr,
+		Network:             *network,
+		TCPAddr:             *tcpAddr,
+		HTTPAddr:            *httpAddr,
+		DTLSAddr:            *dtlsAddr,
+		DTLSCertFile:        *dtlsCert,
+		DTLSKeyFile:         *dtlsKey,
+		QUICAddr:            *quicAddr,
+		QUICCertFile:        *quicCert,
+		QUICKeyFile:         *quicKey,
+		PipeName:            *pipeName,
+		CollectdAddr:        *collectdAddr,
+		MulticastInterface:  *multicastIface,
+		SocketOptions:       statsd.SocketOptions{ReadBuffer: *readBuffer, BusyPoll: *busyPoll, TOS: *tos},
+		KernelStatsInterval: *kernelStatsInterval,
+		Tokens:              cfg.Tokens,
+		StrictFraming:       *strictFraming,
+		MaxLineLength:       *maxLineLength,
+		TruncateLongLines:   *truncateLines,
+		Events:              events,
+		AdminAddr:           *adminAddr,
+		Settings:            func() interface{} { return settings },
+		FlushInterval:       *flushInterval,
+		FlushJitter:         *flushJitter,
+		QueueSize:           *queueSize,
+		StateFile:           *stateFile,
+		WALDir:              *walDir,
+		SubInterval:         *subInterval,
+		RoundCounts:         *roundCounts,
+		GaugeExtremes:       *gaugeExtremes,
+		CounterEvents:       *counterEvents,
+		SetPrecision:        uint8(*setPrecision),
+		TimerUnit:           outputTimerUnit,
+		Histograms:          cfg.Histograms,
+		Percentiles:         cfg.Percentiles,
+		Lateness:            *lateness,
+		MemoryBudget:        *memoryBudget << 20,
+		ShedPolicy:          shed,
+		Backends:            []statsd.BackendConfig{{Name: "graphite", Address: *graphiteAddr}},
+		Alerts:              cfg.Alerts,
+		Rollups:             cfg.Rollups,
+		Tenants:             cfg.Tenants,
+		TenantTag:           cfg.TenantTag,
+		Mappings:            cfg.Mappings,
+		Schema:              cfg.Schema,
+		SchemaReportOnly:    cfg.SchemaReportOnly,
+		TagPolicies:         cfg.TagPolicies,
+		Quotas:              cfg.Quotas,
+		AdaptiveSampling:    *adaptiveSampling,
+		TagRollups:          cfg.TagRollups,
+		InputTimerUnit:      inputTimerUnit,
+		ServiceCheckTimeout: *serviceCheckTimeout,
+		SelfMetrics:         *selfMetrics,
+		DuplicateSources:    *duplicateSources,
+		PerSender:           *perSender,
+	}
+	if *upstreamAddr != "" {
+		serverConfig.Upstream = &statsd.StateClient{Addr: *upstreamAddr}
+	}
+	if *haAddr != "" {
+		serverConfig.Elector = &statsd.PeerElector{
+			ID:       *haID,
+			Addr:     *haAddr,
+			PeerAddr: *haPeer,
+			Interval: time.Second,
+			Timeout:  3 * time.Second,
+		}
+	}
+	if *canaryInterval > 0 {
+		serverConfig.Canary = &statsd.Canary{Interval: *canaryInterval}
+	}
+	if cfg.Anomaly != nil {
+		serverConfig.Anomaly = &statsd.AnomalyDetector{
+			Metrics: cfg.Anomaly.Metrics,
+			Alpha:   cfg.Anomaly.Alpha,
+			Sigmas:  cfg.Anomaly.Sigmas,
+			Warmup:  cfg.Anomaly.Warmup,
+		}
+	}
+	if *webConsoleAddr != "" {
+		serverConfig.Stream = &statsd.MetricStream{}
+	}
+	if *keepHistory || *snapshots > 0 {
+		serverConfig.History = &statsd.MetricHistory{Snapshots: *snapshots}
+		if !*keepHistory {
+			serverConfig.History.Resolutions = []statsd.Resolution{}
+		}
+	}
+	if cfg.Compare != nil {
+		serverConfig.Compare = &statsd.FlushComparator{Tolerance: cfg.Compare.Tolerance}
+		if cfg.Compare.Report != "" {
+			f, err := os.OpenFile(cfg.Compare.Report, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+			if err != nil {
+				log.Fatal(err)
+			}
+			serverConfig.Compare.Report = f
+		}
+		serverConfig.Candidate = newCandidate(cfg.Compare, &serverConfig)
+	}
+	if *dockerSocket != "" {
+		docker := &statsd.DockerTagger{Socket: *dockerSocket}
+		if *dockerLabels != "" {
+			docker.Labels = strings.Split(*dockerLabels, ",")
+		}
+		serverConfig.Tagger = docker
+	}
+	if *mirrorAddr != "" {
+		serverConfig.Mirror = &statsd.Mirror{Addr: *mirrorAddr}
+	}
+	if *watchdogQueue > 0 || *watchdogGoroutines > 0 || *watchdogFlush > 0 || *rejectQueue > 0 || *rejectGoroutines > 0 {
+		serverConfig.Watchdog = &statsd.Watchdog{
+			MaxQueue:         *watchdogQueue,
+			MaxGoroutines:    *watchdogGoroutines,
+			MaxFlushLatency:  *watchdogFlush,
+			RejectQueue:      *rejectQueue,
+			RejectGoroutines: *rejectGoroutines,
+		}
+	}
+	if cfg.Scrape != nil {
+		serverConfig.ScrapeTargets = cfg.Scrape.Targets
+		serverConfig.ScrapeInterval = cfg.Scrape.interval
+	}
+	for _, d := range cfg.Destinations {
+		sender, err := newSender(d, serverConfig.Canary)
+		if err != nil {
+			log.Fatal(err)
+		}
+		serverConfig.Destinations = append(serverConfig.Destinations, statsd.Destination{
+			Sender:        sender,
+			Types:         d.types,
+			Tag:           d.Tag,
+			FlushInterval: d.interval,
+			TimerUnit:     d.timerUnit,
+			CounterEvents: d.CounterEvents,
+		})
+	}
+	if len(secretSenders) > 0 {
+		go rotateSecrets()
+	}
+	server, err := statsd.NewServer(serverConfig)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if err := server.Start(); err != nil {
+		log.Fatal(err)
 	}
-	receiver := statsd.MetricReceiver{*metricsAddr, statsd.HandlerFunc(f)}
-	go receiver.ListenAndReceive()
 
 	// Start the console(s)
 	if *consoleAddr != "" {
-		console := statsd.ConsoleServer{*consoleAddr, &aggregator}
+		console := statsd.ConsoleServer{*consoleAddr, server.Aggregator}
 		go console.ListenAndServe()
 	}
 	if *webConsoleAddr != "" {
-		console := statsd.WebConsoleServer{*webConsoleAddr, &aggregator}
+		console := statsd.WebConsoleServer{Addr: *webConsoleAddr, Aggregator: server.Aggregator, Stream: serverConfig.Stream}
 		go console.ListenAndServe()
 	}
 
-	// Listen forever
-	select {}
+	// Listen until asked to stop, then stop receiving and flush the current interval, or
+	// save it to be restored on startup
+	stopped := waitForStop(*serviceName)
+	if err := server.Stop(); err != nil {
+		log.Fatal(err)
+	}
+	stopped()
+}
+
+// waitForSignal blocks until the process is interrupted or terminated and returns the
+// function to call once the server has shut down
+func waitForSignal() func() {
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, os.Interrupt, syscall.SIGTERM)
+	<-sig
+	return func() {}
+}
+
+// newCandidate returns the candidate aggregator of an A/B comparison. It takes its
+// settings from those of the server unless c overrides them.
+func newCandidate(c *compareConfig, defaults *statsd.Config) *statsd.MetricAggregator {
+	aggregator := statsd.NewMetricAggregator(nil, defaults.FlushInterval)
+	aggregator.SubInterval = defaults.SubInterval
+	aggregator.RoundCounts = defaults.RoundCounts
+	aggregator.GaugeExtremes = defaults.GaugeExtremes
+	aggregator.CounterEvents = defaults.CounterEvents
+	aggregator.SetPrecision = defaults.SetPrecision
+	aggregator.Histograms = defaults.Histograms
+	aggregator.Percentiles = defaults.Percentiles
+	aggregator.TimerUnit = defaults.TimerUnit
+	aggregator.MetricChan = make(chan statsd.Metric, defaults.QueueSize)
+	if c.RoundCounts != nil {
+		aggregator.RoundCounts = *c.RoundCounts
+	}
+	if c.GaugeExtremes != nil {
+		aggregator.GaugeExtremes = *c.GaugeExtremes
+	}
+	if c.CounterEvents != nil {
+		aggregator.CounterEvents = *c.CounterEvents
+	}
+	if c.SetPrecision != nil {
+		aggregator.SetPrecision = *c.SetPrecision
+	}
+	if c.timerUnit != "" {
+		aggregator.TimerUnit = c.timerUnit
+	}
+	if c.Histograms != nil {
+		aggregator.Histograms = *c.Histograms
+	}
+	if c.Percentiles != nil {
+		aggregator.Percentiles = *c.Percentiles
+	}
+	return &aggregator
 }
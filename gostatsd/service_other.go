@@ -0,0 +1,10 @@
+//go:build !windows
+// +build !windows
+
+package main
+
+// waitForStop blocks until the server is asked to stop by a signal and returns the
+// function to call once it has shut down
+func waitForStop(name string) func() {
+	return waitForSignal()
+}
@@ -0,0 +1,80 @@
+//go:build windows
+// +build windows
+
+package main
+
+import (
+	"log"
+
+	"golang.org/x/sys/windows/svc"
+	"golang.org/x/sys/windows/svc/eventlog"
+)
+
+// waitForStop blocks until the server is asked to stop, by the service control manager
+// when it runs as the Windows service name or else by a signal, and returns the function
+// to call once the server has shut down
+func waitForStop(name string) func() {
+	isService, err := svc.IsWindowsService()
+	if err != nil {
+		log.Fatal(err)
+	}
+	if !isService {
+		return waitForSignal()
+	}
+
+	// Nobody reads the standard error of services
+	if elog, err := eventlog.Open(name); err == nil {
+		log.SetFlags(0)
+		log.SetOutput(eventLogWriter{elog})
+	}
+	s := &service{stop: make(chan struct{}), done: make(chan struct{})}
+	finished := make(chan struct{})
+	go func() {
+		if err := svc.Run(name, s); err != nil {
+			log.Fatalf("running as service %q: %s", name, err)
+		}
+		close(finished)
+	}()
+	<-s.stop
+	return func() {
+		close(s.done)
+		<-finished
+	}
+}
+
+// service reports to the service control manager while the server runs
+type service struct {
+	stop chan struct{} // Closed when the service manager asks the server to stop
+	done chan struct{} // Closed once the server has shut down
+}
+
+// Execute reports the server running and waits for the service manager to stop it
+func (s *service) Execute(args []string, requests <-chan svc.ChangeRequest, status chan<- svc.Status) (bool, uint32) {
+	status <- svc.Status{State: svc.Running, Accepts: svc.AcceptStop | svc.AcceptShutdown}
+	log.Print("service started")
+	for req := range requests {
+		switch req.Cmd {
+		case svc.Interrogate:
+			status <- req.CurrentStatus
+		case svc.Stop, svc.Shutdown:
+			log.Print("service stopping")
+			status <- svc.Status{State: svc.StopPending}
+			close(s.stop)
+			<-s.done
+			return false, 0
+		default:
+			log.Printf("unexpected service control request %d", req.Cmd)
+		}
+	}
+	return false, 0
+}
+
+// eventLogWriter writes the log to the Windows event log
+type eventLogWriter struct {
+	elog *eventlog.Log
+}
+
+// Write writes a log message as an information event
+func (w eventLogWriter) Write(b []byte) (int, error) {
+	return len(b), w.elog.Info(1, string(b))
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+)
+
+// envPrefix is prepended to the name of a flag, upper cased with its dashes replaced by
+// underscores, to make the environment variable setting it, e.g. GOSTATSD_FLUSH_JITTER
+const envPrefix = "GOSTATSD_"
+
+// Where the effective value of a flag comes from, from the lowest precedence to the highest
+const (
+	fromDefault = "default"
+	fromFile    = "file"
+	fromEnv     = "env"
+	fromFlag    = "flag"
+)
+
+// setting is the effective value of a flag and where it comes from
+type setting struct {
+	Name   string `json:"name"`
+	Value  string `json:"value"`
+	Source string `json:"source"`
+}
+
+// envName returns the environment variable setting the flag name
+func envName(name string) string {
+	return envPrefix + strings.ToUpper(strings.Replace(name, "-", "_", -1))
+}
+
+// settingValue returns the value of a setting of the configuration file as a flag
+// would take it: strings without their quotes, numbers and booleans as written
+func settingValue(raw json.RawMessage) string {
+	var s string
+	if err := json.Unmarshal(raw, &s); err == nil {
+		return s
+	}
+	return string(raw)
+}
+
+// lookupConfigFile returns the configuration file to read, from the -config flag or
+// else the environment, since it can't come from the file itself
+func lookupConfigFile(fs *flag.FlagSet) string {
+	name := fs.Lookup("config").Value.String()
+	if name == "" {
+		name = os.Getenv(envName("config"))
+	}
+	return name
+}
+
+// overlaySettings sets the flags of fs that weren't given on the command line from the
+// environment or, failing that, from the settings of the configuration file. It returns
+// the effective value of every flag, sorted by name.
+func overlaySettings(fs *flag.FlagSet, file map[string]json.RawMessage) ([]setting, error) {
+	for name := range file {
+		if fs.Lookup(name) == nil {
+			return nil, fmt.Errorf("settings: unknown flag %q", name)
+		}
+		if name == "config" {
+			return nil, fmt.Errorf("settings: config can't be set in the configuration file")
+		}
+	}
+	given := make(map[string]bool)
+	fs.Visit(func(f *flag.Flag) {
+		given[f.Name] = true
+	})
+
+	var settings []setting
+	var err error
+	fs.VisitAll(func(f *flag.Flag) {
+		source := fromDefault
+		switch env, ok := os.LookupEnv(envName(f.Name)); {
+		case given[f.Name]:
+			source = fromFlag
+		case ok:
+			source = fromEnv
+			if e := fs.Set(f.Name, env); e != nil && err == nil {
+				err = fmt.Errorf("%s: %s", envName(f.Name), e)
+			}
+		case file[f.Name] != nil:
+			source = fromFile
+			if e := fs.Set(f.Name, settingValue(file[f.Name])); e != nil && err == nil {
+				err = fmt.Errorf("settings: %s: %s", f.Name, e)
+			}
+		}
+		settings = append(settings, setting{f.Name, f.Value.String(), source})
+	})
+	sort.Slice(settings, func(i, j int) bool { return settings[i].Name < settings[j].Name })
+	return settings, err
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"../statsd"
+	"bufio"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"sort"
+	"text/tabwriter"
+	"time"
+)
+
+// sortKeys maps the keys accepted by top to the column they sort by
+var sortKeys = map[byte]string{'r': "rate", 'v': "value", 'n': "name", 'p': "p99"}
+
+// top implements "gostatsd top", a live view of the busiest buckets of a running server
+// fetched from its admin API
+func top(args []string) {
+	fs := flag.NewFlagSet("top", flag.ExitOnError)
+	adminAddr := fs.String("admin", defaultAdminAddr, "address of the server's admin API")
+	sortBy := fs.String("sort", "rate", "column to sort by: rate, value, name or p99")
+	count := fs.Int("n", 20, "number of buckets to show")
+	interval := fs.Duration("i", 2*time.Second, "refresh interval")
+	fs.Parse(args)
+
+	// Change the sort column by typing its initial followed by enter
+	keys := make(chan string)
+	go func() {
+		stdin := bufio.NewReader(os.Stdin)
+		for {
+			b, err := stdin.ReadByte()
+			if err != nil {
+				return
+			}
+			if column, ok := sortKeys[b]; ok {
+				keys <- column
+			}
+		}
+	}()
+
+	url := "http://" + *adminAddr + "/api/buckets"
+	for {
+		buckets, err := fetchBuckets(url)
+		if err != nil {
+			log.Fatal(err)
+		}
+		sortBuckets(buckets, *sortBy)
+		if len(buckets) > *count {
+			buckets = buckets[:*count]
+		}
+		render(buckets, *adminAddr, *sortBy)
+
+		select {
+		case *sortBy = <-keys:
+		case <-time.After(*interval):
+		}
+	}
+}
+
+// fetchBuckets reads the bucket summaries from the admin API at url
+func fetchBuckets(url string) ([]statsd.BucketSummary, error) {
+	resp, err := http.Get(url)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%s: %s", url, resp.Status)
+	}
+	var buckets []statsd.BucketSummary
+	err = json.NewDecoder(resp.Body).Decode(&buckets)
+	return buckets, err
+}
+
+// sortBuckets sorts the buckets by the given column, largest first except for names
+func sortBuckets(buckets []statsd.BucketSummary, column string) {
+	sort.Slice(buckets, func(i, j int) bool {
+		a, b := buckets[i], buckets[j]
+		switch column {
+		case "name":
+			return a.Name < b.Name
+		case "value":
+			return a.Value > b.Value
+		case "p99":
+			return a.P99 > b.P99
+		}
+		return a.Rate > b.Rate
+	})
+}
+
+// render redraws the terminal with the bucket summaries
+func render(buckets []statsd.BucketSummary, addr, column string) {
+	fmt.Print("\033[H\033[2J")
+	fmt.Printf("gostatsd top - %s - %s - sorted by %s (r/v/n/p + enter to change)\n\n",
+		addr, time.Now().Format("15:04:05"), column)
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', tabwriter.AlignRight)
+	fmt.Fprintln(w, "RATE/S\tVALUE\tP50\tP90\tP99\tTYPE\tBUCKET\t")
+	for _, b := range buckets {
+		fmt.Fprintf(w, "%.2f\t%.2f\t%.2f\t%.2f\t%.2f\t%s\t%s\t\n", b.Rate, b.Value, b.P50, b.P90, b.P99, b.Type, b.Name)
+	}
+	w.Flush()
+}
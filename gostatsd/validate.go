@@ -0,0 +1,313 @@
+package main
+
+import (
+	"../statsd"
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"github.com/golang/snappy"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+// sampleLines are flushed by validate-backend unless it is given lines to flush
+var sampleLines = []string{
+	"validate.requests:1|c|#env:prod,route:api",
+	"validate.requests:3|c|@0.5|#env:prod,route:health",
+	"validate.queue_depth:42|g|#env:prod",
+	"validate.latency:12|ms|#env:prod",
+	"validate.latency:87|ms|#env:prod",
+	"validate.users:alice|s",
+	"validate.users:bob|s",
+}
+
+// validateBackend implements "gostatsd validate-backend", which flushes sample metrics
+// through the mappings of a configuration to one of its backends, redirected to a local
+// listener, and prints exactly what the backend would have sent
+func validateBackend(args []string) {
+	fs := flag.NewFlagSet("validate-backend", flag.ExitOnError)
+	configFile := fs.String("config", "", "JSON configuration file with the mappings and destinations")
+	index := fs.Int("destination", 0, "destination of the configuration to flush to, from 1, or 0 to use -backend")
+	backend := fs.String("backend", "graphite", "backend to flush to if no destination is given")
+	linesFile := fs.String("lines", "", "file of statsd lines to flush instead of the builtin sample, - for stdin")
+	timerUnit := fs.String("flush-timer-unit", "ms", "unit of the flushed timer statistics: s, ms or us")
+	fs.Parse(args)
+
+	cfg := new(config)
+	if *configFile != "" {
+		var err error
+		if cfg, err = loadConfig(*configFile); err != nil {
+			log.Fatal(err)
+		}
+	}
+	d := destination{Backend: *backend}
+	if *index > 0 {
+		if *index > len(cfg.Destinations) {
+			log.Fatalf("the configuration has %d destinations", len(cfg.Destinations))
+		}
+		d = cfg.Destinations[*index-1]
+	}
+	if d.Backend == "" {
+		d.Backend = "graphite"
+	}
+	outputTimerUnit, err := statsd.ParseTimeUnit(*timerUnit)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if d.timerUnit != "" {
+		outputTimerUnit = d.timerUnit
+	}
+	lines, err := readSampleLines(*linesFile)
+	if err != nil {
+		log.Fatal(err)
+	}
+	for _, m := range cfg.Metadata {
+		statsd.SetMetadata(m)
+	}
+
+	c := new(capture)
+	if err := c.listen(); err != nil {
+		log.Fatal(err)
+	}
+	if err := c.redirect(&d); err != nil {
+		log.Fatal(err)
+	}
+	sender, err := newSender(d, nil)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	aggregator := statsd.NewMetricAggregator(sender, time.Hour)
+	aggregator.Histograms = cfg.Histograms
+	aggregator.Percentiles = cfg.Percentiles
+	aggregator.TimerUnit = outputTimerUnit
+	if d.CounterEvents != nil {
+		aggregator.CounterEvents = *d.CounterEvents
+	}
+	go aggregator.Aggregate()
+
+	var handler statsd.Handler = aggregatorHandler{&aggregator}
+	if len(cfg.TagPolicies) > 0 {
+		handler = &statsd.TagPolicyHandler{Policies: cfg.TagPolicies, Handler: handler}
+	}
+	if len(cfg.Mappings) > 0 {
+		handler = &statsd.MappingHandler{Rules: cfg.Mappings, Handler: handler}
+	}
+	for _, line := range lines {
+		m, err := statsd.DefaultParser.ParseLine([]byte(line))
+		if err != nil {
+			log.Fatalf("%q: %s", line, err)
+		}
+		handler.HandleMetric(m)
+	}
+	aggregator.Stop(true)
+	c.close()
+	os.Stdout.Write(c.out.Bytes())
+}
+
+// readSampleLines returns the lines of the file name, or sampleLines if name is empty
+func readSampleLines(name string) ([]string, error) {
+	if name == "" {
+		return sampleLines, nil
+	}
+	f := os.Stdin
+	if name != "-" {
+		var err error
+		if f, err = os.Open(name); err != nil {
+			return nil, err
+		}
+		defer f.Close()
+	}
+	var lines []string
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		if line := strings.TrimSpace(scanner.Text()); line != "" {
+			lines = append(lines, line)
+		}
+	}
+	return lines, scanner.Err()
+}
+
+// capture records what a backend sends to its local TCP and HTTP listeners
+type capture struct {
+	tcp    net.Listener
+	http   net.Listener
+	server *http.Server
+
+	mu    sync.Mutex
+	conns []net.Conn
+	wg    sync.WaitGroup
+	out   bytes.Buffer
+}
+
+// listen starts the listeners on loopback ports
+func (c *capture) listen() (err error) {
+	if c.tcp, err = net.Listen("tcp", "127.0.0.1:0"); err != nil {
+		return err
+	}
+	if c.http, err = net.Listen("tcp", "127.0.0.1:0"); err != nil {
+		return err
+	}
+	c.server = &http.Server{Handler: http.HandlerFunc(c.handleRequest)}
+	go c.server.Serve(c.http)
+	go func() {
+		for {
+			conn, err := c.tcp.Accept()
+			if err != nil {
+				return
+			}
+			c.mu.Lock()
+			c.conns = append(c.conns, conn)
+			c.mu.Unlock()
+			c.wg.Add(1)
+			go c.readConn(conn)
+		}
+	}()
+	return nil
+}
+
+// redirect points d at the listeners instead of its backend server
+func (c *capture) redirect(d *destination) error {
+	options := make(map[string]string)
+	for k, v := range d.Options {
+		options[k] = v
+	}
+	d.Options = options
+	url := "http://" + c.http.Addr().String()
+	switch d.Backend {
+	case "graphite":
+		d.Address = c.tcp.Addr().String()
+	case "wavefront":
+		// Through the proxy if there is one, otherwise straight to the instance
+		if d.Address != "" {
+			d.Address = c.tcp.Addr().String()
+		} else {
+			options["url"] = url
+		}
+	case "newrelic", "signalfx", "librato":
+		options["url"] = url + "/"
+	case "m3":
+		options["url"] = url + "/api/v1/prom/remote/write"
+	case "webhook":
+		d.Address = url + "/"
+	default:
+		return fmt.Errorf("can't validate the %s backend, only graphite, wavefront, newrelic, signalfx, librato, m3 and webhook", d.Backend)
+	}
+	return nil
+}
+
+// readConn records what is written to conn until it is idle after close
+func (c *capture) readConn(conn net.Conn) {
+	defer c.wg.Done()
+	b, _ := ioutil.ReadAll(conn)
+	c.mu.Lock()
+	fmt.Fprintf(&c.out, "--- tcp %s, %d bytes\n", conn.LocalAddr(), len(b))
+	c.out.Write(b)
+	if len(b) > 0 && b[len(b)-1] != '\n' {
+		c.out.WriteByte('\n')
+	}
+	c.mu.Unlock()
+}
+
+// handleRequest records a request and accepts it
+func (c *capture) handleRequest(w http.ResponseWriter, req *http.Request) {
+	body, err := ioutil.ReadAll(req.Body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	fmt.Fprintf(&c.out, "--- %s %s, %d bytes\n", req.Method, req.URL.RequestURI(), len(body))
+	names := make([]string, 0, len(req.Header))
+	for name := range req.Header {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		for _, v := range req.Header[name] {
+			fmt.Fprintf(&c.out, "%s: %s\n", name, redactHeader(name, v))
+		}
+	}
+	c.out.WriteByte('\n')
+	c.writeBody(body, req.Header.Get("Content-Encoding"), req.Header.Get("Content-Type"))
+	w.WriteHeader(http.StatusOK)
+}
+
+// writeBody records body decoded, indented if it is JSON and dumped in hex if it isn't text
+func (c *capture) writeBody(body []byte, encoding, contentType string) {
+	switch encoding {
+	case "gzip":
+		if r, err := gzip.NewReader(bytes.NewReader(body)); err == nil {
+			if b, err := ioutil.ReadAll(r); err == nil {
+				fmt.Fprintf(&c.out, "(gzip, %d bytes decoded)\n", len(b))
+				body = b
+			}
+		}
+	case "snappy":
+		if b, err := snappy.Decode(nil, body); err == nil {
+			fmt.Fprintf(&c.out, "(snappy, %d bytes decoded)\n", len(b))
+			body = b
+		}
+	}
+	var indented bytes.Buffer
+	switch {
+	case strings.Contains(contentType, "json") && json.Indent(&indented, body, "", "  ") == nil:
+		indented.WriteByte('\n')
+		c.out.Write(indented.Bytes())
+	case utf8.Valid(body) && !bytes.ContainsAny(body, "\x00"):
+		c.out.Write(body)
+		if len(body) > 0 && body[len(body)-1] != '\n' {
+			c.out.WriteByte('\n')
+		}
+	default:
+		c.out.WriteString(hex.Dump(body))
+	}
+}
+
+// close waits for what was sent to arrive and stops the listeners
+func (c *capture) close() {
+	// Connections stay open after a flush, so they are read until they go quiet
+	c.mu.Lock()
+	for _, conn := range c.conns {
+		conn.SetReadDeadline(time.Now().Add(200 * time.Millisecond))
+	}
+	c.mu.Unlock()
+	c.tcp.Close()
+	c.wg.Wait()
+	c.server.Close()
+}
+
+// redactHeader hides the values of headers carrying credentials
+func redactHeader(name, value string) string {
+	lower := strings.ToLower(name)
+	for _, s := range []string{"auth", "key", "token", "secret"} {
+		if strings.Contains(lower, s) {
+			return "<redacted>"
+		}
+	}
+	return value
+}
+
+// aggregatorHandler feeds metrics to an aggregator
+type aggregatorHandler struct {
+	aggregator *statsd.MetricAggregator
+}
+
+// HandleMetric sends m to the aggregator
+func (h aggregatorHandler) HandleMetric(m statsd.Metric) {
+	h.aggregator.MetricChan <- m
+}
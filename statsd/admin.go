@@ -0,0 +1,351 @@
+package statsd
+
+import (
+	"encoding/gob"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// DefaultAdminAddr is the default address on which an AdminServer will listen
+const DefaultAdminAddr = ":8127"
+
+// BucketSummary describes what a bucket has aggregated so far in the current interval
+type BucketSummary struct {
+	Name  string  `json:"name"`
+	Type  string  `json:"type"`
+	Value float64 `json:"value"`         // Counter total, last gauge value or number of timer values
+	Rate  float64 `json:"rate"`          // Per second rate of counters and timers
+	P50   float64 `json:"p50,omitempty"` // Timer percentiles
+	P90   float64 `json:"p90,omitempty"`
+	P99   float64 `json:"p99,omitempty"`
+}
+
+// AdminServer is an object that listens for HTTP connections on a TCP address Addr
+// and provides a JSON API to manage its MetricAggregator:
+//
+//	GET    /api/buckets                    summaries of the buckets of the current interval
+//	DELETE /api/buckets?name=<b>[&type=<t>] delete a bucket, optionally only of one type
+//	GET    /api/flush                      the metrics sent by the most recent flush
+//	GET    /api/stats                      statistics of the aggregator
+//	GET    /api/health                     status of the components of a Server, 503 if one is failing
+//	GET    /api/loglevel                   the current log level
+//	PUT    /api/loglevel?level=<l>         change the log level to debug, info or error
+//	GET    /api/trace                      source IPs whose lines are traced
+//	POST   /api/trace?source=<ip>          log every line received from a source IP
+//	DELETE /api/trace?source=<ip>          stop tracing a source IP
+//	GET    /api/history                    names of the series kept by the History
+//	GET    /api/history?name=<n>[&step=<d>] points of a series at the resolution closest to step
+//	GET    /api/query?match=<p>&tag=<t>&from=<t>&to=<t>[&step=<d>] series of the History, see Query
+//	*      /grafana/...                    the History as a Grafana datasource, see GrafanaDatasource
+//	POST   /api/state                      merge a gob encoded AggregatorState sent by a StateClient
+//	GET    /api/metadata                   the declared metadata of buckets
+//	PUT    /api/metadata                   declare the metadata of buckets, a JSON encoded Metadata
+//	DELETE /api/metadata?match=<p>         forget the metadata declared for a pattern
+//	GET    /api/sources                    gauges written by several sources without a host tag
+//	GET    /api/sources?bucket=<b>         source addresses of a bucket during the last interval
+type AdminServer struct {
+	Addr       string
+	Aggregator *MetricAggregator
+	History    *MetricHistory           // If set, recent flushes can be looked at
+	Health     func() []ComponentStatus // If set, the status of the components served by /api/health
+	Sources    *SourceTracker           // If set, the sources of the buckets can be looked at
+	Config     func() interface{}       // If set, the effective configuration served by /api/config
+}
+
+// historyResponse is the body of a /api/history response for a series
+type historyResponse struct {
+	Name   string  `json:"name"`
+	Step   string  `json:"step"`
+	Points []Point `json:"points"`
+}
+
+// flushResponse is the body of a /api/flush response
+type flushResponse struct {
+	Time    time.Time `json:"time"`
+	Metrics MetricMap `json:"metrics"`
+}
+
+// logLevelResponse is the body of a /api/loglevel response
+type logLevelResponse struct {
+	Level string `json:"level"`
+}
+
+// ServeHTTP serves the API endpoints
+func (s *AdminServer) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if s.History != nil && (strings.HasPrefix(req.URL.Path, "/grafana/") || req.URL.Path == "/grafana") {
+		http.StripPrefix("/grafana", &GrafanaDatasource{s.History}).ServeHTTP(w, req)
+		return
+	}
+	switch req.URL.Path {
+	case "/api/buckets":
+		switch req.Method {
+		case "GET":
+			writeJSON(w, s.Aggregator.Buckets())
+		case "DELETE":
+			name := req.FormValue("name")
+			if name == "" {
+				http.Error(w, "missing bucket name", http.StatusBadRequest)
+				return
+			}
+			if !s.Aggregator.DeleteBucket(req.FormValue("type"), name) {
+				http.NotFound(w, req)
+				return
+			}
+			w.WriteHeader(http.StatusNoContent)
+		default:
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		}
+	case "/api/flush":
+		metrics, t := s.Aggregator.LastFlush()
+		writeJSON(w, flushResponse{t, finiteMetrics(metrics)})
+	case "/api/stats":
+		writeJSON(w, s.Aggregator.Statistics())
+	case "/api/health":
+		if s.Health == nil {
+			http.NotFound(w, req)
+			return
+		}
+		status := s.Health()
+		for _, c := range status {
+			if !c.Healthy {
+				w.Header().Set("Content-Type", "application/json")
+				w.WriteHeader(http.StatusServiceUnavailable)
+				break
+			}
+		}
+		writeJSON(w, status)
+	case "/api/config":
+		if s.Config == nil {
+			http.NotFound(w, req)
+			return
+		}
+		writeJSON(w, s.Config())
+	case "/api/loglevel":
+		if req.Method == "PUT" || req.Method == "POST" {
+			level, err := ParseLogLevel(req.FormValue("level"))
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			SetLogLevel(level)
+		}
+		writeJSON(w, logLevelResponse{GetLogLevel().String()})
+	case "/api/trace":
+		source := req.FormValue("source")
+		if req.Method != "GET" && net.ParseIP(source) == nil {
+			http.Error(w, "missing or invalid source IP", http.StatusBadRequest)
+			return
+		}
+		switch req.Method {
+		case "POST", "PUT":
+			TraceSource(source)
+		case "DELETE":
+			UntraceSource(source)
+		}
+		writeJSON(w, TracedSources())
+	case "/api/history":
+		if s.History == nil {
+			http.NotFound(w, req)
+			return
+		}
+		name := req.FormValue("name")
+		if name == "" {
+			writeJSON(w, s.History.Names())
+			return
+		}
+		var step time.Duration
+		if v := req.FormValue("step"); v != "" {
+			var err error
+			if step, err = time.ParseDuration(v); err != nil {
+				http.Error(w, "invalid step", http.StatusBadRequest)
+				return
+			}
+		}
+		points, step := s.History.Series(name, step)
+		writeJSON(w, historyResponse{name, step.String(), finitePoints(points)})
+	case "/api/query":
+		if s.History == nil {
+			http.NotFound(w, req)
+			return
+		}
+		q, err := parseQuery(req)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		writeJSON(w, s.History.Query(q))
+	case "/api/state":
+		if req.Method != "POST" {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		var state AggregatorState
+		if err := gob.NewDecoder(http.MaxBytesReader(w, req.Body, maxHTTPBody)).Decode(&state); err != nil {
+			var tooLarge *http.MaxBytesError
+			if errors.As(err, &tooLarge) {
+				http.Error(w, fmt.Sprintf("body larger than %d bytes", maxHTTPBody), http.StatusRequestEntityTooLarge)
+				return
+			}
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if err := s.Aggregator.MergeState(&state); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	case "/api/sources":
+		if s.Sources == nil {
+			http.NotFound(w, req)
+			return
+		}
+		if bucket := req.FormValue("bucket"); bucket != "" {
+			writeJSON(w, s.Sources.Sources(bucket))
+			return
+		}
+		writeJSON(w, s.Sources.Conflicts())
+	case "/api/metadata":
+		switch req.Method {
+		case "GET":
+			writeJSON(w, AllMetadata())
+		case "PUT", "POST":
+			var m Metadata
+			if err := json.NewDecoder(req.Body).Decode(&m); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			if err := m.Validate(); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			SetMetadata(m)
+			w.WriteHeader(http.StatusNoContent)
+		case "DELETE":
+			if !DeleteMetadata(req.FormValue("match")) {
+				http.NotFound(w, req)
+				return
+			}
+			w.WriteHeader(http.StatusNoContent)
+		default:
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		}
+	default:
+		http.NotFound(w, req)
+	}
+}
+
+// finiteMetrics returns a copy of metrics without the NaN and infinite values JSON can't represent
+func finiteMetrics(metrics MetricMap) MetricMap {
+	finite := make(MetricMap, len(metrics))
+	for k, v := range metrics {
+		if !math.IsNaN(v) && !math.IsInf(v, 0) {
+			finite[k] = v
+		}
+	}
+	return finite
+}
+
+// parseQuery reads a Query from the parameters of a request. Times are Unix times in
+// seconds, RFC 3339 times or durations before now such as "15m".
+func parseQuery(req *http.Request) (Query, error) {
+	if err := req.ParseForm(); err != nil {
+		return Query{}, err
+	}
+	q := Query{Match: req.Form.Get("match"), Tags: req.Form["tag"]}
+	now := time.Now()
+	var err error
+	if q.From, err = parseQueryTime(req.FormValue("from"), now); err != nil {
+		return q, err
+	}
+	if q.To, err = parseQueryTime(req.FormValue("to"), now); err != nil {
+		return q, err
+	}
+	if v := req.FormValue("step"); v != "" {
+		if q.Step, err = time.ParseDuration(v); err != nil {
+			return q, fmt.Errorf("invalid step %q", v)
+		}
+	}
+	return q, nil
+}
+
+// parseQueryTime parses a time of a query relative to now. An empty string is the zero time.
+func parseQueryTime(s string, now time.Time) (time.Time, error) {
+	if s == "" {
+		return time.Time{}, nil
+	}
+	if secs, err := strconv.ParseInt(s, 10, 64); err == nil {
+		return time.Unix(secs, 0), nil
+	}
+	if d, err := time.ParseDuration(s); err == nil {
+		return now.Add(-absDuration(d)), nil
+	}
+	if t, err := time.Parse(time.RFC3339, s); err == nil {
+		return t, nil
+	}
+	return time.Time{}, fmt.Errorf("invalid time %q", s)
+}
+
+// finitePoints returns points without those holding NaN or infinite values
+func finitePoints(points []Point) []Point {
+	finite := points[:0]
+	for _, p := range points {
+		if !math.IsNaN(p.Sum) && !math.IsInf(p.Sum, 0) && !math.IsNaN(p.Last) && !math.IsInf(p.Last, 0) {
+			finite = append(finite, p)
+		}
+	}
+	return finite
+}
+
+// ListenAndServe listens on the AdminServer's TCP network address and then serves the API
+func (s *AdminServer) ListenAndServe() error {
+	if s.Addr == "" {
+		s.Addr = DefaultAdminAddr
+	}
+	return http.ListenAndServe(s.Addr, s)
+}
+
+// writeJSON writes v as the JSON body of the response
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// Buckets summarizes every bucket of the current interval
+func (a *MetricAggregator) Buckets() []BucketSummary {
+	defer a.Unlock()
+	a.Lock()
+
+	elapsed := time.Since(a.Stats.IntervalStart).Seconds()
+	buckets := make([]BucketSummary, 0, len(a.Counters)+len(a.Gauges)+len(a.Timers))
+	for k, v := range a.Counters {
+		buckets = append(buckets, BucketSummary{Name: k, Type: "counter", Value: v, Rate: v / elapsed})
+	}
+	for k, v := range a.Gauges {
+		buckets = append(buckets, BucketSummary{Name: k, Type: "gauge", Value: v})
+	}
+	for k, v := range a.Timers {
+		b := BucketSummary{Name: k, Type: "timer", Value: float64(len(v)), Rate: a.TimersCounters[k] / elapsed}
+		if len(v) > 0 {
+			sorted := append([]float64(nil), v...)
+			sort.Float64s(sorted)
+			b.P50 = percentile(sorted, 50)
+			b.P90 = percentile(sorted, 90)
+			b.P99 = percentile(sorted, 99)
+		}
+		buckets = append(buckets, b)
+	}
+	for k, s := range a.sets {
+		buckets = append(buckets, BucketSummary{Name: k, Type: "set", Value: s.Count()})
+	}
+	return buckets
+}
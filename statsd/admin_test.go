@@ -0,0 +1,132 @@
+package statsd
+
+import (
+	"bytes"
+	"encoding/json"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// serveAdmin sends a request to s and returns the response
+func serveAdmin(s *AdminServer, method, target string, body []byte) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	s.ServeHTTP(w, httptest.NewRequest(method, target, bytes.NewReader(body)))
+	return w
+}
+
+func TestAdminDeleteBucket(t *testing.T) {
+	a := NewMetricAggregator(nil, 10*time.Second)
+	a.aggregate(Metric{Type: COUNTER, Bucket: "foo", Value: 1, SampleRate: 1})
+	a.aggregate(Metric{Type: GAUGE, Bucket: "foo", Value: 2, SampleRate: 1})
+	s := &AdminServer{Aggregator: &a}
+
+	tests := []struct {
+		target string
+		code   int
+	}{
+		{"/api/buckets", http.StatusBadRequest},
+		{"/api/buckets?name=bar", http.StatusNotFound},
+		{"/api/buckets?name=foo&type=timer", http.StatusNotFound},
+		{"/api/buckets?name=foo&type=counter", http.StatusNoContent},
+		{"/api/buckets?name=foo&type=counter", http.StatusNotFound},
+		{"/api/buckets?name=foo", http.StatusNoContent},
+		{"/api/buckets?name=foo", http.StatusNotFound},
+	}
+	for _, tc := range tests {
+		if w := serveAdmin(s, "DELETE", tc.target, nil); w.Code != tc.code {
+			t.Errorf("DELETE %s: expected %d, got %d", tc.target, tc.code, w.Code)
+		}
+	}
+	if len(a.Counters) != 0 || len(a.Gauges) != 0 {
+		t.Errorf("expected the buckets to be deleted, got %v and %v", a.Counters, a.Gauges)
+	}
+}
+
+func TestAdminLogLevel(t *testing.T) {
+	defer SetLogLevel(GetLogLevel())
+	SetLogLevel(LogInfo)
+	s := &AdminServer{}
+
+	tests := []struct {
+		method, target string
+		code           int
+		level          string
+	}{
+		{"GET", "/api/loglevel", http.StatusOK, "info"},
+		{"PUT", "/api/loglevel?level=debug", http.StatusOK, "debug"},
+		{"PUT", "/api/loglevel?level=verbose", http.StatusBadRequest, "debug"},
+		{"POST", "/api/loglevel?level=ERROR", http.StatusOK, "error"},
+	}
+	for _, tc := range tests {
+		w := serveAdmin(s, tc.method, tc.target, nil)
+		if w.Code != tc.code {
+			t.Errorf("%s %s: expected %d, got %d", tc.method, tc.target, tc.code, w.Code)
+		}
+		if l := GetLogLevel().String(); l != tc.level {
+			t.Errorf("%s %s: expected level %s, got %s", tc.method, tc.target, tc.level, l)
+		}
+		if tc.code != http.StatusOK {
+			continue
+		}
+		var resp logLevelResponse
+		if err := json.NewDecoder(w.Body).Decode(&resp); err != nil || resp.Level != tc.level {
+			t.Errorf("%s %s: expected level %s in the response, got %+v (%v)", tc.method, tc.target, tc.level, resp, err)
+		}
+	}
+}
+
+func TestAdminHealth(t *testing.T) {
+	var status []ComponentStatus
+	s := &AdminServer{Health: func() []ComponentStatus { return status }}
+
+	status = []ComponentStatus{{Name: "aggregator", Healthy: true}, {Name: "udp :8125", Healthy: true}}
+	if w := serveAdmin(s, "GET", "/api/health", nil); w.Code != http.StatusOK {
+		t.Errorf("expected 200 when all components are healthy, got %d", w.Code)
+	}
+
+	status[1] = ComponentStatus{Name: "udp :8125", Failures: 1, LastError: "closed"}
+	w := serveAdmin(s, "GET", "/api/health", nil)
+	if w.Code != http.StatusServiceUnavailable {
+		t.Errorf("expected 503 when a component is failing, got %d", w.Code)
+	}
+	var got []ComponentStatus
+	if err := json.NewDecoder(w.Body).Decode(&got); err != nil || len(got) != 2 || got[1].LastError != "closed" {
+		t.Errorf("expected the status of the components, got %+v (%v)", got, err)
+	}
+
+	if w := serveAdmin(&AdminServer{}, "GET", "/api/health", nil); w.Code != http.StatusNotFound {
+		t.Errorf("expected 404 without Health, got %d", w.Code)
+	}
+}
+
+func TestAdminFlush(t *testing.T) {
+	a := NewMetricAggregator(nil, 10*time.Second)
+	s := &AdminServer{Aggregator: &a}
+	flushed := time.Unix(1500000000, 0)
+	a.lastFlush = timedMetricMap{MetricMap{"stats.gauges.foo": 1, "stats.gauges.bar": math.NaN()}, flushed}
+
+	w := serveAdmin(s, "GET", "/api/flush", nil)
+	var resp flushResponse
+	if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+		t.Fatalf("expected a JSON flush, got %q (%s)", w.Body.String(), err)
+	}
+	if !resp.Time.Equal(flushed) || len(resp.Metrics) != 1 || resp.Metrics["stats.gauges.foo"] != 1 {
+		t.Errorf("expected the finite metrics of the last flush, got %+v", resp)
+	}
+}
+
+func TestAdminStateTooLarge(t *testing.T) {
+	a := NewMetricAggregator(nil, 10*time.Second)
+	s := &AdminServer{Aggregator: &a}
+	// A gob message announcing 2MB, which the decoder reads past the limit
+	body := append([]byte{0xfd, 0x20, 0x00, 0x00}, make([]byte, maxHTTPBody)...)
+	if w := serveAdmin(s, "POST", "/api/state", body); w.Code != http.StatusRequestEntityTooLarge {
+		t.Errorf("expected 413, got %d", w.Code)
+	}
+	if w := serveAdmin(s, "POST", "/api/state", []byte("garbage")); w.Code != http.StatusBadRequest {
+		t.Errorf("expected 400, got %d", w.Code)
+	}
+}
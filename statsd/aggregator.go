@@ -1,43 +1,109 @@
 package statsd
 
 import (
-	"fmt"
 	"log"
 	"math"
+	"math/rand"
 	"sort"
-	"strings"
 	"sync"
 	"time"
 )
 
 // metricAggregatorStats is a bookkeeping structure for statistics about a MetricAggregator
 type metricAggregatorStats struct {
-	BadLines       int
-	LastMessage    time.Time
-	LastFlush      time.Time
-	LastFlushError time.Time
+	BadLines        int
+	MetricsReceived int64 // Metrics aggregated since the start
+	LateMetrics     int64 // Metrics aggregated with the interval they were timestamped in after it ended
+	LastMessage     time.Time
+	LastFlush       time.Time
+	LastFlushError  time.Time
+	IntervalStart   time.Time // When the metrics currently held started being aggregated
+	QueueLength     int       // Metrics or batches waiting in the fuller of MetricChan and BatchChan, only set by Statistics
+	QueueCapacity   int
+	MemoryBytes     int64         // Estimated memory taken by the series held, kept if MemoryBudget is set
+	ShedMetrics     int64         // Metrics shed since the start because MemoryBudget was used up
+	FlushDuration   time.Duration // How long sending the last flush took
+	SkippedFlushes  int64         // Flushes not sent because this instance wasn't the leader
+	JournalErrors   int64         // Rotations of the Journal that failed, even after retrying
+	JournalSkipped  int64         // Unparsable lines skipped replaying the Journal
 }
 
+// AggregatorStats is a copy of the statistics about a MetricAggregator
+type AggregatorStats metricAggregatorStats
+
 // MetricSender is an interface that can be implemented by objects which
 // can provide metrics to a MetricAggregator
 type MetricSender interface {
 	SendMetrics(MetricMap) error
 }
 
+// TimestampedSender is implemented by MetricSenders that can send metrics with an explicit
+// timestamp. When an aggregator flushes several sub-intervals at once each of them is sent
+// with the time it ended; other senders receive them one after another without timestamps.
+type TimestampedSender interface {
+	SendMetricsAt(MetricMap, time.Time) error
+}
+
+// timedMetricMap is a flushed MetricMap along with the time its interval ended
+type timedMetricMap struct {
+	Metrics MetricMap
+	Time    time.Time
+}
+
 // MetricAggregator is an object that aggregates statsd metrics.
 // The function NewMetricAggregator should be used to create the objects.
 //
-// Incoming metrics should be sent to the MetricChan channel.
+// Incoming metrics should be sent to the MetricChan channel, or several at a time to BatchChan.
 type MetricAggregator struct {
 	sync.Mutex
-	MetricChan     chan Metric   // Channel on which metrics are received
-	FlushInterval  time.Duration // How often to flush metrics to the sender
-	Sender         MetricSender  // The sender to which metrics are flushed
+	MetricChan     chan Metric     // Channel on which metrics are received
+	BatchChan      chan []Metric   // Channel on which metrics are received several at a time
+	FlushInterval  time.Duration   // How often to flush metrics to the sender
+	SubInterval    time.Duration   // If set, the resolution of the summaries sent at each flush
+	RoundCounts    bool            // If set, counts of counters are rounded to integers when flushed
+	GaugeExtremes  bool            // If set, the min, max and last value of gauges updated in an interval are flushed
+	CounterEvents  bool            // If set, the number of increments of counters is flushed along with their sum
+	TimerUnit      TimeUnit        // Unit of the flushed timer statistics, milliseconds if empty
+	Histograms     []Histogram     // Buckets the values of matching timers are counted in, the first match wins
+	Percentiles    []PercentileSet // Percentiles flushed for matching timers, the first match wins, DefaultPercentiles for the others
+	SetPrecision   uint8           // If set, sets are estimated with HyperLogLogs of this precision instead of counted exactly
+	Sender         MetricSender    // The sender to which metrics are flushed
+	Journal        *WriteAheadLog  // If set, metrics are journaled here before they are aggregated
+	Elector        Elector         // If set, metrics are only sent while this instance is the leader
+	Lateness       time.Duration   // If set, intervals are flushed this long after they end and take the metrics timestamped during them meanwhile
+	Upstream       StateSender     // If set, the state of each interval is sent here to be merged instead of being flushed
+	MemoryBudget   int64           // If set, the estimated memory in bytes the series may take before metrics are shed
+	ShedPolicy     ShedPolicy      // How metrics are shed once MemoryBudget is used up, ShedNewSeries if empty
+	FlushJitter    time.Duration   // If set, each flush is sent after a random delay up to this long, so a fleet of servers doesn't send at once
 	Stats          metricAggregatorStats
+	lastFlush      timedMetricMap
 	Counters       MetricMap
 	Gauges         MetricMap
 	Timers         MetricListMap
 	TimersCounters MetricMap
+	sets           map[string]set
+	counterEvents  MetricMap         // Increments of each counter, kept if CounterEvents is set
+	pending        *MetricAggregator // The interval waiting for late metrics, if Lateness is set
+	pendingStart   time.Time
+	pendingEnd     time.Time
+	gaugesMin      MetricMap // Extremes of the gauges updated this interval, kept if GaugeExtremes is set
+	gaugesMax      MetricMap
+	expiries       map[seriesKey]time.Time // When the series last updated with a TTL are forgotten
+	stop           chan stopRequest
+	shed           int  // Metrics shed this interval
+	shedding       bool // Whether MemoryBudget was used up this interval
+}
+
+// stopRequest asks Aggregate to return, after flushing the current interval if flush is set
+type stopRequest struct {
+	flush bool
+	done  chan struct{}
+}
+
+// seriesKey identifies an aggregated series by its type and key
+type seriesKey struct {
+	Type MetricType
+	Key  string
 }
 
 // NewMetricAggregator creates a new MetricAggregator object
@@ -46,15 +112,19 @@ func NewMetricAggregator(sender MetricSender, flushInterval time.Duration) Metri
 	a.FlushInterval = flushInterval
 	a.Sender = sender
 	a.MetricChan = make(chan Metric)
+	a.BatchChan = make(chan []Metric)
+	a.stop = make(chan stopRequest)
 	a.Counters = make(MetricMap)
 	a.Gauges = make(MetricMap)
 	a.Timers = make(MetricListMap)
 	a.TimersCounters = make(MetricMap)
+	a.Stats.IntervalStart = time.Now()
 	return a
 }
 
-// flush prepares the contents of a MetricAggregator for sending via the Sender
-func (a *MetricAggregator) flush() (metrics MetricMap) {
+// flush prepares the contents of a MetricAggregator for sending via the Sender.
+// Rates are computed over the given interval.
+func (a *MetricAggregator) flush(interval time.Duration) (metrics MetricMap) {
 	defer a.Unlock()
 	a.Lock()
 
@@ -62,19 +132,35 @@ func (a *MetricAggregator) flush() (metrics MetricMap) {
 	numStats := 0
 
 	for k, v := range a.Counters {
-		perSecond := v / a.FlushInterval.Seconds()
+		perSecond := v / interval.Seconds()
 		metrics["stats.counters.rate."+k] = perSecond
+		if a.RoundCounts {
+			v = math.Floor(v + 0.5)
+		}
 		metrics["stats.counters.count."+k] = v
 		numStats += 1
 	}
+	for k, v := range a.counterEvents {
+		if a.RoundCounts {
+			v = math.Floor(v + 0.5)
+		}
+		metrics["stats.counters.events."+k] = v
+	}
 
 	for k, v := range a.Gauges {
 		metrics["stats.gauges."+k] = v
 		numStats += 1
 	}
+	for k, s := range a.sets {
+		metrics[suffixKey("stats.sets."+k, ".count")] = s.Count()
+		numStats += 1
+	}
+	for k, min := range a.gaugesMin {
+		metrics[suffixKey("stats.gauges."+k, ".min")] = min
+		metrics[suffixKey("stats.gauges."+k, ".max")] = a.gaugesMax[k]
+		metrics[suffixKey("stats.gauges."+k, ".last")] = a.Gauges[k]
+	}
 
-	// TODO: add histogram
-	pctThreshold := []int{95}
 	timerData := make(map[string]map[string]float64, 10)
 	for k, v := range a.Timers {
 		if count := len(v); count > 0 {
@@ -93,9 +179,9 @@ func (a *MetricAggregator) flush() (metrics MetricMap) {
 				cumulativeValues[i] = cumulativeValues[i-1] + v[i]
 			}
 
-			for _, pct := range pctThreshold {
+			for _, pct := range percentilesFor(a.Percentiles, k) {
 				if count > 1 {
-					numInThreshold := round(math.Abs(float64(pct)) * float64(count) / 100.0)
+					numInThreshold := round(math.Abs(pct) * float64(count) / 100.0)
 					if numInThreshold == 0 {
 						continue
 					}
@@ -107,7 +193,7 @@ func (a *MetricAggregator) flush() (metrics MetricMap) {
 						sum = cumulativeValues[count-1] - cumulativeValues[count-numInThreshold]
 					}
 					mean = sum / float64(numInThreshold)
-					cleanPct := strings.Replace(fmt.Sprintf("%d", pct), "-", "top", -1)
+					cleanPct := percentileName(pct)
 					var uplowPrefix string
 					if pct > 0 {
 						uplowPrefix = "upper_"
@@ -136,7 +222,7 @@ func (a *MetricAggregator) flush() (metrics MetricMap) {
 			}
 			stddev := math.Sqrt(sumOfDiffs / float64(count))
 			currTimerData["std"] = stddev
-			currTimerData["count_ps"] = a.TimersCounters[k] / a.FlushInterval.Seconds()
+			currTimerData["count_ps"] = a.TimersCounters[k] / interval.Seconds()
 			currTimerData["sum"] = sum
 			currTimerData["mean"] = mean
 			currTimerData["median"] = median
@@ -144,16 +230,27 @@ func (a *MetricAggregator) flush() (metrics MetricMap) {
 			currTimerData["upper"] = max
 			currTimerData["count"] = float64(count)
 
+			if h := histogramFor(a.Histograms, k); h != nil {
+				h.addBuckets(metrics, k, v)
+			}
+
 			numStats += 1
 			timerData[k] = currTimerData
 		}
 		for k, v := range timerData {
 			for k2, v2 := range v {
-				metrics["stats.timers."+k+"."+k2] = v2
+				if a.TimerUnit != "" && isDurationStat(k2) {
+					v2 /= a.TimerUnit.Milliseconds()
+				}
+				metrics[suffixKey("stats.timers."+k, "."+k2)] = v2
 			}
 		}
 	}
 	metrics["statsd.numStats"] = float64(numStats)
+	if a.MemoryBudget > 0 {
+		metrics["statsd.memory_bytes"] = float64(a.Stats.MemoryBytes)
+		metrics["statsd.shed_metrics"] = float64(a.shed)
+	}
 	// log.Println(metrics)
 	return metrics
 }
@@ -162,85 +259,528 @@ func (a *MetricAggregator) flush() (metrics MetricMap) {
 func (a *MetricAggregator) Reset() {
 	defer a.Unlock()
 	a.Lock()
+	a.reset()
+}
 
+// reset starts the next interval. The caller must hold the lock.
+func (a *MetricAggregator) reset() {
 	for k := range a.Counters {
 		a.Counters[k] = 0
 	}
+	for k := range a.counterEvents {
+		a.counterEvents[k] = 0
+	}
 
 	for k := range a.Timers {
 		a.Timers[k] = []float64{}
 		a.TimersCounters[k] = 0
 	}
 
-	// No reset for gauges, they keep the last value
+	a.sets = nil
+
+	// No reset for gauges, they keep the last value, but their extremes are per interval
+	a.gaugesMin, a.gaugesMax = nil, nil
+
+	a.expire(time.Now())
+
+	if a.MemoryBudget > 0 {
+		a.Stats.MemoryBytes = a.estimateMemory()
+		a.shed, a.shedding = 0, false
+	}
+	a.Stats.IntervalStart = time.Now()
+}
+
+// LastFlush returns the metrics of the most recent flush and when it happened
+func (a *MetricAggregator) LastFlush() (MetricMap, time.Time) {
+	defer a.Unlock()
+	a.Lock()
+	return a.lastFlush.Metrics, a.lastFlush.Time
+}
+
+// Statistics returns a copy of the aggregator's statistics
+func (a *MetricAggregator) Statistics() AggregatorStats {
+	defer a.Unlock()
+	a.Lock()
+	stats := AggregatorStats(a.Stats)
+	stats.QueueLength, stats.QueueCapacity = a.queueUse()
+	return stats
+}
+
+// queueUse returns the length and capacity of the fuller of MetricChan and BatchChan
+func (a *MetricAggregator) queueUse() (length, capacity int) {
+	length, capacity = len(a.MetricChan), cap(a.MetricChan)
+	if l, c := len(a.BatchChan), cap(a.BatchChan); c > 0 && (capacity == 0 || l*capacity > length*c) {
+		length, capacity = l, c
+	}
+	return length, capacity
+}
+
+// queueFill returns the fraction of the aggregation queues in use
+func (a *MetricAggregator) queueFill() float64 {
+	length, capacity := a.queueUse()
+	if capacity == 0 {
+		return 0
+	}
+	return float64(length) / float64(capacity)
+}
+
+// DeleteBucket removes a bucket of the given type ("counter", "gauge", "timer" or "set") and reports
+// whether it existed. If typ is blank the bucket is removed regardless of its type.
+func (a *MetricAggregator) DeleteBucket(typ, name string) bool {
+	defer a.Unlock()
+	a.Lock()
+
+	found := false
+	if _, ok := a.Counters[name]; ok && (typ == "" || typ == "counter") {
+		delete(a.Counters, name)
+		delete(a.counterEvents, name)
+		found = true
+	}
+	if _, ok := a.Gauges[name]; ok && (typ == "" || typ == "gauge") {
+		delete(a.Gauges, name)
+		delete(a.gaugesMin, name)
+		delete(a.gaugesMax, name)
+		found = true
+	}
+	if _, ok := a.sets[name]; ok && (typ == "" || typ == "set") {
+		delete(a.sets, name)
+		found = true
+	}
+	if _, ok := a.Timers[name]; ok && (typ == "" || typ == "timer") {
+		delete(a.Timers, name)
+		delete(a.TimersCounters, name)
+		found = true
+	}
+	return found
+}
+
+// ReplayJournal aggregates the metrics left in the Journal by a previous run that were
+// never flushed. It should be called before Aggregate.
+func (a *MetricAggregator) ReplayJournal() error {
+	skipped, err := a.Journal.Replay(func(m Metric) {
+		defer a.Unlock()
+		a.Lock()
+		a.aggregate(m)
+	})
+	if skipped > 0 {
+		log.Printf("Skipped %d unparsable lines replaying the journal", skipped)
+		a.Lock()
+		a.Stats.JournalSkipped += int64(skipped)
+		a.Unlock()
+	}
+	return err
+}
+
+// Attempts at rotating the Journal before giving up until the next flush
+const journalRotateAttempts = 3
+
+// rotateJournal rotates the Journal and returns the segments to commit once the flush is
+// sent. A failed rotation is retried after a short delay; should it keep failing, the
+// segments are left to be committed with those of the next flush.
+func (a *MetricAggregator) rotateJournal() []string {
+	delay := 10 * time.Millisecond
+	for attempt := 1; ; attempt++ {
+		segments, err := a.Journal.Rotate()
+		if err == nil {
+			return segments
+		}
+		if attempt == journalRotateAttempts {
+			log.Printf("Rotating journal failed: %s, its segments will be committed with the next flush", err)
+			a.Lock()
+			a.Stats.JournalErrors++
+			a.Unlock()
+			return nil
+		}
+		log.Printf("Rotating journal failed: %s, retrying in %s", err, delay)
+		time.Sleep(delay)
+		delay *= 2
+	}
 }
 
 // receiveMetric is called for each incoming metric on MetricChan
 func (a *MetricAggregator) receiveMetric(m Metric) {
+	if a.Journal != nil && m.Type != ERROR {
+		if err := a.Journal.Append(m); err != nil {
+			log.Printf("Journaling metric failed: %s", err)
+		}
+		// Written out once no more metrics are waiting
+		if len(a.MetricChan) == 0 {
+			if err := a.Journal.Flush(); err != nil {
+				log.Printf("Journaling metric failed: %s", err)
+			}
+		}
+	}
+
 	defer a.Unlock()
 	a.Lock()
+	a.aggregate(m)
+}
 
+// receiveMetrics is called for each batch of incoming metrics on BatchChan. The lock is
+// only taken once for the whole batch, which is then released to the pool.
+func (a *MetricAggregator) receiveMetrics(ms []Metric) {
+	defer ReleaseMetrics(ms)
+
+	if a.Journal != nil {
+		for _, m := range ms {
+			if m.Type == ERROR {
+				continue
+			}
+			if err := a.Journal.Append(m); err != nil {
+				log.Printf("Journaling metric failed: %s", err)
+			}
+		}
+		if err := a.Journal.Flush(); err != nil {
+			log.Printf("Journaling metric failed: %s", err)
+		}
+	}
+
+	defer a.Unlock()
+	a.Lock()
+	for _, m := range ms {
+		a.aggregate(m)
+	}
+}
+
+// aggregate adds m to the aggregated metrics. The caller must hold the lock.
+func (a *MetricAggregator) aggregate(m Metric) {
+	if m.Timestamp != 0 && a.pending != nil {
+		if t := time.Unix(m.Timestamp, 0); t.Before(a.pendingEnd) && !t.Before(a.pendingStart.Truncate(time.Second)) {
+			a.pending.aggregate(m)
+			a.Stats.MetricsReceived++
+			a.Stats.LateMetrics++
+			a.Stats.LastMessage = time.Now()
+			return
+		}
+	}
+	key := m.Key()
+	if a.MemoryBudget > 0 && m.Type != ERROR && !a.admit(m, key) {
+		a.shed++
+		a.Stats.ShedMetrics++
+		a.Stats.LastMessage = time.Now()
+		return
+	}
 	switch m.Type {
 	case COUNTER:
-		v, ok := a.Counters[m.Bucket]
+		v, ok := a.Counters[key]
 		value := m.Value
 		if m.SampleRate < 1.0 {
 			value = m.Value * (1 / m.SampleRate)
 		}
 		if ok {
-			a.Counters[m.Bucket] = v + value
+			a.Counters[key] = v + value
 		} else {
-			a.Counters[m.Bucket] = value
+			a.Counters[key] = value
+		}
+		if a.CounterEvents {
+			if a.counterEvents == nil {
+				a.counterEvents = make(MetricMap)
+			}
+			events := 1.0
+			if m.SampleRate < 1.0 {
+				events = 1.0 / m.SampleRate
+			}
+			a.counterEvents[key] += events
 		}
 	case GAUGE:
-		a.Gauges[m.Bucket] = m.Value
+		a.Gauges[key] = m.Value
+		if a.GaugeExtremes {
+			if a.gaugesMin == nil {
+				a.gaugesMin, a.gaugesMax = make(MetricMap), make(MetricMap)
+			}
+			if min, ok := a.gaugesMin[key]; !ok || m.Value < min {
+				a.gaugesMin[key] = m.Value
+			}
+			if max, ok := a.gaugesMax[key]; !ok || m.Value > max {
+				a.gaugesMax[key] = m.Value
+			}
+		}
 	case TIMER:
-		v, ok := a.Timers[m.Bucket]
+		v, ok := a.Timers[key]
 		counterValue := 1.0
 		if m.SampleRate < 1.0 {
 			counterValue = 1.0 / m.SampleRate
 		}
 		if ok {
 			v = append(v, m.Value)
-			a.Timers[m.Bucket] = v
-			a.TimersCounters[m.Bucket] += counterValue
+			a.Timers[key] = v
+			a.TimersCounters[key] += counterValue
 		} else {
-			a.Timers[m.Bucket] = []float64{m.Value}
-			a.TimersCounters[m.Bucket] = counterValue
+			a.Timers[key] = []float64{m.Value}
+			a.TimersCounters[key] = counterValue
 		}
+	case SET:
+		a.set(key).Add(m.Member)
 	case ERROR:
 		a.Stats.BadLines += 1
+		a.Counters[key] += m.Value
+	}
+	if m.Type != ERROR {
+		a.Stats.MetricsReceived++
+		if m.TTL > 0 {
+			if a.expiries == nil {
+				a.expiries = make(map[seriesKey]time.Time)
+			}
+			a.expiries[seriesKey{m.Type, key}] = time.Now().Add(time.Duration(m.TTL) * time.Second)
+		} else if a.expiries != nil {
+			delete(a.expiries, seriesKey{m.Type, key})
+		}
 	}
 	a.Stats.LastMessage = time.Now()
 }
 
+// expire forgets the series whose TTL passed by now. Others are kept, counters and timers
+// flushing zeros and gauges their last value. The caller must hold the lock.
+func (a *MetricAggregator) expire(now time.Time) {
+	for s, t := range a.expiries {
+		if now.Before(t) {
+			continue
+		}
+		switch s.Type {
+		case COUNTER:
+			delete(a.Counters, s.Key)
+			delete(a.counterEvents, s.Key)
+		case GAUGE:
+			delete(a.Gauges, s.Key)
+		case TIMER:
+			delete(a.Timers, s.Key)
+			delete(a.TimersCounters, s.Key)
+		}
+		delete(a.expiries, s)
+	}
+}
+
+// set returns the set of key, creating it if needed. The caller must hold the lock.
+func (a *MetricAggregator) set(key string) set {
+	s, ok := a.sets[key]
+	if !ok {
+		if a.sets == nil {
+			a.sets = make(map[string]set)
+		}
+		if a.SetPrecision > 0 {
+			s = NewHyperLogLog(a.SetPrecision)
+		} else {
+			s = make(exactSet)
+		}
+		a.sets[key] = s
+	}
+	return s
+}
+
+// closeInterval moves the metrics of the interval ending at end to a new aggregator held
+// in pending, where the late metrics of the interval join them until they are flushed
+func (a *MetricAggregator) closeInterval(end time.Time) {
+	p := NewMetricAggregator(a.Sender, a.FlushInterval)
+	p.RoundCounts = a.RoundCounts
+	p.GaugeExtremes = a.GaugeExtremes
+	p.CounterEvents = a.CounterEvents
+	p.TimerUnit = a.TimerUnit
+	p.Histograms = a.Histograms
+	p.Percentiles = a.Percentiles
+	p.SetPrecision = a.SetPrecision
+
+	state, start := a.takeState()
+	p.MergeState(state)
+	a.pending, a.pendingStart, a.pendingEnd = &p, start, end
+}
+
+// sendMetricsAt sends metrics to sender, with the timestamp t if the sender supports it
+func sendMetricsAt(sender MetricSender, metrics MetricMap, t time.Time) error {
+	if ts, ok := sender.(TimestampedSender); ok {
+		return ts.SendMetricsAt(metrics, t)
+	}
+	return sender.SendMetrics(metrics)
+}
+
+// send sends the summaries of a flush interval to the Sender
+func (a *MetricAggregator) send(flushed []timedMetricMap) error {
+	for _, f := range flushed {
+		if err := sendMetricsAt(a.Sender, f.Metrics, f.Time); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Stop makes Aggregate aggregate the metrics already queued and return once the flushes
+// under way are done. If flush is set the current interval is flushed first, otherwise
+// it is kept, e.g. to be saved with SaveStateFile. Metrics sent to MetricChan or BatchChan
+// afterwards are never received.
+func (a *MetricAggregator) Stop(flush bool) {
+	done := make(chan struct{})
+	a.stop <- stopRequest{flush, done}
+	<-done
+}
+
+// drain aggregates the metrics waiting in MetricChan and BatchChan
+func (a *MetricAggregator) drain() {
+	for {
+		select {
+		case metric := <-a.MetricChan:
+			a.receiveMetric(metric)
+		case metrics := <-a.BatchChan:
+			a.receiveMetrics(metrics)
+		default:
+			return
+		}
+	}
+}
+
 // Aggregate starts the MetricAggregator so it begins consuming metrics from MetricChan
-// and flushing them periodically via its Sender
+// and flushing them periodically via its Sender. If SubInterval is set, a summary is
+// taken every SubInterval and all of them are sent together every FlushInterval.
+// If Lateness is set each interval is held back for that long, and metrics timestamped
+// during it are aggregated with it rather than with the current interval. It returns
+// once Stop is called.
 func (a *MetricAggregator) Aggregate() {
 	flushChan := make(chan error)
-	flushTimer := time.NewTimer(a.FlushInterval)
+	inFlight := 0
+	interval := a.FlushInterval
+	if a.SubInterval > 0 && a.SubInterval < a.FlushInterval {
+		interval = a.SubInterval
+	}
+	flushTimer := time.NewTimer(interval)
+	var lateTimer <-chan time.Time
+	var flushed []timedMetricMap
+	stopping := false
+
+	// jitter returns the random delay before sending a flush, none once stopping
+	jitter := func() time.Duration {
+		if a.FlushJitter <= 0 || stopping {
+			return 0
+		}
+		return time.Duration(rand.Int63n(int64(a.FlushJitter)))
+	}
+
+	// send sends the summaries of the intervals flushed so far
+	send := func() {
+		var segments []string
+		if a.Journal != nil {
+			segments = a.rotateJournal()
+		}
+		inFlight++
+		delay := jitter()
+		go func(flushed []timedMetricMap) {
+			time.Sleep(delay)
+			start := time.Now()
+			var err error
+			if a.Elector == nil || a.Elector.IsLeader() {
+				err = a.send(flushed)
+			} else {
+				a.Lock()
+				a.Stats.SkippedFlushes++
+				a.Unlock()
+				debugf("not the leader, flush skipped")
+			}
+			if err == nil && segments != nil {
+				err = a.Journal.Commit(segments)
+			}
+			a.Lock()
+			a.Stats.FlushDuration = time.Since(start)
+			a.Unlock()
+			flushChan <- err
+		}(flushed)
+		flushed = nil
+	}
+
+	// finish sends the summary of an interval once those of the whole flush interval are in
+	finish := func(f timedMetricMap) {
+		flushed = append(flushed, f)
+		a.Lock()
+		a.lastFlush = timedMetricMap{copyMetricMap(f.Metrics), f.Time}
+		a.Unlock()
+		if len(flushed) >= int(a.FlushInterval/interval) {
+			send()
+		}
+	}
+
+	// flushDone records the result of a flush
+	flushDone := func(err error) {
+		inFlight--
+		a.Lock()
+		if err != nil {
+			log.Printf("Sending metrics to Graphite failed: %s", err)
+			a.Stats.LastFlushError = time.Now()
+		} else {
+			a.Stats.LastFlush = time.Now()
+		}
+		a.Unlock()
+	}
 
 	for {
 		select {
 		case metric := <-a.MetricChan: // Incoming metrics
 			a.receiveMetric(metric)
-		case <-flushTimer.C: // Time to flush to graphite
-			flushed := a.flush()
-			go func() {
-				flushChan <- a.Sender.SendMetrics(flushed)
-			}()
+		case metrics := <-a.BatchChan:
+			a.receiveMetrics(metrics)
+		case now := <-flushTimer.C: // Time to flush to graphite
+			if a.Upstream != nil {
+				state := a.TakeState()
+				flushTimer = time.NewTimer(interval)
+				inFlight++
+				delay := jitter()
+				go func() {
+					time.Sleep(delay)
+					flushChan <- a.Upstream.SendState(state)
+				}()
+				continue
+			}
+			flushTimer = time.NewTimer(interval)
+			if a.Lateness > 0 {
+				if a.pending != nil {
+					// Held back for longer than an interval
+					finish(timedMetricMap{a.pending.flush(interval), a.pendingEnd})
+				}
+				a.closeInterval(now)
+				lateTimer = time.After(a.Lateness)
+				continue
+			}
+			metrics := a.flush(interval)
 			a.Reset()
-			flushTimer = time.NewTimer(a.FlushInterval)
+			finish(timedMetricMap{metrics, now})
+		case <-lateTimer:
+			lateTimer = nil
+			if a.pending != nil {
+				finish(timedMetricMap{a.pending.flush(interval), a.pendingEnd})
+				a.pending = nil
+			}
 		case flushResult := <-flushChan:
-			a.Lock()
-
-			if flushResult != nil {
-				log.Printf("Sending metrics to Graphite failed: %s", flushResult)
-				a.Stats.LastFlushError = time.Now()
-			} else {
-				a.Stats.LastFlush = time.Now()
+			flushDone(flushResult)
+		case req := <-a.stop:
+			stopping = true
+			flushTimer.Stop()
+			a.drain()
+			if req.flush && a.Upstream != nil {
+				state := a.TakeState()
+				inFlight++
+				go func() {
+					flushChan <- a.Upstream.SendState(state)
+				}()
+			} else if req.flush {
+				if a.pending != nil {
+					finish(timedMetricMap{a.pending.flush(interval), a.pendingEnd})
+					a.pending = nil
+				}
+				// Whatever is left of the flush interval goes out with this partial interval
+				now := time.Now()
+				a.Lock()
+				elapsed := now.Sub(a.Stats.IntervalStart)
+				a.Unlock()
+				if elapsed <= 0 || elapsed > interval {
+					elapsed = interval
+				}
+				metrics := a.flush(elapsed)
+				a.Reset()
+				finish(timedMetricMap{metrics, now})
+				if len(flushed) > 0 {
+					send()
+				}
 			}
-			a.Unlock()
+			for inFlight > 0 {
+				flushDone(<-flushChan)
+			}
+			close(req.done)
+			return
 		}
 	}
 
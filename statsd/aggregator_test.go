@@ -0,0 +1,90 @@
+package statsd
+
+import (
+	"testing"
+	"time"
+)
+
+func TestLateMetricRouting(t *testing.T) {
+	start := time.Unix(1500000000, 0)
+	end := start.Add(10 * time.Second)
+
+	tests := map[string]struct {
+		timestamp time.Time
+		late      bool // whether it joins the closed interval
+	}{
+		"untimestamped":         {},
+		"during the interval":   {timestamp: start.Add(5 * time.Second), late: true},
+		"at the start":          {timestamp: start, late: true},
+		"in the start's second": {timestamp: start.Add(500 * time.Millisecond), late: true},
+		"at the end":            {timestamp: end},
+		"after the end":         {timestamp: end.Add(time.Second)},
+		"before the start":      {timestamp: start.Add(-time.Second)},
+		"long before the start": {timestamp: start.Add(-time.Hour)},
+		"in the last second":    {timestamp: start.Add(9*time.Second + 999*time.Millisecond), late: true},
+	}
+
+	for name, tc := range tests {
+		a := NewMetricAggregator(nil, 10*time.Second)
+		a.Lateness = 5 * time.Second
+		a.Stats.IntervalStart = start.Add(300 * time.Millisecond)
+		a.aggregate(Metric{Type: COUNTER, Bucket: "foo", Value: 1, SampleRate: 1})
+		a.closeInterval(end)
+		if a.pending == nil || !a.pendingEnd.Equal(end) {
+			t.Fatalf("test %s: expected the interval to be held back until %s", name, end)
+		}
+
+		m := Metric{Type: COUNTER, Bucket: "foo", Value: 10, SampleRate: 1}
+		if !tc.timestamp.IsZero() {
+			m.Timestamp = tc.timestamp.Unix()
+		}
+		a.aggregate(m)
+
+		pending, current := a.pending.Counters["foo"], a.Counters["foo"]
+		if tc.late && (pending != 11 || current != 0 || a.Stats.LateMetrics != 1) {
+			t.Errorf("test %s: expected the metric in the closed interval, got %v there and %v in the current one", name, pending, current)
+		}
+		if !tc.late && (pending != 1 || current != 10 || a.Stats.LateMetrics != 0) {
+			t.Errorf("test %s: expected the metric in the current interval, got %v there and %v in the closed one", name, current, pending)
+		}
+	}
+}
+
+func TestLateMetricWithoutPending(t *testing.T) {
+	// Without Lateness there is no closed interval, so timestamps are ignored
+	a := NewMetricAggregator(nil, 10*time.Second)
+	a.aggregate(Metric{Type: COUNTER, Bucket: "foo", Value: 1, SampleRate: 1, Timestamp: time.Now().Add(-time.Minute).Unix()})
+	if a.Counters["foo"] != 1 || a.Stats.LateMetrics != 0 {
+		t.Errorf("expected the metric in the current interval, got %v", a.Counters["foo"])
+	}
+}
+
+func TestQueueFill(t *testing.T) {
+	a := NewMetricAggregator(nil, 10*time.Second)
+	if fill := a.queueFill(); fill != 0 {
+		t.Errorf("expected unbuffered queues to be empty, got %v", fill)
+	}
+
+	a.MetricChan = make(chan Metric, 10)
+	a.BatchChan = make(chan []Metric, 4)
+	a.MetricChan <- Metric{}
+	a.MetricChan <- Metric{}
+	a.BatchChan <- nil
+	if fill := a.queueFill(); fill != 0.25 {
+		t.Errorf("expected the fill of the batch queue, got %v", fill)
+	}
+	a.BatchChan <- nil
+	a.BatchChan <- nil
+	s := &AdaptiveSampler{Aggregator: &a, Threshold: 0.5}
+	if rate := s.sampleRate("foo"); rate >= 1 {
+		t.Errorf("expected a filling batch queue to trigger sampling, got %v", rate)
+	}
+
+	for i := 0; i < 6; i++ {
+		a.MetricChan <- Metric{}
+	}
+	stats := a.Statistics()
+	if fill := a.queueFill(); fill != 0.8 || stats.QueueLength != 8 || stats.QueueCapacity != 10 {
+		t.Errorf("expected the fill of the metric queue, got %v and %d/%d", fill, stats.QueueLength, stats.QueueCapacity)
+	}
+}
@@ -0,0 +1,174 @@
+package statsd
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+	"time"
+)
+
+// AlertRule describes a threshold on a flushed metric. Once the metric has crossed the
+// threshold for For consecutive flushes the alert fires, calling Webhook and/or running
+// Exec, and once it no longer does they are called again to report the resolution.
+type AlertRule struct {
+	Name      string  `json:"name"`
+	Metric    string  `json:"metric"`    // Flushed name of the metric, e.g. "stats.counters.rate.api.errors"
+	Op        string  `json:"op"`        // One of ">", ">=", "<" or "<="
+	Threshold float64 `json:"threshold"` // Value the metric is compared against
+	For       int     `json:"for"`       // Number of consecutive flushes before firing, defaults to 1
+	Webhook   string  `json:"webhook"`   // If set, URL to POST a JSON description of the alert to
+	Exec      string  `json:"exec"`      // If set, command to run with the alert in its environment
+}
+
+// Validate checks that the rule is well formed
+func (r AlertRule) Validate() error {
+	if r.Name == "" || r.Metric == "" {
+		return fmt.Errorf("alert rule needs a name and a metric")
+	}
+	switch r.Op {
+	case ">", ">=", "<", "<=":
+	default:
+		return fmt.Errorf("alert %s has unknown operator %q", r.Name, r.Op)
+	}
+	if r.Webhook == "" && r.Exec == "" {
+		return fmt.Errorf("alert %s has neither webhook nor exec", r.Name)
+	}
+	if r.Exec != "" && len(strings.Fields(r.Exec)) == 0 {
+		return fmt.Errorf("alert %s has an empty exec", r.Name)
+	}
+	return nil
+}
+
+// ValidateAlertRules checks each rule and that no two rules share a name, since the state
+// of a rule is kept by its name
+func ValidateAlertRules(rules []AlertRule) []error {
+	var errs []error
+	names := make(map[string]bool)
+	for _, r := range rules {
+		if err := r.Validate(); err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		if names[r.Name] {
+			errs = append(errs, fmt.Errorf("alert %s is defined more than once", r.Name))
+		}
+		names[r.Name] = true
+	}
+	return errs
+}
+
+// breached reports whether v crosses the rule's threshold
+func (r AlertRule) breached(v float64) bool {
+	switch r.Op {
+	case ">":
+		return v > r.Threshold
+	case ">=":
+		return v >= r.Threshold
+	case "<":
+		return v < r.Threshold
+	case "<=":
+		return v <= r.Threshold
+	}
+	return false
+}
+
+// Alert is the notification sent when an AlertRule fires or resolves
+type Alert struct {
+	Name      string    `json:"name"`
+	Metric    string    `json:"metric"`
+	Value     float64   `json:"value"`
+	Threshold float64   `json:"threshold"`
+	State     string    `json:"state"` // "firing" or "resolved"
+	Time      time.Time `json:"time"`
+}
+
+// AlertSender is a MetricSender that evaluates its Rules against the flushed metrics
+// before passing them on to Sender
+type AlertSender struct {
+	Rules  []AlertRule
+	Sender MetricSender
+
+	mu       sync.Mutex
+	breaches map[string]int  // consecutive breaching flushes per rule
+	firing   map[string]bool // rules currently firing
+}
+
+// SendMetrics evaluates the alert rules and sends metrics to s.Sender
+func (s *AlertSender) SendMetrics(metrics MetricMap) error {
+	return s.SendMetricsAt(metrics, time.Now())
+}
+
+// SendMetricsAt evaluates the alert rules and sends metrics to s.Sender with the timestamp t
+func (s *AlertSender) SendMetricsAt(metrics MetricMap, t time.Time) error {
+	s.evaluate(metrics, t)
+	return sendMetricsAt(s.Sender, metrics, t)
+}
+
+// evaluate updates the state of each rule and notifies those that changed
+func (s *AlertSender) evaluate(metrics MetricMap, t time.Time) {
+	defer s.mu.Unlock()
+	s.mu.Lock()
+
+	if s.breaches == nil {
+		s.breaches = make(map[string]int)
+		s.firing = make(map[string]bool)
+	}
+	for _, r := range s.Rules {
+		v, ok := metrics[r.Metric]
+		if ok && r.breached(v) {
+			s.breaches[r.Name]++
+		} else {
+			s.breaches[r.Name] = 0
+		}
+
+		need := r.For
+		if need < 1 {
+			need = 1
+		}
+		firing := s.breaches[r.Name] >= need
+		if firing == s.firing[r.Name] {
+			continue
+		}
+		s.firing[r.Name] = firing
+		alert := Alert{r.Name, r.Metric, v, r.Threshold, "resolved", t}
+		if firing {
+			alert.State = "firing"
+		}
+		go notify(r, alert)
+	}
+}
+
+// notify calls the webhook and runs the command of the rule for alert
+func notify(r AlertRule, alert Alert) {
+	infof("alert %s %s: %s is %f", alert.Name, alert.State, alert.Metric, alert.Value)
+	if r.Webhook != "" {
+		body, _ := json.Marshal(alert)
+		resp, err := httpClient.Post(r.Webhook, "application/json", bytes.NewReader(body))
+		if err != nil {
+			log.Printf("error calling webhook of alert %s: %s", r.Name, err)
+		} else {
+			resp.Body.Close()
+			if resp.StatusCode >= 300 {
+				log.Printf("error calling webhook of alert %s: %s", r.Name, resp.Status)
+			}
+		}
+	}
+	if r.Exec != "" {
+		args := strings.Fields(r.Exec)
+		cmd := exec.Command(args[0], args[1:]...)
+		cmd.Env = append(os.Environ(),
+			"ALERT_NAME="+alert.Name,
+			"ALERT_METRIC="+alert.Metric,
+			fmt.Sprintf("ALERT_VALUE=%f", alert.Value),
+			fmt.Sprintf("ALERT_THRESHOLD=%f", alert.Threshold),
+			"ALERT_STATE="+alert.State)
+		if out, err := cmd.CombinedOutput(); err != nil {
+			log.Printf("error running command of alert %s: %s: %s", r.Name, err, out)
+		}
+	}
+}
@@ -0,0 +1,33 @@
+package statsd
+
+import (
+	"testing"
+)
+
+func TestAMQPRoutingKey(t *testing.T) {
+	c := &AMQPClient{
+		RoutingKey: "metrics",
+		Routes: []AMQPRoute{
+			{"stats.timers.", "timers"},
+			{"stats.timers.api.", "api-timers"},
+			{"stats.gauges.", "gauges"},
+		},
+	}
+	tests := map[string]string{
+		"stats.counters.foo":      "metrics",
+		"stats.gauges.foo":        "gauges",
+		"stats.timers.db.mean":    "timers",
+		"stats.timers.api.mean":   "api-timers",
+		"stats.timers.api;host:a": "timers",
+	}
+
+	for input, expected := range tests {
+		if result := c.routingKey(input); result != expected {
+			t.Errorf("test %s: expected %s, got %s", input, expected, result)
+		}
+	}
+
+	if result := (&AMQPClient{}).routingKey("stats.gauges.foo"); result != "statsd" {
+		t.Errorf("expected the default routing key statsd, got %s", result)
+	}
+}
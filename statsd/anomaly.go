@@ -0,0 +1,100 @@
+package statsd
+
+import (
+	"math"
+	"sync"
+	"time"
+)
+
+// AnomalyDetector is a MetricSender that follows each matching flushed series with an
+// exponentially weighted moving average and variance. For every such series it adds a
+// companion "<name>.anomaly" metric, with the tags of the series, which is 1 when the
+// flushed value deviates from the average by more than Sigmas standard deviations and 0
+// otherwise.
+type AnomalyDetector struct {
+	Metrics []string // Patterns of the flushed metrics to watch, * matches one component
+	Alpha   float64  // Weight of the latest value in the averages, defaults to 0.1
+	Sigmas  float64  // Deviations considered anomalous, defaults to 3
+	Warmup  int      // Flushes seen before a series can be flagged, defaults to 10
+	Sender  MetricSender
+
+	mu     sync.Mutex
+	series map[string]*ewma
+}
+
+// ewma is the running state of a single series
+type ewma struct {
+	mean     float64
+	variance float64
+	n        int
+}
+
+// SendMetrics sends metrics and their anomaly flags to d.Sender
+func (d *AnomalyDetector) SendMetrics(metrics MetricMap) error {
+	return d.SendMetricsAt(metrics, time.Now())
+}
+
+// SendMetricsAt sends metrics and their anomaly flags to d.Sender with the timestamp t
+func (d *AnomalyDetector) SendMetricsAt(metrics MetricMap, t time.Time) error {
+	return sendMetricsAt(d.Sender, d.detect(metrics), t)
+}
+
+// detect updates the averages and returns a copy of metrics holding the anomaly flags,
+// leaving metrics, which other senders may be reading, untouched
+func (d *AnomalyDetector) detect(metrics MetricMap) MetricMap {
+	defer d.mu.Unlock()
+	d.mu.Lock()
+
+	alpha, sigmas, warmup := d.Alpha, d.Sigmas, d.Warmup
+	if alpha <= 0 || alpha > 1 {
+		alpha = 0.1
+	}
+	if sigmas <= 0 {
+		sigmas = 3
+	}
+	if warmup <= 0 {
+		warmup = 10
+	}
+	if d.series == nil {
+		d.series = make(map[string]*ewma)
+	}
+
+	flags := make(MetricMap)
+	for k, v := range metrics {
+		if !d.watched(k) || math.IsNaN(v) || math.IsInf(v, 0) {
+			continue
+		}
+		s, ok := d.series[k]
+		if !ok {
+			s = &ewma{mean: v}
+			d.series[k] = s
+		}
+
+		diff := v - s.mean
+		flag := suffixKey(k, ".anomaly")
+		flags[flag] = 0
+		if s.n >= warmup && math.Abs(diff) > sigmas*math.Sqrt(s.variance) {
+			flags[flag] = 1
+		}
+
+		incr := alpha * diff
+		s.mean += incr
+		s.variance = (1 - alpha) * (s.variance + diff*incr)
+		s.n++
+	}
+	flagged := copyMetricMap(metrics)
+	for k, v := range flags {
+		flagged[k] = v
+	}
+	return flagged
+}
+
+// watched reports whether the flushed metric name matches one of d.Metrics
+func (d *AnomalyDetector) watched(name string) bool {
+	for _, pattern := range d.Metrics {
+		if matchPattern(pattern, name) {
+			return true
+		}
+	}
+	return false
+}
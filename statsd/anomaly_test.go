@@ -0,0 +1,22 @@
+package statsd
+
+import "testing"
+
+func TestAnomalyDetector(t *testing.T) {
+	d := &AnomalyDetector{Metrics: []string{"stats.gauges.*"}, Warmup: 3}
+	for i := 0; i < 5; i++ {
+		d.detect(MetricMap{"stats.gauges.load;host:a": 1})
+	}
+
+	flushed := MetricMap{"stats.gauges.load;host:a": 100, "stats.counters.count.foo": 1}
+	flagged := d.detect(flushed)
+	if v, ok := flagged["stats.gauges.load.anomaly;host:a"]; !ok || v != 1 {
+		t.Errorf("expected the tagged series to be flagged, got %v", flagged)
+	}
+	if _, ok := flagged["stats.counters.count.foo.anomaly"]; ok {
+		t.Errorf("expected unwatched series not to be flagged, got %v", flagged)
+	}
+	if len(flushed) != 2 {
+		t.Errorf("expected the flushed metrics to be left untouched, got %v", flushed)
+	}
+}
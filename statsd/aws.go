@@ -0,0 +1,161 @@
+package statsd
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/service/sns"
+	snstypes "github.com/aws/aws-sdk-go-v2/service/sns/types"
+	"github.com/aws/aws-sdk-go-v2/service/sqs"
+	sqstypes "github.com/aws/aws-sdk-go-v2/service/sqs/types"
+)
+
+// awsMaxMessage is the size of the flush snapshots sent to SQS or SNS, small enough for a
+// batch of awsMaxBatch of them to fit the 256KB limit of a batch
+const (
+	awsMaxMessage = 24 * 1024
+	awsMaxBatch   = 10
+)
+
+// AWSClient sends each flush to an SQS queue or an SNS topic, where consumers such as
+// Lambda functions can process the metrics without a metrics store. Flushes are split in
+// JSON snapshots of the same layout as the other message backends, sent in batches.
+// Credentials and the region come from the usual AWS environment, shared config files or
+// instance roles.
+type AWSClient struct {
+	QueueURL string // URL of the SQS queue
+	TopicARN string // If QueueURL is blank, ARN of the SNS topic
+	Region   string // Overrides the region of the environment if set
+
+	mu  sync.Mutex
+	sqs *sqs.Client
+	sns *sns.Client
+}
+
+// SendMetrics sends the metrics in a MetricMap to AWS
+func (c *AWSClient) SendMetrics(metrics MetricMap) error {
+	return c.SendMetricsAt(metrics, time.Now())
+}
+
+// SendMetricsAt sends the metrics in a MetricMap to AWS with the timestamp t
+func (c *AWSClient) SendMetricsAt(metrics MetricMap, t time.Time) error {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	if err := c.init(ctx); err != nil {
+		return err
+	}
+
+	messages, err := splitSnapshot(finiteMetrics(metrics), t, awsMaxMessage)
+	if err != nil {
+		return err
+	}
+	for len(messages) > 0 {
+		n := len(messages)
+		if n > awsMaxBatch {
+			n = awsMaxBatch
+		}
+		if err := c.sendBatch(ctx, messages[:n]); err != nil {
+			return err
+		}
+		messages = messages[n:]
+	}
+	return nil
+}
+
+// sendBatch sends up to awsMaxBatch messages in a single request
+func (c *AWSClient) sendBatch(ctx context.Context, messages []string) error {
+	if c.QueueURL != "" {
+		input := &sqs.SendMessageBatchInput{QueueUrl: aws.String(c.QueueURL)}
+		for i, m := range messages {
+			input.Entries = append(input.Entries, sqstypes.SendMessageBatchRequestEntry{
+				Id:          aws.String(strconv.Itoa(i)),
+				MessageBody: aws.String(m),
+			})
+		}
+		out, err := c.sqs.SendMessageBatch(ctx, input)
+		if err != nil {
+			return err
+		}
+		if len(out.Failed) > 0 {
+			return fmt.Errorf("sqs: %d of %d messages failed: %s", len(out.Failed), len(messages), aws.ToString(out.Failed[0].Message))
+		}
+		return nil
+	}
+
+	input := &sns.PublishBatchInput{TopicArn: aws.String(c.TopicARN)}
+	for i, m := range messages {
+		input.PublishBatchRequestEntries = append(input.PublishBatchRequestEntries, snstypes.PublishBatchRequestEntry{
+			Id:      aws.String(strconv.Itoa(i)),
+			Message: aws.String(m),
+		})
+	}
+	out, err := c.sns.PublishBatch(ctx, input)
+	if err != nil {
+		return err
+	}
+	if len(out.Failed) > 0 {
+		return fmt.Errorf("sns: %d of %d messages failed: %s", len(out.Failed), len(messages), aws.ToString(out.Failed[0].Message))
+	}
+	return nil
+}
+
+// init creates the service client on first use
+func (c *AWSClient) init(ctx context.Context) error {
+	defer c.mu.Unlock()
+	c.mu.Lock()
+	if c.sqs != nil || c.sns != nil {
+		return nil
+	}
+	var opts []func(*config.LoadOptions) error
+	if c.Region != "" {
+		opts = append(opts, config.WithRegion(c.Region))
+	}
+	cfg, err := config.LoadDefaultConfig(ctx, opts...)
+	if err != nil {
+		return err
+	}
+	if c.QueueURL != "" {
+		c.sqs = sqs.NewFromConfig(cfg)
+	} else {
+		c.sns = sns.NewFromConfig(cfg)
+	}
+	return nil
+}
+
+// splitSnapshot splits metrics in to JSON flush snapshots of about size bytes at most
+func splitSnapshot(metrics MetricMap, t time.Time, size int) ([]string, error) {
+	var messages []string
+	chunk, chunkSize := make(MetricMap), 0
+	flushChunk := func() error {
+		b, err := json.Marshal(flushSnapshot{t.Unix(), chunk})
+		if err != nil {
+			return err
+		}
+		messages = append(messages, string(b))
+		chunk, chunkSize = make(MetricMap), 0
+		return nil
+	}
+	for k, v := range metrics {
+		// A metric takes its quoted name, a colon, a value of up to 24 characters and a comma
+		n := len(k) + 28
+		if chunkSize+n > size && len(chunk) > 0 {
+			if err := flushChunk(); err != nil {
+				return nil, err
+			}
+		}
+		chunk[k] = v
+		chunkSize += n
+	}
+	if len(chunk) > 0 {
+		if err := flushChunk(); err != nil {
+			return nil, err
+		}
+	}
+	return messages, nil
+}
@@ -0,0 +1,67 @@
+package statsd
+
+import (
+	"encoding/json"
+	"reflect"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestSplitSnapshot(t *testing.T) {
+	tests := map[string]struct {
+		metrics MetricMap
+		size    int
+		chunks  int
+	}{
+		"empty":    {MetricMap{}, 1024, 0},
+		"single":   {MetricMap{"foo": 1}, 1024, 1},
+		"too big":  {MetricMap{"foo": 1}, 8, 1},
+		"split":    {MetricMap{"a": 1, "b": 2, "c": 3, "d": 4}, 2 * 29, 2},
+		"one each": {MetricMap{"a": 1, "b": 2, "c": 3}, 29, 3},
+	}
+
+	for name, test := range tests {
+		messages, err := splitSnapshot(test.metrics, time.Unix(1500000000, 0), test.size)
+		if err != nil {
+			t.Errorf("test %s error: %s", name, err)
+			continue
+		}
+		if len(messages) != test.chunks {
+			t.Errorf("test %s: expected %d messages, got %d", name, test.chunks, len(messages))
+		}
+		merged := make(MetricMap)
+		for _, m := range messages {
+			var snapshot flushSnapshot
+			if err := json.Unmarshal([]byte(m), &snapshot); err != nil {
+				t.Errorf("test %s error: %s", name, err)
+				continue
+			}
+			if snapshot.Time != 1500000000 {
+				t.Errorf("test %s: expected time 1500000000, got %d", name, snapshot.Time)
+			}
+			for k, v := range snapshot.Metrics {
+				merged[k] = v
+			}
+		}
+		if !reflect.DeepEqual(merged, test.metrics) {
+			t.Errorf("test %s: expected %v, got %v", name, test.metrics, merged)
+		}
+	}
+}
+
+func TestSplitSnapshotSize(t *testing.T) {
+	metrics := make(MetricMap)
+	for i := 0; i < 5000; i++ {
+		metrics["stats.timers.api.requests.latency.upper_99;host:web"+strconv.Itoa(i)] = 1234567.891011
+	}
+	messages, err := splitSnapshot(metrics, time.Unix(1500000000, 0), awsMaxMessage)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, m := range messages {
+		if len(m) > awsMaxMessage {
+			t.Errorf("expected messages of at most %d bytes, got %d", awsMaxMessage, len(m))
+		}
+	}
+}
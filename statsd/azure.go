@@ -0,0 +1,176 @@
+package statsd
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// azureResource is the resource Azure Monitor access tokens are requested for
+const azureResource = "https://monitoring.azure.com/"
+
+// AzureMonitorClient posts metrics to Azure Monitor as custom metrics of a resource, with
+// their tags as dimensions. It authenticates with the client secret of a service principal
+// if ClientID and ClientSecret are set, and with the managed identity of the host otherwise.
+type AzureMonitorClient struct {
+	Region     string // Region of the resource, e.g. "westeurope"
+	ResourceID string // e.g. "/subscriptions/<id>/resourceGroups/<group>/providers/Microsoft.Compute/virtualMachines/<vm>"
+	Namespace  string // Metric namespace, "statsd" if blank
+
+	TenantID     string
+	ClientID     string
+	ClientSecret string
+
+	mu      sync.Mutex
+	token   string
+	expires time.Time
+}
+
+// azureMetric is the body of a custom metrics request
+type azureMetric struct {
+	Time string `json:"time"`
+	Data struct {
+		BaseData struct {
+			Metric    string        `json:"metric"`
+			Namespace string        `json:"namespace"`
+			DimNames  []string      `json:"dimNames,omitempty"`
+			Series    []azureSeries `json:"series"`
+		} `json:"baseData"`
+	} `json:"data"`
+}
+
+// azureSeries is a series of a custom metric
+type azureSeries struct {
+	DimValues []string `json:"dimValues,omitempty"`
+	Min       float64  `json:"min"`
+	Max       float64  `json:"max"`
+	Sum       float64  `json:"sum"`
+	Count     int      `json:"count"`
+}
+
+// SendMetrics sends the metrics in a MetricMap to Azure Monitor
+func (c *AzureMonitorClient) SendMetrics(metrics MetricMap) error {
+	return c.SendMetricsAt(metrics, time.Now())
+}
+
+// SendMetricsAt sends the metrics in a MetricMap to Azure Monitor with the timestamp t.
+// Series of the same name and dimension names are sent together.
+func (c *AzureMonitorClient) SendMetricsAt(metrics MetricMap, t time.Time) error {
+	namespace := c.Namespace
+	if namespace == "" {
+		namespace = "statsd"
+	}
+	grouped := make(map[string]*azureMetric)
+	for k, v := range finiteMetrics(metrics) {
+		name, tags := SplitKey(k)
+		var dimNames, dimValues []string
+		for _, tag := range tags {
+			k, v := splitTag(tag)
+			dimNames = append(dimNames, k)
+			dimValues = append(dimValues, v)
+		}
+		group := name + ";" + strings.Join(dimNames, ";")
+		m, ok := grouped[group]
+		if !ok {
+			m = new(azureMetric)
+			m.Time = t.UTC().Format(time.RFC3339)
+			m.Data.BaseData.Metric = name
+			m.Data.BaseData.Namespace = namespace
+			m.Data.BaseData.DimNames = dimNames
+			grouped[group] = m
+		}
+		m.Data.BaseData.Series = append(m.Data.BaseData.Series, azureSeries{dimValues, v, v, v, 1})
+	}
+
+	token, err := c.accessToken()
+	if err != nil {
+		return err
+	}
+	endpoint := fmt.Sprintf("https://%s.monitoring.azure.com%s/metrics", c.Region, c.ResourceID)
+	groups := make([]string, 0, len(grouped))
+	for g := range grouped {
+		groups = append(groups, g)
+	}
+	sort.Strings(groups)
+	for _, g := range groups {
+		body, err := json.Marshal(grouped[g])
+		if err != nil {
+			return err
+		}
+		req, err := http.NewRequest("POST", endpoint, bytes.NewReader(body))
+		if err != nil {
+			return err
+		}
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("Authorization", "Bearer "+token)
+		if err := doRequest(req); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// azureToken is the response of the token endpoints
+type azureToken struct {
+	AccessToken string `json:"access_token"`
+	ExpiresIn   string `json:"expires_in"`
+}
+
+// accessToken returns a valid access token for Azure Monitor, requesting a new one when the
+// current one is about to expire
+func (c *AzureMonitorClient) accessToken() (string, error) {
+	defer c.mu.Unlock()
+	c.mu.Lock()
+	if c.token != "" && time.Now().Before(c.expires) {
+		return c.token, nil
+	}
+
+	var req *http.Request
+	var err error
+	if c.ClientID != "" && c.ClientSecret != "" {
+		form := url.Values{
+			"grant_type":    {"client_credentials"},
+			"client_id":     {c.ClientID},
+			"client_secret": {c.ClientSecret},
+			"resource":      {azureResource},
+		}
+		endpoint := "https://login.microsoftonline.com/" + url.PathEscape(c.TenantID) + "/oauth2/token"
+		req, err = http.NewRequest("POST", endpoint, strings.NewReader(form.Encode()))
+		if err != nil {
+			return "", err
+		}
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	} else {
+		endpoint := "http://169.254.169.254/metadata/identity/oauth2/token?api-version=2018-02-01&resource=" +
+			url.QueryEscape(azureResource)
+		req, err = http.NewRequest("GET", endpoint, nil)
+		if err != nil {
+			return "", err
+		}
+		req.Header.Set("Metadata", "true")
+	}
+
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("requesting Azure access token: %s", resp.Status)
+	}
+	var token azureToken
+	if err := json.NewDecoder(resp.Body).Decode(&token); err != nil {
+		return "", err
+	}
+	expiresIn, _ := strconv.Atoi(token.ExpiresIn)
+	c.token = token.AccessToken
+	c.expires = time.Now().Add(time.Duration(expiresIn)*time.Second - time.Minute)
+	return c.token, nil
+}
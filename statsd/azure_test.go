@@ -0,0 +1,105 @@
+package statsd
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+)
+
+// redirectTransport sends every request to a test server, keeping the original Host header
+type redirectTransport struct {
+	server *httptest.Server
+}
+
+func (t redirectTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	u, err := url.Parse(t.server.URL)
+	if err != nil {
+		return nil, err
+	}
+	req = req.Clone(req.Context())
+	req.Host = req.URL.Host
+	req.URL.Scheme, req.URL.Host = u.Scheme, u.Host
+	return http.DefaultTransport.RoundTrip(req)
+}
+
+// azureServer starts a server standing in for the Azure token and metrics endpoints,
+// sending the requests it receives on the returned channel
+func azureServer() (*httptest.Server, chan capturedRequest) {
+	requests := make(chan capturedRequest, 16)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		requests <- capturedRequest{r.Method, r.Host + r.URL.String(), r.Header, body}
+		if r.Host == "login.microsoftonline.com" {
+			w.Write([]byte(`{"access_token":"token","expires_in":"3600"}`))
+		}
+	}))
+	return server, requests
+}
+
+func TestAzureMonitorFormat(t *testing.T) {
+	tests := map[string]string{
+		"stats.gauges.foo":           `{"time":"2017-07-14T02:40:00Z","data":{"baseData":{"metric":"stats.gauges.foo","namespace":"statsd","series":[{"min":2,"max":2,"sum":2,"count":1}]}}}`,
+		"stats.gauges.foo;region:eu": `{"time":"2017-07-14T02:40:00Z","data":{"baseData":{"metric":"stats.gauges.foo","namespace":"statsd","dimNames":["region"],"series":[{"dimValues":["eu"],"min":2,"max":2,"sum":2,"count":1}]}}}`,
+	}
+
+	server, requests := azureServer()
+	defer server.Close()
+	defer func(transport http.RoundTripper) { httpClient.Transport = transport }(httpClient.Transport)
+	httpClient.Transport = redirectTransport{server}
+
+	c := &AzureMonitorClient{Region: "westeurope", ResourceID: "/subscriptions/s/vm", token: "token", expires: time.Now().Add(time.Hour)}
+	for key, expected := range tests {
+		if err := c.SendMetricsAt(MetricMap{key: 2}, time.Unix(1500000000, 0)); err != nil {
+			t.Errorf("test %s error: %s", key, err)
+			continue
+		}
+		r := <-requests
+		if r.URL != "westeurope.monitoring.azure.com/subscriptions/s/vm/metrics" {
+			t.Errorf("test %s: expected the metrics endpoint of the resource, got %s", key, r.URL)
+		}
+		if auth := r.Header.Get("Authorization"); auth != "Bearer token" {
+			t.Errorf("test %s: expected Bearer token, got %s", key, auth)
+		}
+		if string(r.Body) != expected {
+			t.Errorf("test %s: expected %s, got %s", key, expected, r.Body)
+		}
+	}
+}
+
+func TestAzureMonitorGroupsSeries(t *testing.T) {
+	server, requests := azureServer()
+	defer server.Close()
+	defer func(transport http.RoundTripper) { httpClient.Transport = transport }(httpClient.Transport)
+	httpClient.Transport = redirectTransport{server}
+
+	c := &AzureMonitorClient{Region: "westeurope", ResourceID: "/vm", TenantID: "tenant", ClientID: "id", ClientSecret: "secret"}
+	metrics := MetricMap{"foo;host:a": 1, "foo;host:b": 2, "bar": 3}
+	if err := c.SendMetricsAt(metrics, time.Unix(1500000000, 0)); err != nil {
+		t.Fatal(err)
+	}
+
+	r := <-requests
+	if r.URL != "login.microsoftonline.com/tenant/oauth2/token" {
+		t.Errorf("expected a token request, got %s", r.URL)
+	}
+	form, _ := url.ParseQuery(string(r.Body))
+	if form.Get("grant_type") != "client_credentials" || form.Get("client_id") != "id" || form.Get("client_secret") != "secret" {
+		t.Errorf("expected the client credentials, got %s", r.Body)
+	}
+
+	series := make(map[string]int)
+	for i := 0; i < 2; i++ {
+		var m azureMetric
+		if err := json.Unmarshal((<-requests).Body, &m); err != nil {
+			t.Fatal(err)
+		}
+		series[m.Data.BaseData.Metric] = len(m.Data.BaseData.Series)
+	}
+	if series["foo"] != 2 || series["bar"] != 1 {
+		t.Errorf("expected 2 series of foo and 1 of bar, got %v", series)
+	}
+}
@@ -0,0 +1,230 @@
+package statsd
+
+import (
+	"fmt"
+	"io/ioutil"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// BackendFactory creates the MetricSender of a backend from the address and the backend
+// specific options of a destination
+type BackendFactory func(address string, options map[string]string) (MetricSender, error)
+
+var (
+	backendsMu sync.Mutex
+	backends   = make(map[string]BackendFactory)
+)
+
+// RegisterBackend makes a backend available under name to NewBackend, and so to the
+// destinations of configuration files. Registering a name again replaces its factory.
+func RegisterBackend(name string, factory BackendFactory) {
+	defer backendsMu.Unlock()
+	backendsMu.Lock()
+	backends[name] = factory
+}
+
+// Backends returns the sorted names of the registered backends
+func Backends() []string {
+	defer backendsMu.Unlock()
+	backendsMu.Lock()
+	names := make([]string, 0, len(backends))
+	for name := range backends {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// NewBackend creates a MetricSender with the factory registered under name. References to
+// secrets in address and options are replaced by the secrets first.
+func NewBackend(name, address string, options map[string]string) (MetricSender, error) {
+	backendsMu.Lock()
+	factory, ok := backends[name]
+	backendsMu.Unlock()
+	if !ok {
+		return nil, fmt.Errorf("unknown backend %q", name)
+	}
+	address, err := ResolveSecret(address)
+	if err != nil {
+		return nil, fmt.Errorf("address: %s", err)
+	}
+	if options, err = ResolveSecrets(options); err != nil {
+		return nil, err
+	}
+	return factory(address, options)
+}
+
+// intOption returns the integer value of the option name of a backend, 0 if it isn't set
+func intOption(backend string, options map[string]string, name string) (int, error) {
+	v := options[name]
+	if v == "" {
+		return 0, nil
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil {
+		return 0, fmt.Errorf("%s %s: %s", backend, name, err)
+	}
+	return n, nil
+}
+
+// The builtin backends
+func init() {
+	RegisterBackend("graphite", func(address string, options map[string]string) (MetricSender, error) {
+		var timeout time.Duration
+		if v := options["write_timeout"]; v != "" {
+			var err error
+			if timeout, err = time.ParseDuration(v); err != nil {
+				return nil, fmt.Errorf("graphite write_timeout: %s", err)
+			}
+		}
+		maxWriteSize, err := intOption("graphite", options, "max_write_size")
+		if err != nil {
+			return nil, err
+		}
+		graphite, err := NewGraphiteClient(address)
+		if err != nil {
+			return nil, err
+		}
+		graphite.MaxWriteSize = maxWriteSize
+		graphite.WriteTimeout = timeout
+		graphite.Prefix = options["prefix"]
+		return &graphite, nil
+	})
+	RegisterBackend("wavefront", func(address string, options map[string]string) (MetricSender, error) {
+		return &WavefrontClient{
+			ProxyAddr: address,
+			URL:       options["url"],
+			Token:     options["token"],
+			Source:    options["source"],
+		}, nil
+	})
+	RegisterBackend("newrelic", func(address string, options map[string]string) (MetricSender, error) {
+		batchSize, err := intOption("newrelic", options, "batch_size")
+		if err != nil {
+			return nil, err
+		}
+		return &NewRelicClient{
+			APIKey:     options["api_key"],
+			URL:        options["url"],
+			Attributes: prefixedOptions(options, "attribute."),
+			BatchSize:  batchSize,
+		}, nil
+	})
+	RegisterBackend("signalfx", func(address string, options map[string]string) (MetricSender, error) {
+		return &SignalFxClient{Token: options["token"], URL: options["url"]}, nil
+	})
+	RegisterBackend("azure", func(address string, options map[string]string) (MetricSender, error) {
+		return &AzureMonitorClient{
+			Region:       options["region"],
+			ResourceID:   options["resource_id"],
+			Namespace:    options["namespace"],
+			TenantID:     options["tenant_id"],
+			ClientID:     options["client_id"],
+			ClientSecret: options["client_secret"],
+		}, nil
+	})
+	RegisterBackend("m3", func(address string, options map[string]string) (MetricSender, error) {
+		m3 := &M3Client{URL: options["url"], DefaultStoragePolicy: options["storage_policy"]}
+		for pattern, policy := range prefixedOptions(options, "storage_policy.") {
+			m3.StoragePolicies = append(m3.StoragePolicies, M3StoragePolicy{Pattern: pattern, Policy: policy})
+		}
+		// The longest patterns are the most specific
+		sort.Slice(m3.StoragePolicies, func(i, j int) bool {
+			return len(m3.StoragePolicies[i].Pattern) > len(m3.StoragePolicies[j].Pattern)
+		})
+		return m3, nil
+	})
+	RegisterBackend("librato", func(address string, options map[string]string) (MetricSender, error) {
+		return &LibratoClient{
+			User:  options["user"],
+			Token: options["token"],
+			URL:   options["url"],
+			Tags:  prefixedOptions(options, "tag."),
+		}, nil
+	})
+	RegisterBackend("postgres", func(address string, options map[string]string) (MetricSender, error) {
+		return &PostgresClient{DSN: address, Table: options["table"]}, nil
+	})
+	RegisterBackend("redis", func(address string, options map[string]string) (MetricSender, error) {
+		return &RedisClient{
+			Addr:       address,
+			Password:   options["password"],
+			TimeSeries: options["timeseries"] != "false",
+			Channel:    options["channel"],
+		}, nil
+	})
+	RegisterBackend("mqtt", func(address string, options map[string]string) (MetricSender, error) {
+		qos, err := intOption("mqtt", options, "qos")
+		if err != nil {
+			return nil, err
+		}
+		if qos < 0 || qos > 2 {
+			return nil, fmt.Errorf("mqtt qos: %d isn't 0, 1 or 2", qos)
+		}
+		return &MQTTClient{
+			Broker:   address,
+			ClientID: options["client_id"],
+			Username: options["username"],
+			Password: options["password"],
+			Topic:    options["topic"],
+			JSON:     options["json"] == "true",
+			QoS:      byte(qos),
+			Retain:   options["retain"] == "true",
+		}, nil
+	})
+	RegisterBackend("amqp", func(address string, options map[string]string) (MetricSender, error) {
+		client := &AMQPClient{URL: address, Exchange: options["exchange"], RoutingKey: options["routing_key"]}
+		for prefix, key := range prefixedOptions(options, "routing_key.") {
+			client.Routes = append(client.Routes, AMQPRoute{Prefix: prefix, RoutingKey: key})
+		}
+		return client, nil
+	})
+	RegisterBackend("sqs", func(address string, options map[string]string) (MetricSender, error) {
+		return &AWSClient{QueueURL: address, Region: options["region"]}, nil
+	})
+	RegisterBackend("sns", func(address string, options map[string]string) (MetricSender, error) {
+		return &AWSClient{TopicARN: address, Region: options["region"]}, nil
+	})
+	RegisterBackend("webhook", func(address string, options map[string]string) (MetricSender, error) {
+		text := options["template"]
+		if file := options["template_file"]; file != "" {
+			b, err := ioutil.ReadFile(file)
+			if err != nil {
+				return nil, err
+			}
+			text = string(b)
+		}
+		client, err := NewWebhookClient(address, text)
+		if err != nil {
+			return nil, err
+		}
+		client.Method = options["method"]
+		client.ContentType = options["content_type"]
+		client.Headers = prefixedOptions(options, "header.")
+		return client, nil
+	})
+	RegisterBackend("pipe", func(address string, options map[string]string) (MetricSender, error) {
+		return &PipeClient{Command: address}, nil
+	})
+	RegisterBackend("plugin", func(address string, options map[string]string) (MetricSender, error) {
+		return OpenPluginSender(address, options)
+	})
+}
+
+// prefixedOptions returns the options whose names start with prefix, without the prefix
+func prefixedOptions(options map[string]string, prefix string) map[string]string {
+	var prefixed map[string]string
+	for k, v := range options {
+		if strings.HasPrefix(k, prefix) {
+			if prefixed == nil {
+				prefixed = make(map[string]string)
+			}
+			prefixed[k[len(prefix):]] = v
+		}
+	}
+	return prefixed
+}
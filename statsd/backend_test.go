@@ -0,0 +1,114 @@
+package statsd
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestNewBackend(t *testing.T) {
+	tests := map[string]struct {
+		backend  string
+		address  string
+		options  map[string]string
+		expected MetricSender
+	}{
+		"wavefront": {"wavefront", "proxy:2878", map[string]string{"source": "web1"},
+			&WavefrontClient{ProxyAddr: "proxy:2878", Source: "web1"}},
+		"newrelic": {"newrelic", "", map[string]string{"api_key": "key", "batch_size": "500", "attribute.env": "prod"},
+			&NewRelicClient{APIKey: "key", Attributes: map[string]string{"env": "prod"}, BatchSize: 500}},
+		"signalfx": {"signalfx", "", map[string]string{"token": "secret", "url": "http://sfx"},
+			&SignalFxClient{Token: "secret", URL: "http://sfx"}},
+		"azure": {"azure", "", map[string]string{"region": "westeurope", "resource_id": "/vm", "client_id": "id"},
+			&AzureMonitorClient{Region: "westeurope", ResourceID: "/vm", ClientID: "id"}},
+		"m3": {"m3", "", map[string]string{"url": "http://m3", "storage_policy": "10s:2d", "storage_policy.stats.*": "1m:30d", "storage_policy.stats.timers.*": "1m:90d"},
+			&M3Client{URL: "http://m3", DefaultStoragePolicy: "10s:2d", StoragePolicies: []M3StoragePolicy{{"stats.timers.*", "1m:90d"}, {"stats.*", "1m:30d"}}}},
+		"librato": {"librato", "", map[string]string{"user": "me", "token": "secret", "tag.env": "prod"},
+			&LibratoClient{User: "me", Token: "secret", Tags: map[string]string{"env": "prod"}}},
+		"postgres": {"postgres", "postgres://localhost/metrics", map[string]string{"table": "points"},
+			&PostgresClient{DSN: "postgres://localhost/metrics", Table: "points"}},
+		"redis": {"redis", "localhost:6379", map[string]string{"channel": "flushes"},
+			&RedisClient{Addr: "localhost:6379", TimeSeries: true, Channel: "flushes"}},
+		"redis without time series": {"redis", "localhost:6379", map[string]string{"timeseries": "false"},
+			&RedisClient{Addr: "localhost:6379"}},
+		"mqtt": {"mqtt", "tcp://broker:1883", map[string]string{"topic": "metrics", "qos": "1", "json": "true"},
+			&MQTTClient{Broker: "tcp://broker:1883", Topic: "metrics", QoS: 1, JSON: true}},
+		"amqp": {"amqp", "amqp://localhost", map[string]string{"exchange": "metrics", "routing_key.stats.timers.": "timers"},
+			&AMQPClient{URL: "amqp://localhost", Exchange: "metrics", Routes: []AMQPRoute{{"stats.timers.", "timers"}}}},
+		"sqs": {"sqs", "https://sqs/queue", map[string]string{"region": "eu-west-1"},
+			&AWSClient{QueueURL: "https://sqs/queue", Region: "eu-west-1"}},
+		"sns": {"sns", "arn:aws:sns:topic", nil,
+			&AWSClient{TopicARN: "arn:aws:sns:topic"}},
+		"pipe": {"pipe", "./backend --verbose", nil,
+			&PipeClient{Command: "./backend --verbose"}},
+	}
+
+	for name, test := range tests {
+		result, err := NewBackend(test.backend, test.address, test.options)
+		if err != nil {
+			t.Errorf("test %s error: %s", name, err)
+			continue
+		}
+		if !reflect.DeepEqual(result, test.expected) {
+			t.Errorf("test %s: expected %+v, got %+v", name, test.expected, result)
+		}
+	}
+
+	if _, err := NewBackend("unknown", "", nil); err == nil {
+		t.Errorf("expected error for an unknown backend")
+	}
+}
+
+func TestNewBackendWebhook(t *testing.T) {
+	result, err := NewBackend("webhook", "http://hook", map[string]string{"method": "PUT", "header.Authorization": "Bearer secret"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, ok := result.(*WebhookClient)
+	if !ok {
+		t.Fatalf("expected a WebhookClient, got %T", result)
+	}
+	if c.URL != "http://hook" || c.Method != "PUT" || c.Headers["Authorization"] != "Bearer secret" {
+		t.Errorf("unexpected webhook %+v", c)
+	}
+
+	if _, err := NewBackend("webhook", "http://hook", map[string]string{"template": "{{"}); err == nil {
+		t.Errorf("expected error for an invalid template")
+	}
+}
+
+func TestRegisterBackend(t *testing.T) {
+	sender := &WavefrontClient{ProxyAddr: "registered"}
+	RegisterBackend("test", func(address string, options map[string]string) (MetricSender, error) {
+		return sender, nil
+	})
+
+	found := false
+	for _, name := range Backends() {
+		found = found || name == "test"
+	}
+	if !found {
+		t.Errorf("expected test in %v", Backends())
+	}
+	if result, err := NewBackend("test", "", nil); err != nil || result != sender {
+		t.Errorf("expected the registered sender, got %v, %v", result, err)
+	}
+}
+
+func TestNewBackendInvalidOptions(t *testing.T) {
+	tests := map[string]struct {
+		backend string
+		options map[string]string
+	}{
+		"graphite write_timeout":  {"graphite", map[string]string{"write_timeout": "soon"}},
+		"graphite max_write_size": {"graphite", map[string]string{"max_write_size": "big"}},
+		"newrelic batch_size":     {"newrelic", map[string]string{"batch_size": "1k"}},
+		"mqtt qos":                {"mqtt", map[string]string{"qos": "x"}},
+		"mqtt qos range":          {"mqtt", map[string]string{"qos": "3"}},
+	}
+
+	for name, test := range tests {
+		if result, err := NewBackend(test.backend, "localhost:2003", test.options); err == nil {
+			t.Errorf("test %s: expected error but got %v", name, result)
+		}
+	}
+}
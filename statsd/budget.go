@@ -0,0 +1,157 @@
+package statsd
+
+import (
+	"fmt"
+	"log"
+	"math/rand"
+)
+
+// ShedPolicy is what an aggregator does with the metrics it receives once its estimated
+// memory use is over MemoryBudget
+type ShedPolicy string
+
+// ShedPolicies understood by ParseShedPolicy
+const (
+	// ShedNewSeries drops the metrics of series the aggregator doesn't hold yet. The
+	// series it holds keep being aggregated as usual.
+	ShedNewSeries ShedPolicy = "drop_new"
+	// ShedTimerSamples also drops new series, and keeps the number of values held by
+	// each timer from growing: new values replace random older ones, so the timer
+	// statistics are computed on a uniform sample of the interval. count_ps stays
+	// exact while count is the number of values kept.
+	ShedTimerSamples ShedPolicy = "downsample_timers"
+)
+
+// ParseShedPolicy returns the ShedPolicy named s, ShedNewSeries if s is empty
+func ParseShedPolicy(s string) (ShedPolicy, error) {
+	switch ShedPolicy(s) {
+	case "", ShedNewSeries:
+		return ShedNewSeries, nil
+	case ShedTimerSamples:
+		return ShedTimerSamples, nil
+	}
+	return "", fmt.Errorf("unknown shed policy %q", s)
+}
+
+// Rough sizes of what an aggregator holds, for the estimate of its memory use
+const (
+	mapEntryBytes = 64 // Map entry and string header, on top of the bytes of the key
+	sliceBytes    = 24
+	sampleBytes   = 8
+)
+
+// admit accounts for the memory m takes once aggregated and reports whether it may be
+// aggregated, applying ShedPolicy once MemoryBudget is used up. A timer value that is
+// downsampled is aggregated by admit itself. The caller must hold the lock.
+func (a *MetricAggregator) admit(m Metric, key string) bool {
+	exists := a.hasSeries(m.Type, key)
+	var cost int64
+	if !exists {
+		cost = a.seriesBytes(m.Type, key)
+	}
+	switch m.Type {
+	case TIMER:
+		cost += sampleBytes
+	case SET:
+		if s, ok := a.sets[key].(exactSet); !ok && a.SetPrecision == 0 || ok && !s[m.Member] {
+			cost += int64(len(m.Member) + mapEntryBytes)
+		}
+	}
+	if a.Stats.MemoryBytes+cost <= a.MemoryBudget || cost == 0 {
+		a.Stats.MemoryBytes += cost
+		return true
+	}
+
+	if !a.shedding {
+		a.shedding = true
+		log.Printf("Memory budget of %d bytes used up, shedding metrics until the next flush (%s)", a.MemoryBudget, a.shedPolicy())
+	}
+	switch {
+	case !exists:
+		return false
+	case m.Type == TIMER && a.shedPolicy() == ShedTimerSamples && len(a.Timers[key]) > 0:
+		// Reservoir sampling, weighing values by their sample rate like the count
+		counterValue := 1.0
+		if m.SampleRate < 1.0 {
+			counterValue = 1.0 / m.SampleRate
+		}
+		a.TimersCounters[key] += counterValue
+		v := a.Timers[key]
+		if i := int(rand.Float64() * a.TimersCounters[key]); i < len(v) {
+			v[i] = m.Value
+		}
+		return false
+	}
+	a.Stats.MemoryBytes += cost
+	return true
+}
+
+// shedPolicy returns the ShedPolicy in effect
+func (a *MetricAggregator) shedPolicy() ShedPolicy {
+	if a.ShedPolicy == "" {
+		return ShedNewSeries
+	}
+	return a.ShedPolicy
+}
+
+// hasSeries reports whether the aggregator holds the series key of type t. The caller
+// must hold the lock.
+func (a *MetricAggregator) hasSeries(t MetricType, key string) (ok bool) {
+	switch t {
+	case COUNTER:
+		_, ok = a.Counters[key]
+	case GAUGE:
+		_, ok = a.Gauges[key]
+	case TIMER:
+		_, ok = a.Timers[key]
+	case SET:
+		_, ok = a.sets[key]
+	}
+	return ok
+}
+
+// seriesBytes estimates the memory taken by an empty series key of type t
+func (a *MetricAggregator) seriesBytes(t MetricType, key string) int64 {
+	n := int64(len(key) + mapEntryBytes)
+	switch t {
+	case COUNTER:
+		if a.CounterEvents {
+			n *= 2
+		}
+	case GAUGE:
+		if a.GaugeExtremes {
+			n *= 3
+		}
+	case TIMER:
+		n = 2*n + sliceBytes
+	case SET:
+		if a.SetPrecision > 0 {
+			n += 1 << a.SetPrecision
+		}
+	}
+	return n
+}
+
+// estimateMemory estimates the memory taken by the series the aggregator holds. The
+// caller must hold the lock.
+func (a *MetricAggregator) estimateMemory() int64 {
+	var n int64
+	for k := range a.Counters {
+		n += a.seriesBytes(COUNTER, k)
+	}
+	for k := range a.Gauges {
+		n += a.seriesBytes(GAUGE, k)
+	}
+	for k, v := range a.Timers {
+		n += a.seriesBytes(TIMER, k) + int64(cap(v))*sampleBytes
+	}
+	for k, s := range a.sets {
+		n += a.seriesBytes(SET, k)
+		if s, ok := s.(exactSet); ok {
+			for member := range s {
+				n += int64(len(member) + mapEntryBytes)
+			}
+		}
+	}
+	return n
+}
@@ -0,0 +1,66 @@
+package statsd
+
+import (
+	"time"
+)
+
+// Buckets of the canary gauge and of the latency measured with it
+const (
+	CanaryBucket     = "statsd.canary"
+	E2ELatencyBucket = "statsd.e2e_latency"
+)
+
+// Canary measures the end-to-end latency of the pipeline. Every Interval it passes Handler
+// a synthetic gauge, CanaryBucket, set to the time it was injected at. The MetricSenders
+// returned by Sender find it in the flushes going through them and, once a flush has been
+// sent, pass Handler the time elapsed since as a gauge in milliseconds, E2ELatencyBucket
+// tagged with the backend.
+//
+// The latency includes the wait for the flush. When Interval is the flush interval that
+// part stays the same from one flush to the next, so a growing latency means the metrics
+// got slower through the handlers, the aggregator or the backend.
+type Canary struct {
+	Handler  Handler
+	Interval time.Duration // How often the canary is injected, every 10s if zero
+}
+
+// Run injects the canary every Interval until the program exits
+func (c *Canary) Run() {
+	interval := c.Interval
+	if interval <= 0 {
+		interval = 10 * time.Second
+	}
+	for now := range time.Tick(interval) {
+		c.Handler.HandleMetric(Metric{Type: GAUGE, Bucket: CanaryBucket, Value: float64(now.UnixNano()) / 1e9, SampleRate: 1})
+	}
+}
+
+// Sender returns a MetricSender passing the flushes on to sender and measuring the latency
+// of the canary up to the backend called name
+func (c *Canary) Sender(name string, sender MetricSender) MetricSender {
+	return &canarySender{c, name, sender}
+}
+
+// canarySender measures the latency of the canary up to a backend
+type canarySender struct {
+	canary *Canary
+	name   string
+	sender MetricSender
+}
+
+// SendMetrics sends metrics and measures the latency of the canary
+func (s *canarySender) SendMetrics(metrics MetricMap) error {
+	return s.SendMetricsAt(metrics, time.Now())
+}
+
+// SendMetricsAt sends metrics with the timestamp t and measures the latency of the canary
+func (s *canarySender) SendMetricsAt(metrics MetricMap, t time.Time) error {
+	injected, ok := metrics["stats.gauges."+CanaryBucket]
+	err := sendMetricsAt(s.sender, metrics, t)
+	if ok && err == nil {
+		latency := time.Since(time.Unix(0, int64(injected*1e9)))
+		s.canary.Handler.HandleMetric(Metric{Type: GAUGE, Bucket: E2ELatencyBucket, Value: latency.Seconds() * 1000, SampleRate: 1,
+			Tags: []string{"backend:" + s.name}})
+	}
+	return err
+}
@@ -0,0 +1,54 @@
+package statsd
+
+import (
+	"sync/atomic"
+)
+
+// ChannelHandler is a Handler that delivers the metrics on a bounded channel, for programs
+// that would rather range over the metrics than be called back, e.g.
+//
+//	ch := statsd.NewChannelHandler(10000)
+//	r := statsd.MetricReceiver{Addr: ":8125", Handler: ch}
+//	go r.ListenAndReceive()
+//	for m := range ch.Metrics() {
+//		...
+//	}
+//
+// The receivers never wait for the consumer: metrics that don't fit in the channel are
+// dropped and counted, which Dropped reports.
+type ChannelHandler struct {
+	c       chan Metric
+	dropped int64
+}
+
+// NewChannelHandler returns a ChannelHandler whose channel buffers size metrics
+func NewChannelHandler(size int) *ChannelHandler {
+	return &ChannelHandler{c: make(chan Metric, size)}
+}
+
+// Metrics returns the channel the metrics are delivered on. It is never closed.
+func (h *ChannelHandler) Metrics() <-chan Metric {
+	return h.c
+}
+
+// Dropped returns the number of metrics dropped so far because the channel was full
+func (h *ChannelHandler) Dropped() int64 {
+	return atomic.LoadInt64(&h.dropped)
+}
+
+// HandleMetric delivers m on the channel, or drops it if the channel is full
+func (h *ChannelHandler) HandleMetric(m Metric) {
+	select {
+	case h.c <- m:
+	default:
+		atomic.AddInt64(&h.dropped, 1)
+	}
+}
+
+// HandleMetrics delivers the metrics of a datagram on the channel
+func (h *ChannelHandler) HandleMetrics(ms []Metric) {
+	for _, m := range ms {
+		h.HandleMetric(m)
+	}
+	ReleaseMetrics(ms)
+}
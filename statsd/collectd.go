@@ -0,0 +1,211 @@
+package statsd
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"log"
+	"math"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// DefaultCollectdAddr is the default address on which a CollectdReceiver listens, the
+// port of collectd's network plugin
+const DefaultCollectdAddr = ":25826"
+
+// Part types of the collectd binary protocol
+const (
+	collectdHost           = 0x0000
+	collectdPlugin         = 0x0002
+	collectdPluginInstance = 0x0003
+	collectdType           = 0x0004
+	collectdTypeInstance   = 0x0005
+	collectdValues         = 0x0006
+)
+
+// Data source types of collectd values
+const (
+	collectdCounter  = 0
+	collectdGauge    = 1
+	collectdDerive   = 2
+	collectdAbsolute = 3
+)
+
+// CollectdReceiver receives the binary network protocol of collectd on UDP and passes the
+// values it carries on to Handler.
+//
+// A value of the plugin "cpu", instance "0", type "percent" and type instance "idle" sent
+// by the host "web1" becomes the metric "collectd.cpu.percent.idle" tagged "host:web1"
+// and "plugin_instance:0". Types with several data sources, such as "if_octets", get the
+// index of the source appended, e.g. "collectd.interface.if_octets.0".
+//
+// Gauges become gauges and absolute values counters. Counters and derives are cumulative,
+// so the increase since the previous packet is counted instead. Signed and encrypted
+// packets aren't supported, their parts are skipped.
+type CollectdReceiver struct {
+	Addr    string
+	Handler Handler
+
+	mu   sync.Mutex
+	last map[string]float64 // Previous value of each cumulative series
+}
+
+// ListenAndReceive listens on the UDP address of the receiver and receives packets
+func (r *CollectdReceiver) ListenAndReceive() error {
+	addr := r.Addr
+	if addr == "" {
+		addr = DefaultCollectdAddr
+	}
+	c, err := net.ListenPacket("udp", addr)
+	if err != nil {
+		return err
+	}
+	return r.Receive(c)
+}
+
+// Receive accepts collectd packets on c until it is closed, or reading fails for good
+func (r *CollectdReceiver) Receive(c net.PacketConn) error {
+	defer c.Close()
+
+	msg := make([]byte, 65536)
+	var backoff time.Duration
+	for {
+		n, _, err := c.ReadFrom(msg)
+		if err != nil {
+			if retryRead(err, &backoff, log.Printf) {
+				continue
+			}
+			return closedError(err)
+		}
+		backoff = 0
+		if err := r.handlePacket(msg[:n]); err != nil {
+			debugf("Invalid collectd packet: %s", err)
+		}
+	}
+}
+
+// collectdValueList is the identity of the values of a packet, set by the parts
+// preceding them
+type collectdValueList struct {
+	host, plugin, pluginInstance, typ, typeInstance string
+}
+
+// handlePacket passes on the values of a packet
+func (r *CollectdReceiver) handlePacket(p []byte) error {
+	var vl collectdValueList
+	for len(p) > 0 {
+		if len(p) < 4 {
+			return errors.New("truncated part header")
+		}
+		typ, length := binary.BigEndian.Uint16(p), int(binary.BigEndian.Uint16(p[2:]))
+		if length < 4 || length > len(p) {
+			return errors.New("invalid part length")
+		}
+		body := p[4:length]
+		p = p[length:]
+
+		switch typ {
+		case collectdHost:
+			vl.host = collectdString(body)
+		case collectdPlugin:
+			vl.plugin = collectdString(body)
+		case collectdPluginInstance:
+			vl.pluginInstance = collectdString(body)
+		case collectdType:
+			vl.typ = collectdString(body)
+		case collectdTypeInstance:
+			vl.typeInstance = collectdString(body)
+		case collectdValues:
+			if err := r.handleValues(vl, body); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// collectdString returns a null terminated string part
+func collectdString(b []byte) string {
+	if i := bytes.IndexByte(b, 0); i >= 0 {
+		b = b[:i]
+	}
+	return string(b)
+}
+
+// handleValues passes on the values of a values part
+func (r *CollectdReceiver) handleValues(vl collectdValueList, b []byte) error {
+	if len(b) < 2 {
+		return errors.New("truncated values")
+	}
+	n := int(binary.BigEndian.Uint16(b))
+	if len(b) != 2+n*9 {
+		return errors.New("invalid values length")
+	}
+	types, values := b[2:2+n], b[2+n:]
+
+	bucket := "collectd." + vl.plugin + "." + vl.typ
+	if vl.typeInstance != "" {
+		bucket += "." + vl.typeInstance
+	}
+	var tags []string
+	if vl.host != "" {
+		tags = append(tags, "host:"+vl.host)
+	}
+	if vl.pluginInstance != "" {
+		tags = append(tags, "plugin_instance:"+vl.pluginInstance)
+	}
+
+	for i := 0; i < n; i++ {
+		m := Metric{Bucket: bucket, SampleRate: 1, Tags: tags}
+		if n > 1 {
+			m.Bucket += "." + strconv.Itoa(i)
+		}
+		raw := values[i*8 : i*8+8]
+		switch types[i] {
+		case collectdGauge:
+			m.Type, m.Value = GAUGE, math.Float64frombits(binary.LittleEndian.Uint64(raw))
+		case collectdCounter, collectdAbsolute:
+			m.Type, m.Value = COUNTER, float64(binary.BigEndian.Uint64(raw))
+		case collectdDerive:
+			m.Type, m.Value = COUNTER, float64(int64(binary.BigEndian.Uint64(raw)))
+		default:
+			continue
+		}
+		if types[i] == collectdCounter || types[i] == collectdDerive {
+			delta, ok := r.increase(m.Key(), m.Value)
+			if !ok {
+				continue
+			}
+			if delta < 0 && types[i] == collectdCounter {
+				// The counter wrapped or was reset, derives may decrease
+				delta = m.Value
+			}
+			m.Value = delta
+		}
+		if math.IsNaN(m.Value) || math.IsInf(m.Value, 0) {
+			continue
+		}
+		r.Handler.HandleMetric(m)
+	}
+	return nil
+}
+
+// increase returns how much the cumulative series key increased to value since the last
+// packet, and false if it wasn't seen before
+func (r *CollectdReceiver) increase(key string, value float64) (float64, bool) {
+	defer r.mu.Unlock()
+	r.mu.Lock()
+
+	if r.last == nil {
+		r.last = make(map[string]float64)
+	}
+	last, seen := r.last[key]
+	r.last[key] = value
+	if !seen {
+		return 0, false
+	}
+	return value - last, true
+}
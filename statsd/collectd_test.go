@@ -0,0 +1,141 @@
+package statsd
+
+import (
+	"encoding/binary"
+	"math"
+	"reflect"
+	"testing"
+)
+
+// collectdPart returns a part of the collectd binary protocol
+func collectdPart(typ uint16, body []byte) []byte {
+	b := make([]byte, 4, 4+len(body))
+	binary.BigEndian.PutUint16(b, typ)
+	binary.BigEndian.PutUint16(b[2:], uint16(4+len(body)))
+	return append(b, body...)
+}
+
+// collectdStringPart returns a part holding a null terminated string
+func collectdStringPart(typ uint16, s string) []byte {
+	return collectdPart(typ, append([]byte(s), 0))
+}
+
+// collectdValuesPart returns a values part of data sources of types with the raw values
+func collectdValuesPart(types []byte, values []uint64) []byte {
+	body := make([]byte, 2, 2+9*len(types))
+	binary.BigEndian.PutUint16(body, uint16(len(types)))
+	body = append(body, types...)
+	for i, v := range values {
+		raw := make([]byte, 8)
+		if types[i] == collectdGauge {
+			binary.LittleEndian.PutUint64(raw, v)
+		} else {
+			binary.BigEndian.PutUint64(raw, v)
+		}
+		body = append(body, raw...)
+	}
+	return collectdPart(collectdValues, body)
+}
+
+// collectdPacket returns a packet of the parts
+func collectdPacket(parts ...[]byte) []byte {
+	var p []byte
+	for _, part := range parts {
+		p = append(p, part...)
+	}
+	return p
+}
+
+func TestCollectdPacket(t *testing.T) {
+	header := collectdPacket(
+		collectdStringPart(collectdHost, "web1"),
+		collectdStringPart(collectdPlugin, "cpu"),
+		collectdStringPart(collectdPluginInstance, "0"),
+		collectdStringPart(collectdType, "percent"),
+		collectdStringPart(collectdTypeInstance, "idle"))
+	tags := []string{"host:web1", "plugin_instance:0"}
+
+	tests := map[string]struct {
+		packets  [][]byte
+		expected []Metric
+	}{
+		"gauge": {
+			packets:  [][]byte{collectdPacket(header, collectdValuesPart([]byte{collectdGauge}, []uint64{math.Float64bits(97.5)}))},
+			expected: []Metric{{Bucket: "collectd.cpu.percent.idle", Value: 97.5, Type: GAUGE, SampleRate: 1, Tags: tags}},
+		},
+		"absolute": {
+			packets:  [][]byte{collectdPacket(header, collectdValuesPart([]byte{collectdAbsolute}, []uint64{7}))},
+			expected: []Metric{{Bucket: "collectd.cpu.percent.idle", Value: 7, Type: COUNTER, SampleRate: 1, Tags: tags}},
+		},
+		"derive": {
+			packets: [][]byte{
+				collectdPacket(header, collectdValuesPart([]byte{collectdDerive}, []uint64{100})),
+				collectdPacket(header, collectdValuesPart([]byte{collectdDerive}, []uint64{90})),
+			},
+			expected: []Metric{{Bucket: "collectd.cpu.percent.idle", Value: -10, Type: COUNTER, SampleRate: 1, Tags: tags}},
+		},
+		"counter wrap": {
+			packets: [][]byte{
+				collectdPacket(header, collectdValuesPart([]byte{collectdCounter}, []uint64{100})),
+				collectdPacket(header, collectdValuesPart([]byte{collectdCounter}, []uint64{150})),
+				collectdPacket(header, collectdValuesPart([]byte{collectdCounter}, []uint64{20})),
+			},
+			expected: []Metric{
+				{Bucket: "collectd.cpu.percent.idle", Value: 50, Type: COUNTER, SampleRate: 1, Tags: tags},
+				{Bucket: "collectd.cpu.percent.idle", Value: 20, Type: COUNTER, SampleRate: 1, Tags: tags},
+			},
+		},
+		"data sources": {
+			packets: [][]byte{collectdPacket(
+				collectdStringPart(collectdPlugin, "interface"),
+				collectdStringPart(collectdType, "if_octets"),
+				collectdValuesPart([]byte{collectdGauge, collectdAbsolute}, []uint64{math.Float64bits(1), 2}))},
+			expected: []Metric{
+				{Bucket: "collectd.interface.if_octets.0", Value: 1, Type: GAUGE, SampleRate: 1},
+				{Bucket: "collectd.interface.if_octets.1", Value: 2, Type: COUNTER, SampleRate: 1},
+			},
+		},
+		"not finite": {
+			packets: [][]byte{collectdPacket(header, collectdValuesPart([]byte{collectdGauge}, []uint64{math.Float64bits(math.NaN())}))},
+		},
+		"signed part": {
+			packets:  [][]byte{collectdPacket(collectdPart(0x0200, make([]byte, 36)), header, collectdValuesPart([]byte{collectdAbsolute}, []uint64{1}))},
+			expected: []Metric{{Bucket: "collectd.cpu.percent.idle", Value: 1, Type: COUNTER, SampleRate: 1, Tags: tags}},
+		},
+	}
+
+	for name, tc := range tests {
+		var received []Metric
+		r := &CollectdReceiver{Handler: HandlerFunc(func(m Metric) {
+			received = append(received, m)
+		})}
+		for _, p := range tc.packets {
+			if err := r.handlePacket(p); err != nil {
+				t.Errorf("test %s error: %s", name, err)
+			}
+		}
+		if !reflect.DeepEqual(received, tc.expected) {
+			t.Errorf("test %s: expected %v, got %v", name, tc.expected, received)
+		}
+	}
+}
+
+func TestCollectdMalformed(t *testing.T) {
+	values := collectdValuesPart([]byte{collectdAbsolute}, []uint64{1})
+	failing := map[string][]byte{
+		"truncated header":  {0x00, 0x06, 0x00},
+		"short part":        {0x00, 0x02, 0x00, 0x03},
+		"long part":         {0x00, 0x02, 0x00, 0x10, 'a', 0},
+		"truncated values":  collectdPart(collectdValues, []byte{0x00}),
+		"values length":     collectdPart(collectdValues, []byte{0x00, 0x02, collectdGauge}),
+		"truncated packet":  values[:len(values)-1],
+		"garbage after one": append(append([]byte{}, values...), 0xff),
+	}
+
+	for name, p := range failing {
+		r := &CollectdReceiver{Handler: HandlerFunc(func(m Metric) {})}
+		if err := r.handlePacket(p); err == nil {
+			t.Errorf("test %s: expected error", name)
+		}
+	}
+}
@@ -0,0 +1,147 @@
+package statsd
+
+import (
+	"encoding/json"
+	"io"
+	"log"
+	"math"
+	"sort"
+	"sync"
+	"time"
+)
+
+// maxComparedFlushes is the number of flushes of one side kept waiting for the other side
+const maxComparedFlushes = 10
+
+// FlushComparator compares the flushes of a candidate aggregator with those of the
+// primary one, both fed the same metrics through a TeeHandler, so that a change of their
+// settings can be checked against live traffic before it is made. The flushes of each
+// side are paired in the order they arrive, which matches as long as both aggregators
+// flush at the same interval.
+type FlushComparator struct {
+	Tolerance float64   // Relative difference up to which values are considered equal
+	Report    io.Writer // If set, where a FlushDiff is written as a JSON line each flush
+
+	mu        sync.Mutex
+	primary   []timedMetricMap
+	candidate []timedMetricMap
+}
+
+// FlushDiff is the difference between a flush of the candidate and the primary
+type FlushDiff struct {
+	Time          time.Time       `json:"time"` // Of the primary flush
+	Same          int             `json:"same"`
+	OnlyPrimary   []string        `json:"only_primary,omitempty"`
+	OnlyCandidate []string        `json:"only_candidate,omitempty"`
+	Changed       []ChangedMetric `json:"changed,omitempty"`
+}
+
+// ChangedMetric is a metric whose value differs between the two sides
+type ChangedMetric struct {
+	Name      string  `json:"name"`
+	Primary   float64 `json:"primary"`
+	Candidate float64 `json:"candidate"`
+}
+
+// Primary returns the sender of the primary aggregator, which records its flushes and
+// passes them on to sender
+func (c *FlushComparator) Primary(sender MetricSender) MetricSender {
+	return &comparedSender{c, sender, true}
+}
+
+// Candidate returns the sender of the candidate aggregator, whose flushes go nowhere else
+func (c *FlushComparator) Candidate() MetricSender {
+	return &comparedSender{comparator: c}
+}
+
+// record adds a flush of one side and compares it if the other side's is in
+func (c *FlushComparator) record(primary bool, metrics MetricMap, t time.Time) {
+	f := timedMetricMap{finiteMetrics(metrics), t}
+	c.mu.Lock()
+	if primary {
+		c.primary = append(c.primary, f)
+	} else {
+		c.candidate = append(c.candidate, f)
+	}
+	// Forget flushes the other side has given up on
+	if len(c.primary) > maxComparedFlushes {
+		c.primary = c.primary[1:]
+	}
+	if len(c.candidate) > maxComparedFlushes {
+		c.candidate = c.candidate[1:]
+	}
+	if len(c.primary) == 0 || len(c.candidate) == 0 {
+		c.mu.Unlock()
+		return
+	}
+	p, cand := c.primary[0], c.candidate[0]
+	c.primary, c.candidate = c.primary[1:], c.candidate[1:]
+	c.mu.Unlock()
+
+	c.report(c.Compare(p.Metrics, cand.Metrics, p.Time))
+}
+
+// Compare returns the difference between a flush of the primary and one of the candidate
+func (c *FlushComparator) Compare(primary, candidate MetricMap, t time.Time) FlushDiff {
+	diff := FlushDiff{Time: t}
+	for k, v := range primary {
+		w, ok := candidate[k]
+		switch {
+		case !ok:
+			diff.OnlyPrimary = append(diff.OnlyPrimary, k)
+		case math.Abs(v-w) > c.Tolerance*math.Max(math.Abs(v), math.Abs(w)):
+			diff.Changed = append(diff.Changed, ChangedMetric{k, v, w})
+		default:
+			diff.Same++
+		}
+	}
+	for k := range candidate {
+		if _, ok := primary[k]; !ok {
+			diff.OnlyCandidate = append(diff.OnlyCandidate, k)
+		}
+	}
+	sort.Strings(diff.OnlyPrimary)
+	sort.Strings(diff.OnlyCandidate)
+	sort.Slice(diff.Changed, func(i, j int) bool { return diff.Changed[i].Name < diff.Changed[j].Name })
+	return diff
+}
+
+// report writes diff to Report, or logs a summary of it if it isn't set
+func (c *FlushComparator) report(diff FlushDiff) {
+	if c.Report == nil {
+		log.Printf("flush comparison: %d same, %d only in primary, %d only in candidate, %d changed",
+			diff.Same, len(diff.OnlyPrimary), len(diff.OnlyCandidate), len(diff.Changed))
+		return
+	}
+	b, err := json.Marshal(diff)
+	if err != nil {
+		log.Printf("error encoding flush comparison: %s", err)
+		return
+	}
+	defer c.mu.Unlock()
+	c.mu.Lock()
+	if _, err := c.Report.Write(append(b, '\n')); err != nil {
+		log.Printf("error writing flush comparison: %s", err)
+	}
+}
+
+// comparedSender records the flushes of one side of a FlushComparator
+type comparedSender struct {
+	comparator *FlushComparator
+	sender     MetricSender // If set, where the flushes are passed on to
+	primary    bool
+}
+
+// SendMetrics records metrics and passes them on
+func (s *comparedSender) SendMetrics(metrics MetricMap) error {
+	return s.SendMetricsAt(metrics, time.Now())
+}
+
+// SendMetricsAt records metrics flushed at t and passes them on
+func (s *comparedSender) SendMetricsAt(metrics MetricMap, t time.Time) error {
+	s.comparator.record(s.primary, metrics, t)
+	if s.sender == nil {
+		return nil
+	}
+	return sendMetricsAt(s.sender, metrics, t)
+}
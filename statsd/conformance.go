@@ -0,0 +1,129 @@
+package statsd
+
+import (
+	"fmt"
+	"math"
+)
+
+// Parser parses a line of the statsd wire format, without its trailing newline, in to a Metric
+type Parser interface {
+	ParseLine(line []byte) (Metric, error)
+}
+
+// The ParserFunc type is an adapter to allow the use of ordinary functions as Parsers
+type ParserFunc func(line []byte) (Metric, error)
+
+// ParseLine calls f(line)
+func (f ParserFunc) ParseLine(line []byte) (Metric, error) {
+	return f(line)
+}
+
+// DefaultParser is the Parser used by MetricReceiver
+var DefaultParser Parser = ParserFunc(parseLine)
+
+// TestVector is a line of the wire format along with the Metric it parses in to, or
+// whether it must be rejected
+type TestVector struct {
+	Line   string
+	Metric Metric
+	Error  bool
+}
+
+// TestVectors describe the wire format understood by this package. Tags are sorted.
+var TestVectors = []TestVector{
+	{Line: "foo.bar.baz:2|c", Metric: Metric{Bucket: "foo.bar.baz", Value: 2, Type: COUNTER, SampleRate: 1}},
+	{Line: "abc.def.g:3|g", Metric: Metric{Bucket: "abc.def.g", Value: 3, Type: GAUGE, SampleRate: 1}},
+	{Line: "def.g:10|ms", Metric: Metric{Bucket: "def.g", Value: 10, Type: TIMER, SampleRate: 1}},
+	{Line: "def.g:0.25|ms", Metric: Metric{Bucket: "def.g", Value: 0.25, Type: TIMER, SampleRate: 1}},
+	{Line: "temp:-4.5|g", Metric: Metric{Bucket: "temp", Value: -4.5, Type: GAUGE, SampleRate: 1}},
+	{Line: "big:1e6|c", Metric: Metric{Bucket: "big", Value: 1e6, Type: COUNTER, SampleRate: 1}},
+	{Line: "bytes:0.5|c", Metric: Metric{Bucket: "bytes", Value: 0.5, Type: COUNTER, SampleRate: 1}},
+	{Line: "foo.bar:1|c|T1700000000", Metric: Metric{Bucket: "foo.bar", Value: 1, Type: COUNTER, SampleRate: 1, Timestamp: 1700000000}},
+	{Line: "job.done:1|c|ttl:300", Metric: Metric{Bucket: "job.done", Value: 1, Type: COUNTER, SampleRate: 1, TTL: 300}},
+	{Line: "job.progress:0.5|g|#job:42|ttl:60|T1700000000", Metric: Metric{Bucket: "job.progress", Value: 0.5, Type: GAUGE, SampleRate: 1, Tags: []string{"job:42"}, Timestamp: 1700000000, TTL: 60}},
+	{Line: "users:alice|s", Metric: Metric{Bucket: "users", Member: "alice", Type: SET, SampleRate: 1}},
+	{Line: "users:42|s|#region:eu", Metric: Metric{Bucket: "users", Member: "42", Type: SET, SampleRate: 1, Tags: []string{"region:eu"}}},
+	{Line: "foo.bar:1|c|@0.5", Metric: Metric{Bucket: "foo.bar", Value: 1, Type: COUNTER, SampleRate: 0.5}},
+	{Line: "foo.bar:1|c|@1", Metric: Metric{Bucket: "foo.bar", Value: 1, Type: COUNTER, SampleRate: 1}},
+	{Line: "foo.bar:1|c|", Metric: Metric{Bucket: "foo.bar", Value: 1, Type: COUNTER, SampleRate: 1}},
+	{Line: "foo.bar:1|c|#b:2,a:1", Metric: Metric{Bucket: "foo.bar", Value: 1, Type: COUNTER, SampleRate: 1, Tags: []string{"a:1", "b:2"}}},
+	{Line: "foo.bar:1|c|#canary", Metric: Metric{Bucket: "foo.bar", Value: 1, Type: COUNTER, SampleRate: 1, Tags: []string{"canary"}}},
+	{Line: "foo.bar:1|ms|#region:eu|@0.25", Metric: Metric{Bucket: "foo.bar", Value: 1, Type: TIMER, SampleRate: 0.25, Tags: []string{"region:eu"}}},
+	{Line: "foo.bar:1|ms|@0.25|#region:eu", Metric: Metric{Bucket: "foo.bar", Value: 1, Type: TIMER, SampleRate: 0.25, Tags: []string{"region:eu"}}},
+	{Line: "fOO|bar:bazkk", Error: true},
+	{Line: "foo.bar.baz:1|q", Error: true},
+	{Line: "foo.bar:1|c|x", Error: true},
+	{Line: "foo.bar:abc|c", Error: true},
+	{Line: "foo.bar:1", Error: true},
+	{Line: "foo.bar", Error: true},
+	{Line: "foo.bar:1|c|@0", Error: true},
+	{Line: "foo.bar:1|c|@1.5", Error: true},
+	{Line: "foo.bar:1|c|@x", Error: true},
+	{Line: "foo.bar:1|c|@NaN", Error: true},
+	{Line: "foo.bar:NaN|c", Error: true},
+	{Line: "users:|s", Error: true},
+	{Line: "foo.bar:1|c|T", Error: true},
+	{Line: "foo.bar:1|c|T-5", Error: true},
+	{Line: "foo.bar:1|c|ttl:", Error: true},
+	{Line: "foo.bar:1|c|ttl:0", Error: true},
+	{Line: "foo.bar:1|c|ttl:5m", Error: true},
+	{Line: "foo.bar:+Inf|g", Error: true},
+	{Line: "foo.bar:-Inf|ms", Error: true},
+}
+
+// Conformance runs the TestVectors through p and returns an error for each one it fails
+func Conformance(p Parser) []error {
+	var errs []error
+	for _, v := range TestVectors {
+		m, err := p.ParseLine([]byte(v.Line))
+		switch {
+		case v.Error && err == nil:
+			errs = append(errs, fmt.Errorf("%q: expected an error, got %s", v.Line, m))
+		case !v.Error && err != nil:
+			errs = append(errs, fmt.Errorf("%q: %s", v.Line, err))
+		case !v.Error && !sameMetric(m, v.Metric):
+			errs = append(errs, fmt.Errorf("%q: expected %s, got %s", v.Line, v.Metric, m))
+		}
+	}
+	return errs
+}
+
+// FormatConformance checks that format, a client library's formatting of metrics in to
+// lines, produces lines DefaultParser parses back in to the metrics of the TestVectors.
+// It returns an error for each metric that doesn't make the round trip.
+func FormatConformance(format func(Metric) []byte) []error {
+	var errs []error
+	for _, v := range TestVectors {
+		if v.Error {
+			continue
+		}
+		line := format(v.Metric)
+		if n := len(line); n > 0 && line[n-1] == '\n' {
+			line = line[:n-1]
+		}
+		m, err := DefaultParser.ParseLine(line)
+		switch {
+		case err != nil:
+			errs = append(errs, fmt.Errorf("%s formatted as %q: %s", v.Metric, line, err))
+		case !sameMetric(m, v.Metric):
+			errs = append(errs, fmt.Errorf("%s formatted as %q: parsed as %s", v.Metric, line, m))
+		}
+	}
+	return errs
+}
+
+// sameMetric reports whether a and b are the same metric
+func sameMetric(a, b Metric) bool {
+	if a.Type != b.Type || a.Bucket != b.Bucket || a.Member != b.Member || a.Timestamp != b.Timestamp || a.TTL != b.TTL || len(a.Tags) != len(b.Tags) {
+		return false
+	}
+	if math.Abs(a.Value-b.Value) > 1e-9*math.Abs(b.Value) || a.SampleRate != b.SampleRate {
+		return false
+	}
+	for i := range a.Tags {
+		if a.Tags[i] != b.Tags[i] {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,120 @@
+package statsd
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// DNSRefreshInterval is how long the addresses a backend host name resolves to are used
+// before it is resolved again, and how long a Graphite connection is kept before it is
+// reopened, so backends behind DNS based load balancing see their traffic move along with
+// the records
+var DNSRefreshInterval = 30 * time.Second
+
+// resolvedHost holds the addresses of a host name
+type resolvedHost struct {
+	addrs    []string
+	next     int // index of the address to dial next
+	resolved time.Time
+}
+
+// backendDialer dials backends, resolving their host names again once DNSRefreshInterval
+// has passed and rotating among their addresses
+type backendDialer struct {
+	mu    sync.Mutex
+	hosts map[string]*resolvedHost
+}
+
+// dialer is used for every backend connection
+var dialer = &backendDialer{hosts: make(map[string]*resolvedHost)}
+
+// httpClient is used for every backend request. Its connections are pooled and reused,
+// and closed once idle for a while so new ones follow DNS changes.
+var httpClient = &http.Client{
+	Timeout: time.Minute,
+	Transport: &http.Transport{
+		Proxy:               http.ProxyFromEnvironment,
+		DialContext:         dialer.DialContext,
+		MaxIdleConnsPerHost: 8,
+		IdleConnTimeout:     90 * time.Second,
+		TLSHandshakeTimeout: 10 * time.Second,
+	},
+}
+
+// Dial connects to addr on the named network
+func (d *backendDialer) Dial(network, addr string) (net.Conn, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	return d.DialContext(ctx, network, addr)
+}
+
+// DialContext connects to addr on the named network, trying each address of its host,
+// starting after the one dialed last time
+func (d *backendDialer) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil || net.ParseIP(host) != nil {
+		var nd net.Dialer
+		return nd.DialContext(ctx, network, addr)
+	}
+	addrs, err := d.resolve(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+	var nd net.Dialer
+	for _, a := range addrs {
+		var c net.Conn
+		if c, err = nd.DialContext(ctx, network, net.JoinHostPort(a, port)); err == nil {
+			return c, nil
+		}
+	}
+	return nil, err
+}
+
+// resolve returns the addresses of host in the order they should be tried. If host can't
+// be resolved again the addresses it had are used.
+func (d *backendDialer) resolve(ctx context.Context, host string) ([]string, error) {
+	defer d.mu.Unlock()
+	d.mu.Lock()
+	h := d.hosts[host]
+	if h == nil || time.Since(h.resolved) > DNSRefreshInterval {
+		addrs, err := net.DefaultResolver.LookupHost(ctx, host)
+		switch {
+		case err == nil && len(addrs) > 0:
+			if h == nil {
+				h = new(resolvedHost)
+				d.hosts[host] = h
+			}
+			h.addrs, h.resolved = addrs, time.Now()
+		case h == nil:
+			return nil, fmt.Errorf("resolving %s: %v", host, err)
+		default:
+			infof("resolving %s failed, using its previous addresses: %s", host, err)
+			h.resolved = time.Now()
+		}
+	}
+	n := len(h.addrs)
+	start := h.next % n
+	h.next = start + 1
+	addrs := make([]string, 0, n)
+	for i := 0; i < n; i++ {
+		addrs = append(addrs, h.addrs[(start+i)%n])
+	}
+	return addrs, nil
+}
+
+// doRequest sends req and returns an error unless it succeeds with a 2xx status
+func doRequest(req *http.Request) error {
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("%s %s: %s", req.Method, req.URL.Host, resp.Status)
+	}
+	return nil
+}
@@ -0,0 +1,181 @@
+package statsd
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DefaultDockerSocket is the default path of the socket of the Docker API
+const DefaultDockerSocket = "/var/run/docker.sock"
+
+// Containers seen sending metrics but unknown to DockerTagger trigger a listing at most
+// this often
+const dockerMissInterval = 5 * time.Second
+
+// DockerTagger is a SourceTagger that tags the metrics sent from Docker containers on the
+// same host with the container they come from, found by its IP address:
+//
+//	container_name:<name>, container_id:<short id>, image_name:<image>, image_tag:<tag>
+//
+// along with the values of Labels, as "<label>:<value>". Containers are listed through the
+// Docker API every Interval, in the background, so looking tags up never waits for it.
+// Metrics sent from the host itself or containers using its network get no tags.
+type DockerTagger struct {
+	Socket   string        // Path of the socket of the Docker API, DefaultDockerSocket if empty
+	Labels   []string      // Container labels added as tags
+	Interval time.Duration // How often containers are listed, every 30s if zero
+
+	mu        sync.Mutex
+	byIP      map[string][]string // Tags of the containers by IP address
+	listed    time.Time           // When the containers were last listed
+	listing   bool
+	client    *http.Client
+	lastError string
+}
+
+// dockerContainer is a container as listed by the Docker API
+type dockerContainer struct {
+	ID              string            `json:"Id"`
+	Names           []string          `json:"Names"`
+	Image           string            `json:"Image"`
+	Labels          map[string]string `json:"Labels"`
+	NetworkSettings struct {
+		Networks map[string]struct {
+			IPAddress         string `json:"IPAddress"`
+			GlobalIPv6Address string `json:"GlobalIPv6Address"`
+		} `json:"Networks"`
+	} `json:"NetworkSettings"`
+}
+
+// SourceTags returns the tags of the container with the IP address of addr, if any
+func (d *DockerTagger) SourceTags(addr net.Addr) []string {
+	ip := addr.String()
+	if host, _, err := net.SplitHostPort(ip); err == nil {
+		ip = host
+	}
+
+	defer d.mu.Unlock()
+	d.mu.Lock()
+	tags, ok := d.byIP[ip]
+	interval := d.Interval
+	if interval <= 0 {
+		interval = 30 * time.Second
+	}
+	since := time.Since(d.listed)
+	if !d.listing && (since >= interval || !ok && since >= dockerMissInterval) {
+		d.listing = true
+		go d.refresh()
+	}
+	return tags
+}
+
+// refresh lists the containers again
+func (d *DockerTagger) refresh() {
+	byIP, err := d.list()
+
+	defer d.mu.Unlock()
+	d.mu.Lock()
+	d.listing = false
+	d.listed = time.Now()
+	if err != nil {
+		// Log each distinct error once rather than every interval
+		if err.Error() != d.lastError {
+			d.lastError = err.Error()
+			infof("listing Docker containers failed: %s", err)
+		}
+		return
+	}
+	d.lastError = ""
+	d.byIP = byIP
+}
+
+// list returns the tags of the running containers by IP address
+func (d *DockerTagger) list() (map[string][]string, error) {
+	d.mu.Lock()
+	if d.client == nil {
+		socket := d.Socket
+		if socket == "" {
+			socket = DefaultDockerSocket
+		}
+		d.client = &http.Client{
+			Timeout: 10 * time.Second,
+			Transport: &http.Transport{
+				DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+					var dialer net.Dialer
+					return dialer.DialContext(ctx, "unix", socket)
+				},
+			},
+		}
+	}
+	client := d.client
+	d.mu.Unlock()
+
+	resp, err := client.Get("http://docker/containers/json")
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("Docker API returned %s", resp.Status)
+	}
+	var containers []dockerContainer
+	if err := json.NewDecoder(resp.Body).Decode(&containers); err != nil {
+		return nil, err
+	}
+
+	byIP := make(map[string][]string)
+	for _, c := range containers {
+		tags := d.containerTags(c)
+		for _, n := range c.NetworkSettings.Networks {
+			if n.IPAddress != "" {
+				byIP[n.IPAddress] = tags
+			}
+			if n.GlobalIPv6Address != "" {
+				byIP[n.GlobalIPv6Address] = tags
+			}
+		}
+	}
+	return byIP, nil
+}
+
+// containerTags returns the sorted tags of c
+func (d *DockerTagger) containerTags(c dockerContainer) []string {
+	var tags []string
+	if len(c.Names) > 0 {
+		tags = append(tags, "container_name:"+strings.TrimPrefix(c.Names[0], "/"))
+	}
+	id := c.ID
+	if len(id) > 12 {
+		id = id[:12]
+	}
+	tags = append(tags, "container_id:"+id)
+	name, tag := splitImage(c.Image)
+	tags = append(tags, "image_name:"+name)
+	if tag != "" {
+		tags = append(tags, "image_tag:"+tag)
+	}
+	for _, label := range d.Labels {
+		if v, ok := c.Labels[label]; ok && v != "" {
+			tags = append(tags, label+":"+v)
+		}
+	}
+	return mergeTags(nil, tags)
+}
+
+// splitImage splits a Docker image reference such as "registry:5000/redis:7" in to its
+// name and tag, dropping any digest
+func splitImage(image string) (name, tag string) {
+	if at := strings.IndexByte(image, '@'); at >= 0 {
+		image = image[:at]
+	}
+	if colon := strings.LastIndexByte(image, ':'); colon > strings.LastIndexByte(image, '/') {
+		return image[:colon], image[colon+1:]
+	}
+	return image, ""
+}
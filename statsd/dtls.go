@@ -0,0 +1,79 @@
+package statsd
+
+import (
+	"crypto/tls"
+	"io"
+	"net"
+	"time"
+
+	"github.com/pion/dtls/v3"
+)
+
+// ListenAndReceiveDTLS acts like ListenAndReceive but expects the datagrams to be
+// encrypted with DTLS. The server certificate and matching private key are loaded
+// from the PEM encoded files certFile and keyFile.
+func (r *MetricReceiver) ListenAndReceiveDTLS(certFile, keyFile string) error {
+	l, err := r.listenDTLS(certFile, keyFile)
+	if err != nil {
+		return err
+	}
+	return r.ReceiveDTLS(l)
+}
+
+// listenDTLS listens for DTLS sessions on r.Addr with the certificate and key of certFile
+// and keyFile
+func (r *MetricReceiver) listenDTLS(certFile, keyFile string) (net.Listener, error) {
+	addr := r.Addr
+	if addr == "" {
+		addr = DefaultMetricsAddr
+	}
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, err
+	}
+	udpAddr, err := net.ResolveUDPAddr(r.network(), addr)
+	if err != nil {
+		return nil, err
+	}
+	config := &dtls.Config{
+		Certificates:         []tls.Certificate{cert},
+		ExtendedMasterSecret: dtls.RequireExtendedMasterSecret,
+	}
+	return dtls.Listen(r.network(), udpAddr, config)
+}
+
+// ReceiveDTLS accepts DTLS sessions on l and calls r.Handler.HandleMetric() for each line
+// in the decrypted datagrams that successfully parses in to a Metric
+func (r *MetricReceiver) ReceiveDTLS(l net.Listener) error {
+	defer l.Close()
+	var backoff time.Duration
+	for {
+		c, err := l.Accept()
+		if err != nil {
+			if retryRead(err, &backoff, r.logf) {
+				continue
+			}
+			return closedError(err)
+		}
+		backoff = 0
+		go r.receiveDTLSConn(c)
+	}
+}
+
+// receiveDTLSConn reads the datagrams of a single DTLS session until it is closed.
+// The handshake happens on the first read, so a misbehaving client only ends its own session.
+func (r *MetricReceiver) receiveDTLSConn(c net.Conn) {
+	defer c.Close()
+
+	msg := make([]byte, r.datagramSize())
+	for {
+		nbytes, err := c.Read(msg)
+		if err != nil {
+			if err != io.EOF {
+				r.logf("DTLS session with %s failed: %s", c.RemoteAddr(), err)
+			}
+			return
+		}
+		r.dispatchMessage(c.RemoteAddr(), msg[:nbytes])
+	}
+}
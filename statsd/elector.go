@@ -0,0 +1,157 @@
+package statsd
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"sync"
+	"time"
+)
+
+// Elector is implemented by objects that decide whether this instance is the one that
+// flushes metrics when several instances aggregate the same traffic.
+type Elector interface {
+	IsLeader() bool
+}
+
+// PeerElector elects a leader among a pair of gostatsd instances that receive duplicated
+// traffic, so that only one of them flushes to the backends. The instances exchange UDP
+// heartbeats, and when the leader's heartbeats stop the other instance takes over at its
+// next flush.
+//
+// Leadership is sticky: an instance that comes back does not take over from a healthy
+// leader. Only when both claim leadership, e.g. after a network partition heals, the
+// instance with the lower ID wins. IDs must be positive and differ: Run fails on hearing
+// from a peer with the same ID rather than leave the pair without a leader.
+type PeerElector struct {
+	ID       int           // Identifies this instance, positive and different from the peer's
+	Addr     string        // UDP address on which to listen for the peer's heartbeats
+	PeerAddr string        // UDP address of the peer
+	Interval time.Duration // How often to send heartbeats
+	Timeout  time.Duration // How long without heartbeats until the peer is considered dead
+
+	mu         sync.Mutex
+	leader     bool
+	peerID     int
+	peerLeader bool
+	lastSeen   time.Time
+}
+
+// IsLeader reports whether this instance is currently the leader
+func (e *PeerElector) IsLeader() bool {
+	defer e.mu.Unlock()
+	e.mu.Lock()
+	return e.leader
+}
+
+// Validate checks the settings of the elector
+func (e *PeerElector) Validate() error {
+	if e.ID <= 0 {
+		return errors.New("elector: the ID must be set to a positive number")
+	}
+	if e.PeerAddr == "" {
+		return errors.New("elector: missing peer address")
+	}
+	if e.Interval <= 0 || e.Timeout <= 0 {
+		return errors.New("elector: the interval and timeout must be positive")
+	}
+	return nil
+}
+
+// Run exchanges heartbeats with the peer and updates the leadership until an error occurs
+func (e *PeerElector) Run() error {
+	if err := e.Validate(); err != nil {
+		return err
+	}
+	c, err := net.ListenPacket("udp", e.Addr)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+	peer, err := net.ResolveUDPAddr("udp", e.PeerAddr)
+	if err != nil {
+		return err
+	}
+
+	// Give the peer a chance to announce itself before claiming leadership
+	e.mu.Lock()
+	e.lastSeen = time.Now()
+	e.mu.Unlock()
+
+	errc := make(chan error, 1)
+	go e.receive(c, errc)
+	tick := time.NewTicker(e.Interval)
+	defer tick.Stop()
+	for {
+		select {
+		case err := <-errc:
+			return err
+		case <-tick.C:
+		}
+		leader := e.elect()
+		_, err := c.WriteTo([]byte(fmt.Sprintf("%d %t\n", e.ID, leader)), peer)
+		if err != nil {
+			log.Printf("error sending heartbeat to %s: %s", peer, err)
+		}
+	}
+}
+
+// receive records the heartbeats sent by the peer until reading fails or one of them
+// can't be accepted
+func (e *PeerElector) receive(c net.PacketConn, errc chan<- error) {
+	msg := make([]byte, 64)
+	for {
+		nbytes, addr, err := c.ReadFrom(msg)
+		if err != nil {
+			errc <- fmt.Errorf("error reading heartbeat: %s", err)
+			return
+		}
+		if err := e.heartbeat(msg[:nbytes], time.Now()); err != nil {
+			errc <- fmt.Errorf("heartbeat from %s: %s", addr, err)
+			return
+		}
+	}
+}
+
+// heartbeat records a heartbeat of the peer received at now. Malformed heartbeats are
+// ignored, but one carrying the ID of this instance is an error since neither instance
+// could win a tie.
+func (e *PeerElector) heartbeat(msg []byte, now time.Time) error {
+	var id int
+	var leader bool
+	if _, err := fmt.Sscanf(string(msg), "%d %t", &id, &leader); err != nil {
+		return nil
+	}
+	if id == e.ID {
+		return fmt.Errorf("the peer has the same ID as this instance, %d", id)
+	}
+	defer e.mu.Unlock()
+	e.mu.Lock()
+	e.peerID, e.peerLeader, e.lastSeen = id, leader, now
+	return nil
+}
+
+// elect updates and returns this instance's leadership based on the peer's last heartbeat
+func (e *PeerElector) elect() bool {
+	defer e.mu.Unlock()
+	e.mu.Lock()
+
+	wasLeader := e.leader
+	switch {
+	case time.Since(e.lastSeen) > e.Timeout:
+		e.leader = true
+	case e.peerID == 0:
+		// Not heard from the peer yet, wait for it until the timeout
+	case e.peerLeader && e.leader:
+		e.leader = e.ID < e.peerID
+	case e.peerLeader:
+		e.leader = false
+	case !e.leader:
+		e.leader = e.ID < e.peerID
+	}
+	if e.leader != wasLeader {
+		infof("leader: %t", e.leader)
+	}
+	return e.leader
+}
@@ -0,0 +1,83 @@
+package statsd
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestPeerElector(t *testing.T) {
+	now := time.Now()
+	tests := []struct {
+		name       string
+		id         int
+		leader     bool
+		peerID     int
+		peerLeader bool
+		lastSeen   time.Time
+		expected   bool
+	}{
+		{"missing peer", 2, false, 0, false, now.Add(-time.Minute), true},
+		{"peer not heard yet", 1, false, 0, false, now, false},
+		{"peer timed out", 2, false, 1, true, now.Add(-time.Minute), true},
+		{"two leaders, lower ID", 1, true, 2, true, now, true},
+		{"two leaders, higher ID", 2, true, 1, true, now, false},
+		{"no leader, lower ID", 1, false, 2, false, now, true},
+		{"no leader, higher ID", 2, false, 1, false, now, false},
+		{"sticky leader", 2, true, 1, false, now, true},
+		{"follower of a leader", 1, false, 2, true, now, false},
+	}
+	for _, tc := range tests {
+		e := &PeerElector{ID: tc.id, Timeout: 3 * time.Second, leader: tc.leader,
+			peerID: tc.peerID, peerLeader: tc.peerLeader, lastSeen: tc.lastSeen}
+		if leader := e.elect(); leader != tc.expected {
+			t.Errorf("test %s: expected leader %t, got %t", tc.name, tc.expected, leader)
+		}
+	}
+}
+
+func TestPeerElectorIDs(t *testing.T) {
+	for _, id := range []int{0, -1} {
+		e := &PeerElector{ID: id, PeerAddr: "peer:8130", Interval: time.Second, Timeout: 3 * time.Second}
+		if err := e.Validate(); err == nil {
+			t.Errorf("test ID %d: expected error", id)
+		}
+	}
+
+	e := &PeerElector{ID: 1, PeerAddr: "peer:8130", Interval: time.Second, Timeout: 3 * time.Second}
+	if err := e.Validate(); err != nil {
+		t.Errorf("test ID 1: %s", err)
+	}
+	if err := e.heartbeat([]byte("1 true\n"), time.Now()); err == nil {
+		t.Errorf("test equal IDs: expected error")
+	}
+	if err := e.heartbeat([]byte("2 true\n"), time.Now()); err != nil {
+		t.Errorf("test peer heartbeat: %s", err)
+	}
+	if e.peerID != 2 || !e.peerLeader {
+		t.Errorf("test peer heartbeat: expected peer 2 leading, got peer %d leading %t", e.peerID, e.peerLeader)
+	}
+	if err := e.heartbeat([]byte("garbage"), time.Now()); err != nil {
+		t.Errorf("test malformed heartbeat: %s", err)
+	}
+}
+
+func TestPeerElectorReadError(t *testing.T) {
+	c, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.Close()
+
+	e := &PeerElector{ID: 1}
+	errc := make(chan error, 1)
+	go e.receive(c, errc)
+	select {
+	case err := <-errc:
+		if err == nil {
+			t.Error("expected the read error")
+		}
+	case <-time.After(time.Second):
+		t.Error("expected the read error to be reported")
+	}
+}
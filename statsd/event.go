@@ -0,0 +1,324 @@
+package statsd
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Event is a DogStatsD event, sent as a line of the form
+//
+//	_e{<title length>,<text length>}:<title>|<text>|d:<timestamp>|h:<hostname>|p:<priority>|t:<alert type>|k:<aggregation key>|s:<source type>|#<tags>
+//
+// where everything after the text is optional. Lengths are in bytes and newlines in the
+// text are escaped as "\n".
+type Event struct {
+	Title          string   `json:"title"`
+	Text           string   `json:"text"`
+	Timestamp      int64    `json:"timestamp,omitempty"` // Seconds since the epoch, if the client said
+	Hostname       string   `json:"hostname,omitempty"`
+	AggregationKey string   `json:"aggregation_key,omitempty"`
+	Priority       string   `json:"priority"` // "normal" or "low"
+	SourceType     string   `json:"source_type,omitempty"`
+	AlertType      string   `json:"alert_type"` // "error", "warning", "info" or "success"
+	Tags           []string `json:"tags,omitempty"`
+}
+
+// Event priorities
+const (
+	PriorityNormal = "normal"
+	PriorityLow    = "low"
+)
+
+// Event alert types
+const (
+	AlertError   = "error"
+	AlertWarning = "warning"
+	AlertInfo    = "info"
+	AlertSuccess = "success"
+)
+
+// EventHandler handles the events received by a MetricReceiver
+type EventHandler interface {
+	HandleEvent(e Event)
+}
+
+// The EventHandlerFunc type is an adapter to allow the use of ordinary functions as EventHandlers
+type EventHandlerFunc func(Event)
+
+// HandleEvent calls f(e)
+func (f EventHandlerFunc) HandleEvent(e Event) {
+	f(e)
+}
+
+// isEvent reports whether line is an event rather than a metric
+func isEvent(line []byte) bool {
+	return bytes.HasPrefix(line, []byte("_e{"))
+}
+
+// parseEventLine parses an event and passes it to the Events handler, or drops it if
+// there is none. Like parseTaggedLine, events that don't parse are logged and turned in
+// to an ERROR Metric counting the rejection, which is returned along with true.
+func (srv *MetricReceiver) parseEventLine(addr net.Addr, line []byte, tags []string) (Metric, bool) {
+	var e Event
+	var err error
+	if line, err = srv.limitLength(line); err == nil {
+		e, err = parseEvent(line)
+	}
+	if err != nil {
+		if len(line) > 256 {
+			line = line[:256]
+		}
+		srv.infof("error parsing event %q from %s: %s", line, addr, err)
+		srv.countParseError(addr, err)
+		return rejection(err), true
+	}
+	if len(tags) > 0 {
+		e.Tags = mergeTags(e.Tags, tags)
+	}
+	srv.countMetric(addr)
+	srv.debugf("received event %q from %s", e.Title, addr)
+	if srv.Events != nil && srv.SyncHandlers {
+		srv.Events.HandleEvent(e)
+	} else if srv.Events != nil {
+		go srv.Events.HandleEvent(e)
+	}
+	return Metric{}, false
+}
+
+// parseEvent parses a line in to an Event
+func parseEvent(line []byte) (Event, error) {
+	e := Event{Priority: PriorityNormal, AlertType: AlertInfo}
+
+	rest := line[len("_e{"):]
+	brace := bytes.IndexByte(rest, '}')
+	if brace < 0 {
+		return e, rejectf(RejectBadEvent, "error parsing event: no '}' after the lengths")
+	}
+	lengths := strings.Split(string(rest[:brace]), ",")
+	if len(lengths) != 2 {
+		return e, rejectf(RejectBadEvent, "error parsing event lengths: %q", rest[:brace])
+	}
+	titleLen, err1 := strconv.Atoi(lengths[0])
+	textLen, err2 := strconv.Atoi(lengths[1])
+	if err1 != nil || err2 != nil || titleLen <= 0 || textLen < 0 {
+		return e, rejectf(RejectBadEvent, "error parsing event lengths: %q", rest[:brace])
+	}
+	rest = rest[brace+1:]
+	if len(rest) < 1+titleLen+1+textLen || rest[0] != ':' || rest[1+titleLen] != '|' {
+		return e, rejectf(RejectBadEvent, "error parsing event: title and text don't match their lengths")
+	}
+	e.Title = string(rest[1 : 1+titleLen])
+	e.Text = strings.Replace(string(rest[2+titleLen:2+titleLen+textLen]), `\n`, "\n", -1)
+	rest = rest[2+titleLen+textLen:]
+	if len(rest) > 0 && rest[0] != '|' {
+		return e, rejectf(RejectBadEvent, "error parsing event: text doesn't match its length")
+	}
+
+	for _, section := range bytes.Split(rest, []byte{'|'}) {
+		if len(section) == 0 {
+			continue
+		}
+		if section[0] == '#' {
+			e.Tags = parseTags(section[1:])
+			continue
+		}
+		if len(section) < 2 || section[1] != ':' {
+			return e, rejectf(RejectBadEvent, "error parsing event field %q", section)
+		}
+		value := string(section[2:])
+		switch section[0] {
+		case 'd':
+			ts, err := strconv.ParseInt(value, 10, 64)
+			if err != nil || ts <= 0 {
+				return e, rejectf(RejectBadEvent, "error converting event timestamp: %q", value)
+			}
+			e.Timestamp = ts
+		case 'h':
+			e.Hostname = value
+		case 'k':
+			e.AggregationKey = value
+		case 's':
+			e.SourceType = value
+		case 'p':
+			if value != PriorityNormal && value != PriorityLow {
+				return e, rejectf(RejectBadEvent, "invalid event priority: %q", value)
+			}
+			e.Priority = value
+		case 't':
+			switch value {
+			case AlertError, AlertWarning, AlertInfo, AlertSuccess:
+			default:
+				return e, rejectf(RejectBadEvent, "invalid event alert type: %q", value)
+			}
+			e.AlertType = value
+		default:
+			return e, rejectf(RejectBadEvent, "error parsing event field %q", section)
+		}
+	}
+	return e, nil
+}
+
+// EventRoute sends the events of some alert types and priorities to event backends
+type EventRoute struct {
+	AlertTypes []string `json:"alert_types"` // "error", "warning", "info" or "success", all if empty
+	Priorities []string `json:"priorities"`  // "normal" or "low", all if empty
+	Backends   []string `json:"backends"`    // Names of the event backends
+}
+
+// Validate checks that the route is well formed
+func (r EventRoute) Validate() error {
+	for _, t := range r.AlertTypes {
+		switch t {
+		case AlertError, AlertWarning, AlertInfo, AlertSuccess:
+		default:
+			return fmt.Errorf("event route has unknown alert type %q", t)
+		}
+	}
+	for _, p := range r.Priorities {
+		if p != PriorityNormal && p != PriorityLow {
+			return fmt.Errorf("event route has unknown priority %q", p)
+		}
+	}
+	if len(r.Backends) == 0 {
+		return fmt.Errorf("event route has no backends")
+	}
+	return nil
+}
+
+// matches reports whether e is sent along the route
+func (r EventRoute) matches(e Event) bool {
+	return (len(r.AlertTypes) == 0 || containsString(r.AlertTypes, e.AlertType)) &&
+		(len(r.Priorities) == 0 || containsString(r.Priorities, e.Priority))
+}
+
+// EventRouter is an EventHandler that passes each event on to the Backends named by the
+// Routes it matches, once per backend. Events that match no route are dropped.
+type EventRouter struct {
+	Routes   []EventRoute
+	Backends map[string]EventHandler
+}
+
+// HandleEvent passes e on to the backends of its routes
+func (r *EventRouter) HandleEvent(e Event) {
+	sent := make(map[string]bool)
+	for _, route := range r.Routes {
+		if !route.matches(e) {
+			continue
+		}
+		for _, name := range route.Backends {
+			if b, ok := r.Backends[name]; ok && !sent[name] {
+				sent[name] = true
+				b.HandleEvent(e)
+			}
+		}
+	}
+}
+
+// EventBackendFactory creates the EventHandler of an event backend from its options
+type EventBackendFactory func(options map[string]string) (EventHandler, error)
+
+var (
+	eventBackendsMu sync.Mutex
+	eventBackends   = make(map[string]EventBackendFactory)
+)
+
+// RegisterEventBackend makes an event backend available under name to NewEventBackend.
+// Registering a name again replaces its factory.
+func RegisterEventBackend(name string, factory EventBackendFactory) {
+	defer eventBackendsMu.Unlock()
+	eventBackendsMu.Lock()
+	eventBackends[name] = factory
+}
+
+// EventBackends returns the sorted names of the registered event backends
+func EventBackends() []string {
+	defer eventBackendsMu.Unlock()
+	eventBackendsMu.Lock()
+	names := make([]string, 0, len(eventBackends))
+	for name := range eventBackends {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// NewEventBackend creates an EventHandler with the factory registered under name.
+// References to secrets in options are replaced by the secrets first.
+func NewEventBackend(name string, options map[string]string) (EventHandler, error) {
+	eventBackendsMu.Lock()
+	factory, ok := eventBackends[name]
+	eventBackendsMu.Unlock()
+	if !ok {
+		return nil, fmt.Errorf("unknown event backend %q", name)
+	}
+	options, err := ResolveSecrets(options)
+	if err != nil {
+		return nil, err
+	}
+	return factory(options)
+}
+
+// EventWebhook posts each event as JSON to URL
+type EventWebhook struct {
+	URL     string
+	Headers map[string]string // e.g. an Authorization header
+}
+
+// HandleEvent posts e to the webhook
+func (w *EventWebhook) HandleEvent(e Event) {
+	if err := postJSON(w.URL, e, w.Headers); err != nil {
+		log.Printf("error posting event %q: %s", e.Title, err)
+	}
+}
+
+// postJSON posts v encoded as JSON to url with headers
+func postJSON(url string, v interface{}, headers map[string]string) error {
+	body, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest("POST", url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for k, v := range headers {
+		req.Header.Set(k, v)
+	}
+	return doRequest(req)
+}
+
+// The builtin event backends
+func init() {
+	RegisterEventBackend("log", func(options map[string]string) (EventHandler, error) {
+		return EventHandlerFunc(func(e Event) {
+			log.Printf("event [%s/%s] %s: %s %s", e.AlertType, e.Priority, e.Title, e.Text, strings.Join(e.Tags, ","))
+		}), nil
+	})
+	RegisterEventBackend("webhook", func(options map[string]string) (EventHandler, error) {
+		if options["url"] == "" {
+			return nil, fmt.Errorf("webhook event backend needs a url")
+		}
+		return &EventWebhook{URL: options["url"], Headers: prefixedOptions(options, "header.")}, nil
+	})
+	RegisterEventBackend("slack", func(options map[string]string) (EventHandler, error) {
+		if options["url"] == "" {
+			return nil, fmt.Errorf("slack event backend needs a url")
+		}
+		return &SlackClient{URL: options["url"], Channel: options["channel"], Username: options["username"]}, nil
+	})
+	RegisterEventBackend("pagerduty", func(options map[string]string) (EventHandler, error) {
+		if options["routing_key"] == "" {
+			return nil, fmt.Errorf("pagerduty event backend needs a routing_key")
+		}
+		return &PagerDutyClient{RoutingKey: options["routing_key"], URL: options["url"]}, nil
+	})
+}
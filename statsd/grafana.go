@@ -0,0 +1,104 @@
+package statsd
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// GrafanaDatasource serves the recent flushes kept by History to Grafana with the
+// SimpleJSON datasource protocol, also understood by the Infinity and JSON datasources:
+//
+//	GET  /             health check
+//	POST /search       names of the series starting with the target
+//	POST /query        data points of the targets over the range of the panel
+//	POST /annotations  no annotations
+//
+// A target is a Query pattern optionally followed by tag patterns, separated by
+// semicolons like flushed names, e.g. "stats.timers.api.*.upper_95;region:eu".
+type GrafanaDatasource struct {
+	History *MetricHistory
+}
+
+// grafanaQuery is the body of a /query request
+type grafanaQuery struct {
+	Range struct {
+		From time.Time `json:"from"`
+		To   time.Time `json:"to"`
+	} `json:"range"`
+	IntervalMs int64 `json:"intervalMs"`
+	Targets    []struct {
+		Target string `json:"target"`
+	} `json:"targets"`
+}
+
+// grafanaSeries is a time series of a /query response
+type grafanaSeries struct {
+	Target     string       `json:"target"`
+	Datapoints [][2]float64 `json:"datapoints"` // Value and time in milliseconds
+}
+
+// ServeHTTP serves the datasource endpoints
+func (g *GrafanaDatasource) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	switch req.URL.Path {
+	case "/", "":
+		w.WriteHeader(http.StatusOK)
+	case "/search":
+		var body struct {
+			Target string `json:"target"`
+		}
+		json.NewDecoder(req.Body).Decode(&body)
+		names := []string{}
+		for _, name := range g.History.Names() {
+			if strings.HasPrefix(name, body.Target) {
+				names = append(names, name)
+			}
+		}
+		writeJSON(w, names)
+	case "/query":
+		var q grafanaQuery
+		if err := json.NewDecoder(req.Body).Decode(&q); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		writeJSON(w, g.query(q))
+	case "/annotations":
+		writeJSON(w, []struct{}{})
+	default:
+		http.NotFound(w, req)
+	}
+}
+
+// query returns the series of the targets of q. Ranges the snapshots cover are read from
+// them, longer ones from the resolution closest to the interval of the panel.
+func (g *GrafanaDatasource) query(q grafanaQuery) []grafanaSeries {
+	var step time.Duration
+	oldest := g.History.oldestSnapshot()
+	if len(g.History.resolutions()) > 0 && (oldest.IsZero() || q.Range.From.Before(oldest)) {
+		step = time.Duration(q.IntervalMs) * time.Millisecond
+		if step <= 0 {
+			step = time.Nanosecond // The finest resolution
+		}
+	}
+
+	series := []grafanaSeries{}
+	for _, t := range q.Targets {
+		if t.Target == "" {
+			continue
+		}
+		parts := strings.Split(t.Target, ";")
+		results := g.History.Query(Query{Match: parts[0], Tags: parts[1:], From: q.Range.From, To: q.Range.To, Step: step})
+		for _, r := range results {
+			s := grafanaSeries{Target: r.Name, Datapoints: make([][2]float64, len(r.Points))}
+			if len(r.Tags) > 0 {
+				s.Target += ";" + strings.Join(r.Tags, ";")
+			}
+			for i, p := range r.Points {
+				s.Datapoints[i] = [2]float64{p.Value, float64(p.Time.UnixNano() / int64(time.Millisecond))}
+			}
+			series = append(series, s)
+		}
+	}
+	return series
+}
@@ -23,45 +23,131 @@ func normalizeBucketName(name string) string {
 	return regInvalid.ReplaceAllString(noslashes, "")
 }
 
+// graphiteName formats a flushed metric name for Graphite. Tags are sent the way Graphite
+// expects tagged series, "name;key=value", and tags without a value become "tag=true".
+func graphiteName(key string) string {
+	name, tags := SplitKey(key)
+	name = normalizeBucketName(name)
+	for _, tag := range tags {
+		k, v := splitTag(tag)
+		if v == "" {
+			v = "true"
+		}
+		name += ";" + normalizeBucketName(k) + "=" + normalizeBucketName(v)
+	}
+	return name
+}
+
+// Defaults of the writes of a GraphiteClient
+const (
+	DefaultGraphiteWriteSize    = 64 << 10
+	DefaultGraphiteWriteTimeout = 10 * time.Second
+)
+
 // GraphiteClient is an object that is used to send messages to a Graphite server's UDP interface
+//
+// Flushes are written in chunks of whole lines of up to MaxWriteSize bytes, each of which
+// must be written within WriteTimeout, so a huge flush to a slow server can't hold the
+// connection past the next one. When a write fails the client reconnects once and carries
+// on from the first line that wasn't written entirely.
 type GraphiteClient struct {
-	conn *net.Conn
-	addr string
+	Prefix       string        // Prepended to the name of every metric, e.g. "teams.payments."
+	MaxWriteSize int           // DefaultGraphiteWriteSize if zero
+	WriteTimeout time.Duration // DefaultGraphiteWriteTimeout if zero
+
+	conn      *net.Conn
+	addr      string
+	connected time.Time // when conn was opened
 }
 
 // SendMetrics sends the metrics in a MetricsMap to the Graphite server
 func (client *GraphiteClient) SendMetrics(metrics MetricMap) (err error) {
+	return client.SendMetricsAt(metrics, time.Now())
+}
+
+// SendMetricsAt sends the metrics in a MetricsMap to the Graphite server with the timestamp t
+func (client *GraphiteClient) SendMetricsAt(metrics MetricMap, t time.Time) (err error) {
 	buf := new(bytes.Buffer)
-	now := time.Now().Unix()
+	now := t.Unix()
 	for k, v := range metrics {
-		nk := normalizeBucketName(k)
+		nk := client.Prefix + graphiteName(k)
 		fmt.Fprintf(buf, "%s %f %d\n", nk, v, now)
 	}
-	if client.conn != nil {
-		_, err = buf.WriteTo(*client.conn)
-		if err != nil {
-			client.Reconnect()
-			return err
-		}
-	} else {
+	if client.conn != nil && time.Since(client.connected) > DNSRefreshInterval {
+		// Reconnect from time to time so the connection follows DNS changes
+		client.Reconnect()
+	}
+	if client.conn == nil {
 		client.Reconnect()
 		return errors.New("graphite not connected")
 	}
+
+	size, timeout := client.MaxWriteSize, client.WriteTimeout
+	if size <= 0 {
+		size = DefaultGraphiteWriteSize
+	}
+	if timeout <= 0 {
+		timeout = DefaultGraphiteWriteTimeout
+	}
+	data := buf.Bytes()
+	reconnected := false
+	for len(data) > 0 {
+		chunk := graphiteChunk(data, size)
+		conn := *client.conn
+		conn.SetWriteDeadline(time.Now().Add(timeout))
+		n, err := conn.Write(chunk)
+		if err == nil {
+			data = data[len(chunk):]
+			continue
+		}
+		client.Reconnect()
+		if reconnected || client.conn == nil {
+			return fmt.Errorf("writing to graphite: %s, %d bytes unsent", err, len(data))
+		}
+		reconnected = true
+		// Start again from the first line not written entirely
+		data = data[bytes.LastIndexByte(chunk[:n], '\n')+1:]
+	}
 	return nil
 }
 
+// graphiteChunk returns the whole lines at the start of data that fit in size bytes, or
+// the first line if it is longer
+func graphiteChunk(data []byte, size int) []byte {
+	if len(data) <= size {
+		return data
+	}
+	if i := bytes.LastIndexByte(data[:size], '\n'); i >= 0 {
+		return data[:i+1]
+	}
+	if i := bytes.IndexByte(data, '\n'); i >= 0 {
+		return data[:i+1]
+	}
+	return data
+}
+
 // NewGraphiteClient constructs a GraphiteClient object by connecting to an address
 func NewGraphiteClient(addr string) (client GraphiteClient, err error) {
 	conn, err := Connect(addr)
-	client = GraphiteClient{&conn, addr}
+	client = GraphiteClient{conn: &conn, addr: addr, connected: time.Now()}
 	return
 }
 
 func Connect(addr string) (conn net.Conn, err error) {
-	conn, err = net.Dial("tcp", addr)
+	conn, err = dialer.Dial("tcp", addr)
 	return conn, err
 }
 
+// Close closes the connection to the Graphite server
+func (client *GraphiteClient) Close() error {
+	if client.conn == nil || *client.conn == nil {
+		return nil
+	}
+	err := (*client.conn).Close()
+	client.conn = nil
+	return err
+}
+
 func (client *GraphiteClient) Reconnect() {
 	if client.conn != nil {
 		err := (*client.conn).Close()
@@ -78,4 +164,5 @@ func (client *GraphiteClient) Reconnect() {
 		return
 	}
 	client.conn = &conn
+	client.connected = time.Now()
 }
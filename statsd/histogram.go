@@ -0,0 +1,52 @@
+package statsd
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Histogram describes the buckets in to which the values of the timers matching Match are
+// counted at each flush, Prometheus style: each bucket counts the values less than or
+// equal to its upper bound, and a last bucket with the bound +Inf counts every value.
+type Histogram struct {
+	Match   string    `json:"match"`   // Timer names, * matching a single dot separated component
+	Buckets []float64 `json:"buckets"` // Upper bounds of the buckets, ascending
+}
+
+// Validate checks that the histogram is well formed
+func (h Histogram) Validate() error {
+	if h.Match == "" {
+		return fmt.Errorf("histogram without match")
+	}
+	if len(h.Buckets) == 0 {
+		return fmt.Errorf("histogram %q has no buckets", h.Match)
+	}
+	if !sort.Float64sAreSorted(h.Buckets) {
+		return fmt.Errorf("histogram %q: buckets must be ascending", h.Match)
+	}
+	return nil
+}
+
+// histogramFor returns the first histogram matching the timer key, or nil
+func histogramFor(histograms []Histogram, key string) *Histogram {
+	for i := range histograms {
+		if matchPattern(histograms[i].Match, key) {
+			return &histograms[i]
+		}
+	}
+	return nil
+}
+
+// addBuckets adds the cumulative bucket counts of the sorted values of the timer key to
+// metrics, named like "stats.timers.api.latency.bucket;host:a;le:100"
+func (h *Histogram) addBuckets(metrics MetricMap, key string, sorted []float64) {
+	name, tags := SplitKey(key)
+	name = "stats.timers." + name + ".bucket"
+	for _, b := range h.Buckets {
+		n := sort.Search(len(sorted), func(i int) bool { return sorted[i] > b })
+		metrics[name+";"+strings.Join(mergeTags(tags, []string{"le:" + strconv.FormatFloat(b, 'g', -1, 64)}), ";")] = float64(n)
+	}
+	metrics[name+";"+strings.Join(mergeTags(tags, []string{"le:+Inf"}), ";")] = float64(len(sorted))
+}
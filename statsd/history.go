@@ -0,0 +1,327 @@
+package statsd
+
+import (
+	"math"
+	"path"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Resolution is a step at which a MetricHistory consolidates flushed values, and the
+// number of steps it keeps
+type Resolution struct {
+	Step   time.Duration
+	Points int
+}
+
+// DefaultResolutions keep half an hour at 10 seconds, six hours at a minute and a day at
+// five minutes: about 40KB per series
+var DefaultResolutions = []Resolution{
+	{10 * time.Second, 180},
+	{time.Minute, 360},
+	{5 * time.Minute, 288},
+}
+
+// Point consolidates the values a series was flushed with during a step
+type Point struct {
+	Time  time.Time `json:"time"` // Start of the step
+	Min   float64   `json:"min"`
+	Max   float64   `json:"max"`
+	Sum   float64   `json:"sum"`
+	Last  float64   `json:"last"`
+	Count int       `json:"count"` // Number of flushes
+}
+
+// Mean returns the average of the values of the point
+func (p Point) Mean() float64 {
+	return p.Sum / float64(p.Count)
+}
+
+// add adds a value flushed during the step of the point
+func (p *Point) add(v float64) {
+	if p.Count == 0 || v < p.Min {
+		p.Min = v
+	}
+	if p.Count == 0 || v > p.Max {
+		p.Max = v
+	}
+	p.Sum += v
+	p.Last = v
+	p.Count++
+}
+
+// MetricHistory is a MetricSender that keeps recent flushes in memory, so they can be
+// looked at without querying a backend, before passing them on to Sender. The last
+// Snapshots flushes are kept as they were sent, and every series is consolidated at
+// several Resolutions. Series that haven't been flushed for as long as the coarsest
+// resolution covers are forgotten.
+type MetricHistory struct {
+	Resolutions []Resolution // DefaultResolutions if nil
+	Snapshots   int          // Number of flushes kept whole
+	Sender      MetricSender
+
+	mu        sync.Mutex
+	series    map[string][][]Point // Points of each series, at each resolution, oldest first
+	last      map[string]time.Time
+	pruned    time.Time
+	snapshots []timedMetricMap // Ring of the last Snapshots flushes
+	next      int              // Position of the next snapshot in the ring
+}
+
+// SendMetrics records metrics and sends them to h.Sender
+func (h *MetricHistory) SendMetrics(metrics MetricMap) error {
+	return h.SendMetricsAt(metrics, time.Now())
+}
+
+// SendMetricsAt records metrics as flushed at t and sends them to h.Sender with that timestamp
+func (h *MetricHistory) SendMetricsAt(metrics MetricMap, t time.Time) error {
+	h.record(metrics, t)
+	return sendMetricsAt(h.Sender, metrics, t)
+}
+
+// resolutions returns the resolutions kept
+func (h *MetricHistory) resolutions() []Resolution {
+	if h.Resolutions == nil {
+		return DefaultResolutions
+	}
+	return h.Resolutions
+}
+
+// record adds the flushed metrics to the history
+func (h *MetricHistory) record(metrics MetricMap, t time.Time) {
+	defer h.mu.Unlock()
+	h.mu.Lock()
+
+	if h.Snapshots > 0 {
+		if len(h.snapshots) < h.Snapshots {
+			h.snapshots = append(h.snapshots, timedMetricMap{copyMetricMap(metrics), t})
+		} else {
+			h.snapshots[h.next] = timedMetricMap{copyMetricMap(metrics), t}
+		}
+		h.next = (h.next + 1) % h.Snapshots
+	}
+
+	res := h.resolutions()
+	if len(res) == 0 {
+		return
+	}
+	if h.series == nil {
+		h.series = make(map[string][][]Point)
+		h.last = make(map[string]time.Time)
+	}
+	for name, v := range metrics {
+		series, ok := h.series[name]
+		if !ok {
+			series = make([][]Point, len(res))
+			h.series[name] = series
+		}
+		h.last[name] = t
+		for i, r := range res {
+			start := t.Truncate(r.Step)
+			points := series[i]
+			if n := len(points); n == 0 || points[n-1].Time.Before(start) {
+				points = append(points, Point{Time: start})
+				if len(points) > r.Points {
+					points = points[len(points)-r.Points:]
+				}
+			}
+			points[len(points)-1].add(v)
+			series[i] = points
+		}
+	}
+
+	// Forget the series that are gone, once in a while
+	var span time.Duration
+	for _, r := range res {
+		if d := r.Step * time.Duration(r.Points); d > span {
+			span = d
+		}
+	}
+	if t.Sub(h.pruned) > span/10 {
+		h.pruned = t
+		for name, last := range h.last {
+			if t.Sub(last) > span {
+				delete(h.series, name)
+				delete(h.last, name)
+			}
+		}
+	}
+}
+
+// Series returns the points of the named series at the resolution closest to step, along
+// with the step of that resolution. Points are oldest first and only cover steps during
+// which the series was flushed.
+func (h *MetricHistory) Series(name string, step time.Duration) ([]Point, time.Duration) {
+	defer h.mu.Unlock()
+	h.mu.Lock()
+
+	res := h.resolutions()
+	if len(res) == 0 {
+		return nil, 0
+	}
+	best := 0
+	for i, r := range res {
+		if absDuration(r.Step-step) < absDuration(res[best].Step-step) {
+			best = i
+		}
+	}
+	series, ok := h.series[name]
+	if !ok {
+		return nil, res[best].Step
+	}
+	return append([]Point(nil), series[best]...), res[best].Step
+}
+
+// Names returns the names of the series in the history, or in the latest snapshot, sorted
+func (h *MetricHistory) Names() []string {
+	defer h.mu.Unlock()
+	h.mu.Lock()
+
+	names := make([]string, 0, len(h.series))
+	for name := range h.series {
+		names = append(names, name)
+	}
+	if len(h.snapshots) > 0 && len(h.series) == 0 {
+		latest := h.snapshots[(h.next+len(h.snapshots)-1)%len(h.snapshots)]
+		for name := range latest.Metrics {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+// oldestSnapshot returns the time of the oldest snapshot kept, or the zero time
+func (h *MetricHistory) oldestSnapshot() time.Time {
+	defer h.mu.Unlock()
+	h.mu.Lock()
+
+	if len(h.snapshots) == 0 {
+		return time.Time{}
+	}
+	return h.snapshots[h.next%len(h.snapshots)].Time
+}
+
+// Query selects the series of a MetricHistory
+type Query struct {
+	Match string    // Pattern of the series names, * matching a single dot separated component
+	Tags  []string  // Patterns, as in path.Match, of "key:value" tags the series must all have
+	From  time.Time // Start of the time range, inclusive
+	To    time.Time // End of the time range, inclusive; now if zero
+	Step  time.Duration
+}
+
+// QueryPoint is a value of a series at a point in time
+type QueryPoint struct {
+	Time  time.Time `json:"time"`
+	Value float64   `json:"value"`
+}
+
+// QueryResult is a series selected by a Query
+type QueryResult struct {
+	Name   string       `json:"name"`
+	Tags   []string     `json:"tags,omitempty"`
+	Points []QueryPoint `json:"points"`
+}
+
+// matches reports whether the series key is selected by q
+func (q *Query) matches(key string) bool {
+	if q.Match != "" && !matchPattern(q.Match, key) {
+		return false
+	}
+	_, tags := SplitKey(key)
+	for _, pattern := range q.Tags {
+		found := false
+		for _, tag := range tags {
+			if ok, _ := path.Match(pattern, tag); ok {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
+
+// Query returns the series selected by q, sorted by name. Without a Step the values are
+// read from the snapshots, as they were flushed; with a Step they are the means of the
+// points at the closest resolution.
+func (h *MetricHistory) Query(q Query) []QueryResult {
+	to := q.To
+	if to.IsZero() {
+		to = time.Now()
+	}
+	inRange := func(t time.Time) bool {
+		return !t.Before(q.From) && !t.After(to)
+	}
+
+	defer h.mu.Unlock()
+	h.mu.Lock()
+
+	results := make(map[string]*QueryResult)
+	result := func(key string) *QueryResult {
+		r, ok := results[key]
+		if !ok {
+			name, tags := SplitKey(key)
+			r = &QueryResult{Name: name, Tags: tags}
+			results[key] = r
+		}
+		return r
+	}
+
+	if q.Step == 0 {
+		// The ring starts with the oldest snapshot once it's full
+		for i := range h.snapshots {
+			s := h.snapshots[(h.next+i)%len(h.snapshots)]
+			if !inRange(s.Time) {
+				continue
+			}
+			for key, v := range s.Metrics {
+				if q.matches(key) && !math.IsNaN(v) && !math.IsInf(v, 0) {
+					r := result(key)
+					r.Points = append(r.Points, QueryPoint{s.Time, v})
+				}
+			}
+		}
+	} else if res := h.resolutions(); len(res) > 0 {
+		best := 0
+		for i, r := range res {
+			if absDuration(r.Step-q.Step) < absDuration(res[best].Step-q.Step) {
+				best = i
+			}
+		}
+		for key, series := range h.series {
+			if !q.matches(key) {
+				continue
+			}
+			for _, p := range series[best] {
+				if v := p.Mean(); inRange(p.Time) && !math.IsNaN(v) && !math.IsInf(v, 0) {
+					r := result(key)
+					r.Points = append(r.Points, QueryPoint{p.Time, v})
+				}
+			}
+		}
+	}
+
+	keys := make([]string, 0, len(results))
+	for key := range results {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	list := make([]QueryResult, len(keys))
+	for i, key := range keys {
+		list[i] = *results[key]
+	}
+	return list
+}
+
+// absDuration returns the absolute value of d
+func absDuration(d time.Duration) time.Duration {
+	if d < 0 {
+		return -d
+	}
+	return d
+}
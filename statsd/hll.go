@@ -0,0 +1,120 @@
+package statsd
+
+import (
+	"errors"
+	"hash/fnv"
+	"math"
+	"math/bits"
+)
+
+// Precision bounds of a HyperLogLog
+const (
+	MinHLLPrecision = 4
+	MaxHLLPrecision = 16
+)
+
+// HyperLogLog estimates the number of distinct members added to it in 2^precision bytes,
+// with a standard error of about 1.04/sqrt(2^precision): 0.8% at precision 14. Sketches of
+// the same precision can be merged, so members counted on several servers are only
+// counted once.
+type HyperLogLog struct {
+	Registers []uint8
+}
+
+// NewHyperLogLog returns an empty sketch of the given precision, which is clamped to
+// MinHLLPrecision and MaxHLLPrecision
+func NewHyperLogLog(precision uint8) *HyperLogLog {
+	if precision < MinHLLPrecision {
+		precision = MinHLLPrecision
+	}
+	if precision > MaxHLLPrecision {
+		precision = MaxHLLPrecision
+	}
+	return &HyperLogLog{Registers: make([]uint8, 1<<precision)}
+}
+
+// hashMember hashes a set member, mixing the bits of FNV-1a as it spreads them poorly
+func hashMember(member string) uint64 {
+	h := fnv.New64a()
+	h.Write([]byte(member))
+	x := h.Sum64()
+	x ^= x >> 33
+	x *= 0xff51afd7ed558ccd
+	x ^= x >> 33
+	x *= 0xc4ceb9fe1a85ec53
+	x ^= x >> 33
+	return x
+}
+
+// Add adds member to the sketch
+func (h *HyperLogLog) Add(member string) {
+	p := uint(bits.TrailingZeros(uint(len(h.Registers))))
+	x := hashMember(member)
+	i := x >> (64 - p)
+	rank := uint8(bits.LeadingZeros64(x<<p|1<<(p-1))) + 1
+	if rank > h.Registers[i] {
+		h.Registers[i] = rank
+	}
+}
+
+// Count returns the estimated number of distinct members
+func (h *HyperLogLog) Count() float64 {
+	m := float64(len(h.Registers))
+	var alpha float64
+	switch len(h.Registers) {
+	case 16:
+		alpha = 0.673
+	case 32:
+		alpha = 0.697
+	case 64:
+		alpha = 0.709
+	default:
+		alpha = 0.7213 / (1 + 1.079/m)
+	}
+
+	sum, zeros := 0.0, 0
+	for _, r := range h.Registers {
+		sum += math.Ldexp(1, -int(r))
+		if r == 0 {
+			zeros++
+		}
+	}
+	estimate := alpha * m * m / sum
+	if estimate <= 2.5*m && zeros > 0 {
+		// Linear counting is more accurate for small sets
+		estimate = m * math.Log(m/float64(zeros))
+	}
+	return math.Floor(estimate + 0.5)
+}
+
+// Merge adds the members counted by o to h
+func (h *HyperLogLog) Merge(o *HyperLogLog) error {
+	if len(o.Registers) != len(h.Registers) {
+		return errors.New("merging HyperLogLogs of different precisions")
+	}
+	for i, r := range o.Registers {
+		if r > h.Registers[i] {
+			h.Registers[i] = r
+		}
+	}
+	return nil
+}
+
+// set collects the distinct members of a SET metric over an interval
+type set interface {
+	Add(member string)
+	Count() float64
+}
+
+// exactSet is a set that keeps each of its members
+type exactSet map[string]bool
+
+// Add adds member to the set
+func (s exactSet) Add(member string) {
+	s[member] = true
+}
+
+// Count returns the number of members
+func (s exactSet) Count() float64 {
+	return float64(len(s))
+}
@@ -0,0 +1,86 @@
+package statsd
+
+import (
+	"math"
+	"reflect"
+	"strconv"
+	"testing"
+)
+
+// addMembers adds the members from to to-1 to h
+func addMembers(h *HyperLogLog, from, to int) {
+	for i := from; i < to; i++ {
+		h.Add("member" + strconv.Itoa(i))
+	}
+}
+
+func TestHyperLogLogMerge(t *testing.T) {
+	tests := map[string]struct {
+		precision        uint8
+		a, b             [2]int // ranges of members added to each sketch
+		expected         float64
+		maxRelativeError float64
+	}{
+		"disjoint":        {precision: 14, a: [2]int{0, 10000}, b: [2]int{10000, 20000}, expected: 20000, maxRelativeError: 0.03},
+		"overlapping":     {precision: 14, a: [2]int{0, 10000}, b: [2]int{5000, 15000}, expected: 15000, maxRelativeError: 0.03},
+		"identical":       {precision: 14, a: [2]int{0, 10000}, b: [2]int{0, 10000}, expected: 10000, maxRelativeError: 0.03},
+		"small":           {precision: 14, a: [2]int{0, 50}, b: [2]int{25, 100}, expected: 100, maxRelativeError: 0.02},
+		"empty":           {precision: 10, a: [2]int{0, 1000}, expected: 1000, maxRelativeError: 0.1},
+		"low precision":   {precision: 4, a: [2]int{0, 1000}, b: [2]int{1000, 2000}, expected: 2000, maxRelativeError: 0.8},
+		"clamped to 16":   {precision: 20, a: [2]int{0, 10000}, b: [2]int{5000, 15000}, expected: 15000, maxRelativeError: 0.02},
+		"linear counting": {precision: 16, a: [2]int{0, 3}, b: [2]int{2, 5}, expected: 5},
+	}
+
+	for name, tc := range tests {
+		a, b := NewHyperLogLog(tc.precision), NewHyperLogLog(tc.precision)
+		addMembers(a, tc.a[0], tc.a[1])
+		addMembers(b, tc.b[0], tc.b[1])
+		merged := &HyperLogLog{append([]uint8(nil), a.Registers...)}
+		if err := merged.Merge(b); err != nil {
+			t.Errorf("test %s error: %s", name, err)
+			continue
+		}
+		count := merged.Count()
+		if math.Abs(count-tc.expected) > tc.expected*tc.maxRelativeError {
+			t.Errorf("test %s: expected about %v, got %v", name, tc.expected, count)
+		}
+
+		// Merging is commutative and idempotent
+		reversed := &HyperLogLog{append([]uint8(nil), b.Registers...)}
+		reversed.Merge(a)
+		reversed.Merge(a)
+		if !reflect.DeepEqual(reversed, merged) {
+			t.Errorf("test %s: merging the other way round gives a different sketch", name)
+		}
+	}
+}
+
+func TestHyperLogLogPrecisionMismatch(t *testing.T) {
+	a, b := NewHyperLogLog(14), NewHyperLogLog(12)
+	addMembers(a, 0, 100)
+	addMembers(b, 100, 200)
+	before := append([]uint8(nil), a.Registers...)
+	if err := a.Merge(b); err == nil {
+		t.Error("expected merging sketches of different precisions to fail")
+	}
+	if !reflect.DeepEqual(a.Registers, before) {
+		t.Error("expected the failed merge to leave the sketch untouched")
+	}
+
+	// Aggregators merge the rest of the state regardless
+	sketched := NewMetricAggregator(nil, 0)
+	sketched.SetPrecision = 12
+	exact := NewMetricAggregator(nil, 0)
+	for _, agg := range []*MetricAggregator{&sketched, &exact} {
+		state := &AggregatorState{
+			Counters: map[string]float64{"foo": 1},
+			Sketches: map[string]*HyperLogLog{"users": a},
+		}
+		if err := agg.MergeState(state); err == nil {
+			t.Errorf("expected merging a sketch of precision 14 in to precision %d to fail", agg.SetPrecision)
+		}
+		if agg.Counters["foo"] != 1 {
+			t.Errorf("expected the counters to be merged with precision %d", agg.SetPrecision)
+		}
+	}
+}
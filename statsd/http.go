@@ -0,0 +1,126 @@
+package statsd
+
+import (
+	"bytes"
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+)
+
+// maxHTTPBody is the largest request body accepted by the HTTP receiver and by the state
+// endpoint of the AdminServer, larger ones are refused with 413 Request Entity Too Large
+const maxHTTPBody = 1 << 20
+
+// httpAddr is the net.Addr of an HTTP client
+type httpAddr string
+
+func (a httpAddr) Network() string { return "http" }
+func (a httpAddr) String() string  { return string(a) }
+
+// ListenAndReceiveHTTP listens on the TCP network address r.Addr and then receives the
+// metrics POSTed to it with ServeHTTP. If Addr is blank then DefaultMetricsAddr is used.
+func (r *MetricReceiver) ListenAndReceiveHTTP() error {
+	addr := r.Addr
+	if addr == "" {
+		addr = DefaultMetricsAddr
+	}
+	return http.ListenAndServe(addr, r)
+}
+
+// ServeHTTP receives the metrics POSTed in the request body, one per line, and calls
+// r.Handler.HandleMetric() for each line that successfully parses in to a Metric. The body
+// may also be a JSON document, hold one JSON document per line, or be a batch in the
+// binary format.
+//
+// If r.Tokens is set the request must carry one of them, either as a bearer token in the
+// Authorization header or in the X-API-Key header, and the tags of the token are added to
+// every metric of the request, replacing any of the metric's own tags with the same key.
+//
+// If r.Queue is set its depth is returned in the X-Queue-Depth header, and while it is full
+// requests are refused with 429 Too Many Requests and a Retry-After header. Requests are
+// refused with 503 Service Unavailable while r.Watchdog is rejecting metrics.
+func (r *MetricReceiver) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if req.Method != "POST" {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	var tags []string
+	if r.Tokens != nil {
+		var ok bool
+		if tags, ok = r.tokenTags(requestToken(req)); !ok {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			http.Error(w, "invalid or missing token", http.StatusUnauthorized)
+			return
+		}
+	}
+
+	if r.Queue != nil {
+		w.Header().Set("X-Queue-Depth", fmt.Sprintf("%d/%d", len(r.Queue), cap(r.Queue)))
+		if r.saturated() {
+			w.Header().Set("Retry-After", "1")
+			http.Error(w, "queue full, retry later", http.StatusTooManyRequests)
+			return
+		}
+	}
+
+	if r.Watchdog != nil && r.Watchdog.Rejecting() {
+		w.Header().Set("Retry-After", "1")
+		http.Error(w, "server overloaded, retry later", http.StatusServiceUnavailable)
+		return
+	}
+
+	body, err := ioutil.ReadAll(http.MaxBytesReader(w, req.Body, maxHTTPBody))
+	if err != nil {
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			http.Error(w, fmt.Sprintf("body larger than %d bytes", maxHTTPBody), http.StatusRequestEntityTooLarge)
+			return
+		}
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	addr := httpAddr(req.RemoteAddr)
+	r.countPacket(addr, len(body))
+	tags = r.sourceTags(addr, tags)
+	if isBinary(body) {
+		for _, metric := range r.parseBinary(addr, body, tags) {
+			r.dispatch(metric)
+		}
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	if isJSON(body) {
+		// JSON documents may span several lines
+		r.handleTaggedLine(addr, body, tags)
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	for _, line := range bytes.Split(body, []byte{'\n'}) {
+		r.handleTaggedLine(addr, bytes.TrimSuffix(line, []byte{'\r'}), tags)
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// tokenTags returns the tags of token if it is one of r.Tokens. Every token is compared
+// in constant time, so the time taken gives nothing away about them.
+func (r *MetricReceiver) tokenTags(token string) ([]string, bool) {
+	var tags []string
+	found := false
+	for t, tt := range r.Tokens {
+		if subtle.ConstantTimeCompare([]byte(t), []byte(token)) == 1 {
+			tags, found = tt, true
+		}
+	}
+	return tags, found
+}
+
+// requestToken returns the token carried by req, if any
+func requestToken(req *http.Request) string {
+	if auth := req.Header.Get("Authorization"); strings.HasPrefix(auth, "Bearer ") {
+		return strings.TrimSpace(auth[len("Bearer "):])
+	}
+	return req.Header.Get("X-API-Key")
+}
@@ -0,0 +1,22 @@
+package statsd
+
+import (
+	"time"
+)
+
+// runIntervals calls endInterval every interval, 10s if not set, until the program exits
+// and passes the internal metrics it returns for the interval that ended on to h, if set
+func runIntervals(interval time.Duration, endInterval func() []Metric, h Handler) {
+	if interval <= 0 {
+		interval = 10 * time.Second
+	}
+	for _ = range time.Tick(interval) {
+		metrics := endInterval()
+		if h == nil {
+			continue
+		}
+		for _, m := range metrics {
+			h.HandleMetric(m)
+		}
+	}
+}
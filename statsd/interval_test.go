@@ -0,0 +1,73 @@
+package statsd
+
+import (
+	"net"
+	"reflect"
+	"testing"
+)
+
+// discard is a Handler dropping the metrics passed on to it
+type discard struct{}
+
+func (discard) HandleMetric(m Metric) {}
+
+func TestEndInterval(t *testing.T) {
+	quotas := &QuotaHandler{Quotas: []Quota{{Prefix: "api.", MaxTagSets: 1}}, Handler: discard{}}
+	schema := &SchemaHandler{Rules: []SchemaRule{{Prefix: "api."}}, Handler: discard{}}
+	tenants := &TenantHandler{Tenants: []Tenant{{Name: "payments", MaxSeries: 1}}, TagKey: "tenant", Handler: discard{}}
+	sources := &SourceTracker{}
+	addr := func(ip string) net.Addr { return &net.UDPAddr{IP: net.ParseIP(ip), Port: 8125} }
+
+	tests := map[string]struct {
+		feed        func()
+		endInterval func() []Metric
+		expected    []Metric
+	}{
+		"quota": {
+			feed: func() {
+				for _, host := range []string{"host:a", "host:b", "host:c"} {
+					quotas.HandleMetric(Metric{Type: COUNTER, Bucket: "api.requests", Value: 1, SampleRate: 1, Tags: []string{host}})
+				}
+			},
+			endInterval: quotas.endInterval,
+			expected:    []Metric{{Type: COUNTER, Bucket: QuotaExceededBucket, Value: 2, SampleRate: 1, Tags: []string{"prefix:api."}}},
+		},
+		"schema": {
+			feed: func() {
+				schema.HandleMetric(Metric{Type: COUNTER, Bucket: "web.requests", Value: 1, SampleRate: 1})
+			},
+			endInterval: schema.endInterval,
+			expected:    []Metric{{Type: COUNTER, Bucket: SchemaViolationsBucket, Value: 1, SampleRate: 1, Tags: []string{"reason:" + ViolationUnknownPrefix}}},
+		},
+		"tenant": {
+			feed: func() {
+				for _, bucket := range []string{"a", "b"} {
+					tenants.HandleMetric(Metric{Type: COUNTER, Bucket: bucket, Value: 1, SampleRate: 1, Tags: []string{"tenant:payments"}})
+				}
+			},
+			endInterval: tenants.endInterval,
+			expected:    []Metric{{Type: COUNTER, Bucket: TenantDroppedBucket, Value: 1, SampleRate: 1, Tags: []string{"tenant:payments"}}},
+		},
+		"sources": {
+			feed: func() {
+				for _, ip := range []string{"10.0.0.1", "10.0.0.2"} {
+					sources.Observe(addr(ip), Metric{Type: GAUGE, Bucket: "queue.length", Value: 1, SampleRate: 1})
+				}
+			},
+			endInterval: sources.endInterval,
+			expected:    []Metric{{Type: GAUGE, Bucket: ConflictingGaugesBucket, Value: 1, SampleRate: 1}},
+		},
+	}
+
+	for name, tc := range tests {
+		tc.feed()
+		if result := tc.endInterval(); !reflect.DeepEqual(result, tc.expected) {
+			t.Errorf("test %s: expected %v, got %v", name, tc.expected, result)
+		}
+		// The counts start over with the new interval
+		tc.feed()
+		if result := tc.endInterval(); !reflect.DeepEqual(result, tc.expected) {
+			t.Errorf("test %s: expected %v in the next interval, got %v", name, tc.expected, result)
+		}
+	}
+}
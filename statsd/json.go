@@ -0,0 +1,184 @@
+package statsd
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"math"
+	"net"
+	"sort"
+)
+
+// jsonMetric is a metric in the JSON format, e.g.
+//
+//	{"name": "api.latency", "value": 12.5, "type": "ms", "tags": {"region": "eu"}, "ts": 1700000000}
+//
+// Type is a statsd type, "c", "g", "ms" or "s", or its name, "counter", "gauge", "timer"
+// or "set". Tags are either an object or a list of "key:value" strings. Rate is the
+// optional sample rate, Ts the optional timestamp in seconds since the epoch and TTL the
+// optional number of seconds after which the series is forgotten.
+type jsonMetric struct {
+	Name  string          `json:"name"`
+	Value json.RawMessage `json:"value"`
+	Type  string          `json:"type"`
+	Tags  json.RawMessage `json:"tags"`
+	Rate  *float64        `json:"rate"`
+	Ts    int64           `json:"ts"`
+	TTL   int64           `json:"ttl"`
+}
+
+// isJSON reports whether b holds JSON rather than statsd lines: a metric object or an
+// array of them
+func isJSON(b []byte) bool {
+	b = bytes.TrimLeft(b, " \t\r\n")
+	return len(b) > 0 && (b[0] == '{' || b[0] == '[')
+}
+
+// parseJSON parses objects or arrays of objects in the JSON format, one after the other, in
+// to Metrics and adds tags to them. Like parseTaggedLine, objects that don't parse are
+// logged and turned in to ERROR Metrics counting the rejection.
+func (srv *MetricReceiver) parseJSON(addr net.Addr, b []byte, tags []string) []Metric {
+	var metrics []Metric
+	var objects []json.RawMessage
+	dec := json.NewDecoder(bytes.NewReader(b))
+	for {
+		var doc json.RawMessage
+		if err := dec.Decode(&doc); err == io.EOF {
+			break
+		} else if err != nil {
+			metrics = append(metrics, srv.rejectJSON(addr, b, rejectf(RejectBadField, "error parsing JSON: %s", err)))
+			break
+		}
+		if doc[0] != '[' {
+			objects = append(objects, doc)
+			continue
+		}
+		var list []json.RawMessage
+		if err := json.Unmarshal(doc, &list); err != nil {
+			metrics = append(metrics, srv.rejectJSON(addr, doc, rejectf(RejectBadField, "error parsing JSON: %s", err)))
+			continue
+		}
+		objects = append(objects, list...)
+	}
+
+	for _, object := range objects {
+		var metric Metric
+		var err error
+		if srv.MaxLineLength > 0 && len(object) > srv.MaxLineLength {
+			err = rejectf(RejectTooLong, "object longer than %d bytes", srv.MaxLineLength)
+		} else {
+			metric, err = parseJSONMetric(object)
+		}
+		if traced(addr) {
+			trace(addr, object, metric, err)
+		}
+		if err != nil {
+			metrics = append(metrics, srv.rejectJSON(addr, object, err))
+			continue
+		}
+		if len(tags) > 0 {
+			metric.Tags = mergeTags(metric.Tags, tags)
+		}
+		srv.debugf("received %s from %s", metric, addr)
+		srv.countMetric(addr)
+		srv.trackSource(addr, metric)
+		metrics = append(metrics, metric)
+	}
+	return metrics
+}
+
+// rejectJSON logs JSON that didn't parse and returns the ERROR Metric counting it
+func (srv *MetricReceiver) rejectJSON(addr net.Addr, b []byte, err error) Metric {
+	if len(b) > 256 {
+		b = b[:256]
+	}
+	srv.infof("error parsing JSON %q from %s: %s", b, addr, err)
+	srv.countParseError(addr, err)
+	return rejection(err)
+}
+
+// parseJSONMetric parses a single object in the JSON format in to a Metric
+func parseJSONMetric(b []byte) (Metric, error) {
+	var metric Metric
+	var jm jsonMetric
+	if err := json.Unmarshal(b, &jm); err != nil {
+		return metric, rejectf(RejectBadField, "error parsing JSON: %s", err)
+	}
+	if jm.Name == "" {
+		return metric, rejectf(RejectBadName, "error parsing metric name: missing name")
+	}
+	metric.Bucket = jm.Name
+
+	switch jm.Type {
+	case "c", "counter":
+		metric.Type = COUNTER
+	case "g", "gauge":
+		metric.Type = GAUGE
+	case "ms", "timer":
+		metric.Type = TIMER
+	case "s", "set":
+		metric.Type = SET
+	default:
+		return metric, rejectf(RejectBadType, "invalid metric type: %q", jm.Type)
+	}
+
+	if len(jm.Value) == 0 || string(jm.Value) == "null" {
+		return metric, rejectf(RejectBadValue, "error converting metric value: missing value")
+	}
+	if metric.Type == SET {
+		// Members are strings, but numeric ids are common enough to take them as is
+		var member string
+		if json.Unmarshal(jm.Value, &member) != nil {
+			member = string(jm.Value)
+		}
+		if member == "" {
+			return metric, rejectf(RejectBadValue, "error parsing set member: empty member")
+		}
+		metric.Member = member
+	} else {
+		if err := json.Unmarshal(jm.Value, &metric.Value); err != nil {
+			return metric, rejectf(RejectBadValue, "error converting metric value: %s", jm.Value)
+		}
+		if math.IsNaN(metric.Value) || math.IsInf(metric.Value, 0) {
+			return metric, rejectf(RejectBadValue, "error converting metric value: not a finite number")
+		}
+	}
+
+	metric.SampleRate = 1.0
+	if jm.Rate != nil {
+		metric.SampleRate = *jm.Rate
+		if !(metric.SampleRate > 0.0 && metric.SampleRate <= 1.0) {
+			return metric, rejectf(RejectBadRate, "error converting metric sample rate, value out of range (0, 1]")
+		}
+	}
+
+	if len(jm.Tags) > 0 {
+		var list []string
+		var object map[string]string
+		if json.Unmarshal(jm.Tags, &list) == nil {
+			for _, tag := range list {
+				if tag != "" {
+					metric.Tags = append(metric.Tags, tag)
+				}
+			}
+		} else if json.Unmarshal(jm.Tags, &object) == nil {
+			for k, v := range object {
+				metric.Tags = append(metric.Tags, k+":"+v)
+			}
+		} else {
+			return metric, rejectf(RejectBadField, "error parsing tags: expected an object or a list of strings")
+		}
+		sort.Strings(metric.Tags)
+	}
+
+	if jm.Ts < 0 {
+		return metric, rejectf(RejectBadField, "error converting metric timestamp: %d", jm.Ts)
+	}
+	metric.Timestamp = jm.Ts
+
+	if jm.TTL < 0 {
+		return metric, rejectf(RejectBadField, "error converting metric TTL: %d", jm.TTL)
+	}
+	metric.TTL = jm.TTL
+	return metric, nil
+}
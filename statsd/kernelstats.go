@@ -0,0 +1,52 @@
+package statsd
+
+import (
+	"net"
+	"time"
+)
+
+// Buckets of the internal metrics reporting kernel level socket statistics
+const (
+	KernelDropsBucket   = "statsd.kernel_drops"
+	KernelRxQueueBucket = "statsd.kernel_rx_queue"
+)
+
+// monitorKernelStats periodically reads the kernel statistics of the listening sockets
+// and passes them to the Handler: the packets dropped since the last reading as a counter,
+// and the bytes waiting in the receive queues as a gauge. These drops happen before the
+// packets ever reach ReadFrom, so they are invisible otherwise. It returns once done is
+// closed.
+func (r *MetricReceiver) monitorKernelStats(conns []*net.UDPConn, done <-chan struct{}) {
+	inodes := make(map[uint64]bool)
+	for _, c := range conns {
+		ino, err := socketInode(c)
+		if err != nil {
+			r.logf("not monitoring kernel drops: %s", err)
+			return
+		}
+		inodes[ino] = true
+	}
+
+	_, lastDrops, err := readKernelStats(inodes)
+	if err != nil {
+		r.logf("not monitoring kernel drops: %s", err)
+		return
+	}
+	ticker := time.NewTicker(r.KernelStatsInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+		}
+		rxQueue, drops, err := readKernelStats(inodes)
+		if err != nil {
+			r.logf("error reading kernel socket statistics: %s", err)
+			continue
+		}
+		r.Handler.HandleMetric(Metric{Type: COUNTER, Bucket: KernelDropsBucket, Value: float64(drops - lastDrops), SampleRate: 1})
+		r.Handler.HandleMetric(Metric{Type: GAUGE, Bucket: KernelRxQueueBucket, Value: float64(rxQueue), SampleRate: 1})
+		lastDrops = drops
+	}
+}
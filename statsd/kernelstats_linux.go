@@ -0,0 +1,64 @@
+//go:build linux
+// +build linux
+
+package statsd
+
+import (
+	"bufio"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// socketInode returns the inode number identifying c in /proc/net/udp
+func socketInode(c *net.UDPConn) (ino uint64, err error) {
+	err = control(c, func(fd int) error {
+		var st syscall.Stat_t
+		if err := syscall.Fstat(fd, &st); err != nil {
+			return err
+		}
+		ino = st.Ino
+		return nil
+	})
+	return ino, err
+}
+
+// readKernelStats sums the receive queue length and drop counter of the sockets with the
+// given inodes from /proc/net/udp and /proc/net/udp6
+func readKernelStats(inodes map[uint64]bool) (rxQueue, drops uint64, err error) {
+	for _, path := range []string{"/proc/net/udp", "/proc/net/udp6"} {
+		f, err := os.Open(path)
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return 0, 0, err
+		}
+		scanner := bufio.NewScanner(f)
+		scanner.Scan() // header
+		for scanner.Scan() {
+			// sl local_address rem_address st tx_queue:rx_queue tr:tm->when retrnsmt uid timeout inode ref pointer drops
+			fields := strings.Fields(scanner.Text())
+			if len(fields) < 13 {
+				continue
+			}
+			ino, err := strconv.ParseUint(fields[9], 10, 64)
+			if err != nil || !inodes[ino] {
+				continue
+			}
+			if i := strings.IndexByte(fields[4], ':'); i >= 0 {
+				rx, _ := strconv.ParseUint(fields[4][i+1:], 16, 64)
+				rxQueue += rx
+			}
+			d, _ := strconv.ParseUint(fields[12], 10, 64)
+			drops += d
+		}
+		f.Close()
+		if err := scanner.Err(); err != nil {
+			return 0, 0, err
+		}
+	}
+	return rxQueue, drops, nil
+}
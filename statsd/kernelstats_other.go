@@ -0,0 +1,22 @@
+//go:build !linux
+// +build !linux
+
+package statsd
+
+import (
+	"errors"
+	"net"
+)
+
+var errKernelStatsUnsupported = errors.New("kernel socket statistics are only supported on Linux")
+
+// socketInode returns the inode number identifying c in /proc/net/udp
+func socketInode(c *net.UDPConn) (uint64, error) {
+	return 0, errKernelStatsUnsupported
+}
+
+// readKernelStats sums the receive queue length and drop counter of the sockets with the
+// given inodes from /proc/net/udp and /proc/net/udp6
+func readKernelStats(inodes map[uint64]bool) (rxQueue, drops uint64, err error) {
+	return 0, 0, errKernelStatsUnsupported
+}
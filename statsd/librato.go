@@ -0,0 +1,138 @@
+package statsd
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"time"
+)
+
+// DefaultLibratoURL is the endpoint of the Librato measurements API
+const DefaultLibratoURL = "https://metrics-api.librato.com/v1/measurements"
+
+// libratoMaxMeasurements is the largest number of measurements Librato accepts per request
+const libratoMaxMeasurements = 300
+
+// LibratoClient sends metrics to the Librato (AppOptics) measurements API, with their tags
+// as measurement tags. The statistics of each timer are sent as a single summarized gauge
+// of its count, sum, minimum, maximum and sum of squares; percentiles remain gauges of their own.
+type LibratoClient struct {
+	User  string // Account email
+	Token string // API token
+	URL   string // DefaultLibratoURL if blank
+	Tags  map[string]string
+}
+
+// libratoMeasurement is a measurement of a measurements API request
+type libratoMeasurement struct {
+	Name       string            `json:"name"`
+	Value      *float64          `json:"value,omitempty"`
+	Count      *float64          `json:"count,omitempty"`
+	Sum        *float64          `json:"sum,omitempty"`
+	Min        *float64          `json:"min,omitempty"`
+	Max        *float64          `json:"max,omitempty"`
+	SumSquares *float64          `json:"sum_squares,omitempty"`
+	Tags       map[string]string `json:"tags,omitempty"`
+}
+
+// libratoRequest is the body of a measurements API request
+type libratoRequest struct {
+	Time         int64                `json:"time"`
+	Tags         map[string]string    `json:"tags,omitempty"`
+	Measurements []libratoMeasurement `json:"measurements"`
+}
+
+// SendMetrics sends the metrics in a MetricMap to Librato
+func (c *LibratoClient) SendMetrics(metrics MetricMap) error {
+	return c.SendMetricsAt(metrics, time.Now())
+}
+
+// SendMetricsAt sends the metrics in a MetricMap to Librato with the timestamp t
+func (c *LibratoClient) SendMetricsAt(metrics MetricMap, t time.Time) error {
+	metrics = finiteMetrics(metrics)
+	var measurements []libratoMeasurement
+	timers := make(map[string]map[string]float64)
+	for k, v := range metrics {
+		if timer, stat, ok := splitTimerKey(k); ok {
+			switch stat {
+			case "count", "sum", "lower", "upper", "std":
+				if timers[timer] == nil {
+					timers[timer] = make(map[string]float64)
+				}
+				timers[timer][stat] = v
+				continue
+			case "mean", "median", "count_ps":
+				continue // derived from the summary
+			}
+		}
+		name, tags := SplitKey(k)
+		v := v
+		measurements = append(measurements, libratoMeasurement{Name: name, Value: &v, Tags: libratoTags(tags)})
+	}
+	for timer, stats := range timers {
+		name, tags := SplitKey(timer)
+		count, sum, std := stats["count"], stats["sum"], stats["std"]
+		min, max := stats["lower"], stats["upper"]
+		var sumSquares float64
+		if count > 0 {
+			mean := sum / count
+			sumSquares = count * (std*std + mean*mean)
+		}
+		measurements = append(measurements, libratoMeasurement{
+			Name:       "stats.timers." + name,
+			Count:      &count,
+			Sum:        &sum,
+			Min:        &min,
+			Max:        &max,
+			SumSquares: &sumSquares,
+			Tags:       libratoTags(tags),
+		})
+	}
+
+	for len(measurements) > 0 {
+		n := len(measurements)
+		if n > libratoMaxMeasurements {
+			n = libratoMaxMeasurements
+		}
+		if err := c.post(libratoRequest{t.Unix(), c.Tags, measurements[:n]}); err != nil {
+			return err
+		}
+		measurements = measurements[n:]
+	}
+	return nil
+}
+
+// libratoTags converts tags to Librato tags, whose values can't be empty
+func libratoTags(tags []string) map[string]string {
+	if len(tags) == 0 {
+		return nil
+	}
+	m := make(map[string]string, len(tags))
+	for _, tag := range tags {
+		k, v := splitTag(tag)
+		if v == "" {
+			v = "true"
+		}
+		m[k] = v
+	}
+	return m
+}
+
+// post sends a request to the measurements API
+func (c *LibratoClient) post(r libratoRequest) error {
+	body, err := json.Marshal(r)
+	if err != nil {
+		return err
+	}
+	url := c.URL
+	if url == "" {
+		url = DefaultLibratoURL
+	}
+	req, err := http.NewRequest("POST", url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.SetBasicAuth(c.User, c.Token)
+	return doRequest(req)
+}
@@ -0,0 +1,76 @@
+package statsd
+
+import (
+	"encoding/json"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestLibratoFormat(t *testing.T) {
+	tests := map[string]struct {
+		metrics  MetricMap
+		expected string
+	}{
+		"gauge": {
+			MetricMap{"stats.gauges.foo": 1.5},
+			`{"time":1500000000,"tags":{"env":"prod"},"measurements":[{"name":"stats.gauges.foo","value":1.5}]}`,
+		},
+		"tags": {
+			MetricMap{"stats.gauges.foo;region:eu;canary": 1.5},
+			`{"time":1500000000,"tags":{"env":"prod"},"measurements":[{"name":"stats.gauges.foo","value":1.5,"tags":{"canary":"true","region":"eu"}}]}`,
+		},
+		"timer": {
+			MetricMap{
+				"stats.timers.req.count;host:a": 4,
+				"stats.timers.req.sum;host:a":   10,
+				"stats.timers.req.lower;host:a": 1,
+				"stats.timers.req.upper;host:a": 4,
+				"stats.timers.req.std;host:a":   1,
+				"stats.timers.req.mean;host:a":  2.5,
+			},
+			`{"time":1500000000,"tags":{"env":"prod"},"measurements":[{"name":"stats.timers.req","count":4,"sum":10,"min":1,"max":4,"sum_squares":29,"tags":{"host":"a"}}]}`,
+		},
+	}
+
+	server, requests := captureServer()
+	defer server.Close()
+
+	c := &LibratoClient{User: "me@example.com", Token: "secret", URL: server.URL, Tags: map[string]string{"env": "prod"}}
+	for name, test := range tests {
+		if err := c.SendMetricsAt(test.metrics, time.Unix(1500000000, 0)); err != nil {
+			t.Errorf("test %s error: %s", name, err)
+			continue
+		}
+		r := <-requests
+		if auth := r.Header.Get("Authorization"); auth != "Basic bWVAZXhhbXBsZS5jb206c2VjcmV0" {
+			t.Errorf("test %s: expected basic authentication, got %s", name, auth)
+		}
+		if string(r.Body) != test.expected {
+			t.Errorf("test %s: expected %s, got %s", name, test.expected, r.Body)
+		}
+	}
+}
+
+func TestLibratoBatches(t *testing.T) {
+	server, requests := captureServer()
+	defer server.Close()
+
+	metrics := make(MetricMap)
+	for i := 0; i < libratoMaxMeasurements+1; i++ {
+		metrics["stats.gauges.foo"+strconv.Itoa(i)] = 1
+	}
+	c := &LibratoClient{URL: server.URL}
+	if err := c.SendMetricsAt(metrics, time.Unix(1500000000, 0)); err != nil {
+		t.Fatal(err)
+	}
+	for _, expected := range []int{libratoMaxMeasurements, 1} {
+		var r libratoRequest
+		if err := json.Unmarshal((<-requests).Body, &r); err != nil {
+			t.Fatal(err)
+		}
+		if len(r.Measurements) != expected {
+			t.Errorf("expected %d measurements, got %d", expected, len(r.Measurements))
+		}
+	}
+}
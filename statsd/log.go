@@ -0,0 +1,66 @@
+package statsd
+
+import (
+	"fmt"
+	"log"
+	"strings"
+	"sync/atomic"
+)
+
+// LogLevel controls how verbose the package's logging is. Errors are always logged.
+type LogLevel int32
+
+const (
+	LogDebug LogLevel = iota
+	LogInfo
+	LogError
+)
+
+// logLevel is the current LogLevel, accessed atomically
+var logLevel = int32(LogInfo)
+
+func (l LogLevel) String() string {
+	switch l {
+	case LogDebug:
+		return "debug"
+	case LogInfo:
+		return "info"
+	case LogError:
+		return "error"
+	}
+	return "unknown"
+}
+
+// ParseLogLevel returns the LogLevel with the given name
+func ParseLogLevel(name string) (LogLevel, error) {
+	for l := LogDebug; l <= LogError; l++ {
+		if strings.EqualFold(name, l.String()) {
+			return l, nil
+		}
+	}
+	return 0, fmt.Errorf("unknown log level %q", name)
+}
+
+// SetLogLevel changes the log level, it's safe to call at any time
+func SetLogLevel(l LogLevel) {
+	atomic.StoreInt32(&logLevel, int32(l))
+}
+
+// GetLogLevel returns the current log level
+func GetLogLevel() LogLevel {
+	return LogLevel(atomic.LoadInt32(&logLevel))
+}
+
+// debugf logs a message if the log level is LogDebug
+func debugf(format string, v ...interface{}) {
+	if GetLogLevel() <= LogDebug {
+		log.Printf(format, v...)
+	}
+}
+
+// infof logs a message if the log level is LogInfo or lower
+func infof(format string, v ...interface{}) {
+	if GetLogLevel() <= LogInfo {
+		log.Printf(format, v...)
+	}
+}
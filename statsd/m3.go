@@ -0,0 +1,161 @@
+package statsd
+
+import (
+	"bytes"
+	"encoding/binary"
+	"math"
+	"net/http"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/golang/snappy"
+)
+
+// regPromInvalid matches the characters that aren't allowed in Prometheus metric and label names
+var regPromInvalid = regexp.MustCompile("[^a-zA-Z0-9_:]")
+
+// M3StoragePolicy assigns the metrics matching Pattern to an M3 storage policy
+type M3StoragePolicy struct {
+	Pattern string // Pattern of the flushed names, as in rollups
+	Policy  string // Resolution and retention, e.g. "10s:2d"
+}
+
+// M3Client writes metrics to an M3 coordinator with the Prometheus remote write protocol.
+// Dots in the names become underscores and tags become labels. The Metadata of the
+// metrics is sent along as their help text and unit.
+//
+// Metrics are written as aggregated to the namespace of their storage policy: the first
+// of StoragePolicies matching them, or DefaultStoragePolicy. Metrics without a storage
+// policy are written to the unaggregated namespace.
+type M3Client struct {
+	URL                  string // e.g. "http://m3coordinator:7201/api/v1/prom/remote/write"
+	DefaultStoragePolicy string
+	StoragePolicies      []M3StoragePolicy
+}
+
+// SendMetrics sends the metrics in a MetricMap to M3
+func (c *M3Client) SendMetrics(metrics MetricMap) error {
+	return c.SendMetricsAt(metrics, time.Now())
+}
+
+// SendMetricsAt sends the metrics in a MetricMap to M3 with the timestamp t, with one
+// request per storage policy
+func (c *M3Client) SendMetricsAt(metrics MetricMap, t time.Time) error {
+	byPolicy := make(map[string]MetricMap)
+	for k, v := range metrics {
+		policy := c.DefaultStoragePolicy
+		for _, p := range c.StoragePolicies {
+			if matchPattern(p.Pattern, k) {
+				policy = p.Policy
+				break
+			}
+		}
+		if byPolicy[policy] == nil {
+			byPolicy[policy] = make(MetricMap)
+		}
+		byPolicy[policy][k] = v
+	}
+
+	for policy, metrics := range byPolicy {
+		body := snappy.Encode(nil, promWriteRequest(metrics, t))
+		req, err := http.NewRequest("POST", c.URL, bytes.NewReader(body))
+		if err != nil {
+			return err
+		}
+		req.Header.Set("Content-Type", "application/x-protobuf")
+		req.Header.Set("Content-Encoding", "snappy")
+		req.Header.Set("X-Prometheus-Remote-Write-Version", "0.1.0")
+		if policy != "" {
+			req.Header.Set("M3-Metrics-Type", "aggregated")
+			req.Header.Set("M3-Storage-Policy", policy)
+		}
+		if err := doRequest(req); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// promWriteRequest encodes metrics as the protobuf WriteRequest of the remote write protocol:
+//
+//	message WriteRequest { repeated TimeSeries timeseries = 1; }
+//	message TimeSeries   { repeated Label labels = 1; repeated Sample samples = 2; }
+//	message Label        { string name = 1; string value = 2; }
+//	message Sample       { double value = 1; int64 timestamp = 2; }
+//
+// along with the metadata of the metrics that have some:
+//
+//	message WriteRequest   { repeated MetricMetadata metadata = 3; }
+//	message MetricMetadata { MetricType type = 1; string metric_family_name = 2; string help = 4; string unit = 5; }
+func promWriteRequest(metrics MetricMap, t time.Time) []byte {
+	keys := make([]string, 0, len(metrics))
+	for k := range metrics {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	var req []byte
+	described := make(map[string]bool)
+	for _, k := range keys {
+		name, tags := SplitKey(k)
+		family := regPromInvalid.ReplaceAllString(name, "_")
+		if m, ok := MetadataFor(name); ok && !described[family] {
+			described[family] = true
+			req = protoBytes(req, 3, promMetadata(family, m))
+		}
+		var series []byte
+		series = protoBytes(series, 1, promLabel("__name__", family))
+		for _, tag := range tags {
+			k, v := splitTag(tag)
+			series = protoBytes(series, 1, promLabel(regPromInvalid.ReplaceAllString(k, "_"), v))
+		}
+		sample := []byte{1<<3 | 1} // field 1, 64-bit
+		sample = binary.LittleEndian.AppendUint64(sample, math.Float64bits(metrics[k]))
+		sample = protoVarint(sample, 2<<3, uint64(t.UnixNano()/int64(time.Millisecond)))
+		series = protoBytes(series, 2, sample)
+		req = protoBytes(req, 1, series)
+	}
+	return req
+}
+
+// promMetadata encodes the MetricMetadata message of a family of gauges, the type of every
+// flushed metric, with the owner appended to the help text
+func promMetadata(family string, m Metadata) []byte {
+	help := m.Description
+	if m.Owner != "" {
+		help = strings.TrimSpace(help + " (owner: " + m.Owner + ")")
+	}
+	var metadata []byte
+	metadata = protoVarint(metadata, 1<<3, 2) // GAUGE
+	metadata = protoBytes(metadata, 2, []byte(family))
+	if help != "" {
+		metadata = protoBytes(metadata, 4, []byte(help))
+	}
+	if m.Unit != "" {
+		metadata = protoBytes(metadata, 5, []byte(m.Unit))
+	}
+	return metadata
+}
+
+// promLabel encodes a Label message
+func promLabel(name, value string) []byte {
+	var label []byte
+	label = protoBytes(label, 1, []byte(name))
+	label = protoBytes(label, 2, []byte(value))
+	return label
+}
+
+// protoVarint appends a varint field with the given tag byte to b
+func protoVarint(b []byte, tag byte, v uint64) []byte {
+	b = append(b, tag)
+	return binary.AppendUvarint(b, v)
+}
+
+// protoBytes appends a length delimited field to b
+func protoBytes(b []byte, field byte, v []byte) []byte {
+	b = append(b, field<<3|2)
+	b = binary.AppendUvarint(b, uint64(len(v)))
+	return append(b, v...)
+}
@@ -0,0 +1,71 @@
+package statsd
+
+import (
+	"encoding/hex"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/golang/snappy"
+)
+
+func TestPromWriteRequest(t *testing.T) {
+	// Each a WriteRequest of a TimeSeries with the labels and a Sample of 1.5 at 1500000000000
+	tests := map[string]string{
+		"stats.gauges.foo": "0a300a1c0a085f5f6e616d655f5f121073746174735f6761756765735f666f6f" +
+			"121009000000000000f83f1080b0def7d32b",
+		"stats.gauges.foo;region:eu;host.name:a": "0a4e0a1c0a085f5f6e616d655f5f121073746174735f6761756765735f666f6f" +
+			"0a0c0a06726567696f6e12026575" +
+			"0a0e0a09686f73745f6e616d65120161" +
+			"121009000000000000f83f1080b0def7d32b",
+	}
+
+	for key, expected := range tests {
+		result := hex.EncodeToString(promWriteRequest(MetricMap{key: 1.5}, time.Unix(1500000000, 0)))
+		if result != expected {
+			t.Errorf("test %s: expected %s, got %s", key, expected, result)
+		}
+	}
+}
+
+func TestM3StoragePolicies(t *testing.T) {
+	server, requests := captureServer()
+	defer server.Close()
+
+	c := &M3Client{
+		URL:             server.URL,
+		StoragePolicies: []M3StoragePolicy{{"stats.gauges.*", "1m:30d"}},
+	}
+	now := time.Unix(1500000000, 0)
+	if err := c.SendMetricsAt(MetricMap{"stats.gauges.foo": 1, "stats.counters.foo": 2}, now); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := map[string]MetricMap{
+		"1m:30d": MetricMap{"stats.gauges.foo": 1},
+		"":       MetricMap{"stats.counters.foo": 2},
+	}
+	for i := 0; i < len(expected); i++ {
+		r := <-requests
+		if r.Header.Get("Content-Encoding") != "snappy" || r.Header.Get("Content-Type") != "application/x-protobuf" {
+			t.Errorf("expected a snappy compressed protobuf, got %v", r.Header)
+		}
+		policy := r.Header.Get("M3-Storage-Policy")
+		metrics, ok := expected[policy]
+		if !ok {
+			t.Errorf("unexpected storage policy %q", policy)
+			continue
+		}
+		if typ := r.Header.Get("M3-Metrics-Type"); (policy != "") != (typ == "aggregated") {
+			t.Errorf("policy %q: unexpected metrics type %q", policy, typ)
+		}
+		body, err := snappy.Decode(nil, r.Body)
+		if err != nil {
+			t.Errorf("policy %q error: %s", policy, err)
+			continue
+		}
+		if !reflect.DeepEqual(body, promWriteRequest(metrics, now)) {
+			t.Errorf("policy %q: expected the write request of %v", policy, metrics)
+		}
+	}
+}
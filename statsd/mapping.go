@@ -0,0 +1,198 @@
+package statsd
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Types of MappingRule matches
+const (
+	MatchGlob  = "glob"  // Dot separated components where * matches a single component
+	MatchRegex = "regex" // A regular expression matched against the whole name
+)
+
+// Actions of MappingRules
+const (
+	MappingMap  = "map"  // Rename the metric and add the labels as tags
+	MappingDrop = "drop" // Discard the metric
+)
+
+// mappingCacheSize bounds the number of bucket names whose mapping is remembered
+const mappingCacheSize = 10000
+
+// MappingRule turns a dotted bucket name in to a name and labels, like the mappings of
+// the Prometheus statsd_exporter. In Name and the values of Labels, $1, $2... refer to
+// what the *s of a glob or the groups of a regular expression matched, e.g. the glob
+// "api.*.requests" with the labels {"service": "$1"} maps "api.users.requests" to the
+// tag "service:users".
+type MappingRule struct {
+	Match     string            `json:"match"`
+	MatchType string            `json:"match_type"`  // MatchGlob, the default, or MatchRegex
+	Types     []string          `json:"metric_type"` // Types the rule applies to, all if empty
+	Action    string            `json:"action"`      // MappingMap, the default, or MappingDrop
+	Name      string            `json:"name"`        // New name of the bucket, unchanged if empty
+	Labels    map[string]string `json:"labels"`
+}
+
+// Validate checks that the rule is well formed
+func (r MappingRule) Validate() error {
+	if _, err := r.compile(); err != nil {
+		return err
+	}
+	for _, s := range r.Types {
+		if _, err := ParseMetricType(s); err != nil {
+			return fmt.Errorf("mapping %q: %s", r.Match, err)
+		}
+	}
+	switch r.Action {
+	case "", MappingMap, MappingDrop:
+	default:
+		return fmt.Errorf("mapping %q: unknown action %q", r.Match, r.Action)
+	}
+	return nil
+}
+
+// compile returns the regular expression matching the names the rule applies to
+func (r MappingRule) compile() (*regexp.Regexp, error) {
+	if r.Match == "" {
+		return nil, fmt.Errorf("mapping rule without match")
+	}
+	switch r.MatchType {
+	case "", MatchGlob:
+		parts := strings.Split(r.Match, ".")
+		for i, part := range parts {
+			if part == "*" {
+				parts[i] = "([^.]*)"
+			} else {
+				parts[i] = regexp.QuoteMeta(part)
+			}
+		}
+		return regexp.Compile("^" + strings.Join(parts, `\.`) + "$")
+	case MatchRegex:
+		re, err := regexp.Compile(r.Match)
+		if err != nil {
+			return nil, fmt.Errorf("mapping %q: %s", r.Match, err)
+		}
+		return re, nil
+	}
+	return nil, fmt.Errorf("mapping %q: unknown match type %q", r.Match, r.MatchType)
+}
+
+// compiledMapping is a MappingRule ready to be matched
+type compiledMapping struct {
+	MappingRule
+	re    *regexp.Regexp
+	types map[MetricType]bool
+}
+
+// mapping is the outcome of the rules for a bucket and metric type
+type mapping struct {
+	drop bool
+	name string
+	tags []string
+}
+
+// MappingHandler is a Handler that maps the bucket names of metrics to names and tags by
+// the first of its Rules that matches before passing them on to Handler. Metrics that no
+// rule matches are passed on unchanged. Invalid rules are ignored, see MappingRule.Validate.
+type MappingHandler struct {
+	Rules   []MappingRule
+	Handler Handler
+
+	once  sync.Once
+	rules []compiledMapping
+	mu    sync.Mutex
+	cache map[string]mapping // Mappings of recently seen buckets, keyed by type and bucket
+}
+
+// HandleMetric maps m and passes it on
+func (h *MappingHandler) HandleMetric(m Metric) {
+	h.handle(m, h.Handler.HandleMetric)
+}
+
+// HandleMetrics maps the metrics of a datagram and passes them on at once
+func (h *MappingHandler) HandleMetrics(ms []Metric) {
+	batchMetrics(ms, h.Handler, h.handle)
+}
+
+// handle maps m and emits it
+func (h *MappingHandler) handle(m Metric, emit func(Metric)) {
+	if m.Type == ERROR {
+		emit(m)
+		return
+	}
+	h.once.Do(h.compile)
+
+	key := m.Type.String() + ":" + m.Bucket
+	h.mu.Lock()
+	mp, ok := h.cache[key]
+	h.mu.Unlock()
+	if !ok {
+		mp = h.lookup(m)
+		h.mu.Lock()
+		if h.cache == nil || len(h.cache) >= mappingCacheSize {
+			h.cache = make(map[string]mapping)
+		}
+		h.cache[key] = mp
+		h.mu.Unlock()
+	}
+
+	if mp.drop {
+		return
+	}
+	if mp.name != "" {
+		m.Bucket = mp.name
+	}
+	if len(mp.tags) > 0 {
+		m.Tags = mergeTags(m.Tags, mp.tags)
+	}
+	emit(m)
+}
+
+// compile compiles the rules
+func (h *MappingHandler) compile() {
+	for _, r := range h.Rules {
+		re, err := r.compile()
+		if err != nil {
+			continue
+		}
+		c := compiledMapping{MappingRule: r, re: re}
+		if len(r.Types) > 0 {
+			c.types = make(map[MetricType]bool)
+			for _, s := range r.Types {
+				if t, err := ParseMetricType(s); err == nil {
+					c.types[t] = true
+				}
+			}
+		}
+		h.rules = append(h.rules, c)
+	}
+}
+
+// lookup finds the mapping of m by the first rule that matches it
+func (h *MappingHandler) lookup(m Metric) mapping {
+	for _, r := range h.rules {
+		if r.types != nil && !r.types[m.Type] {
+			continue
+		}
+		match := r.re.FindStringSubmatchIndex(m.Bucket)
+		if match == nil {
+			continue
+		}
+		if r.Action == MappingDrop {
+			return mapping{drop: true}
+		}
+		mp := mapping{name: string(r.re.ExpandString(nil, r.Name, m.Bucket, match))}
+		for k, v := range r.Labels {
+			if v = string(r.re.ExpandString(nil, v, m.Bucket, match)); v != "" {
+				mp.tags = append(mp.tags, k+":"+v)
+			}
+		}
+		sort.Strings(mp.tags)
+		return mp
+	}
+	return mapping{}
+}
@@ -0,0 +1,101 @@
+package statsd
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+)
+
+// Metadata describes the buckets matching Match, for the backends that can carry it
+type Metadata struct {
+	Match       string `json:"match"` // Bucket names, * matching a single dot separated component
+	Unit        string `json:"unit,omitempty"`
+	Description string `json:"description,omitempty"`
+	Owner       string `json:"owner,omitempty"`
+}
+
+// Validate checks that the metadata is well formed
+func (m Metadata) Validate() error {
+	if m.Match == "" {
+		return fmt.Errorf("metadata without match")
+	}
+	return nil
+}
+
+// metadata holds the declared Metadata, in the order it was declared
+var (
+	metadataMu sync.RWMutex
+	metadata   []Metadata
+)
+
+// SetMetadata declares the metadata of the buckets matching m.Match, replacing any
+// declared before for the same pattern
+func SetMetadata(m Metadata) {
+	defer metadataMu.Unlock()
+	metadataMu.Lock()
+	for i := range metadata {
+		if metadata[i].Match == m.Match {
+			metadata[i] = m
+			return
+		}
+	}
+	metadata = append(metadata, m)
+}
+
+// DeleteMetadata forgets the metadata declared for pattern, reporting whether there was any
+func DeleteMetadata(pattern string) bool {
+	defer metadataMu.Unlock()
+	metadataMu.Lock()
+	for i := range metadata {
+		if metadata[i].Match == pattern {
+			metadata = append(metadata[:i], metadata[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+// AllMetadata returns the declared metadata
+func AllMetadata() []Metadata {
+	defer metadataMu.RUnlock()
+	metadataMu.RLock()
+	return append([]Metadata{}, metadata...)
+}
+
+// flushedPrefixes are the prefixes the aggregator puts before the buckets it flushes
+var flushedPrefixes = []string{
+	"stats.counters.rate.",
+	"stats.counters.count.",
+	"stats.counters.events.",
+	"stats.gauges.",
+	"stats.sets.",
+	"stats.timers.",
+}
+
+// MetadataFor returns the metadata of the first pattern declared matching the bucket of a
+// flushed metric, e.g. "api.*.latency" for "stats.timers.api.login.latency.upper_95"
+func MetadataFor(name string) (Metadata, bool) {
+	defer metadataMu.RUnlock()
+	metadataMu.RLock()
+	if len(metadata) == 0 {
+		return Metadata{}, false
+	}
+	name, _ = SplitKey(name)
+	for _, prefix := range flushedPrefixes {
+		if strings.HasPrefix(name, prefix) {
+			name = name[len(prefix):]
+			break
+		}
+	}
+	// Timers, sets and the extremes of gauges are flushed with the statistic after the bucket
+	stripped := name
+	if i := strings.LastIndexByte(name, '.'); i > 0 {
+		stripped = name[:i]
+	}
+	for _, m := range metadata {
+		if matchPattern(m.Match, name) || matchPattern(m.Match, stripped) {
+			return m, true
+		}
+	}
+	return Metadata{}, false
+}
@@ -3,6 +3,9 @@ package statsd
 import (
 	"bytes"
 	"fmt"
+	"sort"
+	"strconv"
+	"strings"
 )
 
 // MetricType is an enumeration of all the possible types of Metric
@@ -14,10 +17,13 @@ const (
 	COUNTER
 	TIMER
 	GAUGE
+	SET
 )
 
 func (m MetricType) String() string {
 	switch {
+	case m >= SET:
+		return "set"
 	case m >= GAUGE:
 		return "gauge"
 	case m >= TIMER:
@@ -33,13 +39,133 @@ type Metric struct {
 	Type       MetricType // The type of metric
 	Bucket     string     // The name of the bucket where the metric belongs
 	Value      float64    // The numeric value of the metric
+	Member     string     // The member added to a SET, which has no value
 	SampleRate float64    // The sample rate of the metric
+	Timestamp  int64      // When the metric was measured in seconds since the epoch, if the client said
+	TTL        int64      // If set, seconds after its last update the series is forgotten
+	Tags       []string   // Sorted DogStatsD style tags, "key:value" or just "value"
 }
 
 func (m Metric) String() string {
+	if len(m.Tags) > 0 {
+		return fmt.Sprintf("{%s, %s, %f, %f, %s}", m.Type, m.Bucket, m.Value, m.SampleRate, strings.Join(m.Tags, ","))
+	}
 	return fmt.Sprintf("{%s, %s, %f, %f}", m.Type, m.Bucket, m.Value, m.SampleRate)
 }
 
+// Key returns the name under which the metric is aggregated: its bucket followed by each
+// of its tags, separated by semicolons. Keys are also used as names in flushed MetricMaps,
+// e.g. "stats.counters.rate.api.requests;host:a;region:eu".
+func (m Metric) Key() string {
+	if len(m.Tags) == 0 {
+		return m.Bucket
+	}
+	return m.Bucket + ";" + strings.Join(m.Tags, ";")
+}
+
+// splitTag splits a "key:value" tag in to its key and value. Tags without a colon are
+// returned as the key with an empty value.
+func splitTag(tag string) (key, value string) {
+	i := strings.IndexByte(tag, ':')
+	if i < 0 {
+		return tag, ""
+	}
+	return tag[:i], tag[i+1:]
+}
+
+// mergeTags returns the sorted union of tags and extra, leaving out the tags whose key
+// also appears in extra
+func mergeTags(tags, extra []string) []string {
+	keys := make(map[string]bool, len(extra))
+	for _, tag := range extra {
+		k, _ := splitTag(tag)
+		keys[k] = true
+	}
+	merged := append([]string(nil), extra...)
+	for _, tag := range tags {
+		if k, _ := splitTag(tag); !keys[k] {
+			merged = append(merged, tag)
+		}
+	}
+	sort.Strings(merged)
+	return merged
+}
+
+// suffixKey appends suffix to the name of key, before its tags
+func suffixKey(key, suffix string) string {
+	i := strings.IndexByte(key, ';')
+	if i < 0 {
+		return key + suffix
+	}
+	return key[:i] + suffix + key[i:]
+}
+
+// splitTimerKey splits a flushed timer statistic such as "stats.timers.api.latency.upper;host:a"
+// in to the key of the timer, "api.latency;host:a", and the statistic, "upper"
+func splitTimerKey(key string) (timer, stat string, ok bool) {
+	name, tags := SplitKey(key)
+	if !strings.HasPrefix(name, "stats.timers.") {
+		return "", "", false
+	}
+	name = name[len("stats.timers."):]
+	i := strings.LastIndex(name, ".")
+	if i < 0 {
+		return "", "", false
+	}
+	name, stat = name[:i], name[i+1:]
+	if len(tags) > 0 {
+		name += ";" + strings.Join(tags, ";")
+	}
+	return name, stat, true
+}
+
+// SplitKey splits a key returned by Metric.Key, or a flushed metric name, in to the
+// name and the tags
+func SplitKey(key string) (name string, tags []string) {
+	i := strings.IndexByte(key, ';')
+	if i < 0 {
+		return key, nil
+	}
+	return key[:i], strings.Split(key[i+1:], ";")
+}
+
+// wireTypes maps each MetricType to its representation in the statsd protocol
+var wireTypes = map[MetricType]string{
+	COUNTER: "c",
+	TIMER:   "ms",
+	GAUGE:   "g",
+	SET:     "s",
+}
+
+// formatLine formats m as a newline terminated line of the statsd protocol
+func formatLine(m Metric) []byte {
+	var line []byte
+	if m.Type == SET {
+		line = []byte(m.Bucket + ":" + m.Member)
+	} else {
+		line = strconv.AppendFloat([]byte(m.Bucket+":"), m.Value, 'g', -1, 64)
+	}
+	line = append(line, '|')
+	line = append(line, wireTypes[m.Type]...)
+	if m.SampleRate > 0 && m.SampleRate < 1 {
+		line = append(line, "|@"...)
+		line = strconv.AppendFloat(line, m.SampleRate, 'g', -1, 64)
+	}
+	if len(m.Tags) > 0 {
+		line = append(line, "|#"...)
+		line = append(line, strings.Join(m.Tags, ",")...)
+	}
+	if m.Timestamp != 0 {
+		line = append(line, "|T"...)
+		line = strconv.AppendInt(line, m.Timestamp, 10)
+	}
+	if m.TTL != 0 {
+		line = append(line, "|ttl:"...)
+		line = strconv.AppendInt(line, m.TTL, 10)
+	}
+	return append(line, '\n')
+}
+
 // MetricMap is used for storing aggregated Metric values.
 // The keys of the map are metric bucket names.
 type MetricMap map[string]float64
@@ -52,6 +178,12 @@ func (m MetricMap) String() string {
 	return buf.String()
 }
 
+// flushSnapshot is the JSON representation of a flush used by the message queue backends
+type flushSnapshot struct {
+	Time    int64     `json:"time"`
+	Metrics MetricMap `json:"metrics"`
+}
+
 // MetricListMap is simlar to MetricMap but instead of storing a single aggregated
 // Metric value it stores a list of all collected values.
 type MetricListMap map[string][]float64
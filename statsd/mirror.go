@@ -0,0 +1,78 @@
+package statsd
+
+import (
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Mirror copies the raw datagrams received to another statsd server, e.g. a shadow
+// deployment of a new aggregation stack to be validated against live traffic. Datagrams
+// are sent from a goroutine of their own so the receivers never wait for the mirror: when
+// QueueSize datagrams are already waiting, or the address can't be reached, they are
+// dropped and counted.
+type Mirror struct {
+	Addr      string // UDP address of the server the datagrams are copied to
+	QueueSize int    // Datagrams waiting to be sent, 1000 if zero
+
+	once    sync.Once
+	queue   chan []byte
+	dropped int64
+}
+
+// Send queues a copy of the datagram b to be mirrored
+func (m *Mirror) Send(b []byte) {
+	m.once.Do(m.start)
+	msg := make([]byte, len(b))
+	copy(msg, b)
+	select {
+	case m.queue <- msg:
+	default:
+		atomic.AddInt64(&m.dropped, 1)
+	}
+}
+
+// Dropped returns the number of datagrams that couldn't be mirrored so far
+func (m *Mirror) Dropped() int64 {
+	return atomic.LoadInt64(&m.dropped)
+}
+
+// start creates the queue and starts sending
+func (m *Mirror) start() {
+	size := m.QueueSize
+	if size <= 0 {
+		size = 1000
+	}
+	m.queue = make(chan []byte, size)
+	go m.run()
+}
+
+// run sends the queued datagrams, dialing Addr again every DNSRefreshInterval so the
+// mirror follows DNS changes
+func (m *Mirror) run() {
+	var c net.Conn
+	var dialed, retry time.Time
+	for msg := range m.queue {
+		if c != nil && time.Since(dialed) > DNSRefreshInterval {
+			c.Close()
+			c = nil
+		}
+		if c == nil && time.Now().After(retry) {
+			var err error
+			if c, err = dialer.Dial("udp", m.Addr); err != nil {
+				infof("mirroring to %s failed: %s", m.Addr, err)
+				retry = time.Now().Add(time.Second)
+			}
+			dialed = time.Now()
+		}
+		if c == nil {
+			atomic.AddInt64(&m.dropped, 1)
+			continue
+		}
+		if _, err := c.Write(msg); err != nil {
+			// e.g. nothing listens on the port for now
+			atomic.AddInt64(&m.dropped, 1)
+		}
+	}
+}
@@ -0,0 +1,95 @@
+package statsd
+
+import (
+	"encoding/json"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+// MQTTClient publishes metrics to an MQTT broker, either each on a topic of its own below
+// Topic, e.g. "statsd/stats/gauges/room/temperature", or all of a flush as a single JSON
+// message on Topic
+type MQTTClient struct {
+	Broker   string // e.g. "tcp://localhost:1883" or "ssl://broker:8883"
+	ClientID string
+	Username string
+	Password string
+	Topic    string // "statsd" if blank
+	JSON     bool   // Publish each flush as one JSON message instead of a topic per metric
+	QoS      byte
+	Retain   bool
+
+	mu     sync.Mutex
+	client mqtt.Client
+}
+
+// SendMetrics sends the metrics in a MetricMap to the broker
+func (c *MQTTClient) SendMetrics(metrics MetricMap) error {
+	return c.SendMetricsAt(metrics, time.Now())
+}
+
+// SendMetricsAt sends the metrics in a MetricMap to the broker with the timestamp t
+func (c *MQTTClient) SendMetricsAt(metrics MetricMap, t time.Time) error {
+	client, err := c.connect()
+	if err != nil {
+		return err
+	}
+	topic := c.Topic
+	if topic == "" {
+		topic = "statsd"
+	}
+
+	var tokens []mqtt.Token
+	if c.JSON {
+		b, err := json.Marshal(flushSnapshot{t.Unix(), finiteMetrics(metrics)})
+		if err != nil {
+			return err
+		}
+		tokens = append(tokens, client.Publish(topic, c.QoS, c.Retain, b))
+	} else {
+		for k, v := range metrics {
+			payload := strconv.FormatFloat(v, 'f', -1, 64) + " " + strconv.FormatInt(t.Unix(), 10)
+			tokens = append(tokens, client.Publish(topic+"/"+mqttTopic(k), c.QoS, c.Retain, payload))
+		}
+	}
+	for _, token := range tokens {
+		if token.WaitTimeout(30*time.Second) && token.Error() != nil {
+			return token.Error()
+		}
+	}
+	return nil
+}
+
+// mqttTopic turns a flushed name in to topic levels, replacing the characters MQTT gives
+// a special meaning. Tags become further levels, "api.requests;host:a" becoming "api/requests/host:a".
+func mqttTopic(key string) string {
+	return strings.NewReplacer(".", "/", ";", "/", "+", "_", "#", "_").Replace(key)
+}
+
+// connect returns the connected client, connecting on first use. The client reconnects
+// by itself when the connection is lost.
+func (c *MQTTClient) connect() (mqtt.Client, error) {
+	defer c.mu.Unlock()
+	c.mu.Lock()
+	if c.client != nil {
+		return c.client, nil
+	}
+	opts := mqtt.NewClientOptions().
+		AddBroker(c.Broker).
+		SetClientID(c.ClientID).
+		SetUsername(c.Username).
+		SetPassword(c.Password).
+		SetAutoReconnect(true).
+		SetConnectRetry(true)
+	client := mqtt.NewClient(opts)
+	token := client.Connect()
+	if token.WaitTimeout(30*time.Second) && token.Error() != nil {
+		return nil, token.Error()
+	}
+	c.client = client
+	return client, nil
+}
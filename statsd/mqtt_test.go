@@ -0,0 +1,19 @@
+package statsd
+
+import (
+	"testing"
+)
+
+func TestMQTTTopic(t *testing.T) {
+	tests := map[string]string{
+		"stats.gauges.room.temperature":      "stats/gauges/room/temperature",
+		"stats.counters.api.requests;host:a": "stats/counters/api/requests/host:a",
+		"stats.gauges.c++;lang:c#":           "stats/gauges/c__/lang:c_",
+	}
+
+	for input, expected := range tests {
+		if result := mqttTopic(input); result != expected {
+			t.Errorf("test %s: expected %s, got %s", input, expected, result)
+		}
+	}
+}
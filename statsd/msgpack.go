@@ -0,0 +1,389 @@
+package statsd
+
+import (
+	"errors"
+	"math"
+	"net"
+	"sort"
+)
+
+// BinaryMagic is the first byte of a batch of metrics in the binary format. It is never
+// used by MessagePack and can't start a UTF-8 line, so receivers tell batches apart from
+// statsd lines and JSON by it.
+//
+// A batch is the magic byte followed by MessagePack arrays, one per metric:
+//
+//	[name, type, value, rate, tags, timestamp, ttl]
+//
+// where type is the statsd type, "c", "g", "ms" or "s", value is a number or for sets a
+// string, rate a number, tags an array of "key:value" strings, timestamp an integer
+// number of seconds since the epoch and ttl the number of seconds after which the series
+// is forgotten. Trailing elements may be left out, and nil stands for a missing rate,
+// timestamp or ttl.
+const BinaryMagic = 0xc1
+
+// isBinary reports whether b is a batch in the binary format
+func isBinary(b []byte) bool {
+	return len(b) > 0 && b[0] == BinaryMagic
+}
+
+// AppendBinary appends m in the binary format to a batch started with BinaryMagic
+func AppendBinary(b []byte, m Metric) []byte {
+	n := 3
+	if m.TTL != 0 {
+		n = 7
+	} else if m.Timestamp != 0 {
+		n = 6
+	} else if len(m.Tags) > 0 {
+		n = 5
+	} else if m.SampleRate != 1 && m.SampleRate != 0 {
+		n = 4
+	}
+	b = append(b, 0x90|byte(n))
+	b = appendMsgpackString(b, m.Bucket)
+	switch m.Type {
+	case COUNTER:
+		b = appendMsgpackString(b, "c")
+	case GAUGE:
+		b = appendMsgpackString(b, "g")
+	case TIMER:
+		b = appendMsgpackString(b, "ms")
+	case SET:
+		b = appendMsgpackString(b, "s")
+	default:
+		b = appendMsgpackString(b, m.Type.String())
+	}
+	if m.Type == SET {
+		b = appendMsgpackString(b, m.Member)
+	} else {
+		b = appendMsgpackFloat(b, m.Value)
+	}
+	if n > 3 {
+		rate := m.SampleRate
+		if rate == 0 {
+			rate = 1
+		}
+		b = appendMsgpackFloat(b, rate)
+	}
+	if n > 4 {
+		b = appendMsgpackArrayHeader(b, len(m.Tags))
+		for _, tag := range m.Tags {
+			b = appendMsgpackString(b, tag)
+		}
+	}
+	if n > 5 {
+		if m.Timestamp == 0 {
+			b = append(b, 0xc0)
+		} else {
+			b = append(b, 0xd3)
+			b = appendUint(b, uint64(m.Timestamp), 8)
+		}
+	}
+	if n > 6 {
+		b = append(b, 0xd3)
+		b = appendUint(b, uint64(m.TTL), 8)
+	}
+	return b
+}
+
+// appendMsgpackString appends s as a MessagePack string
+func appendMsgpackString(b []byte, s string) []byte {
+	switch n := len(s); {
+	case n < 32:
+		b = append(b, 0xa0|byte(n))
+	case n < 1<<8:
+		b = append(b, 0xd9, byte(n))
+	case n < 1<<16:
+		b = append(b, 0xda)
+		b = appendUint(b, uint64(n), 2)
+	default:
+		b = append(b, 0xdb)
+		b = appendUint(b, uint64(n), 4)
+	}
+	return append(b, s...)
+}
+
+// appendMsgpackFloat appends f as a MessagePack float 64
+func appendMsgpackFloat(b []byte, f float64) []byte {
+	b = append(b, 0xcb)
+	return appendUint(b, math.Float64bits(f), 8)
+}
+
+// appendMsgpackArrayHeader appends the header of a MessagePack array of n elements
+func appendMsgpackArrayHeader(b []byte, n int) []byte {
+	switch {
+	case n < 16:
+		return append(b, 0x90|byte(n))
+	case n < 1<<16:
+		b = append(b, 0xdc)
+		return appendUint(b, uint64(n), 2)
+	}
+	b = append(b, 0xdd)
+	return appendUint(b, uint64(n), 4)
+}
+
+// appendUint appends v as a big endian unsigned integer of n bytes
+func appendUint(b []byte, v uint64, n int) []byte {
+	for i := n - 1; i >= 0; i-- {
+		b = append(b, byte(v>>(8*uint(i))))
+	}
+	return b
+}
+
+var errMsgpack = errors.New("malformed MessagePack")
+
+// msgpackReader decodes the subset of MessagePack used by the binary format
+type msgpackReader struct {
+	b []byte
+}
+
+// next returns the next n bytes
+func (r *msgpackReader) next(n int) ([]byte, error) {
+	if n < 0 || n > len(r.b) {
+		return nil, errMsgpack
+	}
+	b := r.b[:n]
+	r.b = r.b[n:]
+	return b, nil
+}
+
+// uint reads a big endian unsigned integer of n bytes
+func (r *msgpackReader) uint(n int) (uint64, error) {
+	b, err := r.next(n)
+	if err != nil {
+		return 0, err
+	}
+	var v uint64
+	for _, c := range b {
+		v = v<<8 | uint64(c)
+	}
+	return v, nil
+}
+
+// arrayHeader reads the header of an array and returns its number of elements
+func (r *msgpackReader) arrayHeader() (int, error) {
+	b, err := r.next(1)
+	if err != nil {
+		return 0, err
+	}
+	var n uint64
+	switch c := b[0]; {
+	case c&0xf0 == 0x90:
+		return int(c & 0x0f), nil
+	case c == 0xdc:
+		n, err = r.uint(2)
+	case c == 0xdd:
+		n, err = r.uint(4)
+	default:
+		return 0, errMsgpack
+	}
+	return int(n), err
+}
+
+// value reads a nil, boolean, number or string. Numbers are returned as float64 and
+// strings, or binaries, as string.
+func (r *msgpackReader) value() (interface{}, error) {
+	b, err := r.next(1)
+	if err != nil {
+		return nil, err
+	}
+	c := b[0]
+	var n uint64
+	switch {
+	case c <= 0x7f:
+		return float64(c), nil
+	case c >= 0xe0:
+		return float64(int8(c)), nil
+	case c&0xe0 == 0xa0:
+		n = uint64(c & 0x1f)
+	case c == 0xc0:
+		return nil, nil
+	case c == 0xc2, c == 0xc3:
+		return c == 0xc3, nil
+	case c == 0xca:
+		v, err := r.uint(4)
+		return float64(math.Float32frombits(uint32(v))), err
+	case c == 0xcb:
+		v, err := r.uint(8)
+		return math.Float64frombits(v), err
+	case c >= 0xcc && c <= 0xcf:
+		v, err := r.uint(1 << (c - 0xcc))
+		return float64(v), err
+	case c >= 0xd0 && c <= 0xd3:
+		size := 1 << (c - 0xd0)
+		v, err := r.uint(size)
+		// Sign extend
+		shift := uint(64 - 8*size)
+		return float64(int64(v<<shift) >> shift), err
+	case c == 0xd9, c == 0xc4:
+		n, err = r.uint(1)
+	case c == 0xda, c == 0xc5:
+		n, err = r.uint(2)
+	case c == 0xdb, c == 0xc6:
+		n, err = r.uint(4)
+	default:
+		return nil, errMsgpack
+	}
+	if err != nil {
+		return nil, err
+	}
+	s, err := r.next(int(n))
+	return string(s), err
+}
+
+// parseBinary parses a batch in the binary format in to Metrics. Like parseTaggedLine,
+// metrics that don't parse are logged and turned in to ERROR Metrics counting the
+// rejection. A batch that can't be decoded any further ends there.
+func (srv *MetricReceiver) parseBinary(addr net.Addr, b []byte, tags []string) []Metric {
+	var metrics []Metric
+	r := &msgpackReader{b[1:]}
+	for len(r.b) > 0 {
+		start := r.b
+		metric, err := r.metric()
+		if traced(addr) {
+			trace(addr, start[:len(start)-len(r.b)], metric, err)
+		}
+		if err == errMsgpack {
+			srv.infof("error parsing binary batch from %s: %s", addr, err)
+			srv.countParseError(addr, err)
+			return append(metrics, rejection(rejectf(RejectBadField, "%s", err)))
+		}
+		if err != nil {
+			srv.infof("error parsing binary metric from %s: %s", addr, err)
+			srv.countParseError(addr, err)
+			metrics = append(metrics, rejection(err))
+			continue
+		}
+		if len(tags) > 0 {
+			metric.Tags = mergeTags(metric.Tags, tags)
+		}
+		srv.debugf("received %s from %s", metric, addr)
+		srv.countMetric(addr)
+		srv.trackSource(addr, metric)
+		metrics = append(metrics, metric)
+	}
+	return metrics
+}
+
+// metric reads a metric in the binary format. It returns errMsgpack if the batch can't be
+// decoded, or a parseError if the metric is invalid, in which case the next one can be read.
+func (r *msgpackReader) metric() (Metric, error) {
+	var metric Metric
+	n, err := r.arrayHeader()
+	if err != nil {
+		return metric, err
+	}
+	fields := make([]interface{}, 7)
+	for i := 0; i < n; i++ {
+		var v interface{}
+		if i == 4 {
+			v, err = r.tags()
+		} else {
+			v, err = r.value()
+		}
+		if err != nil {
+			return metric, err
+		}
+		if i < len(fields) {
+			fields[i] = v
+		}
+	}
+
+	name, _ := fields[0].(string)
+	if name == "" {
+		return metric, rejectf(RejectBadName, "error parsing metric name: missing name")
+	}
+	metric.Bucket = name
+
+	typ, _ := fields[1].(string)
+	switch typ {
+	case "c":
+		metric.Type = COUNTER
+	case "g":
+		metric.Type = GAUGE
+	case "ms":
+		metric.Type = TIMER
+	case "s":
+		metric.Type = SET
+	default:
+		return metric, rejectf(RejectBadType, "invalid metric type: %q", typ)
+	}
+
+	switch v := fields[2].(type) {
+	case float64:
+		if metric.Type == SET {
+			return metric, rejectf(RejectBadValue, "error parsing set member: not a string")
+		}
+		if math.IsNaN(v) || math.IsInf(v, 0) {
+			return metric, rejectf(RejectBadValue, "error converting metric value: not a finite number")
+		}
+		metric.Value = v
+	case string:
+		if metric.Type != SET || v == "" {
+			return metric, rejectf(RejectBadValue, "error converting metric value: %q", v)
+		}
+		metric.Member = v
+	default:
+		return metric, rejectf(RejectBadValue, "error converting metric value: missing value")
+	}
+
+	metric.SampleRate = 1.0
+	if fields[3] != nil {
+		rate, ok := fields[3].(float64)
+		if !ok || !(rate > 0.0 && rate <= 1.0) {
+			return metric, rejectf(RejectBadRate, "error converting metric sample rate, value out of range (0, 1]")
+		}
+		metric.SampleRate = rate
+	}
+
+	if fields[4] != nil {
+		metric.Tags = fields[4].([]string)
+	}
+
+	if fields[5] != nil {
+		ts, ok := fields[5].(float64)
+		if !ok || ts <= 0 || ts != math.Trunc(ts) {
+			return metric, rejectf(RejectBadField, "error converting metric timestamp: %v", fields[5])
+		}
+		metric.Timestamp = int64(ts)
+	}
+
+	if fields[6] != nil {
+		ttl, ok := fields[6].(float64)
+		if !ok || ttl <= 0 || ttl != math.Trunc(ttl) {
+			return metric, rejectf(RejectBadField, "error converting metric TTL: %v", fields[6])
+		}
+		metric.TTL = int64(ttl)
+	}
+	return metric, nil
+}
+
+// tags reads an array of tags, or nil
+func (r *msgpackReader) tags() (interface{}, error) {
+	if len(r.b) > 0 && r.b[0] == 0xc0 {
+		r.b = r.b[1:]
+		return nil, nil
+	}
+	n, err := r.arrayHeader()
+	if err != nil {
+		return nil, err
+	}
+	if n > len(r.b) {
+		return nil, errMsgpack
+	}
+	tags := make([]string, 0, n)
+	for i := 0; i < n; i++ {
+		v, err := r.value()
+		if err != nil {
+			return nil, err
+		}
+		if tag, ok := v.(string); ok && tag != "" {
+			tags = append(tags, tag)
+		}
+	}
+	if len(tags) == 0 {
+		return nil, nil
+	}
+	sort.Strings(tags)
+	return tags, nil
+}
@@ -0,0 +1,98 @@
+package statsd
+
+import (
+	"math"
+	"reflect"
+	"testing"
+)
+
+func TestBinaryRoundTrip(t *testing.T) {
+	tests := map[string]Metric{
+		"counter":   {Bucket: "foo.bar", Value: 2, Type: COUNTER, SampleRate: 1},
+		"gauge":     {Bucket: "foo.gauge", Value: -3.5, Type: GAUGE, SampleRate: 1},
+		"sampled":   {Bucket: "foo.timer", Value: 12, Type: TIMER, SampleRate: 0.25},
+		"set":       {Bucket: "foo.users", Member: "alice", Type: SET, SampleRate: 1},
+		"tagged":    {Bucket: "foo.bar", Value: 1, Type: COUNTER, SampleRate: 1, Tags: []string{"a:1", "b:2"}},
+		"timestamp": {Bucket: "foo.bar", Value: 1, Type: COUNTER, SampleRate: 1, Timestamp: 1500000000},
+		"ttl":       {Bucket: "foo.bar", Value: 1, Type: GAUGE, SampleRate: 1, TTL: 300},
+		"long name": {Bucket: string(make([]byte, 300)), Value: 1, Type: COUNTER, SampleRate: 1},
+	}
+
+	for name, expected := range tests {
+		b := AppendBinary([]byte{BinaryMagic}, expected)
+		if !isBinary(b) {
+			t.Errorf("test %s: batch doesn't start with the magic byte", name)
+			continue
+		}
+		r := &msgpackReader{b[1:]}
+		result, err := r.metric()
+		if err != nil {
+			t.Errorf("test %s error: %s", name, err)
+			continue
+		}
+		if !reflect.DeepEqual(result, expected) {
+			t.Errorf("test %s: expected %s, got %s", name, expected, result)
+		}
+		if len(r.b) != 0 {
+			t.Errorf("test %s: %d bytes left over", name, len(r.b))
+		}
+	}
+}
+
+func TestBinaryMalformed(t *testing.T) {
+	valid := AppendBinary(nil, Metric{Bucket: "foo", Value: 1, Type: COUNTER, SampleRate: 1})
+
+	// Batches that can't be decoded any further
+	undecodable := map[string][]byte{
+		"empty":          {},
+		"not an array":   {0xa3, 'f', 'o', 'o'},
+		"truncated":      valid[:len(valid)-1],
+		"long string":    {0x93, 0xdb, 0xff, 0xff, 0xff, 0xff},
+		"unknown type":   {0x93, 0xc1},
+		"truncated tags": {0x95, 0xa3, 'f', 'o', 'o', 0xa1, 'c', 0x01, 0x01, 0xdd, 0xff, 0xff, 0xff, 0xff},
+	}
+	for name, b := range undecodable {
+		r := &msgpackReader{b}
+		if result, err := r.metric(); err != errMsgpack {
+			t.Errorf("test %s: expected errMsgpack but got %s, %v", name, result, err)
+		}
+	}
+
+	// Metrics that decode but are invalid, after which the batch goes on
+	invalid := map[string]Metric{
+		"no name":      {Value: 1, Type: COUNTER, SampleRate: 1},
+		"bad type":     {Bucket: "foo", Value: 1, Type: ERROR, SampleRate: 1},
+		"not finite":   {Bucket: "foo", Value: math.Inf(1), Type: GAUGE, SampleRate: 1},
+		"bad rate":     {Bucket: "foo", Value: 1, Type: COUNTER, SampleRate: 2},
+		"empty member": {Bucket: "foo", Type: SET, SampleRate: 1},
+		"negative ttl": {Bucket: "foo", Value: 1, Type: GAUGE, SampleRate: 1, TTL: -1},
+	}
+	for name, m := range invalid {
+		r := &msgpackReader{append(AppendBinary(nil, m), valid...)}
+		if result, err := r.metric(); err == nil || err == errMsgpack {
+			t.Errorf("test %s: expected a parse error but got %s, %v", name, result, err)
+			continue
+		}
+		if result, err := r.metric(); err != nil || result.Bucket != "foo" {
+			t.Errorf("test %s: expected the next metric but got %s, %v", name, result, err)
+		}
+	}
+}
+
+func TestParseBinary(t *testing.T) {
+	var srv MetricReceiver
+	b := []byte{BinaryMagic}
+	b = AppendBinary(b, Metric{Bucket: "foo", Value: 1, Type: COUNTER, SampleRate: 1})
+	b = AppendBinary(b, Metric{Bucket: "bar", Value: 1, Type: COUNTER, SampleRate: 2})
+	b = append(b, 0x93, 0xa3) // cut short
+
+	metrics := srv.parseBinary(nil, b, []string{"env:prod"})
+	expected := []Metric{
+		{Bucket: "foo", Value: 1, Type: COUNTER, SampleRate: 1, Tags: []string{"env:prod"}},
+		rejection(rejectf(RejectBadRate, "")),
+		rejection(rejectf(RejectBadField, "")),
+	}
+	if !reflect.DeepEqual(metrics, expected) {
+		t.Errorf("expected %v, got %v", expected, metrics)
+	}
+}
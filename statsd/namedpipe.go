@@ -0,0 +1,24 @@
+package statsd
+
+// DefaultPipeName is the default named pipe on which ListenAndReceivePipe listens
+const DefaultPipeName = `\\.\pipe\gostatsd`
+
+// pipeSecurity is the security descriptor of the named pipes, in SDDL: the local system
+// and administrators have full control and authenticated users may read and write
+const pipeSecurity = "D:P(A;;GA;;;SY)(A;;GA;;;BA)(A;;GRGW;;;AU)"
+
+// ListenAndReceivePipe listens on the Windows named pipe r.Addr, e.g. `\\.\pipe\gostatsd`,
+// and then calls ReceiveTCP to receive newline terminated metrics from each client, the
+// way local processes usually talk to services on Windows. Remote clients are refused.
+// If Addr is blank then DefaultPipeName is used.
+func (r *MetricReceiver) ListenAndReceivePipe() error {
+	addr := r.Addr
+	if addr == "" {
+		addr = DefaultPipeName
+	}
+	l, err := listenPipe(addr)
+	if err != nil {
+		return err
+	}
+	return r.ReceiveTCP(l)
+}
@@ -0,0 +1,14 @@
+//go:build !windows
+// +build !windows
+
+package statsd
+
+import (
+	"errors"
+	"net"
+)
+
+// listenPipe listens on the named pipe name
+func listenPipe(name string) (net.Listener, error) {
+	return nil, errors.New("named pipes are only supported on Windows")
+}
@@ -0,0 +1,15 @@
+//go:build windows
+// +build windows
+
+package statsd
+
+import (
+	"net"
+
+	"github.com/Microsoft/go-winio"
+)
+
+// listenPipe listens on the named pipe name
+func listenPipe(name string) (net.Listener, error) {
+	return winio.ListenPipe(name, &winio.PipeConfig{SecurityDescriptor: pipeSecurity})
+}
@@ -0,0 +1,93 @@
+package statsd
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"time"
+)
+
+// DefaultNewRelicURL is the endpoint of the New Relic Metric API in the US region
+const DefaultNewRelicURL = "https://metric-api.newrelic.com/metric/v1"
+
+// NewRelicClient sends metrics to the New Relic Metric API. Each flushed metric is sent as
+// a gauge, with its tags as attributes.
+type NewRelicClient struct {
+	APIKey     string            // License or insert key
+	URL        string            // DefaultNewRelicURL if blank, e.g. "https://metric-api.eu.newrelic.com/metric/v1"
+	Attributes map[string]string // Attributes common to every metric
+	BatchSize  int               // Metrics per request, 1000 if zero
+}
+
+// newRelicMetric is a metric of a Metric API request
+type newRelicMetric struct {
+	Name       string            `json:"name"`
+	Type       string            `json:"type"`
+	Value      float64           `json:"value"`
+	Timestamp  int64             `json:"timestamp"`
+	Attributes map[string]string `json:"attributes,omitempty"`
+}
+
+// newRelicBatch is the body of a Metric API request
+type newRelicBatch struct {
+	Common struct {
+		Attributes map[string]string `json:"attributes,omitempty"`
+	} `json:"common"`
+	Metrics []newRelicMetric `json:"metrics"`
+}
+
+// SendMetrics sends the metrics in a MetricMap to New Relic
+func (c *NewRelicClient) SendMetrics(metrics MetricMap) error {
+	return c.SendMetricsAt(metrics, time.Now())
+}
+
+// SendMetricsAt sends the metrics in a MetricMap to New Relic with the timestamp t
+func (c *NewRelicClient) SendMetricsAt(metrics MetricMap, t time.Time) error {
+	size := c.BatchSize
+	if size <= 0 {
+		size = 1000
+	}
+	batch := newRelicBatch{}
+	batch.Common.Attributes = c.Attributes
+	for k, v := range finiteMetrics(metrics) {
+		name, tags := SplitKey(k)
+		m := newRelicMetric{Name: name, Type: "gauge", Value: v, Timestamp: t.UnixNano() / int64(time.Millisecond)}
+		if len(tags) > 0 {
+			m.Attributes = make(map[string]string, len(tags))
+			for _, tag := range tags {
+				k, v := splitTag(tag)
+				m.Attributes[k] = v
+			}
+		}
+		batch.Metrics = append(batch.Metrics, m)
+		if len(batch.Metrics) == size {
+			if err := c.post(batch); err != nil {
+				return err
+			}
+			batch.Metrics = nil
+		}
+	}
+	if len(batch.Metrics) > 0 {
+		return c.post(batch)
+	}
+	return nil
+}
+
+// post sends a batch of metrics to the Metric API
+func (c *NewRelicClient) post(batch newRelicBatch) error {
+	body, err := json.Marshal([]newRelicBatch{batch})
+	if err != nil {
+		return err
+	}
+	url := c.URL
+	if url == "" {
+		url = DefaultNewRelicURL
+	}
+	req, err := http.NewRequest("POST", url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Api-Key", c.APIKey)
+	return doRequest(req)
+}
@@ -0,0 +1,57 @@
+package statsd
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+)
+
+func TestNewRelicFormat(t *testing.T) {
+	tests := map[string]string{
+		"stats.gauges.foo":             `[{"common":{"attributes":{"env":"prod"}},"metrics":[{"name":"stats.gauges.foo","type":"gauge","value":1.5,"timestamp":1500000000000}]}]`,
+		"stats.gauges.foo;region:eu":   `[{"common":{"attributes":{"env":"prod"}},"metrics":[{"name":"stats.gauges.foo","type":"gauge","value":1.5,"timestamp":1500000000000,"attributes":{"region":"eu"}}]}]`,
+		"stats.gauges.foo;canary;az:b": `[{"common":{"attributes":{"env":"prod"}},"metrics":[{"name":"stats.gauges.foo","type":"gauge","value":1.5,"timestamp":1500000000000,"attributes":{"az":"b","canary":""}}]}]`,
+	}
+
+	server, requests := captureServer()
+	defer server.Close()
+
+	c := &NewRelicClient{APIKey: "secret", URL: server.URL, Attributes: map[string]string{"env": "prod"}}
+	for key, expected := range tests {
+		if err := c.SendMetricsAt(MetricMap{key: 1.5}, time.Unix(1500000000, 0)); err != nil {
+			t.Errorf("test %s error: %s", key, err)
+			continue
+		}
+		r := <-requests
+		if key := r.Header.Get("Api-Key"); key != "secret" {
+			t.Errorf("expected Api-Key secret, got %s", key)
+		}
+		if string(r.Body) != expected {
+			t.Errorf("test %s: expected %s, got %s", key, expected, r.Body)
+		}
+	}
+}
+
+func TestNewRelicBatches(t *testing.T) {
+	server, requests := captureServer()
+	defer server.Close()
+
+	c := &NewRelicClient{URL: server.URL, BatchSize: 2}
+	metrics := MetricMap{"a": 1, "b": 2, "c": 3, "d": 4, "e": 5}
+	if err := c.SendMetricsAt(metrics, time.Unix(1500000000, 0)); err != nil {
+		t.Fatal(err)
+	}
+	var sizes []int
+	sent := 0
+	for sent < len(metrics) {
+		var batches []newRelicBatch
+		if err := json.Unmarshal((<-requests).Body, &batches); err != nil {
+			t.Fatal(err)
+		}
+		sizes = append(sizes, len(batches[0].Metrics))
+		sent += len(batches[0].Metrics)
+	}
+	if len(sizes) != 3 || sizes[0] != 2 || sizes[1] != 2 || sizes[2] != 1 {
+		t.Errorf("expected batches of 2, 2 and 1 metrics, got %v", sizes)
+	}
+}
@@ -0,0 +1,64 @@
+package statsd
+
+import (
+	"log"
+)
+
+// ReceiverOption configures a MetricReceiver created by NewMetricReceiver
+type ReceiverOption func(*MetricReceiver)
+
+// NewMetricReceiver returns a MetricReceiver listening on addr and passing the metrics it
+// receives to handler, configured by opts. Options can be added without breaking callers,
+// unlike positional arguments; the fields of the receiver remain available as well.
+func NewMetricReceiver(addr string, handler Handler, opts ...ReceiverOption) *MetricReceiver {
+	r := &MetricReceiver{Addr: addr, Handler: handler}
+	for _, opt := range opts {
+		opt(r)
+	}
+	return r
+}
+
+// WithNetwork sets the network of the UDP listeners, "udp4", "udp6" or "udp"
+func WithNetwork(network string) ReceiverOption {
+	return func(r *MetricReceiver) { r.Network = network }
+}
+
+// WithBufferSize sets the size of the buffer datagrams are read in to
+func WithBufferSize(size int) ReceiverOption {
+	return func(r *MetricReceiver) { r.DatagramSize = size }
+}
+
+// WithWorkers sets the number of goroutines reading each UDP socket
+func WithWorkers(n int) ReceiverOption {
+	return func(r *MetricReceiver) { r.Workers = n }
+}
+
+// WithParser sets the Parser of the lines received
+func WithParser(p Parser) ReceiverOption {
+	return func(r *MetricReceiver) { r.Parser = p }
+}
+
+// WithLogger sets the logger the receiver logs to
+func WithLogger(l *log.Logger) ReceiverOption {
+	return func(r *MetricReceiver) { r.Logger = l }
+}
+
+// WithSocketOptions sets the options applied to the UDP sockets
+func WithSocketOptions(o SocketOptions) ReceiverOption {
+	return func(r *MetricReceiver) { r.SocketOptions = o }
+}
+
+// WithEvents sets the handler of the DogStatsD events received
+func WithEvents(h EventHandler) ReceiverOption {
+	return func(r *MetricReceiver) { r.Events = h }
+}
+
+// WithSourceTagger sets the tagger of the metrics of each source
+func WithSourceTagger(t SourceTagger) ReceiverOption {
+	return func(r *MetricReceiver) { r.Tagger = t }
+}
+
+// WithSyncHandlers makes the receiver call the handlers from the reading goroutine
+func WithSyncHandlers() ReceiverOption {
+	return func(r *MetricReceiver) { r.SyncHandlers = true }
+}
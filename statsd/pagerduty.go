@@ -0,0 +1,80 @@
+package statsd
+
+import (
+	"log"
+	"time"
+)
+
+// DefaultPagerDutyURL is the endpoint of the PagerDuty Events API v2
+const DefaultPagerDutyURL = "https://events.pagerduty.com/v2/enqueue"
+
+// PagerDutyClient sends events to the PagerDuty Events API v2. Errors and warnings
+// trigger incidents, deduplicated by the aggregation key of the event if it has one.
+// Successes resolve the incident of their aggregation key; without one they are dropped,
+// as are infos, which aren't worth paging for.
+type PagerDutyClient struct {
+	RoutingKey string // Integration key of the service
+	URL        string // DefaultPagerDutyURL if blank
+}
+
+// pagerDutyEvent is the body of an Events API v2 request
+type pagerDutyEvent struct {
+	RoutingKey  string            `json:"routing_key"`
+	EventAction string            `json:"event_action"` // "trigger" or "resolve"
+	DedupKey    string            `json:"dedup_key,omitempty"`
+	Payload     *pagerDutyPayload `json:"payload,omitempty"`
+}
+
+// pagerDutyPayload describes the incident triggered by a pagerDutyEvent
+type pagerDutyPayload struct {
+	Summary       string            `json:"summary"`
+	Source        string            `json:"source"`
+	Severity      string            `json:"severity"` // "critical", "error", "warning" or "info"
+	Timestamp     string            `json:"timestamp,omitempty"`
+	Class         string            `json:"class,omitempty"`
+	CustomDetails map[string]string `json:"custom_details,omitempty"`
+}
+
+// HandleEvent triggers or resolves an incident for e
+func (c *PagerDutyClient) HandleEvent(e Event) {
+	pe := pagerDutyEvent{RoutingKey: c.RoutingKey, DedupKey: e.AggregationKey}
+	switch e.AlertType {
+	case AlertError, AlertWarning:
+		pe.EventAction = "trigger"
+		source := e.Hostname
+		if source == "" {
+			source = "gostatsd"
+		}
+		pe.Payload = &pagerDutyPayload{
+			Summary:  e.Title,
+			Source:   source,
+			Severity: e.AlertType,
+			Class:    e.SourceType,
+		}
+		if e.Timestamp != 0 {
+			pe.Payload.Timestamp = time.Unix(e.Timestamp, 0).UTC().Format(time.RFC3339)
+		}
+		if e.Text != "" || len(e.Tags) > 0 {
+			pe.Payload.CustomDetails = map[string]string{"text": e.Text}
+			for _, tag := range e.Tags {
+				k, v := splitTag(tag)
+				pe.Payload.CustomDetails["tag."+k] = v
+			}
+		}
+	case AlertSuccess:
+		if e.AggregationKey == "" {
+			return
+		}
+		pe.EventAction = "resolve"
+	default:
+		return
+	}
+
+	url := c.URL
+	if url == "" {
+		url = DefaultPagerDutyURL
+	}
+	if err := postJSON(url, pe, nil); err != nil {
+		log.Printf("error sending event %q to PagerDuty: %s", e.Title, err)
+	}
+}
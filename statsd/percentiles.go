@@ -0,0 +1,49 @@
+package statsd
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// DefaultPercentiles are the percentiles flushed for the timers matching no PercentileSet
+var DefaultPercentiles = []float64{95}
+
+// PercentileSet lists the percentiles flushed for the timers matching Match, e.g. 99.9
+// only for "api.*.latency", as computing many percentiles for every timer wastes CPU.
+// Negative percentiles are taken from the top, like 95 is from the bottom.
+type PercentileSet struct {
+	Match       string    `json:"match"`       // Timer names, * matching a single dot separated component
+	Percentiles []float64 `json:"percentiles"` // Percentiles between -100 and 100, none for no percentile stats
+}
+
+// Validate checks that the set is well formed
+func (p PercentileSet) Validate() error {
+	if p.Match == "" {
+		return fmt.Errorf("percentile set without match")
+	}
+	for _, pct := range p.Percentiles {
+		if pct == 0 || pct < -100 || pct > 100 {
+			return fmt.Errorf("percentile set %q: invalid percentile %g", p.Match, pct)
+		}
+	}
+	return nil
+}
+
+// percentilesFor returns the percentiles of the first set matching the timer key, or
+// DefaultPercentiles
+func percentilesFor(sets []PercentileSet, key string) []float64 {
+	for i := range sets {
+		if matchPattern(sets[i].Match, key) {
+			return sets[i].Percentiles
+		}
+	}
+	return DefaultPercentiles
+}
+
+// percentileName formats pct for the names of the flushed statistics, e.g. "95", "top5"
+// or "99_9"
+func percentileName(pct float64) string {
+	name := strconv.FormatFloat(pct, 'f', -1, 64)
+	return strings.Replace(strings.Replace(name, "-", "top", -1), ".", "_", -1)
+}
@@ -0,0 +1,119 @@
+package statsd
+
+import (
+	"net"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Buckets of the counters of SenderAccounting, tagged with the source
+const (
+	PerSenderPacketsBucket = "statsd.per_sender.packets"
+	PerSenderMetricsBucket = "statsd.per_sender.metrics"
+	PerSenderBytesBucket   = "statsd.per_sender.bytes"
+)
+
+// SenderAccounting counts the packets, metrics and bytes received from each source IP, so
+// traffic spikes can be attributed to the hosts causing them. Every Interval the counts of
+// the TopN sources that sent the most bytes are passed to Handler, tagged "source:<ip>",
+// and those of the other sources summed up as "source:other".
+type SenderAccounting struct {
+	TopN     int           // Sources reported individually, 10 if zero
+	Interval time.Duration // How often the counts are reported, usually the flush interval
+	Handler  Handler
+
+	mu      sync.Mutex
+	senders map[string]*senderCounts
+}
+
+// senderCounts is what a source sent during an interval
+type senderCounts struct {
+	source                 string
+	packets, metrics, size float64
+}
+
+// counts returns the counts of the source of addr. The caller must hold the lock.
+func (s *SenderAccounting) counts(addr net.Addr) *senderCounts {
+	ip := addr.String()
+	if host, _, err := net.SplitHostPort(ip); err == nil {
+		ip = host
+	}
+	if s.senders == nil {
+		s.senders = make(map[string]*senderCounts)
+	}
+	c := s.senders[ip]
+	if c == nil {
+		c = &senderCounts{source: ip}
+		s.senders[ip] = c
+	}
+	return c
+}
+
+// countPacket counts a packet of n bytes received from addr
+func (s *SenderAccounting) countPacket(addr net.Addr, n int) {
+	if addr == nil {
+		return
+	}
+	defer s.mu.Unlock()
+	s.mu.Lock()
+	c := s.counts(addr)
+	c.packets++
+	c.size += float64(n)
+}
+
+// countMetric counts a metric received from addr
+func (s *SenderAccounting) countMetric(addr net.Addr) {
+	if addr == nil {
+		return
+	}
+	defer s.mu.Unlock()
+	s.mu.Lock()
+	s.counts(addr).metrics++
+}
+
+// Run reports the counts every Interval until the program exits
+func (s *SenderAccounting) Run() {
+	runIntervals(s.Interval, s.report, s.Handler)
+}
+
+// report returns the counters of the interval that ended and starts a new one
+func (s *SenderAccounting) report() []Metric {
+	s.mu.Lock()
+	senders := make([]*senderCounts, 0, len(s.senders))
+	for _, c := range s.senders {
+		senders = append(senders, c)
+	}
+	s.senders = nil
+	s.mu.Unlock()
+
+	sort.Slice(senders, func(i, j int) bool {
+		if senders[i].size != senders[j].size {
+			return senders[i].size > senders[j].size
+		}
+		return senders[i].source < senders[j].source
+	})
+	top := s.TopN
+	if top <= 0 {
+		top = 10
+	}
+	if len(senders) > top {
+		other := &senderCounts{source: "other"}
+		for _, c := range senders[top:] {
+			other.packets += c.packets
+			other.metrics += c.metrics
+			other.size += c.size
+		}
+		senders = append(senders[:top], other)
+	}
+
+	var metrics []Metric
+	for _, c := range senders {
+		tags := []string{"source:" + c.source}
+		metrics = append(metrics,
+			Metric{Type: COUNTER, Bucket: PerSenderPacketsBucket, Value: c.packets, SampleRate: 1, Tags: tags},
+			Metric{Type: COUNTER, Bucket: PerSenderMetricsBucket, Value: c.metrics, SampleRate: 1, Tags: tags},
+			Metric{Type: COUNTER, Bucket: PerSenderBytesBucket, Value: c.size, SampleRate: 1, Tags: tags})
+	}
+	return metrics
+}
@@ -0,0 +1,94 @@
+package statsd
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"os/exec"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// PipeClient writes flushed metrics to the standard input of a child process, so backends
+// can be written in any language. Each metric is a line in the Graphite plaintext format,
+// "name value timestamp", with tags appended to the name as ";key=value". The process is
+// started on the first flush and started again on the next one whenever it has exited.
+type PipeClient struct {
+	Command string // Command line of the process, split on white space
+
+	mu    sync.Mutex
+	cmd   *exec.Cmd
+	stdin io.WriteCloser
+	done  chan struct{} // closed once the process has exited
+}
+
+// SendMetrics sends the metrics in a MetricMap to the process
+func (c *PipeClient) SendMetrics(metrics MetricMap) error {
+	return c.SendMetricsAt(metrics, time.Now())
+}
+
+// SendMetricsAt sends the metrics in a MetricMap to the process with the timestamp t
+func (c *PipeClient) SendMetricsAt(metrics MetricMap, t time.Time) error {
+	keys := make([]string, 0, len(metrics))
+	for k := range metrics {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	buf := new(bytes.Buffer)
+	for _, k := range keys {
+		fmt.Fprintf(buf, "%s %f %d\n", graphiteName(k), metrics[k], t.Unix())
+	}
+
+	defer c.mu.Unlock()
+	c.mu.Lock()
+	if err := c.start(); err != nil {
+		return err
+	}
+	if _, err := buf.WriteTo(c.stdin); err != nil {
+		// The process no longer reads its input, have it started again on the next flush
+		c.stdin.Close()
+		c.cmd.Process.Kill()
+		<-c.done
+		return err
+	}
+	return nil
+}
+
+// start starts the process unless it is running. The caller must hold the lock.
+func (c *PipeClient) start() error {
+	if c.done != nil {
+		select {
+		case <-c.done:
+		default:
+			return nil // still running
+		}
+	}
+	args := strings.Fields(c.Command)
+	if len(args) == 0 {
+		return errors.New("pipe: no command")
+	}
+	cmd := exec.Command(args[0], args[1:]...)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return err
+	}
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+	done := make(chan struct{})
+	go func() {
+		if err := cmd.Wait(); err != nil {
+			log.Printf("Pipe backend %q exited: %s", c.Command, err)
+		}
+		close(done)
+	}()
+	c.cmd, c.stdin, c.done = cmd, stdin, done
+	return nil
+}
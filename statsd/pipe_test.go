@@ -0,0 +1,58 @@
+package statsd
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// readEventually returns the content of a file once it is expected, or after a second
+func readEventually(name, expected string) string {
+	var b []byte
+	for i := 0; i < 100; i++ {
+		b, _ = ioutil.ReadFile(name)
+		if string(b) == expected {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	return string(b)
+}
+
+func TestPipeClient(t *testing.T) {
+	dir, err := ioutil.TempDir("", "pipe")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	out := filepath.Join(dir, "out")
+
+	c := &PipeClient{Command: "cp /dev/stdin " + out}
+	metrics := MetricMap{"stats.gauges.foo": 1.5, "stats.gauges.foo;host:a": 2}
+	if err := c.SendMetricsAt(metrics, time.Unix(1500000000, 0)); err != nil {
+		t.Fatal(err)
+	}
+	expected := "stats.gauges.foo 1.500000 1500000000\nstats.gauges.foo;host=a 2.000000 1500000000\n"
+	if result := readEventually(out, expected); result != expected {
+		t.Errorf("expected %q, got %q", expected, result)
+	}
+
+	// The process is started again on the flush after it exits
+	c.stdin.Close()
+	<-c.done
+	if err := c.SendMetricsAt(MetricMap{"stats.gauges.bar": 3}, time.Unix(1500000010, 0)); err != nil {
+		t.Fatal(err)
+	}
+	expected = "stats.gauges.bar 3.000000 1500000010\n"
+	if result := readEventually(out, expected); result != expected {
+		t.Errorf("expected %q after the restart, got %q", expected, result)
+	}
+	c.stdin.Close()
+	<-c.done
+
+	if err := (&PipeClient{}).SendMetrics(metrics); err == nil {
+		t.Errorf("expected error without a command")
+	}
+}
@@ -0,0 +1,34 @@
+package statsd
+
+import (
+	"fmt"
+	"plugin"
+)
+
+// PluginSymbol is the name of the function a backend plugin exports
+const PluginSymbol = "NewSender"
+
+// PluginFactory is the type of the function a backend plugin exports as PluginSymbol. It
+// receives the options of the destination and returns the MetricSender of the backend.
+type PluginFactory func(options map[string]string) (MetricSender, error)
+
+// OpenPluginSender loads the Go plugin at path, built with "go build -buildmode=plugin"
+// against the same version of this package, and returns the MetricSender made by its
+// PluginSymbol function from options
+func OpenPluginSender(path string, options map[string]string) (MetricSender, error) {
+	p, err := plugin.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	sym, err := p.Lookup(PluginSymbol)
+	if err != nil {
+		return nil, err
+	}
+	switch f := sym.(type) {
+	case func(map[string]string) (MetricSender, error):
+		return f(options)
+	case *PluginFactory:
+		return (*f)(options)
+	}
+	return nil, fmt.Errorf("plugin %s: %s is a %T, not a PluginFactory", path, PluginSymbol, sym)
+}
@@ -0,0 +1,101 @@
+package statsd
+
+import (
+	"database/sql"
+	"encoding/json"
+	"sync"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// PostgresSchema creates the table written by a PostgresClient. With TimescaleDB it is
+// also turned in to a hypertable with
+//
+//	SELECT create_hypertable('metrics', 'time');
+const PostgresSchema = `CREATE TABLE IF NOT EXISTS metrics (
+	time  timestamptz      NOT NULL,
+	name  text             NOT NULL,
+	tags  jsonb            NOT NULL DEFAULT '{}',
+	value double precision NOT NULL
+);
+CREATE INDEX IF NOT EXISTS metrics_name_time_idx ON metrics (name, time DESC);`
+
+// PostgresClient inserts metrics in to a PostgreSQL or TimescaleDB table laid out as in
+// PostgresSchema, with one COPY per flush. Tags are stored as a JSON object.
+type PostgresClient struct {
+	DSN   string // Connection string, e.g. "postgres://statsd@localhost/metrics?sslmode=disable"
+	Table string // "metrics" if blank
+
+	mu sync.Mutex
+	db *sql.DB
+}
+
+// SendMetrics sends the metrics in a MetricMap to the database
+func (c *PostgresClient) SendMetrics(metrics MetricMap) error {
+	return c.SendMetricsAt(metrics, time.Now())
+}
+
+// SendMetricsAt sends the metrics in a MetricMap to the database with the timestamp t
+func (c *PostgresClient) SendMetricsAt(metrics MetricMap, t time.Time) error {
+	db, err := c.open()
+	if err != nil {
+		return err
+	}
+	table := c.Table
+	if table == "" {
+		table = "metrics"
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	stmt, err := tx.Prepare(pq.CopyIn(table, "time", "name", "tags", "value"))
+	if err != nil {
+		return err
+	}
+	for k, v := range finiteMetrics(metrics) {
+		name, tags := SplitKey(k)
+		b, err := postgresTags(tags)
+		if err != nil {
+			return err
+		}
+		if _, err := stmt.Exec(t, name, b, v); err != nil {
+			return err
+		}
+	}
+	if _, err := stmt.Exec(); err != nil {
+		return err
+	}
+	if err := stmt.Close(); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// postgresTags encodes tags as the JSON object of the tags column
+func postgresTags(tags []string) (string, error) {
+	m := make(map[string]string, len(tags))
+	for _, tag := range tags {
+		k, v := splitTag(tag)
+		m[k] = v
+	}
+	b, err := json.Marshal(m)
+	return string(b), err
+}
+
+// open returns the connection pool to the database, opening it on first use
+func (c *PostgresClient) open() (*sql.DB, error) {
+	defer c.mu.Unlock()
+	c.mu.Lock()
+	if c.db == nil {
+		db, err := sql.Open("postgres", c.DSN)
+		if err != nil {
+			return nil, err
+		}
+		c.db = db
+	}
+	return c.db, nil
+}
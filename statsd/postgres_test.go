@@ -0,0 +1,26 @@
+package statsd
+
+import (
+	"testing"
+)
+
+func TestPostgresTags(t *testing.T) {
+	tests := map[string]string{
+		"stats.gauges.foo":                  `{}`,
+		"stats.gauges.foo;region:eu":        `{"region":"eu"}`,
+		"stats.gauges.foo;region:eu;canary": `{"canary":"","region":"eu"}`,
+		"stats.gauges.foo;url:http://a":     `{"url":"http://a"}`,
+	}
+
+	for key, expected := range tests {
+		_, tags := SplitKey(key)
+		result, err := postgresTags(tags)
+		if err != nil {
+			t.Errorf("test %s error: %s", key, err)
+			continue
+		}
+		if result != expected {
+			t.Errorf("test %s: expected %s, got %s", key, expected, result)
+		}
+	}
+}
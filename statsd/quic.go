@@ -0,0 +1,117 @@
+package statsd
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"io"
+	"net"
+	"time"
+
+	"github.com/quic-go/quic-go"
+)
+
+// QUICProtocol is the ALPN protocol identifier negotiated by QUIC clients sending metrics
+const QUICProtocol = "statsd"
+
+// ListenAndReceiveQUIC listens for QUIC connections on r.Addr and then calls ReceiveQUIC.
+// Each stream opened by a client carries newline terminated metrics in the usual format,
+// so lost packets are retransmitted without stalling the other clients sharing the port.
+// The server certificate and matching private key are loaded from certFile and keyFile.
+func (r *MetricReceiver) ListenAndReceiveQUIC(certFile, keyFile string) error {
+	l, err := r.listenQUIC(certFile, keyFile)
+	if err != nil {
+		return err
+	}
+	return r.ReceiveQUIC(l)
+}
+
+// listenQUIC listens for QUIC connections on r.Addr with the certificate and key of
+// certFile and keyFile
+func (r *MetricReceiver) listenQUIC(certFile, keyFile string) (*quic.Listener, error) {
+	addr := r.Addr
+	if addr == "" {
+		addr = DefaultMetricsAddr
+	}
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, err
+	}
+	config := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		NextProtos:   []string{QUICProtocol},
+	}
+	return quic.ListenAddr(addr, config, nil)
+}
+
+// ReceiveQUIC accepts incoming connections on l and calls r.Handler.HandleMetric() for each line
+// received on their streams that successfully parses in to a Metric. It returns nil once l
+// is closed.
+func (r *MetricReceiver) ReceiveQUIC(l *quic.Listener) error {
+	defer l.Close()
+	var backoff time.Duration
+	for {
+		c, err := l.Accept(context.Background())
+		if err != nil {
+			if retryRead(err, &backoff, r.logf) {
+				continue
+			}
+			return closedError(err)
+		}
+		backoff = 0
+		go r.receiveQUICConn(c)
+	}
+}
+
+// receiveQUICConn accepts the streams of a single QUIC connection until it is closed
+func (r *MetricReceiver) receiveQUICConn(c *quic.Conn) {
+	for {
+		s, err := c.AcceptStream(context.Background())
+		if err != nil {
+			return
+		}
+		go r.receiveStream(c.RemoteAddr(), s)
+	}
+}
+
+// receiveStream reads newline terminated metrics from s until it is closed, pausing while r.Queue is full
+func (r *MetricReceiver) receiveStream(addr net.Addr, s io.Reader) {
+	buf := bufio.NewReader(s)
+	for {
+		r.waitQueue()
+		line, err := r.readLine(buf)
+		if len(line) > 0 {
+			r.countPacket(addr, len(line))
+		}
+		if err == io.EOF {
+			if len(line) > 0 && !r.StrictFraming {
+				r.handleLine(addr, line)
+			}
+			return
+		}
+		if err != nil {
+			r.logf("error reading stream from %s: %s", addr, err)
+			return
+		}
+		r.handleLine(addr, line[:len(line)-1])
+	}
+}
+
+// readLine reads a line from buf including its newline. Beyond the MaxLineLength the rest
+// of the line is skipped, so a client can't make the receiver buffer an endless line.
+func (r *MetricReceiver) readLine(buf *bufio.Reader) ([]byte, error) {
+	max := r.maxLineLength()
+	var line []byte
+	for {
+		chunk, err := buf.ReadSlice('\n')
+		if len(line) <= max {
+			line = append(line, chunk...)
+		}
+		if err != bufio.ErrBufferFull {
+			if err == nil && len(line) > 0 && line[len(line)-1] != '\n' {
+				line = append(line, '\n') // the skipped part of the line ended with one
+			}
+			return line, err
+		}
+	}
+}
@@ -0,0 +1,157 @@
+package statsd
+
+import (
+	"math/rand"
+	"strings"
+	"sync"
+	"time"
+)
+
+// QuotaExceededBucket is the internal counter of the metrics dropped or sampled away by
+// quotas, tagged with the prefix of the quota
+const QuotaExceededBucket = "statsd.quota_exceeded"
+
+// Policies applied to the metrics exceeding a Quota's MaxRate
+const (
+	QuotaDrop   = "drop"   // Drop the excess metrics
+	QuotaSample = "sample" // Sample counters and timers down to MaxRate and compensate the sample rate
+)
+
+// Quota limits the metrics of the buckets starting with Prefix
+type Quota struct {
+	Prefix     string  `json:"prefix"`
+	MaxRate    float64 `json:"max_rate"`     // Metrics per second across the prefix, unlimited if zero
+	MaxTagSets int     `json:"max_tag_sets"` // Tag combinations per bucket and interval, unlimited if zero
+	Policy     string  `json:"policy"`       // QuotaDrop, the default, or QuotaSample
+}
+
+// quotaState tracks the usage of a Quota
+type quotaState struct {
+	Quota
+	second    int64   // the second being rate limited
+	count     float64 // metrics seen in that second
+	lastCount float64 // metrics seen in the second before
+	tagSets   map[string]map[string]bool
+	exceeded  float64
+}
+
+// QuotaHandler is a Handler that enforces Quotas on the metrics before passing them on to
+// Handler. Each metric is subject to the quota with the longest matching prefix. While Run
+// is running, the number of metrics dropped in each interval is counted in
+// QuotaExceededBucket.
+type QuotaHandler struct {
+	Quotas   []Quota
+	Interval time.Duration // Period over which MaxTagSets applies, usually the flush interval
+	Handler  Handler
+
+	mu    sync.Mutex
+	state []*quotaState
+}
+
+// HandleMetric applies the quota matching m and passes it on if it is within the quota
+func (h *QuotaHandler) HandleMetric(m Metric) {
+	h.handle(m, h.Handler.HandleMetric)
+}
+
+// HandleMetrics applies the quotas to the metrics of a datagram and passes those within
+// them on at once
+func (h *QuotaHandler) HandleMetrics(ms []Metric) {
+	batchMetrics(ms, h.Handler, h.handle)
+}
+
+// handle applies the quota matching m and emits it if it is within the quota
+func (h *QuotaHandler) handle(m Metric, emit func(Metric)) {
+	now := time.Now()
+	h.mu.Lock()
+	q := h.quota(m.Bucket)
+	ok := q == nil || h.admit(q, &m, now)
+	h.mu.Unlock()
+
+	if ok {
+		emit(m)
+	}
+}
+
+// Run starts a new interval every Interval until the program exits
+func (h *QuotaHandler) Run() {
+	runIntervals(h.Interval, h.endInterval, h.Handler)
+}
+
+// quota returns the quota with the longest prefix of bucket. The caller must hold the lock.
+func (h *QuotaHandler) quota(bucket string) *quotaState {
+	if h.state == nil {
+		for _, q := range h.Quotas {
+			h.state = append(h.state, &quotaState{Quota: q, tagSets: make(map[string]map[string]bool)})
+		}
+	}
+	var match *quotaState
+	for _, q := range h.state {
+		if strings.HasPrefix(bucket, q.Prefix) && (match == nil || len(q.Prefix) > len(match.Prefix)) {
+			match = q
+		}
+	}
+	return match
+}
+
+// endInterval starts a new interval and returns the counters of the metrics exceeding each
+// quota during the one that ended
+func (h *QuotaHandler) endInterval() []Metric {
+	defer h.mu.Unlock()
+	h.mu.Lock()
+
+	var exceeded []Metric
+	for _, q := range h.state {
+		if q.exceeded > 0 {
+			exceeded = append(exceeded, Metric{Type: COUNTER, Bucket: QuotaExceededBucket, Value: q.exceeded, SampleRate: 1, Tags: []string{"prefix:" + q.Prefix}})
+		}
+		q.exceeded = 0
+		q.tagSets = make(map[string]map[string]bool)
+	}
+	return exceeded
+}
+
+// admit applies q to m, possibly adjusting its sample rate. The caller must hold the lock.
+func (h *QuotaHandler) admit(q *quotaState, m *Metric, now time.Time) bool {
+	if q.MaxTagSets > 0 && len(m.Tags) > 0 {
+		key := m.Key()
+		sets := q.tagSets[m.Bucket]
+		if sets == nil {
+			sets = make(map[string]bool)
+			q.tagSets[m.Bucket] = sets
+		}
+		if !sets[key] {
+			if len(sets) >= q.MaxTagSets {
+				q.exceeded++
+				return false
+			}
+			sets[key] = true
+		}
+	}
+
+	if q.MaxRate > 0 {
+		if sec := now.Unix(); sec != q.second {
+			if sec == q.second+1 {
+				q.lastCount = q.count
+			} else {
+				q.lastCount = 0
+			}
+			q.second, q.count = sec, 0
+		}
+		q.count++
+		if q.count <= q.MaxRate {
+			return true
+		}
+		// Sample the excess at the rate that would have kept the previous second within the quota
+		sampleable := m.Type == COUNTER || m.Type == TIMER
+		if q.Policy == QuotaSample && sampleable && q.lastCount > q.MaxRate {
+			rate := q.MaxRate / q.lastCount
+			if rand.Float64() < rate {
+				m.SampleRate *= rate
+				return true
+			}
+		}
+		q.exceeded++
+		return false
+	}
+	return true
+}
@@ -2,11 +2,16 @@ package statsd
 
 import (
 	"bytes"
+	"errors"
 	"fmt"
-	"io"
 	"log"
+	"math"
 	"net"
+	"sort"
 	"strconv"
+	"strings"
+	"sync"
+	"time"
 )
 
 // DefaultMetricsAddr is the default address on which a MetricReceiver will listen
@@ -27,129 +32,562 @@ func (f HandlerFunc) HandleMetric(m Metric) {
 	f(m)
 }
 
+// BatchHandler is implemented by Handlers that can handle several metrics at once. The
+// receivers pass them all the metrics of a datagram together instead of one at a time.
+// HandleMetrics takes ownership of ms and may give it back with ReleaseMetrics once done.
+type BatchHandler interface {
+	Handler
+	HandleMetrics(ms []Metric)
+}
+
+// metricSlices pools the slices the metrics of datagrams are parsed in to
+var metricSlices = sync.Pool{
+	New: func() interface{} {
+		ms := make([]Metric, 0, 16)
+		return &ms
+	},
+}
+
+// getMetrics returns an empty slice from the pool
+func getMetrics() []Metric {
+	return (*metricSlices.Get().(*[]Metric))[:0]
+}
+
+// ReleaseMetrics returns a slice received by a BatchHandler to the pool it came from. It
+// must not be used afterwards.
+func ReleaseMetrics(ms []Metric) {
+	for i := range ms {
+		ms[i] = Metric{}
+	}
+	ms = ms[:0]
+	metricSlices.Put(&ms)
+}
+
+// handleMetrics passes ms on to h, all at once if it is a BatchHandler
+func handleMetrics(h Handler, ms []Metric) {
+	if bh, ok := h.(BatchHandler); ok && len(ms) > 0 {
+		bh.HandleMetrics(ms)
+		return
+	}
+	for _, m := range ms {
+		h.HandleMetric(m)
+	}
+	ReleaseMetrics(ms)
+}
+
+// batchMetrics passes each metric of ms to handle, which emits those to pass on, and
+// passes them on to h at once. It lets the Handlers wrapping another be BatchHandlers.
+func batchMetrics(ms []Metric, h Handler, handle func(m Metric, emit func(Metric))) {
+	out := getMetrics()
+	emit := func(m Metric) {
+		out = append(out, m)
+	}
+	for _, m := range ms {
+		handle(m, emit)
+	}
+	ReleaseMetrics(ms)
+	handleMetrics(h, out)
+}
+
 // MetricReceiver receives data on its listening port and converts lines in to Metrics.
 // For each Metric it calls r.Handler.HandleMetric()
 type MetricReceiver struct {
-	Addr    string  // UDP address on which to listen for metrics
+	Addr    string  // UDP address on which to listen for metrics, several may be separated by commas
+	Network string  // "udp4", "udp6" or "udp" for dual-stack. If blank then "udp" is used
 	Handler Handler // handler to invoke
+
+	// MulticastInterface is the name of the network interface used to join multicast
+	// group addresses in Addr. If blank then the system default interface is used.
+	MulticastInterface string
+
+	// SocketOptions are applied to each listening socket. The values in effect are logged
+	// once the socket is open.
+	SocketOptions SocketOptions
+
+	// KernelStatsInterval is how often the kernel drop counters of the listening sockets are
+	// reported to the Handler as internal metrics. If zero they are not monitored.
+	KernelStatsInterval time.Duration
+
+	// Tokens, if set, are the tokens accepted by the HTTP receiver along with the tags
+	// added to the metrics received with each of them, e.g. "team:payments".
+	Tokens map[string][]string
+
+	// Queue, if set, is the queue fed by the Handler. While it is full the stream transports
+	// stop reading and the HTTP receiver turns requests away, so clients slow down.
+	Queue chan Metric
+
+	// StrictFraming makes the stream transports drop a last line that isn't terminated by
+	// a newline when the stream ends, in case it was cut short. Datagrams always end a line.
+	StrictFraming bool
+
+	// MaxLineLength is the length in bytes of the longest line accepted, or if not set
+	// DefaultMaxLineLength. Longer lines are rejected, or with TruncateLongLines cut after
+	// their last tag or field that fits.
+	MaxLineLength     int
+	TruncateLongLines bool
+
+	// Events, if set, handles the DogStatsD events received. Otherwise they are dropped.
+	Events EventHandler
+
+	// SyncHandlers makes the receiver call the handlers from the goroutine reading the
+	// metrics instead of a goroutine of their own, saving their cost and keeping metrics in
+	// the order they were sent. A slow handler then holds up the reads.
+	SyncHandlers bool
+
+	// DatagramSize is the size of the buffer datagrams are read in to, 1024 if zero. Longer
+	// datagrams are cut short.
+	DatagramSize int
+
+	// Workers is the number of goroutines reading each UDP socket, 1 if zero
+	Workers int
+
+	// Parser parses the lines received, DefaultParser if nil
+	Parser Parser
+
+	// Logger, if set, is where the receiver logs instead of the standard logger
+	Logger *log.Logger
+
+	// Tagger, if set, returns tags added to the metrics of each source, e.g. those of the
+	// container sending them. The metrics' own tags with the same keys are replaced.
+	Tagger SourceTagger
+
+	// Mirror, if set, is sent a copy of each datagram received
+	Mirror *Mirror
+
+	// Watchdog, if set, rejects datagrams while the server is under extreme pressure
+	Watchdog *Watchdog
+
+	// Sources, if set, tracks the source addresses of the metrics received
+	Sources *SourceTracker
+
+	// PerSender, if set, counts the packets, metrics and bytes received from each source
+	PerSender *SenderAccounting
+
+	counters receiverCounters
 }
 
-// ListenAndReceive listens on the UDP network address of srv.Addr and then calls
-// Receive to handle the incoming datagrams. If Addr is blank then DefaultMetricsAddr is used.
-func (r *MetricReceiver) ListenAndReceive() error {
-	addr := r.Addr
-	if addr == "" {
-		addr = DefaultMetricsAddr
+// SourceTagger returns the tags of the metrics received from a source address
+type SourceTagger interface {
+	SourceTags(addr net.Addr) []string
+}
+
+// sourceTags returns the tags of the metrics received from addr, merged with tags
+func (r *MetricReceiver) sourceTags(addr net.Addr, tags []string) []string {
+	if r.Tagger == nil {
+		return tags
+	}
+	source := r.Tagger.SourceTags(addr)
+	if len(source) == 0 {
+		return tags
+	}
+	if len(tags) == 0 {
+		return source
+	}
+	return mergeTags(source, tags)
+}
+
+// datagramSize returns the size of the buffer datagrams are read in to
+func (r *MetricReceiver) datagramSize() int {
+	if r.DatagramSize <= 0 {
+		return 1024
+	}
+	return r.DatagramSize
+}
+
+// parser returns the Parser of the receiver
+func (r *MetricReceiver) parser() Parser {
+	if r.Parser == nil {
+		return DefaultParser
 	}
-	c, err := net.ListenPacket("udp", addr)
+	return r.Parser
+}
+
+// logf logs a message to the Logger of the receiver
+func (r *MetricReceiver) logf(format string, v ...interface{}) {
+	if r.Logger != nil {
+		r.Logger.Printf(format, v...)
+	} else {
+		log.Printf(format, v...)
+	}
+}
+
+// debugf logs a message to the Logger of the receiver if the log level is LogDebug
+func (r *MetricReceiver) debugf(format string, v ...interface{}) {
+	if GetLogLevel() <= LogDebug {
+		r.logf(format, v...)
+	}
+}
+
+// infof logs a message to the Logger of the receiver if the log level is LogInfo or lower
+func (r *MetricReceiver) infof(format string, v ...interface{}) {
+	if GetLogLevel() <= LogInfo {
+		r.logf(format, v...)
+	}
+}
+
+// network returns the network the receiver listens on
+func (r *MetricReceiver) network() string {
+	if r.Network == "" {
+		return "udp"
+	}
+	return r.Network
+}
+
+// addrs returns the list of addresses the receiver listens on
+func (r *MetricReceiver) addrs() []string {
+	if r.Addr == "" {
+		return []string{DefaultMetricsAddr}
+	}
+	var addrs []string
+	for _, addr := range strings.Split(r.Addr, ",") {
+		if addr = strings.TrimSpace(addr); addr != "" {
+			addrs = append(addrs, addr)
+		}
+	}
+	return addrs
+}
+
+// listen opens a packet connection on addr with the receiver's socket options applied
+func (r *MetricReceiver) listen(addr string) (*net.UDPConn, error) {
+	c, err := r.listenUDP(addr)
+	if err != nil {
+		return nil, err
+	}
+	opts, err := r.SocketOptions.apply(c)
+	if err != nil {
+		if r.SocketOptions != (SocketOptions{}) {
+			c.Close()
+			return nil, err
+		}
+		return c, nil
+	}
+	r.infof("listening on %s with SO_RCVBUF=%d SO_BUSY_POLL=%d IP_TOS=%d",
+		c.LocalAddr(), opts.ReadBuffer, opts.BusyPoll, opts.TOS)
+	return c, nil
+}
+
+// listenUDP opens a UDP socket on addr, joining the group if addr is a multicast address
+func (r *MetricReceiver) listenUDP(addr string) (*net.UDPConn, error) {
+	udpAddr, err := net.ResolveUDPAddr(r.network(), addr)
 	if err != nil {
-		return err
+		return nil, err
+	}
+	if !udpAddr.IP.IsMulticast() {
+		return net.ListenUDP(r.network(), udpAddr)
+	}
+	var ifi *net.Interface
+	if r.MulticastInterface != "" {
+		ifi, err = net.InterfaceByName(r.MulticastInterface)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return net.ListenMulticastUDP(r.network(), ifi, udpAddr)
+}
+
+// ListenAndReceive listens on the UDP network addresses of srv.Addr and then calls
+// Receive to handle the incoming datagrams on each of them. If Addr is blank then
+// DefaultMetricsAddr is used. Link-local IPv6 addresses take their zone the usual way,
+// e.g. "[fe80::1%eth0]:8125", and multicast addresses join the group on MulticastInterface.
+// Once receiving on one of the addresses ends, the others are closed and its error returned.
+func (r *MetricReceiver) ListenAndReceive() error {
+	var conns []*net.UDPConn
+	for _, addr := range r.addrs() {
+		c, err := r.listen(addr)
+		if err != nil {
+			for _, c := range conns {
+				c.Close()
+			}
+			return err
+		}
+		conns = append(conns, c)
 	}
-	return r.Receive(c)
+	if r.KernelStatsInterval > 0 {
+		done := make(chan struct{})
+		defer close(done)
+		go r.monitorKernelStats(conns, done)
+	}
+	workers := r.Workers
+	if workers < 1 {
+		workers = 1
+	}
+	errc := make(chan error, len(conns)*workers)
+	for _, c := range conns {
+		for i := 0; i < workers; i++ {
+			go func(c net.PacketConn) {
+				errc <- r.Receive(c)
+			}(c)
+		}
+	}
+	err := <-errc
+	for _, c := range conns {
+		c.Close()
+	}
+	return err
 }
 
 // Receive accepts incoming datagrams on c and calls r.Handler.HandleMetric() for each line in the
-// datagram that successfully parses in to a Metric
+// datagram that successfully parses in to a Metric. It returns nil once c is closed, and the
+// error if reading fails for good; temporary errors are retried.
 func (r *MetricReceiver) Receive(c net.PacketConn) error {
 	defer c.Close()
 
-	msg := make([]byte, 1024)
+	msg := make([]byte, r.datagramSize())
+	var backoff time.Duration
 	for {
 		nbytes, addr, err := c.ReadFrom(msg)
 		if err != nil {
-			log.Printf("%s", err)
-			continue
+			if retryRead(err, &backoff, r.logf) {
+				continue
+			}
+			return closedError(err)
 		}
-		buf := make([]byte, nbytes)
-		copy(buf, msg[:nbytes])
-		go r.handleMessage(addr, buf)
+		backoff = 0
+		r.dispatchMessage(addr, msg[:nbytes])
+	}
+}
+
+// dispatchMessage handles a datagram read in to a buffer that is about to be reused, in a
+// goroutine of its own unless SyncHandlers is set
+func (r *MetricReceiver) dispatchMessage(addr net.Addr, msg []byte) {
+	r.countPacket(addr, len(msg))
+	if r.Mirror != nil {
+		r.Mirror.Send(msg)
+	}
+	if r.Watchdog != nil && r.Watchdog.Rejecting() {
+		return
 	}
-	panic("not reached")
+	if r.SyncHandlers {
+		r.handleMessage(addr, msg)
+		return
+	}
+	buf := make([]byte, len(msg))
+	copy(buf, msg)
+	go r.handleMessage(addr, buf)
+}
+
+// dispatch passes m to the Handler, in a goroutine of its own unless SyncHandlers is set
+func (srv *MetricReceiver) dispatch(m Metric) {
+	if srv.SyncHandlers {
+		srv.Handler.HandleMetric(m)
+		return
+	}
+	go srv.Handler.HandleMetric(m)
+}
+
+// retryRead reports whether a read or accept loop should carry on after err. Temporary
+// errors are logged with logf and retried after *backoff, which doubles up to a second;
+// the loop resets it after a successful read. Closing the connection and other errors
+// are final.
+func retryRead(err error, backoff *time.Duration, logf func(string, ...interface{})) bool {
+	if errors.Is(err, net.ErrClosed) {
+		return false
+	}
+	ne, ok := err.(net.Error)
+	if !ok || !(ne.Temporary() || ne.Timeout()) {
+		return false
+	}
+	switch {
+	case *backoff == 0:
+		*backoff = 5 * time.Millisecond
+	case *backoff < time.Second:
+		*backoff *= 2
+	}
+	if *backoff > time.Second {
+		*backoff = time.Second
+	}
+	logf("%s, retrying in %s", err, *backoff)
+	time.Sleep(*backoff)
+	return true
+}
+
+// closedError returns the error a read loop ends with: nil if the connection was closed,
+// otherwise err
+func closedError(err error) error {
+	if errors.Is(err, net.ErrClosed) {
+		return nil
+	}
+	return err
 }
 
-// handleMessage handles the contents of a datagram and attempts to parse a Metric from each line
+// handleMessage handles the contents of a datagram and attempts to parse a Metric from each line.
+// The metrics are parsed in to a pooled slice and passed to the Handler from the calling
+// goroutine, all at once if it is a BatchHandler.
 func (srv *MetricReceiver) handleMessage(addr net.Addr, msg []byte) {
-	buf := bytes.NewBuffer(msg)
-	for {
-		line, err := buf.ReadBytes('\n')
-		// log.Println("handle msg", string(line), msg, err)
-		if err == io.EOF {
-			break
+	metrics := getMetrics()
+	tags := srv.sourceTags(addr, nil)
+	if isBinary(msg) {
+		metrics = append(metrics, srv.parseBinary(addr, msg, tags)...)
+		msg = nil
+	} else if isJSON(msg) {
+		metrics = append(metrics, srv.parseJSON(addr, msg, tags)...)
+		msg = nil
+	}
+	for len(msg) > 0 {
+		// A datagram is complete, so its last line needn't end with a newline
+		line := msg
+		if eol := bytes.IndexByte(msg, '\n'); eol >= 0 {
+			line, msg = msg[:eol], msg[eol+1:]
+		} else {
+			msg = nil
 		}
-		if err != nil {
-			log.Printf("error reading message from %s: %s", addr, err)
-			return
+		if metric, ok := srv.parseTaggedLine(addr, line, tags); ok {
+			metrics = append(metrics, metric)
 		}
+	}
+	handleMetrics(srv.Handler, metrics)
+}
 
-		// print msg counter
-		// msgCounter += 1
-		// fmt.Println("msg #", msgCounter)
+// handleLine parses a single line, without its trailing newline, and passes the Metric to the Handler
+func (srv *MetricReceiver) handleLine(addr net.Addr, line []byte) {
+	srv.handleTaggedLine(addr, line, srv.sourceTags(addr, nil))
+}
 
-		lineLength := len(line)
-		// Only process lines with more than one character
-		if lineLength > 1 {
-			metric, err := parseLine(line[:lineLength-1])
-			if err != nil {
-				log.Println("error parsing line %q from %s: %s", line, addr, err)
-				continue
-			}
-			go srv.Handler.HandleMetric(metric)
+// handleTaggedLine acts like handleLine and adds tags to the Metric, replacing any of its
+// own tags with the same keys. A line holding JSON may carry several metrics.
+func (srv *MetricReceiver) handleTaggedLine(addr net.Addr, line []byte, tags []string) {
+	if isJSON(line) {
+		for _, metric := range srv.parseJSON(addr, line, tags) {
+			srv.dispatch(metric)
 		}
+		return
+	}
+	if metric, ok := srv.parseTaggedLine(addr, line, tags); ok {
+		srv.dispatch(metric)
 	}
 }
 
-func parseLine(line []byte) (Metric, error) {
-	var metric Metric
+// DefaultMaxLineLength is the length of the longest line accepted by a MetricReceiver
+// without a MaxLineLength, as large as a datagram can be
+const DefaultMaxLineLength = 65535
 
-	buf := bytes.NewBuffer(line)
-	bucket, err := buf.ReadBytes(':')
-	if err != nil {
-		return metric, fmt.Errorf("error parsing metric name: %s", err)
+// maxLineLength returns the length of the longest line accepted
+func (srv *MetricReceiver) maxLineLength() int {
+	if srv.MaxLineLength <= 0 {
+		return DefaultMaxLineLength
 	}
-	metric.Bucket = string(bucket[:len(bucket)-1])
+	return srv.MaxLineLength
+}
 
-	value, err := buf.ReadBytes('|')
-	if err != nil {
-		return metric, fmt.Errorf("error parsing metric value: %s", err)
+// limitLength applies the MaxLineLength to line
+func (srv *MetricReceiver) limitLength(line []byte) ([]byte, error) {
+	max := srv.maxLineLength()
+	if len(line) <= max {
+		return line, nil
+	}
+	if srv.TruncateLongLines {
+		// Cut at a tag or field separator so what remains is a shorter but valid line
+		if i := bytes.LastIndexAny(line[:max+1], ",|"); i > 0 {
+			return line[:i], nil
+		}
+	}
+	return line, rejectf(RejectTooLong, "line longer than %d bytes", max)
+}
+
+// parseTaggedLine parses a line and adds tags to the Metric, reporting whether there is a
+// Metric to handle. Lines that don't parse are logged and turned in to an ERROR Metric
+// counting the rejection.
+func (srv *MetricReceiver) parseTaggedLine(addr net.Addr, line []byte, tags []string) (Metric, bool) {
+	// Only process non-empty lines
+	if len(line) == 0 {
+		return Metric{}, false
+	}
+	if isEvent(line) {
+		return srv.parseEventLine(addr, line, tags)
+	}
+	if isServiceCheck(line) {
+		return srv.parseServiceCheckLine(addr, line, tags)
+	}
+	var metric Metric
+	var err error
+	if line, err = srv.limitLength(line); err == nil {
+		metric, err = srv.parser().ParseLine(line)
+	}
+	if traced(addr) {
+		trace(addr, line, metric, err)
 	}
-	metric.Value, err = strconv.ParseFloat(string(value[:len(value)-1]), 64)
 	if err != nil {
-		return metric, fmt.Errorf("error converting metric value: %s", err)
+		if len(line) > 256 {
+			line = line[:256]
+		}
+		srv.infof("error parsing line %q from %s: %s", line, addr, err)
+		srv.countParseError(addr, err)
+		return rejection(err), true
 	}
+	if len(tags) > 0 {
+		metric.Tags = mergeTags(metric.Tags, tags)
+	}
+	srv.countMetric(addr)
+	srv.trackSource(addr, metric)
+	srv.debugf("received %s from %s", metric, addr)
+	return metric, true
+}
+
+// RejectedLinesBucket counts the lines that don't parse, tagged with the reason they were
+// rejected for. The receivers pass them on as ERROR metrics, which the aggregator counts
+// as bad lines and flushes as counters.
+const RejectedLinesBucket = "statsd.rejected_lines"
 
-	typ, err := buf.ReadBytes('|')
-	if err != nil && err != io.EOF {
-		return metric, fmt.Errorf("error parsing metric type: %s", err)
+// Reasons lines are rejected for
+const (
+	RejectBadName  = "bad_name"  // No name separator
+	RejectBadValue = "bad_value" // Missing or invalid value
+	RejectBadType  = "bad_type"  // Unknown metric type
+	RejectBadRate  = "bad_rate"  // Invalid or out of range sample rate
+	RejectBadField = "bad_field" // Field that isn't a sample rate or tags
+	RejectTooLong  = "too_long"  // Longer than the MaxLineLength of the receiver
+	RejectBadEvent = "bad_event" // Malformed DogStatsD event
+)
+
+// parseError is an error parsing a line along with the reason it was rejected for
+type parseError struct {
+	reason string
+	msg    string
+}
+
+func (e *parseError) Error() string { return e.msg }
+
+// rejectf returns a parseError with a formatted message
+func rejectf(reason, format string, args ...interface{}) error {
+	return &parseError{reason, fmt.Sprintf(format, args...)}
+}
+
+// rejection returns the ERROR Metric counting a line rejected with err
+func rejection(err error) Metric {
+	reason := RejectBadField
+	if pe, ok := err.(*parseError); ok {
+		reason = pe.reason
 	}
-	metricType := ""
-	if typ[len(typ)-1] == '|' {
-		metricType = string(typ[:len(typ)-1])
-	} else {
-		metricType = string(typ)
+	return Metric{Type: ERROR, Bucket: RejectedLinesBucket, Value: 1, SampleRate: 1, Tags: []string{"reason:" + reason}}
+}
+
+// parseLine parses a line in to a Metric. It works on indices of line so the only
+// allocations in the common case are the bucket name and the tags.
+func parseLine(line []byte) (Metric, error) {
+	var metric Metric
+	var err error
+
+	colon := bytes.IndexByte(line, ':')
+	if colon < 0 {
+		return metric, rejectf(RejectBadName, "error parsing metric name: no ':' separator")
 	}
+	metric.Bucket = string(line[:colon])
+	rest := line[colon+1:]
 
-	sampleRate := buf.Bytes()
-	if err != nil && err != io.EOF {
-		return metric, fmt.Errorf("error parsing metric sample rate: %s", err)
+	pipe := bytes.IndexByte(rest, '|')
+	if pipe < 0 {
+		return metric, rejectf(RejectBadValue, "error parsing metric value: no '|' separator")
 	}
+	value := rest[:pipe]
+	rest = rest[pipe+1:]
 
-	if len(sampleRate) == 0 {
-		metric.SampleRate = 1.0
+	metricType := rest
+	if pipe = bytes.IndexByte(rest, '|'); pipe >= 0 {
+		metricType, rest = rest[:pipe], rest[pipe+1:]
 	} else {
-		if sampleRate[0] != '@' {
-			return metric, fmt.Errorf("error parsing metric sample rate, no prefix @")
-		} else {
-			metric.SampleRate, err = strconv.ParseFloat(string(sampleRate[1:len(sampleRate)]), 64)
-			if err != nil {
-				return metric, fmt.Errorf("error converting metric sample rate: %s", err)
-			}
-			if metric.SampleRate > 1.0 || metric.SampleRate <= 0.0 {
-				return metric, fmt.Errorf("error converting metric sample rate, value out of range (0, 1]")
-			}
-		}
+		rest = nil
 	}
-
-	switch string(metricType[:len(metricType)]) {
+	switch string(metricType) {
 	case "ms":
 		// Timer
 		metric.Type = TIMER
@@ -158,10 +596,127 @@ func parseLine(line []byte) (Metric, error) {
 		metric.Type = GAUGE
 	case "c":
 		metric.Type = COUNTER
+	case "s":
+		metric.Type = SET
 	default:
-		err = fmt.Errorf("invalid metric type: %q", metricType)
+		err = rejectf(RejectBadType, "invalid metric type: %q", metricType)
 		return metric, err
 	}
 
+	if metric.Type == SET {
+		if len(value) == 0 {
+			return metric, rejectf(RejectBadValue, "error parsing set member: empty member")
+		}
+		metric.Member = string(value)
+	} else {
+		metric.Value, err = parseFloat(value)
+		if err != nil {
+			return metric, rejectf(RejectBadValue, "error converting metric value: %s", err)
+		}
+		if math.IsNaN(metric.Value) || math.IsInf(metric.Value, 0) {
+			return metric, rejectf(RejectBadValue, "error converting metric value: not a finite number")
+		}
+	}
+
+	// The optional sample rate, DogStatsD style tags, timestamp and TTL follow in any order
+	metric.SampleRate = 1.0
+	for len(rest) > 0 {
+		section := rest
+		if pipe = bytes.IndexByte(rest, '|'); pipe >= 0 {
+			section, rest = rest[:pipe], rest[pipe+1:]
+		} else {
+			rest = nil
+		}
+		switch {
+		case len(section) == 0:
+			continue
+		case section[0] == '@':
+			metric.SampleRate, err = parseFloat(section[1:])
+			if err != nil {
+				return metric, rejectf(RejectBadRate, "error converting metric sample rate: %s", err)
+			}
+			if !(metric.SampleRate > 0.0 && metric.SampleRate <= 1.0) {
+				return metric, rejectf(RejectBadRate, "error converting metric sample rate, value out of range (0, 1]")
+			}
+		case section[0] == '#':
+			metric.Tags = parseTags(section[1:])
+		case section[0] == 'T':
+			metric.Timestamp, err = strconv.ParseInt(string(section[1:]), 10, 64)
+			if err != nil || metric.Timestamp <= 0 {
+				return metric, rejectf(RejectBadField, "error converting metric timestamp: %q", section[1:])
+			}
+		case bytes.HasPrefix(section, []byte("ttl:")):
+			metric.TTL, err = strconv.ParseInt(string(section[4:]), 10, 64)
+			if err != nil || metric.TTL <= 0 {
+				return metric, rejectf(RejectBadField, "error converting metric TTL: %q", section[4:])
+			}
+		default:
+			return metric, rejectf(RejectBadField, "error parsing metric sample rate, tags, timestamp or TTL, no prefix @, #, T or ttl:")
+		}
+	}
+
 	return metric, nil
 }
+
+// pow10 holds the powers of ten that are exactly representable as float64
+var pow10 = [...]float64{1e0, 1e1, 1e2, 1e3, 1e4, 1e5, 1e6, 1e7, 1e8, 1e9, 1e10, 1e11, 1e12, 1e13, 1e14, 1e15}
+
+// parseFloat parses b as a float64. Plain decimal numbers of up to 15 digits, which is
+// what clients send, are converted without allocating; anything else goes through strconv.
+func parseFloat(b []byte) (float64, error) {
+	i, neg := 0, false
+	if len(b) > 0 && (b[0] == '-' || b[0] == '+') {
+		neg = b[0] == '-'
+		i++
+	}
+	var mantissa uint64
+	digits, frac, dot := 0, 0, false
+	for ; i < len(b); i++ {
+		c := b[i]
+		switch {
+		case c >= '0' && c <= '9':
+			mantissa = mantissa*10 + uint64(c-'0')
+			digits++
+			if dot {
+				frac++
+			}
+		case c == '.' && !dot:
+			dot = true
+		default:
+			digits = len(pow10) // not a plain decimal number
+		}
+		if digits >= len(pow10) {
+			return strconv.ParseFloat(string(b), 64)
+		}
+	}
+	if digits == 0 {
+		return strconv.ParseFloat(string(b), 64)
+	}
+	// Both operands are exact so the division is correctly rounded, as strconv would be
+	v := float64(mantissa) / pow10[frac]
+	if neg {
+		v = -v
+	}
+	return v, nil
+}
+
+// parseTags parses a comma separated list of tags and returns them sorted
+func parseTags(b []byte) []string {
+	tags := make([]string, 0, bytes.Count(b, []byte{','})+1)
+	for len(b) > 0 {
+		tag := b
+		if comma := bytes.IndexByte(b, ','); comma >= 0 {
+			tag, b = b[:comma], b[comma+1:]
+		} else {
+			b = nil
+		}
+		if len(tag) > 0 {
+			tags = append(tags, string(tag))
+		}
+	}
+	if len(tags) == 0 {
+		return nil
+	}
+	sort.Strings(tags)
+	return tags
+}
@@ -1,14 +1,22 @@
 package statsd
 
 import (
+	"bufio"
+	"math"
+	"reflect"
+	"strconv"
+	"strings"
 	"testing"
 )
 
 func TestParseLine(t *testing.T) {
 	tests := map[string]Metric{
-		"foo.bar.baz:2|c": Metric{Bucket: "foo.bar.baz", Value: 2.0, Type: COUNTER},
-		"abc.def.g:3|g":   Metric{Bucket: "abc.def.g", Value: 3, Type: GAUGE},
-		"def.g:10|ms":     Metric{Bucket: "def.g", Value: 10, Type: TIMER},
+		"foo.bar.baz:2|c":               Metric{Bucket: "foo.bar.baz", Value: 2.0, Type: COUNTER, SampleRate: 1},
+		"abc.def.g:3|g":                 Metric{Bucket: "abc.def.g", Value: 3, Type: GAUGE, SampleRate: 1},
+		"def.g:10|ms":                   Metric{Bucket: "def.g", Value: 10, Type: TIMER, SampleRate: 1},
+		"foo.bar:1|c|@0.5":              Metric{Bucket: "foo.bar", Value: 1, Type: COUNTER, SampleRate: 0.5},
+		"foo.bar:1|c|#b:2,a:1":          Metric{Bucket: "foo.bar", Value: 1, Type: COUNTER, SampleRate: 1, Tags: []string{"a:1", "b:2"}},
+		"foo.bar:1|ms|#region:eu|@0.25": Metric{Bucket: "foo.bar", Value: 1, Type: TIMER, SampleRate: 0.25, Tags: []string{"region:eu"}},
 	}
 
 	for input, expected := range tests {
@@ -17,13 +25,13 @@ func TestParseLine(t *testing.T) {
 			t.Errorf("test %s error: %s", input, err)
 			continue
 		}
-		if result != expected {
+		if !reflect.DeepEqual(result, expected) {
 			t.Errorf("test %s: expected %s, got %s", input, expected, result)
 			continue
 		}
 	}
 
-	failing := []string{"fOO|bar:bazkk", "foo.bar.baz:1|q"}
+	failing := []string{"fOO|bar:bazkk", "foo.bar.baz:1|q", "foo.bar:1|c|x"}
 	for _, tc := range failing {
 		result, err := parseLine([]byte(tc))
 		if err == nil {
@@ -31,3 +39,113 @@ func TestParseLine(t *testing.T) {
 		}
 	}
 }
+
+func TestParseFloat(t *testing.T) {
+	for _, s := range []string{"0", "1", "-1", "+2", "3.25", ".5", "1.", "0.1", "123456789012345", "1234567890123456", "1e3", "-0.000001", "NaN"} {
+		expected, _ := strconv.ParseFloat(s, 64)
+		result, err := parseFloat([]byte(s))
+		if err != nil {
+			t.Errorf("test %s error: %s", s, err)
+			continue
+		}
+		if result != expected && !(math.IsNaN(result) && math.IsNaN(expected)) {
+			t.Errorf("test %s: expected %v, got %v", s, expected, result)
+		}
+	}
+	for _, s := range []string{"", "-", ".", "1.2.3", "abc"} {
+		if result, err := parseFloat([]byte(s)); err == nil {
+			t.Errorf("test %s: expected error but got %v", s, result)
+		}
+	}
+}
+
+func BenchmarkParseLine(b *testing.B) {
+	line := []byte("api.requests.latency:12.5|ms|@0.5")
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		parseLine(line)
+	}
+}
+
+func BenchmarkParseLineTags(b *testing.B) {
+	line := []byte("api.requests:1|c|#region:eu,host:web1")
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		parseLine(line)
+	}
+}
+
+func TestConformance(t *testing.T) {
+	for _, err := range Conformance(DefaultParser) {
+		t.Error(err)
+	}
+	for _, err := range FormatConformance(formatLine) {
+		t.Error(err)
+	}
+}
+
+func FuzzParseLine(f *testing.F) {
+	for _, v := range TestVectors {
+		f.Add([]byte(v.Line))
+	}
+	f.Add([]byte("a:1|"))
+	f.Add([]byte("a:1||"))
+	f.Fuzz(func(t *testing.T, line []byte) {
+		m, err := parseLine(line)
+		if err != nil {
+			if _, ok := err.(*parseError); !ok {
+				t.Errorf("%q: error without a rejection reason: %s", line, err)
+			}
+			return
+		}
+		if math.IsNaN(m.Value) || math.IsInf(m.Value, 0) {
+			t.Errorf("%q: accepted value %v", line, m.Value)
+		}
+		// Whatever parses must make the round trip through the wire format
+		formatted := formatLine(m)
+		again, err := parseLine(formatted[:len(formatted)-1])
+		if err != nil || !sameMetric(m, again) {
+			t.Errorf("%q parsed as %s, formatted as %q, parsed again as %s, %v", line, m, formatted, again, err)
+		}
+	})
+}
+
+func TestHandleMessage(t *testing.T) {
+	var received []string
+	r := MetricReceiver{Handler: HandlerFunc(func(m Metric) {
+		received = append(received, m.Bucket)
+	})}
+	r.handleMessage(nil, []byte("a:1|c\nb:2|g\n\nc:3|ms"))
+	if !reflect.DeepEqual(received, []string{"a", "b", "c"}) {
+		t.Errorf("expected metrics a, b and c, got %v", received)
+	}
+}
+
+func TestMaxLineLength(t *testing.T) {
+	r := MetricReceiver{MaxLineLength: 20}
+	if _, err := r.limitLength([]byte("foo.bar:1|c|#a:1,b:2,c:3")); err == nil {
+		t.Error("expected a long line to be rejected")
+	}
+	r.TruncateLongLines = true
+	line, err := r.limitLength([]byte("foo.bar:1|c|#a:1,b:2,c:3"))
+	if err != nil || string(line) != "foo.bar:1|c|#a:1,b:2" {
+		t.Errorf("expected the line to be cut after tag b, got %q, %v", line, err)
+	}
+}
+
+func TestReadLineDefaultLength(t *testing.T) {
+	var r MetricReceiver
+	long := "foo:1|c|#" + strings.Repeat("a", 4*DefaultMaxLineLength)
+	buf := bufio.NewReader(strings.NewReader(long + "\nbar:1|c\n"))
+
+	line, err := r.readLine(buf)
+	if err != nil || len(line) > 2*DefaultMaxLineLength || line[len(line)-1] != '\n' {
+		t.Fatalf("expected the long line to be cut short, got %d bytes, %v", len(line), err)
+	}
+	if _, err := r.limitLength(line[:len(line)-1]); err == nil {
+		t.Error("expected the long line to be rejected")
+	}
+	if line, err := r.readLine(buf); err != nil || string(line) != "bar:1|c\n" {
+		t.Errorf("expected the next line, got %q, %v", line, err)
+	}
+}
@@ -0,0 +1,89 @@
+package statsd
+
+import (
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// ReceiverStats are the statistics of a MetricReceiver since it started, for embedders to
+// feed their own monitoring
+type ReceiverStats struct {
+	Packets     int64 // Datagrams, stream lines and HTTP requests received
+	Bytes       int64 // Bytes of the packets
+	Metrics     int64 // Metrics, events and service checks parsed
+	ParseErrors int64 // Lines, objects and binary metrics that didn't parse
+
+	LastError     string    // The last parse error, if any
+	LastErrorFrom string    // Address of the source of the last parse error
+	LastErrorTime time.Time // When the last parse error happened
+}
+
+// receiverCounters are the counters behind MetricReceiver.Stats, accessed atomically
+type receiverCounters struct {
+	packets     int64
+	bytes       int64
+	metrics     int64
+	parseErrors int64
+
+	mu            sync.Mutex
+	lastError     string
+	lastErrorFrom string
+	lastErrorTime time.Time
+}
+
+// Stats returns the statistics of the receiver since it started
+func (r *MetricReceiver) Stats() ReceiverStats {
+	c := &r.counters
+	stats := ReceiverStats{
+		Packets:     atomic.LoadInt64(&c.packets),
+		Bytes:       atomic.LoadInt64(&c.bytes),
+		Metrics:     atomic.LoadInt64(&c.metrics),
+		ParseErrors: atomic.LoadInt64(&c.parseErrors),
+	}
+	c.mu.Lock()
+	stats.LastError = c.lastError
+	stats.LastErrorFrom = c.lastErrorFrom
+	stats.LastErrorTime = c.lastErrorTime
+	c.mu.Unlock()
+	return stats
+}
+
+// countPacket counts a packet of n bytes received from addr
+func (r *MetricReceiver) countPacket(addr net.Addr, n int) {
+	atomic.AddInt64(&r.counters.packets, 1)
+	atomic.AddInt64(&r.counters.bytes, int64(n))
+	if r.PerSender != nil {
+		r.PerSender.countPacket(addr, n)
+	}
+}
+
+// countMetric counts a metric parsed from what addr sent
+func (r *MetricReceiver) countMetric(addr net.Addr) {
+	atomic.AddInt64(&r.counters.metrics, 1)
+	if r.PerSender != nil {
+		r.PerSender.countMetric(addr)
+	}
+}
+
+// trackSource passes m, received from addr, to the Sources tracker if there is one
+func (r *MetricReceiver) trackSource(addr net.Addr, m Metric) {
+	if r.Sources != nil {
+		r.Sources.Observe(addr, m)
+	}
+}
+
+// countParseError counts a parse error from addr and remembers it as the last one
+func (r *MetricReceiver) countParseError(addr net.Addr, err error) {
+	c := &r.counters
+	atomic.AddInt64(&c.parseErrors, 1)
+	c.mu.Lock()
+	c.lastError = err.Error()
+	c.lastErrorFrom = ""
+	if addr != nil {
+		c.lastErrorFrom = addr.String()
+	}
+	c.lastErrorTime = time.Now()
+	c.mu.Unlock()
+}
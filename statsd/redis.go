@@ -0,0 +1,188 @@
+package statsd
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// RedisClient writes metrics to RedisTimeSeries with TS.MADD, one series per flushed name
+// labelled with its name and tags, and/or publishes each flush as a JSON object with the
+// time and the flushed names and values on a pub/sub channel.
+type RedisClient struct {
+	Addr       string
+	Password   string
+	TimeSeries bool   // Write the metrics to time series
+	Channel    string // If set, publish each flush on this channel
+
+	mu      sync.Mutex
+	conn    net.Conn
+	r       *bufio.Reader
+	created map[string]bool // series known to exist
+}
+
+// SendMetrics sends the metrics in a MetricMap to Redis
+func (c *RedisClient) SendMetrics(metrics MetricMap) error {
+	return c.SendMetricsAt(metrics, time.Now())
+}
+
+// SendMetricsAt sends the metrics in a MetricMap to Redis with the timestamp t
+func (c *RedisClient) SendMetricsAt(metrics MetricMap, t time.Time) error {
+	defer c.mu.Unlock()
+	c.mu.Lock()
+	if err := c.connect(); err != nil {
+		return err
+	}
+	err := c.send(finiteMetrics(metrics), t)
+	if _, ok := err.(redisError); err != nil && !ok {
+		c.conn.Close()
+		c.conn = nil
+	}
+	return err
+}
+
+// send writes the metrics on the current connection. The caller must hold the lock.
+func (c *RedisClient) send(metrics MetricMap, t time.Time) error {
+	if c.TimeSeries && len(metrics) > 0 {
+		keys := make([]string, 0, len(metrics))
+		for k := range metrics {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+
+		// Series are created first so they are labelled, TS.MADD would create them bare
+		for _, k := range keys {
+			if c.created[k] {
+				continue
+			}
+			name, tags := SplitKey(k)
+			args := []string{"TS.CREATE", k, "LABELS", "name", name}
+			for _, tag := range tags {
+				k, v := splitTag(tag)
+				if v == "" {
+					v = "true"
+				}
+				args = append(args, k, v)
+			}
+			err := c.do(args...)
+			if err != nil && !strings.Contains(err.Error(), "already exists") {
+				return err
+			}
+			c.created[k] = true
+		}
+
+		args := []string{"TS.MADD"}
+		ms := strconv.FormatInt(t.UnixNano()/int64(time.Millisecond), 10)
+		for _, k := range keys {
+			args = append(args, k, ms, strconv.FormatFloat(metrics[k], 'f', -1, 64))
+		}
+		if err := c.do(args...); err != nil {
+			return err
+		}
+	}
+	if c.Channel != "" {
+		b, err := json.Marshal(flushSnapshot{t.Unix(), metrics})
+		if err != nil {
+			return err
+		}
+		if err := c.do("PUBLISH", c.Channel, string(b)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// connect connects to Redis unless already connected. The caller must hold the lock.
+func (c *RedisClient) connect() error {
+	if c.conn != nil {
+		return nil
+	}
+	conn, err := dialer.Dial("tcp", c.Addr)
+	if err != nil {
+		return err
+	}
+	c.conn, c.r = conn, bufio.NewReader(conn)
+	if c.created == nil {
+		c.created = make(map[string]bool)
+	}
+	if c.Password != "" {
+		if err := c.do("AUTH", c.Password); err != nil {
+			c.conn.Close()
+			c.conn = nil
+			return err
+		}
+	}
+	return nil
+}
+
+// do sends a command and reads its reply, returning the error replied by Redis if any.
+// The caller must hold the lock.
+func (c *RedisClient) do(args ...string) error {
+	c.conn.SetDeadline(time.Now().Add(30 * time.Second))
+	w := bufio.NewWriter(c.conn)
+	fmt.Fprintf(w, "*%d\r\n", len(args))
+	for _, arg := range args {
+		fmt.Fprintf(w, "$%d\r\n%s\r\n", len(arg), arg)
+	}
+	if err := w.Flush(); err != nil {
+		return err
+	}
+	return readRedisReply(c.r)
+}
+
+// redisError is an error replied by Redis, after which the connection remains usable
+type redisError string
+
+func (e redisError) Error() string { return "redis: " + string(e) }
+
+// readRedisReply reads a RESP reply, returning the first error it contains
+func readRedisReply(r *bufio.Reader) error {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return err
+	}
+	line = strings.TrimRight(line, "\r\n")
+	if line == "" {
+		return errors.New("redis: empty reply")
+	}
+	switch line[0] {
+	case '+', ':':
+		return nil
+	case '-':
+		return redisError(line[1:])
+	case '$':
+		n, err := strconv.Atoi(line[1:])
+		if err != nil {
+			return err
+		}
+		if n >= 0 {
+			_, err = r.Discard(n + 2)
+		}
+		return err
+	case '*':
+		n, err := strconv.Atoi(line[1:])
+		if err != nil {
+			return err
+		}
+		var first error
+		for i := 0; i < n; i++ {
+			if err := readRedisReply(r); err != nil {
+				if _, ok := err.(redisError); !ok {
+					return err
+				}
+				if first == nil {
+					first = err
+				}
+			}
+		}
+		return first
+	}
+	return fmt.Errorf("redis: unexpected reply %q", line)
+}
@@ -0,0 +1,118 @@
+package statsd
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// redisServer starts a server answering the commands of a RedisClient like Redis, with an
+// error to the creation of the series named exists, and sending the commands it receives
+// on the returned channel
+func redisServer(t *testing.T) (net.Listener, chan string) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	commands := make(chan string, 16)
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				r := bufio.NewReader(conn)
+				for {
+					line, err := r.ReadString('\n')
+					if err != nil {
+						return
+					}
+					n, _ := strconv.Atoi(strings.TrimSpace(line[1:]))
+					args := make([]string, n)
+					for i := range args {
+						r.ReadString('\n')
+						arg, _ := r.ReadString('\n')
+						args[i] = strings.TrimSuffix(arg, "\r\n")
+					}
+					commands <- strings.Join(args, " ")
+					switch {
+					case args[0] == "TS.CREATE" && args[1] == "exists":
+						io.WriteString(conn, "-ERR TSDB: key already exists\r\n")
+					case args[0] == "TS.MADD":
+						io.WriteString(conn, "*"+strconv.Itoa(n/3)+"\r\n"+strings.Repeat(":1500000000000\r\n", n/3))
+					default:
+						io.WriteString(conn, "+OK\r\n")
+					}
+				}
+			}()
+		}
+	}()
+	return l, commands
+}
+
+func TestRedisCommands(t *testing.T) {
+	l, commands := redisServer(t)
+	defer l.Close()
+
+	c := &RedisClient{Addr: l.Addr().String(), Password: "secret", TimeSeries: true, Channel: "flushes"}
+	flushes := []MetricMap{
+		MetricMap{"foo;host:a;canary": 1.5, "exists": 2},
+		MetricMap{"foo;host:a;canary": 3},
+	}
+	expected := [][]string{
+		{
+			"AUTH secret",
+			"TS.CREATE exists LABELS name exists",
+			"TS.CREATE foo;host:a;canary LABELS name foo host a canary true",
+			"TS.MADD exists 1500000000000 2 foo;host:a;canary 1500000000000 1.5",
+			`PUBLISH flushes {"time":1500000000,"metrics":{"exists":2,"foo;host:a;canary":1.5}}`,
+		},
+		{
+			"TS.MADD foo;host:a;canary 1500000000000 3",
+			`PUBLISH flushes {"time":1500000000,"metrics":{"foo;host:a;canary":3}}`,
+		},
+	}
+	for i, metrics := range flushes {
+		if err := c.SendMetricsAt(metrics, time.Unix(1500000000, 0)); err != nil {
+			t.Fatalf("flush %d error: %s", i, err)
+		}
+		var result []string
+		for len(commands) > 0 {
+			result = append(result, <-commands)
+		}
+		if !reflect.DeepEqual(result, expected[i]) {
+			t.Errorf("flush %d: expected %q, got %q", i, expected[i], result)
+		}
+	}
+}
+
+func TestReadRedisReply(t *testing.T) {
+	tests := map[string]string{
+		"+OK\r\n":                        "",
+		":1\r\n":                         "",
+		"$3\r\nfoo\r\n+OK\r\n":           "",
+		"$-1\r\n":                        "",
+		"*2\r\n:1\r\n:2\r\n":             "",
+		"-ERR wrong type\r\n":            "redis: ERR wrong type",
+		"*2\r\n:1\r\n-ERR bad value\r\n": "redis: ERR bad value",
+		"?\r\n":                          `redis: unexpected reply "?"`,
+	}
+
+	for input, expected := range tests {
+		err := readRedisReply(bufio.NewReader(strings.NewReader(input)))
+		result := ""
+		if err != nil {
+			result = err.Error()
+		}
+		if result != expected {
+			t.Errorf("test %q: expected %q, got %q", input, expected, result)
+		}
+	}
+}
@@ -0,0 +1,117 @@
+package statsd
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+// Types of RollupRule
+const (
+	RollupRatio         = "ratio"          // Metrics[0] divided by Metrics[1]
+	RollupSum           = "sum"            // Sum of all the metrics matching any of Metrics
+	RollupMovingAverage = "moving_average" // Average of Metrics[0] over the last Window flushes
+)
+
+// RollupRule describes a series derived from the flushed metrics, such as the ratio of
+// errors to requests. Metric names refer to flushed names, e.g. "stats.counters.rate.api.errors",
+// and patterns may use * to match a single dot separated component.
+type RollupRule struct {
+	Name    string   `json:"name"`    // Name of the derived metric
+	Type    string   `json:"type"`    // One of RollupRatio, RollupSum or RollupMovingAverage
+	Metrics []string `json:"metrics"` // Names or patterns of the metrics the series is derived from
+	Window  int      `json:"window"`  // Number of flushes to average over for moving averages
+}
+
+// Validate checks that the rule is well formed
+func (r RollupRule) Validate() error {
+	if r.Name == "" {
+		return fmt.Errorf("rollup rule without name")
+	}
+	switch r.Type {
+	case RollupRatio:
+		if len(r.Metrics) != 2 {
+			return fmt.Errorf("ratio rollup %s needs exactly two metrics", r.Name)
+		}
+	case RollupSum:
+		if len(r.Metrics) == 0 {
+			return fmt.Errorf("sum rollup %s needs at least one metric", r.Name)
+		}
+	case RollupMovingAverage:
+		if len(r.Metrics) != 1 || r.Window < 1 {
+			return fmt.Errorf("moving average rollup %s needs one metric and a window", r.Name)
+		}
+	default:
+		return fmt.Errorf("rollup %s has unknown type %q", r.Name, r.Type)
+	}
+	return nil
+}
+
+// RollupSender is a MetricSender that adds the series derived by its Rules to the flushed
+// metrics before passing them on to Sender
+type RollupSender struct {
+	Rules  []RollupRule
+	Sender MetricSender
+
+	mu      sync.Mutex
+	history map[string][]float64 // recent values of the moving averages' metrics
+}
+
+// SendMetrics sends metrics and the derived series to s.Sender
+func (s *RollupSender) SendMetrics(metrics MetricMap) error {
+	return s.SendMetricsAt(metrics, time.Now())
+}
+
+// SendMetricsAt sends metrics and the derived series to s.Sender with the timestamp t
+func (s *RollupSender) SendMetricsAt(metrics MetricMap, t time.Time) error {
+	return sendMetricsAt(s.Sender, s.rollup(metrics), t)
+}
+
+// rollup computes the derived series and returns a copy of metrics holding them, leaving
+// metrics, which other senders may be reading, untouched
+func (s *RollupSender) rollup(flushed MetricMap) MetricMap {
+	defer s.mu.Unlock()
+	s.mu.Lock()
+
+	metrics := copyMetricMap(flushed)
+
+	for _, r := range s.Rules {
+		switch r.Type {
+		case RollupRatio:
+			num, ok1 := metrics[r.Metrics[0]]
+			den, ok2 := metrics[r.Metrics[1]]
+			if ok1 && ok2 && den != 0 {
+				metrics[r.Name] = num / den
+			}
+		case RollupSum:
+			sum, found := 0.0, false
+			for k, v := range metrics {
+				for _, pattern := range r.Metrics {
+					if matchPattern(pattern, k) {
+						sum += v
+						found = true
+						break
+					}
+				}
+			}
+			if found {
+				metrics[r.Name] = sum
+			}
+		case RollupMovingAverage:
+			v, ok := metrics[r.Metrics[0]]
+			if !ok {
+				continue
+			}
+			if s.history == nil {
+				s.history = make(map[string][]float64)
+			}
+			h := append(s.history[r.Name], v)
+			if len(h) > r.Window {
+				h = h[len(h)-r.Window:]
+			}
+			s.history[r.Name] = h
+			metrics[r.Name] = average(h)
+		}
+	}
+	return metrics
+}
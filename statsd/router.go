@@ -0,0 +1,155 @@
+package statsd
+
+import (
+	"fmt"
+)
+
+// ParseMetricType returns the MetricType named "counter", "gauge", "timer" or "set"
+func ParseMetricType(s string) (MetricType, error) {
+	switch s {
+	case "counter":
+		return COUNTER, nil
+	case "gauge":
+		return GAUGE, nil
+	case "timer":
+		return TIMER, nil
+	case "set":
+		return SET, nil
+	}
+	return ERROR, fmt.Errorf("unknown metric type %q", s)
+}
+
+// TypeRouter is a Handler that passes each metric on to the Handler registered for its
+// type, or to Default if there is none
+type TypeRouter struct {
+	Handlers map[MetricType]Handler
+	Default  Handler
+}
+
+// HandleMetric passes m on to the Handler for its type
+func (r *TypeRouter) HandleMetric(m Metric) {
+	r.handler(m.Type).HandleMetric(m)
+}
+
+// HandleMetrics passes the metrics of a datagram on to the Handlers for their types, those
+// of each type at once
+func (r *TypeRouter) HandleMetrics(ms []Metric) {
+	batches := make(map[MetricType][]Metric)
+	for _, m := range ms {
+		if batches[m.Type] == nil {
+			batches[m.Type] = getMetrics()
+		}
+		batches[m.Type] = append(batches[m.Type], m)
+	}
+	ReleaseMetrics(ms)
+	for t, batch := range batches {
+		handleMetrics(r.handler(t), batch)
+	}
+}
+
+// handler returns the Handler for metrics of type t
+func (r *TypeRouter) handler(t MetricType) Handler {
+	if h, ok := r.Handlers[t]; ok {
+		return h
+	}
+	return r.Default
+}
+
+// TagRoute sends the metrics carrying a tag to a Handler
+type TagRoute struct {
+	Tag     string       // e.g. "team:payments"
+	Types   []MetricType // Types of the metrics routed, all if empty
+	Handler Handler
+}
+
+// matches reports whether m is sent along the route
+func (r TagRoute) matches(m Metric) bool {
+	if !containsString(m.Tags, r.Tag) {
+		return false
+	}
+	if len(r.Types) == 0 {
+		return true
+	}
+	for _, t := range r.Types {
+		if t == m.Type {
+			return true
+		}
+	}
+	return false
+}
+
+// TagRouter is a Handler that passes each metric on to the Handler of the first of the
+// Routes it matches, or to Default if there is none, e.g. so the metrics of each team go
+// to an account of its own
+type TagRouter struct {
+	Routes  []TagRoute
+	Default Handler
+}
+
+// HandleMetric passes m on to the Handler of its route
+func (r *TagRouter) HandleMetric(m Metric) {
+	r.handler(r.route(m)).HandleMetric(m)
+}
+
+// HandleMetrics passes the metrics of a datagram on to the Handlers of their routes, those
+// of each route at once
+func (r *TagRouter) HandleMetrics(ms []Metric) {
+	batches := make([][]Metric, len(r.Routes)+1)
+	for _, m := range ms {
+		i := r.route(m)
+		if batches[i] == nil {
+			batches[i] = getMetrics()
+		}
+		batches[i] = append(batches[i], m)
+	}
+	ReleaseMetrics(ms)
+	for i, batch := range batches {
+		if batch != nil {
+			handleMetrics(r.handler(i), batch)
+		}
+	}
+}
+
+// route returns the index of the first of the Routes m matches, or len(Routes) if none
+func (r *TagRouter) route(m Metric) int {
+	for i, route := range r.Routes {
+		if route.matches(m) {
+			return i
+		}
+	}
+	return len(r.Routes)
+}
+
+// handler returns the Handler of the route at index i, Default past the last one
+func (r *TagRouter) handler(i int) Handler {
+	if i < len(r.Routes) {
+		return r.Routes[i].Handler
+	}
+	return r.Default
+}
+
+// TeeHandler is a Handler that passes each metric on to all of its Handlers, e.g. to
+// feed two aggregators the same metrics
+type TeeHandler struct {
+	Handlers []Handler
+}
+
+// HandleMetric passes m on to each Handler
+func (t *TeeHandler) HandleMetric(m Metric) {
+	for _, h := range t.Handlers {
+		h.HandleMetric(m)
+	}
+}
+
+// HandleMetrics passes the metrics of a datagram on to each Handler at once, each one a
+// copy of its own as the Handlers take ownership of them
+func (t *TeeHandler) HandleMetrics(ms []Metric) {
+	if len(t.Handlers) == 0 {
+		ReleaseMetrics(ms)
+		return
+	}
+	for _, h := range t.Handlers[:len(t.Handlers)-1] {
+		handleMetrics(h, append(getMetrics(), ms...))
+	}
+	handleMetrics(t.Handlers[len(t.Handlers)-1], ms)
+}
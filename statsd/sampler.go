@@ -0,0 +1,77 @@
+package statsd
+
+import (
+	"math/rand"
+	"sync"
+	"time"
+)
+
+// AdaptiveSampler is a Handler that downsamples busy counters and timers while the queues
+// feeding Aggregator are filling up, instead of letting them overflow. The sample rate of
+// the metrics it lets through is scaled accordingly, so the aggregates stay right.
+type AdaptiveSampler struct {
+	Aggregator    *MetricAggregator // Aggregator whose queue saturation triggers sampling
+	Threshold     float64           // Fraction of the queue capacity at which sampling starts, 0.5 if zero
+	MinSampleRate float64           // Lowest sample rate applied, 0.01 if zero
+	MinBucketRate float64           // Buckets updated fewer times per second are never sampled
+	Handler       Handler
+
+	mu     sync.Mutex
+	second int64
+	counts map[string]float64
+}
+
+// HandleMetric passes m on to the Handler, or drops it at the current sample rate
+func (s *AdaptiveSampler) HandleMetric(m Metric) {
+	s.handle(m, s.Handler.HandleMetric)
+}
+
+// HandleMetrics samples the metrics of a datagram and passes those kept on at once
+func (s *AdaptiveSampler) HandleMetrics(ms []Metric) {
+	batchMetrics(ms, s.Handler, s.handle)
+}
+
+// handle emits m, or drops it at the current sample rate
+func (s *AdaptiveSampler) handle(m Metric, emit func(Metric)) {
+	if m.Type == COUNTER || m.Type == TIMER {
+		if rate := s.sampleRate(m.Key()); rate < 1 {
+			if rand.Float64() >= rate {
+				return
+			}
+			m.SampleRate *= rate
+		}
+	}
+	emit(m)
+}
+
+// sampleRate returns the rate at which the bucket with the given key is sampled. It is
+// one while the queue is below the threshold, then decreases linearly down to the
+// minimum as the queue fills up.
+func (s *AdaptiveSampler) sampleRate(key string) float64 {
+	threshold := s.Threshold
+	if threshold <= 0 || threshold >= 1 {
+		threshold = 0.5
+	}
+	minRate := s.MinSampleRate
+	if minRate <= 0 || minRate > 1 {
+		minRate = 0.01
+	}
+
+	defer s.mu.Unlock()
+	s.mu.Lock()
+	if sec := time.Now().Unix(); sec != s.second || s.counts == nil {
+		s.second = sec
+		s.counts = make(map[string]float64)
+	}
+	s.counts[key]++
+
+	fill := s.Aggregator.queueFill()
+	if fill < threshold || s.counts[key] <= s.MinBucketRate {
+		return 1
+	}
+	rate := 1 - (fill-threshold)/(1-threshold)
+	if rate < minRate {
+		rate = minRate
+	}
+	return rate
+}
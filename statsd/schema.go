@@ -0,0 +1,151 @@
+package statsd
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// SchemaViolationsBucket is the internal counter of the metrics that didn't match the
+// schema, tagged with the reason
+const SchemaViolationsBucket = "statsd.schema_violations"
+
+// Reasons metrics violate a schema for
+const (
+	ViolationUnknownPrefix = "unknown_prefix" // No rule matches the bucket
+	ViolationType          = "type"           // The rule doesn't allow the type of the metric
+	ViolationTag           = "tag"            // The rule doesn't allow one of the tag keys
+)
+
+// SchemaRule declares the metrics allowed in the buckets starting with Prefix
+type SchemaRule struct {
+	Prefix string   `json:"prefix"`
+	Types  []string `json:"types"` // "counter", "gauge", "timer" or "set", any if empty
+	Tags   []string `json:"tags"`  // Keys of the tags allowed, any if empty
+}
+
+// Validate checks that the rule is well formed
+func (r SchemaRule) Validate() error {
+	if r.Prefix == "" {
+		return fmt.Errorf("schema rule without prefix")
+	}
+	for _, t := range r.Types {
+		if _, err := ParseMetricType(t); err != nil {
+			return fmt.Errorf("schema rule %q: %s", r.Prefix, err)
+		}
+	}
+	return nil
+}
+
+// check returns the reason m violates the rule, or "" if it doesn't
+func (r *SchemaRule) check(m Metric) string {
+	if len(r.Types) > 0 && !containsString(r.Types, m.Type.String()) {
+		return ViolationType
+	}
+	if len(r.Tags) > 0 {
+		for _, tag := range m.Tags {
+			if k, _ := splitTag(tag); !containsString(r.Tags, k) {
+				return ViolationTag
+			}
+		}
+	}
+	return ""
+}
+
+// SchemaHandler is a Handler that only passes on to Handler the metrics matching a schema,
+// so typos in names, types or tags don't turn in to new series. Each metric is checked
+// against the rule with the longest matching prefix, and metrics matching no rule violate
+// the schema. Rejected lines and the internal metrics of the server, in buckets starting
+// with "statsd.", are always passed on.
+//
+// Violations are dropped, or only reported with ReportOnly, which helps rolling a schema
+// out. The first violation of each bucket in an interval is logged, and while Run is
+// running the number of violations of an interval is counted in SchemaViolationsBucket.
+type SchemaHandler struct {
+	Rules      []SchemaRule
+	ReportOnly bool
+	Interval   time.Duration // Period over which violations are counted, usually the flush interval
+	Handler    Handler
+
+	mu         sync.Mutex
+	violations map[string]float64 // by reason
+	logged     map[string]bool    // buckets whose violation was logged
+}
+
+// HandleMetric checks m against the schema and passes it on if it matches
+func (h *SchemaHandler) HandleMetric(m Metric) {
+	h.handle(m, h.Handler.HandleMetric)
+}
+
+// HandleMetrics checks the metrics of a datagram against the schema and passes those
+// matching it on at once
+func (h *SchemaHandler) HandleMetrics(ms []Metric) {
+	batchMetrics(ms, h.Handler, h.handle)
+}
+
+// handle checks m against the schema and emits it if it matches
+func (h *SchemaHandler) handle(m Metric, emit func(Metric)) {
+	reason := ""
+	if m.Type != ERROR && !strings.HasPrefix(m.Bucket, "statsd.") {
+		reason = h.check(m)
+	}
+
+	h.mu.Lock()
+	if reason != "" {
+		if h.violations == nil {
+			h.violations = make(map[string]float64)
+			h.logged = make(map[string]bool)
+		}
+		h.violations[reason]++
+		if !h.logged[m.Bucket] {
+			h.logged[m.Bucket] = true
+			infof("%s violates the schema: %s", m, reason)
+		}
+	}
+	h.mu.Unlock()
+
+	if reason == "" || h.ReportOnly {
+		emit(m)
+	}
+}
+
+// Run starts a new interval every Interval until the program exits
+func (h *SchemaHandler) Run() {
+	runIntervals(h.Interval, h.endInterval, h.Handler)
+}
+
+// check returns the reason m violates the schema, or "" if it doesn't
+func (h *SchemaHandler) check(m Metric) string {
+	var match *SchemaRule
+	for i := range h.Rules {
+		r := &h.Rules[i]
+		if strings.HasPrefix(m.Bucket, r.Prefix) && (match == nil || len(r.Prefix) > len(match.Prefix)) {
+			match = r
+		}
+	}
+	if match == nil {
+		return ViolationUnknownPrefix
+	}
+	return match.check(m)
+}
+
+// endInterval starts a new interval and returns the counters of the violations of the one
+// that ended
+func (h *SchemaHandler) endInterval() []Metric {
+	defer h.mu.Unlock()
+	h.mu.Lock()
+
+	reasons := make([]string, 0, len(h.violations))
+	for reason := range h.violations {
+		reasons = append(reasons, reason)
+	}
+	sort.Strings(reasons)
+	var counts []Metric
+	for _, reason := range reasons {
+		counts = append(counts, Metric{Type: COUNTER, Bucket: SchemaViolationsBucket, Value: h.violations[reason], SampleRate: 1, Tags: []string{"reason:" + reason}})
+	}
+	h.violations, h.logged = nil, nil
+	return counts
+}
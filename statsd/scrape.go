@@ -0,0 +1,206 @@
+package statsd
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Scraper pulls the Prometheus text format, as served by /metrics endpoints, from its
+// Targets every Interval and passes the samples on to Handler, tagged with the labels of
+// the sample and the instance they were scraped from.
+//
+// Gauges and untyped samples become gauges. Counters, and the buckets, sums and counts
+// of histograms and summaries, are cumulative: the first scrape of a series only
+// remembers its value and later ones pass on the increase as a counter, so that it can
+// be aggregated with the counters sent by statsd clients. Quantiles of summaries become
+// gauges.
+type Scraper struct {
+	Targets  []string      // URLs of the endpoints
+	Interval time.Duration // 15 seconds if zero
+	Handler  Handler
+
+	mu   sync.Mutex
+	last map[string]float64 // Previous value of each cumulative series, by target and key
+}
+
+// Run scrapes the targets until the program exits
+func (s *Scraper) Run() {
+	interval := s.Interval
+	if interval <= 0 {
+		interval = 15 * time.Second
+	}
+	for {
+		var wg sync.WaitGroup
+		for _, target := range s.Targets {
+			wg.Add(1)
+			go func(target string) {
+				defer wg.Done()
+				if err := s.scrape(target); err != nil {
+					infof("Scraping %s failed: %s", target, err)
+				}
+			}(target)
+		}
+		wg.Wait()
+		time.Sleep(interval)
+	}
+}
+
+// scrape pulls the samples of target and passes them on
+func (s *Scraper) scrape(target string) error {
+	req, err := http.NewRequest("GET", target, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", "text/plain;version=0.0.4")
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("GET %s: %s", target, resp.Status)
+	}
+	instance := target
+	if u, err := url.Parse(target); err == nil {
+		instance = u.Host
+	}
+	return s.parse(resp.Body, target, instance)
+}
+
+// parse reads the samples in the Prometheus text format from r
+func (s *Scraper) parse(r io.Reader, target, instance string) error {
+	types := make(map[string]string)
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+		if line[0] == '#' {
+			// "# TYPE name type"
+			if f := strings.Fields(line); len(f) == 4 && f[1] == "TYPE" {
+				types[f[2]] = f[3]
+			}
+			continue
+		}
+		name, labels, value, err := parseSample(line)
+		if err != nil {
+			debugf("Scraping %s: %s", target, err)
+			continue
+		}
+		tags := append(labels, "instance:"+instance)
+		sort.Strings(tags)
+		s.sample(target, name, tags, value, sampleType(types, name))
+	}
+	return scanner.Err()
+}
+
+// sampleType returns the type, "counter" or "gauge", of the sample name
+func sampleType(types map[string]string, name string) string {
+	if t, ok := types[name]; ok {
+		if t == "counter" {
+			return "counter"
+		}
+		return "gauge"
+	}
+	for _, suffix := range []string{"_bucket", "_sum", "_count", "_total", "_created"} {
+		if base := strings.TrimSuffix(name, suffix); base != name {
+			switch types[base] {
+			case "histogram", "summary", "counter":
+				return "counter"
+			}
+		}
+	}
+	return "gauge"
+}
+
+// sample passes on a sample as a metric
+func (s *Scraper) sample(target, name string, tags []string, value float64, typ string) {
+	m := Metric{Type: GAUGE, Bucket: name, Value: value, SampleRate: 1, Tags: tags}
+	if typ == "counter" {
+		key := target + " " + m.Key()
+		s.mu.Lock()
+		if s.last == nil {
+			s.last = make(map[string]float64)
+		}
+		last, seen := s.last[key]
+		s.last[key] = value
+		s.mu.Unlock()
+		if !seen {
+			return
+		}
+		m.Type = COUNTER
+		if m.Value = value - last; m.Value < 0 {
+			// The counter was reset
+			m.Value = value
+		}
+	}
+	if math.IsNaN(m.Value) || math.IsInf(m.Value, 0) {
+		return
+	}
+	s.Handler.HandleMetric(m)
+}
+
+// parseSample parses a line such as `http_requests_total{method="post",code="200"} 1027 1395066363000`
+// in to the name, the labels as "name:value" tags, and the value
+func parseSample(line string) (name string, labels []string, value float64, err error) {
+	i := strings.IndexAny(line, "{ \t")
+	if i <= 0 {
+		return "", nil, 0, fmt.Errorf("invalid sample %q", line)
+	}
+	name, rest := line[:i], line[i:]
+	if rest[0] == '{' {
+		rest = rest[1:]
+		for {
+			rest = strings.TrimLeft(rest, " \t,")
+			if rest == "" {
+				return "", nil, 0, fmt.Errorf("unterminated labels in %q", line)
+			}
+			if rest[0] == '}' {
+				rest = rest[1:]
+				break
+			}
+			eq := strings.IndexByte(rest, '=')
+			if eq <= 0 || len(rest) < eq+2 || rest[eq+1] != '"' {
+				return "", nil, 0, fmt.Errorf("invalid labels in %q", line)
+			}
+			label := strings.TrimSpace(rest[:eq])
+			var v []byte
+			j := eq + 2
+			for ; j < len(rest) && rest[j] != '"'; j++ {
+				if rest[j] == '\\' && j+1 < len(rest) {
+					j++
+					if rest[j] == 'n' {
+						v = append(v, '\n')
+						continue
+					}
+				}
+				v = append(v, rest[j])
+			}
+			if j >= len(rest) {
+				return "", nil, 0, fmt.Errorf("unterminated label value in %q", line)
+			}
+			labels = append(labels, label+":"+string(v))
+			rest = rest[j+1:]
+		}
+	}
+	fields := strings.Fields(rest)
+	if len(fields) == 0 {
+		return "", nil, 0, fmt.Errorf("missing value in %q", line)
+	}
+	value, err = strconv.ParseFloat(fields[0], 64)
+	if err != nil {
+		return "", nil, 0, fmt.Errorf("invalid value in %q", line)
+	}
+	return name, labels, value, nil
+}
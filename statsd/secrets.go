@@ -0,0 +1,231 @@
+package statsd
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/service/secretsmanager"
+)
+
+// secretRef matches the references to secrets in the addresses and options of backends,
+// ${<scheme>:<reference>}, e.g. ${env:NEWRELIC_API_KEY}
+var secretRef = regexp.MustCompile(`\$\{([a-z0-9-]+):([^}]*)\}`)
+
+// SecretResolver looks up the secret a reference names
+type SecretResolver func(ref string) (string, error)
+
+var (
+	secretResolversMu sync.Mutex
+	secretResolvers   = make(map[string]SecretResolver)
+)
+
+// RegisterSecretResolver makes the references of the form ${<scheme>:<reference>} look
+// up their secret with resolver. Registering a scheme again replaces its resolver.
+func RegisterSecretResolver(scheme string, resolver SecretResolver) {
+	defer secretResolversMu.Unlock()
+	secretResolversMu.Lock()
+	secretResolvers[scheme] = resolver
+}
+
+// HasSecrets reports whether address or any of the options refer to secrets
+func HasSecrets(address string, options map[string]string) bool {
+	if secretRef.MatchString(address) {
+		return true
+	}
+	for _, v := range options {
+		if secretRef.MatchString(v) {
+			return true
+		}
+	}
+	return false
+}
+
+// ResolveSecret returns value with the references to secrets it contains replaced by the
+// secrets
+func ResolveSecret(value string) (string, error) {
+	var err error
+	resolved := secretRef.ReplaceAllStringFunc(value, func(ref string) string {
+		m := secretRef.FindStringSubmatch(ref)
+		secretResolversMu.Lock()
+		resolver, ok := secretResolvers[m[1]]
+		secretResolversMu.Unlock()
+		if !ok {
+			if err == nil {
+				err = fmt.Errorf("unknown secret scheme %q", m[1])
+			}
+			return ""
+		}
+		secret, e := resolver(m[2])
+		if e != nil && err == nil {
+			err = fmt.Errorf("secret %s: %s", ref, e)
+		}
+		return secret
+	})
+	return resolved, err
+}
+
+// ResolveSecrets returns a copy of options with the references to secrets replaced by the
+// secrets
+func ResolveSecrets(options map[string]string) (map[string]string, error) {
+	resolved := make(map[string]string, len(options))
+	for k, v := range options {
+		var err error
+		if resolved[k], err = ResolveSecret(v); err != nil {
+			return nil, fmt.Errorf("option %s: %s", k, err)
+		}
+	}
+	return resolved, nil
+}
+
+// SecretSender is the MetricSender of a backend whose address or options refer to
+// secrets. Rotate creates the backend again with its secrets looked up again, so secrets
+// can be rotated without a restart.
+type SecretSender struct {
+	Backend string
+	Address string
+	Options map[string]string
+
+	mu     sync.RWMutex
+	sender MetricSender
+}
+
+// NewSecretSender creates the backend registered under name with its secrets looked up
+func NewSecretSender(name, address string, options map[string]string) (*SecretSender, error) {
+	s := &SecretSender{Backend: name, Address: address, Options: options}
+	return s, s.Rotate()
+}
+
+// Rotate creates the backend again with its secrets looked up again. The flush being sent,
+// if any, goes to the old one. If the backend can't be created the old one is kept.
+func (s *SecretSender) Rotate() error {
+	sender, err := NewBackend(s.Backend, s.Address, s.Options)
+	if err != nil {
+		return err
+	}
+	defer s.mu.Unlock()
+	s.mu.Lock()
+	s.sender = sender
+	return nil
+}
+
+// SendMetrics sends the metrics in a MetricMap to the backend
+func (s *SecretSender) SendMetrics(metrics MetricMap) error {
+	return s.SendMetricsAt(metrics, time.Now())
+}
+
+// SendMetricsAt sends the metrics in a MetricMap to the backend with the timestamp t
+func (s *SecretSender) SendMetricsAt(metrics MetricMap, t time.Time) error {
+	s.mu.RLock()
+	sender := s.sender
+	s.mu.RUnlock()
+	return sendMetricsAt(sender, metrics, t)
+}
+
+// splitSecretField splits a reference of the form <name>#<field> in to its parts
+func splitSecretField(ref string) (name, field string) {
+	if hash := strings.LastIndexByte(ref, '#'); hash >= 0 {
+		return ref[:hash], ref[hash+1:]
+	}
+	return ref, ""
+}
+
+// vaultSecret reads the field of a secret from the Vault server at VAULT_ADDR with the
+// token VAULT_TOKEN, e.g. secret/data/statsd#api_key. Fields of the version 2 key/value
+// engine are found under data.data, those of the version 1 engine under data.
+func vaultSecret(ref string) (string, error) {
+	path, field := splitSecretField(ref)
+	if field == "" {
+		return "", fmt.Errorf("missing #field")
+	}
+	addr := os.Getenv("VAULT_ADDR")
+	if addr == "" {
+		return "", fmt.Errorf("VAULT_ADDR isn't set")
+	}
+	req, err := http.NewRequest("GET", strings.TrimSuffix(addr, "/")+"/v1/"+strings.TrimPrefix(path, "/"), nil)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("X-Vault-Token", os.Getenv("VAULT_TOKEN"))
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("vault: %s", resp.Status)
+	}
+	var body struct {
+		Data map[string]interface{} `json:"data"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		return "", err
+	}
+	data := body.Data
+	if v2, ok := data["data"].(map[string]interface{}); ok {
+		if _, ok := data[field]; !ok {
+			data = v2
+		}
+	}
+	v, ok := data[field].(string)
+	if !ok {
+		return "", fmt.Errorf("no field %q", field)
+	}
+	return v, nil
+}
+
+// awsSecret reads a secret from AWS Secrets Manager, with the credentials and region of
+// the usual AWS environment. With a #field the secret is a JSON object and the secret is
+// the value of its field.
+func awsSecret(ref string) (string, error) {
+	id, field := splitSecretField(ref)
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	cfg, err := config.LoadDefaultConfig(ctx)
+	if err != nil {
+		return "", err
+	}
+	out, err := secretsmanager.NewFromConfig(cfg).GetSecretValue(ctx, &secretsmanager.GetSecretValueInput{SecretId: aws.String(id)})
+	if err != nil {
+		return "", err
+	}
+	secret := aws.ToString(out.SecretString)
+	if field == "" {
+		return secret, nil
+	}
+	var fields map[string]interface{}
+	if err := json.Unmarshal([]byte(secret), &fields); err != nil {
+		return "", fmt.Errorf("secret isn't a JSON object: %s", err)
+	}
+	v, ok := fields[field].(string)
+	if !ok {
+		return "", fmt.Errorf("no field %q", field)
+	}
+	return v, nil
+}
+
+// The builtin secret resolvers
+func init() {
+	RegisterSecretResolver("env", func(ref string) (string, error) {
+		v, ok := os.LookupEnv(ref)
+		if !ok {
+			return "", fmt.Errorf("%s isn't set", ref)
+		}
+		return v, nil
+	})
+	RegisterSecretResolver("file", func(ref string) (string, error) {
+		b, err := ioutil.ReadFile(ref)
+		return strings.TrimRight(string(b), "\r\n"), err
+	})
+	RegisterSecretResolver("vault", vaultSecret)
+	RegisterSecretResolver("aws-sm", awsSecret)
+}
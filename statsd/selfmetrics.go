@@ -0,0 +1,69 @@
+package statsd
+
+import (
+	"runtime"
+	"time"
+)
+
+// SelfPrefix is prepended to the buckets of the metrics reported by SelfMetrics
+const SelfPrefix = "statsd.self."
+
+// SelfMetrics reports the Go runtime and process statistics of the server itself through
+// the normal pipeline, every Interval, as gauges and counters under SelfPrefix:
+//
+//	heap_bytes, heap_objects, sys_bytes, goroutines   gauges of the Go runtime
+//	gc_runs, gc_pause_ms                              counters of the garbage collections
+//	cpu_seconds                                       counter of the CPU time used
+//	rss_bytes, open_fds                               gauges of the process
+//
+// The CPU time, resident set size and open file descriptors are only reported on Linux.
+type SelfMetrics struct {
+	Interval time.Duration // How often the statistics are reported, every 10s if zero
+	Handler  Handler
+}
+
+// Run reports the statistics every Interval until the program exits
+func (s *SelfMetrics) Run() {
+	interval := s.Interval
+	if interval <= 0 {
+		interval = 10 * time.Second
+	}
+	var last runtime.MemStats
+	runtime.ReadMemStats(&last)
+	lastCPU, _ := readProcessStats()
+	for _ = range time.Tick(interval) {
+		var mem runtime.MemStats
+		runtime.ReadMemStats(&mem)
+		s.gauge("heap_bytes", float64(mem.HeapAlloc))
+		s.gauge("heap_objects", float64(mem.HeapObjects))
+		s.gauge("sys_bytes", float64(mem.Sys))
+		s.gauge("goroutines", float64(runtime.NumGoroutine()))
+		s.counter("gc_runs", float64(mem.NumGC-last.NumGC))
+		s.counter("gc_pause_ms", float64(mem.PauseTotalNs-last.PauseTotalNs)/1e6)
+		last = mem
+
+		if p, err := readProcessStats(); err == nil {
+			s.counter("cpu_seconds", (p.cpu - lastCPU.cpu).Seconds())
+			s.gauge("rss_bytes", float64(p.rss))
+			s.gauge("open_fds", float64(p.fds))
+			lastCPU = p
+		}
+	}
+}
+
+// gauge reports a gauge under SelfPrefix
+func (s *SelfMetrics) gauge(name string, v float64) {
+	s.Handler.HandleMetric(Metric{Type: GAUGE, Bucket: SelfPrefix + name, Value: v, SampleRate: 1})
+}
+
+// counter reports a counter under SelfPrefix
+func (s *SelfMetrics) counter(name string, v float64) {
+	s.Handler.HandleMetric(Metric{Type: COUNTER, Bucket: SelfPrefix + name, Value: v, SampleRate: 1})
+}
+
+// processStats are the statistics of the process kept by the operating system
+type processStats struct {
+	cpu time.Duration // User and system CPU time used
+	rss int64         // Resident set size in bytes
+	fds int           // Open file descriptors
+}
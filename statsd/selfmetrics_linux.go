@@ -0,0 +1,39 @@
+//go:build linux
+// +build linux
+
+package statsd
+
+import (
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// readProcessStats reads the statistics of the process from getrusage and /proc
+func readProcessStats() (p processStats, err error) {
+	var usage syscall.Rusage
+	if err = syscall.Getrusage(syscall.RUSAGE_SELF, &usage); err != nil {
+		return p, err
+	}
+	p.cpu = time.Duration(usage.Utime.Nano() + usage.Stime.Nano())
+
+	// The second field of statm is the resident set size in pages
+	statm, err := ioutil.ReadFile("/proc/self/statm")
+	if err != nil {
+		return p, err
+	}
+	if fields := strings.Fields(string(statm)); len(fields) > 1 {
+		pages, _ := strconv.ParseInt(fields[1], 10, 64)
+		p.rss = pages * int64(os.Getpagesize())
+	}
+
+	fds, err := ioutil.ReadDir("/proc/self/fd")
+	if err != nil {
+		return p, err
+	}
+	p.fds = len(fds)
+	return p, nil
+}
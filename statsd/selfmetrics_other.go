@@ -0,0 +1,11 @@
+//go:build !linux
+// +build !linux
+
+package statsd
+
+import "errors"
+
+// readProcessStats reads the statistics of the process
+func readProcessStats() (processStats, error) {
+	return processStats{}, errors.New("process statistics are only supported on Linux")
+}
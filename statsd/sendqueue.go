@@ -0,0 +1,84 @@
+package statsd
+
+import (
+	"errors"
+	"log"
+	"sync"
+	"time"
+)
+
+// ErrSendQueueFull is returned by a SendQueue that has no room left for a flush
+var ErrSendQueueFull = errors.New("send queue full, flush dropped")
+
+// SendQueue is a MetricSender that queues flushes for its Sender and returns without
+// waiting for them to be sent, so a slow backend doesn't hold back the flushes of the
+// others. Backends aren't safe for concurrent use, so the flushes are sent one at a time,
+// each given up on after Timeout: a flush given up on is left to finish in the background
+// and the next one waits for it. Errors of queued flushes are logged since the aggregator
+// has moved on by then.
+type SendQueue struct {
+	Name    string // Name of the backend in log messages
+	Sender  MetricSender
+	Timeout time.Duration // If set, how long a flush may take before it's given up on
+	Length  int           // Flushes waiting to be sent, 10 if zero
+
+	once  sync.Once
+	queue chan timedMetricMap
+}
+
+// SendMetrics queues the metrics in a MetricMap
+func (q *SendQueue) SendMetrics(metrics MetricMap) error {
+	return q.SendMetricsAt(metrics, time.Now())
+}
+
+// SendMetricsAt queues the metrics in a MetricMap with the timestamp t
+func (q *SendQueue) SendMetricsAt(metrics MetricMap, t time.Time) error {
+	q.once.Do(q.start)
+	select {
+	case q.queue <- timedMetricMap{metrics, t}:
+		return nil
+	default:
+		return ErrSendQueueFull
+	}
+}
+
+// start starts the worker sending the queued flushes
+func (q *SendQueue) start() {
+	length := q.Length
+	if length <= 0 {
+		length = 10
+	}
+	q.queue = make(chan timedMetricMap, length)
+	go func() {
+		var abandoned <-chan error
+		for f := range q.queue {
+			if abandoned != nil {
+				<-abandoned
+			}
+			var err error
+			if abandoned, err = q.send(f); err != nil {
+				log.Printf("Sending metrics to %s failed: %s", q.Name, err)
+			}
+		}
+	}()
+}
+
+// send sends a flush, giving up after the timeout. A send given up on keeps running in
+// the background, and the channel it returns receives once it is over.
+func (q *SendQueue) send(f timedMetricMap) (abandoned <-chan error, err error) {
+	if q.Timeout <= 0 {
+		return nil, sendMetricsAt(q.Sender, f.Metrics, f.Time)
+	}
+	errc := make(chan error, 1)
+	go func() {
+		errc <- sendMetricsAt(q.Sender, f.Metrics, f.Time)
+	}()
+	timer := time.NewTimer(q.Timeout)
+	defer timer.Stop()
+	select {
+	case err := <-errc:
+		return nil, err
+	case <-timer.C:
+		return errc, errors.New("timed out after " + q.Timeout.String())
+	}
+}
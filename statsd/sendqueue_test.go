@@ -0,0 +1,64 @@
+package statsd
+
+import (
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// slowSender is a backend that blocks each send until released, counting concurrent sends
+type slowSender struct {
+	release  chan struct{}
+	sent     chan MetricMap
+	inFlight int32
+	overlap  int32
+}
+
+func (s *slowSender) SendMetrics(metrics MetricMap) error {
+	if atomic.AddInt32(&s.inFlight, 1) > 1 {
+		atomic.StoreInt32(&s.overlap, 1)
+	}
+	defer atomic.AddInt32(&s.inFlight, -1)
+	<-s.release
+	s.sent <- metrics
+	return nil
+}
+
+func TestSendQueueTimeout(t *testing.T) {
+	s := &slowSender{release: make(chan struct{}), sent: make(chan MetricMap, 2)}
+	q := &SendQueue{Name: "slow", Sender: s, Timeout: 10 * time.Millisecond}
+	q.SendMetrics(MetricMap{"first": 1})
+	q.SendMetrics(MetricMap{"second": 1})
+
+	// The first send is given up on, but the second must wait for it to return
+	time.Sleep(50 * time.Millisecond)
+	if n := atomic.LoadInt32(&s.inFlight); n != 1 {
+		t.Fatalf("expected only the send given up on to be running, got %d", n)
+	}
+	s.release <- struct{}{}
+	if m := <-s.sent; m["first"] != 1 {
+		t.Errorf("expected the first flush to be sent first, got %v", m)
+	}
+	s.release <- struct{}{}
+	if m := <-s.sent; m["second"] != 1 {
+		t.Errorf("expected the second flush to be sent next, got %v", m)
+	}
+	if atomic.LoadInt32(&s.overlap) != 0 {
+		t.Error("expected the sends not to overlap")
+	}
+}
+
+func TestSendQueueFull(t *testing.T) {
+	s := &slowSender{release: make(chan struct{}), sent: make(chan MetricMap, 3)}
+	q := &SendQueue{Name: "slow", Sender: s, Length: 1}
+	defer close(s.release)
+
+	var err error
+	for i := 0; i < 3 && err == nil; i++ {
+		err = q.SendMetrics(MetricMap{"foo": 1})
+		time.Sleep(10 * time.Millisecond)
+	}
+	if err != ErrSendQueueFull {
+		t.Errorf("expected the queue to fill up, got %v", err)
+	}
+}
@@ -0,0 +1,1021 @@
+package statsd
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+// DefaultFlushInterval is the flush interval of a Server whose Config doesn't set one
+const DefaultFlushInterval = 10 * time.Second
+
+// Config describes the listeners, processing and backends of a Server
+type Config struct {
+	Addr     string // Comma separated UDP addresses, DefaultMetricsAddr if empty
+	Network  string // "udp4", "udp6" or "udp", the default
+	TCPAddr  string // If set, also accept newline terminated metrics over TCP
+	HTTPAddr string // If set, also accept metrics POSTed over HTTP
+
+	// If set, also accept DTLS encrypted datagrams and metrics over QUIC, with the PEM
+	// encoded certificate and private key of the files given
+	DTLSAddr, DTLSCertFile, DTLSKeyFile string
+	QUICAddr, QUICCertFile, QUICKeyFile string
+
+	PipeName     string // If set, also accept newline terminated metrics on this Windows named pipe
+	CollectdAddr string // If set, also accept collectd's binary network protocol
+
+	// Options of the receivers, see MetricReceiver
+	MulticastInterface  string
+	SocketOptions       SocketOptions
+	KernelStatsInterval time.Duration
+	Tokens              map[string][]string
+	StrictFraming       bool
+	MaxLineLength       int
+	TruncateLongLines   bool
+	Tagger              SourceTagger
+	Mirror              *Mirror
+	Events              EventHandler // If set, the handler of the DogStatsD events received
+
+	AdminAddr string             // If set, serve the HTTP admin API on this address
+	Settings  func() interface{} // If set, the effective settings served by the admin API
+
+	FlushInterval time.Duration // DefaultFlushInterval if zero
+	FlushJitter   time.Duration // If set, each flush is sent after a random delay up to this long
+	QueueSize     int           // Metrics queued for aggregation, 10000 if zero
+	StateFile     string        // If set, the aggregator state is restored from and saved to this file
+	WALDir        string        // If set, the metrics are journaled here and those not flushed yet replayed by Start
+	Upstream      StateSender   // If set, the state of each interval is sent here to be merged instead of being flushed
+	Elector       *PeerElector  // If set, only the leader of a high availability pair flushes
+
+	// How the metrics are aggregated, see MetricAggregator. The destinations aggregate them
+	// the same way unless they override it.
+	SubInterval   time.Duration
+	RoundCounts   bool
+	GaugeExtremes bool
+	CounterEvents bool
+	SetPrecision  uint8
+	TimerUnit     TimeUnit
+	Histograms    []Histogram
+	Percentiles   []PercentileSet
+	Lateness      time.Duration
+	MemoryBudget  int64
+	ShedPolicy    ShedPolicy
+
+	// Where the flushed metrics are sent, each of them every flush. There must be at least one.
+	Backends []BackendConfig
+
+	// Metrics of some types, or carrying some tag, aggregated and flushed elsewhere
+	Destinations []Destination
+
+	// What is done with each flush on its way to the backends. The Sender of Anomaly, Stream
+	// and History is set by the server; Stream also gets the metrics received, History is
+	// served by the admin API.
+	Alerts  []AlertRule
+	Anomaly *AnomalyDetector
+	Stream  *MetricStream
+	History *MetricHistory
+	Rollups []RollupRule
+
+	// If Compare is set, the metrics are also aggregated by Candidate, whose flushes go to
+	// the comparator instead of the backends. Its Sender is set by the server.
+	Compare   *FlushComparator
+	Candidate *MetricAggregator
+
+	// Processing of the received metrics before they are aggregated, in this order
+	Tenants             []Tenant // See TenantHandler
+	TenantTag           string
+	Mappings            []MappingRule
+	Schema              []SchemaRule // See SchemaHandler
+	SchemaReportOnly    bool
+	TagPolicies         []TagPolicy
+	Quotas              []Quota
+	AdaptiveSampling    bool // If set, busy counters and timers are downsampled while the queue fills up
+	TagRollups          []TagRollup
+	InputTimerUnit      TimeUnit      // Unit of the timers received, milliseconds if empty
+	ServiceCheckTimeout time.Duration // If set, service checks not received for this long become unknown
+
+	// Internal metrics
+	Canary           *Canary       // If set, measures the latency up to each backend; its Handler is set by the server
+	SelfMetrics      bool          // If set, report the runtime and process statistics of the server
+	DuplicateSources int           // If set, report the gauges written by this many sources, see SourceTracker
+	PerSender        int           // If set, report the traffic of this many of the sources sending the most
+	Watchdog         *Watchdog     // If set, its Aggregator and Handler are set by the server
+	ScrapeTargets    []string      // If set, Prometheus endpoints whose metrics are scraped
+	ScrapeInterval   time.Duration // How often they are scraped, see Scraper
+}
+
+// BackendConfig names a registered backend along with its address and backend specific
+// options, as taken by NewBackend
+type BackendConfig struct {
+	Name    string            `json:"name"`
+	Address string            `json:"address"`
+	Options map[string]string `json:"options"`
+}
+
+// Destination takes the metrics of some types, or those carrying a tag, away from the
+// backends of a Server to an aggregator of its own flushing to Sender
+type Destination struct {
+	Sender        MetricSender
+	Types         []MetricType
+	Tag           string        // If set, only the metrics carrying this tag, e.g. "team:payments", of Types if any
+	FlushInterval time.Duration // That of the server if zero
+	TimerUnit     TimeUnit      // That of the server if empty
+	CounterEvents *bool         // That of the server if nil
+}
+
+// Server runs a complete statsd pipeline: receivers feeding the enrichment handlers,
+// which feed an aggregator flushing to the backends. NewServer builds it from a Config,
+// Start starts it from the backends up and Stop stops it from the receivers down, so
+// that no metric received before Stop is lost.
+//
+// The receivers and the aggregator are supervised: when one fails, returning an error
+// or panicking, it is restarted after a delay that doubles from 100ms up to 30s, and
+// reopens its listener. A backend failing to send is created again through its factory
+// after the same delays, at the first flush once they have passed. Failures and failing
+// backends show in Health.
+type Server struct {
+	Config     Config
+	Aggregator *MetricAggregator
+	Handler    Handler // The head of the pipeline, which the receivers feed
+
+	mu           sync.Mutex
+	started      bool
+	quit         chan struct{}  // Closed by Stop
+	wg           sync.WaitGroup // Receivers running
+	aggDone      chan struct{}  // Closed once the aggregator is stopped for good
+	admin        *http.Server
+	backends     *backendSet
+	destinations []*MetricAggregator
+	tenants      *TenantHandler
+	sources      *SourceTracker
+	accounting   *SenderAccounting
+	runners      []func() // Producers of internal metrics, run until the program exits
+	runOnce      sync.Once
+
+	healthMu sync.Mutex
+	health   map[string]*ComponentStatus
+}
+
+// ComponentStatus is the health of a component of a Server
+type ComponentStatus struct {
+	Name      string    `json:"name"` // e.g. "udp :8125", "aggregator" or "backend graphite localhost:2003"
+	Healthy   bool      `json:"healthy"`
+	Failures  int       `json:"failures"`             // Since the Server started
+	LastError string    `json:"last_error,omitempty"` // Of the last failure
+	Since     time.Time `json:"since"`                // When it last became healthy or failed
+}
+
+// Delays before restarting a failed component
+const (
+	minRestartDelay = 100 * time.Millisecond
+	maxRestartDelay = 30 * time.Second
+)
+
+// component is a receiver of a Server, restarted when it fails
+type component struct {
+	name string
+
+	// open opens the listener of the component and returns the loop receiving on it,
+	// which returns once closeFn is called
+	open func() (loop func() error, closeFn func() error, err error)
+}
+
+// NewServer builds the pipeline of cfg. Nothing is started until Start is called.
+func NewServer(cfg Config) (*Server, error) {
+	if len(cfg.Backends) == 0 {
+		return nil, errors.New("server has no backends")
+	}
+	if cfg.Compare != nil && cfg.Candidate == nil {
+		return nil, errors.New("server compares flushes without a candidate aggregator")
+	}
+	if cfg.Elector != nil {
+		if err := cfg.Elector.Validate(); err != nil {
+			return nil, err
+		}
+	}
+	for _, r := range cfg.Mappings {
+		if err := r.Validate(); err != nil {
+			return nil, err
+		}
+	}
+	if errs := ValidateAlertRules(cfg.Alerts); len(errs) > 0 {
+		return nil, errs[0]
+	}
+	if cfg.FlushInterval <= 0 {
+		cfg.FlushInterval = DefaultFlushInterval
+	}
+	if cfg.QueueSize <= 0 {
+		cfg.QueueSize = 10000
+	}
+	s := &Server{Config: cfg}
+	backends, err := s.newBackends(cfg.Backends)
+	if err != nil {
+		return nil, err
+	}
+	s.backends = &backendSet{backends: backends}
+
+	// The flushes go through the senders of cfg on their way to the backends
+	var sender MetricSender = s.backends
+	if len(cfg.Alerts) > 0 {
+		sender = &AlertSender{Rules: cfg.Alerts, Sender: sender}
+	}
+	if cfg.Anomaly != nil {
+		cfg.Anomaly.Sender = sender
+		sender = cfg.Anomaly
+	}
+	if cfg.Stream != nil {
+		cfg.Stream.Sender = sender
+		sender = cfg.Stream
+	}
+	if cfg.History != nil {
+		cfg.History.Sender = sender
+		sender = cfg.History
+	}
+	if len(cfg.Rollups) > 0 {
+		sender = &RollupSender{Rules: cfg.Rollups, Sender: sender}
+	}
+	if cfg.Compare != nil {
+		sender = cfg.Compare.Primary(sender)
+	}
+	aggregator := NewMetricAggregator(sender, cfg.FlushInterval)
+	cfg.aggregation(&aggregator)
+	aggregator.SubInterval = cfg.SubInterval
+	aggregator.Lateness = cfg.Lateness
+	aggregator.Upstream = cfg.Upstream
+	aggregator.MetricChan = make(chan Metric, cfg.QueueSize)
+	aggregator.BatchChan = make(chan []Metric, cfg.QueueSize)
+	if cfg.Elector != nil {
+		aggregator.Elector = cfg.Elector
+	}
+	s.Aggregator = &aggregator
+
+	var handler Handler = queueHandler{&aggregator, cfg.Stream}
+	if cfg.Compare != nil {
+		cfg.Candidate.Sender = cfg.Compare.Candidate()
+		handler = &TeeHandler{Handlers: []Handler{handler, queueHandler{cfg.Candidate, nil}}}
+	}
+	if len(cfg.Destinations) > 0 {
+		router := &TypeRouter{Handlers: make(map[MetricType]Handler), Default: handler}
+		var tagRoutes []TagRoute
+		for _, d := range cfg.Destinations {
+			h := queueHandler{s.newDestination(d), cfg.Stream}
+			if d.Tag != "" {
+				tagRoutes = append(tagRoutes, TagRoute{Tag: d.Tag, Types: d.Types, Handler: h})
+				continue
+			}
+			for _, t := range d.Types {
+				router.Handlers[t] = h
+			}
+		}
+		handler = router
+		if len(tagRoutes) > 0 {
+			handler = &TagRouter{Routes: tagRoutes, Default: router}
+		}
+	}
+	if cfg.ServiceCheckTimeout > 0 {
+		heartbeats := &HeartbeatHandler{Timeout: cfg.ServiceCheckTimeout, Handler: handler}
+		s.runners = append(s.runners, heartbeats.Run)
+		handler = heartbeats
+	}
+	if cfg.InputTimerUnit != "" && cfg.InputTimerUnit != Milliseconds {
+		handler = &TimerUnitHandler{Unit: cfg.InputTimerUnit, Handler: handler}
+	}
+	if len(cfg.TagRollups) > 0 {
+		handler = &TagRollupHandler{Rules: cfg.TagRollups, Handler: handler}
+	}
+	if cfg.AdaptiveSampling {
+		handler = &AdaptiveSampler{Aggregator: &aggregator, MinBucketRate: 100, Handler: handler}
+	}
+	if len(cfg.Quotas) > 0 {
+		quotas := &QuotaHandler{Quotas: cfg.Quotas, Interval: cfg.FlushInterval, Handler: handler}
+		s.runners = append(s.runners, quotas.Run)
+		handler = quotas
+	}
+	if len(cfg.TagPolicies) > 0 {
+		handler = &TagPolicyHandler{Policies: cfg.TagPolicies, Handler: handler}
+	}
+	if len(cfg.Schema) > 0 {
+		schema := &SchemaHandler{Rules: cfg.Schema, ReportOnly: cfg.SchemaReportOnly, Interval: cfg.FlushInterval, Handler: handler}
+		s.runners = append(s.runners, schema.Run)
+		handler = schema
+	}
+	if len(cfg.Mappings) > 0 {
+		handler = &MappingHandler{Rules: cfg.Mappings, Handler: handler}
+	}
+	if cfg.DuplicateSources > 0 {
+		s.sources = &SourceTracker{MinSources: cfg.DuplicateSources, Interval: cfg.FlushInterval, Handler: handler}
+		s.runners = append(s.runners, s.sources.Run)
+	}
+	if cfg.PerSender > 0 {
+		s.accounting = &SenderAccounting{TopN: cfg.PerSender, Interval: cfg.FlushInterval, Handler: handler}
+		s.runners = append(s.runners, s.accounting.Run)
+	}
+	if len(cfg.Tenants) > 0 {
+		s.tenants = &TenantHandler{Tenants: cfg.Tenants, TagKey: cfg.TenantTag, Interval: cfg.FlushInterval, Handler: handler}
+		s.runners = append(s.runners, s.tenants.Run)
+		handler = s.tenants
+	}
+
+	// The internal metrics are processed like those received
+	if cfg.Canary != nil {
+		cfg.Canary.Handler = handler
+		s.runners = append(s.runners, cfg.Canary.Run)
+	}
+	if cfg.SelfMetrics {
+		self := &SelfMetrics{Interval: cfg.FlushInterval, Handler: handler}
+		s.runners = append(s.runners, self.Run)
+	}
+	if cfg.Watchdog != nil {
+		cfg.Watchdog.Aggregator, cfg.Watchdog.Handler = &aggregator, handler
+		if cfg.Watchdog.Interval <= 0 {
+			cfg.Watchdog.Interval = cfg.FlushInterval
+		}
+		s.runners = append(s.runners, cfg.Watchdog.Run)
+	}
+	if len(cfg.ScrapeTargets) > 0 {
+		scraper := &Scraper{Targets: cfg.ScrapeTargets, Interval: cfg.ScrapeInterval, Handler: handler}
+		s.runners = append(s.runners, scraper.Run)
+	}
+	s.Config, s.Handler = cfg, handler
+	return s, nil
+}
+
+// aggregation applies the settings of cfg shared by the aggregators of the server
+func (cfg *Config) aggregation(a *MetricAggregator) {
+	a.RoundCounts = cfg.RoundCounts
+	a.GaugeExtremes = cfg.GaugeExtremes
+	a.CounterEvents = cfg.CounterEvents
+	a.SetPrecision = cfg.SetPrecision
+	a.TimerUnit = cfg.TimerUnit
+	a.Histograms = cfg.Histograms
+	a.Percentiles = cfg.Percentiles
+	a.MemoryBudget = cfg.MemoryBudget
+	a.ShedPolicy = cfg.ShedPolicy
+	a.FlushJitter = cfg.FlushJitter
+}
+
+// newDestination creates the aggregator of d, started and stopped along with the server's
+func (s *Server) newDestination(d Destination) *MetricAggregator {
+	flushInterval := s.Config.FlushInterval
+	if d.FlushInterval > 0 {
+		flushInterval = d.FlushInterval
+	}
+	aggregator := NewMetricAggregator(d.Sender, flushInterval)
+	s.Config.aggregation(&aggregator)
+	if d.TimerUnit != "" {
+		aggregator.TimerUnit = d.TimerUnit
+	}
+	if d.CounterEvents != nil {
+		aggregator.CounterEvents = *d.CounterEvents
+	}
+	s.destinations = append(s.destinations, &aggregator)
+	return &aggregator
+}
+
+// newBackends creates the backends of configs
+func (s *Server) newBackends(configs []BackendConfig) ([]*supervisedSender, error) {
+	var backends []*supervisedSender
+	for _, b := range configs {
+		backend, sender, err := s.newBackend(b)
+		if err != nil {
+			return nil, err
+		}
+		name := "backend " + b.Name
+		if b.Address != "" {
+			name += " " + b.Address
+		}
+		backends = append(backends, &supervisedSender{name: name, config: b, backend: backend, sender: sender, server: s})
+	}
+	return backends, nil
+}
+
+// newBackend creates the backend of config through its factory, and returns it with the
+// sender flushing to it, wrapped by the canary if there is one
+func (s *Server) newBackend(config BackendConfig) (backend, sender MetricSender, err error) {
+	if backend, err = NewBackend(config.Name, config.Address, config.Options); err != nil {
+		return nil, nil, err
+	}
+	sender = backend
+	if s.Config.Canary != nil {
+		sender = s.Config.Canary.Sender(config.Name, sender)
+	}
+	return backend, sender, nil
+}
+
+// ReplaceBackends replaces the backends the server flushes to by those of configs, e.g.
+// on a configuration reload. The swap waits for the flush in progress, if any, to be sent
+// to the old backends, and every later flush goes to the new ones, so nothing is lost or
+// sent twice. The old backends are then closed if they implement io.Closer. If one of the
+// new backends can't be created the old ones are kept.
+func (s *Server) ReplaceBackends(configs []BackendConfig) error {
+	if len(configs) == 0 {
+		return errors.New("server has no backends")
+	}
+	backends, err := s.newBackends(configs)
+	if err != nil {
+		return err
+	}
+
+	defer s.mu.Unlock()
+	s.mu.Lock()
+	old := s.backends.swap(backends)
+	s.Config.Backends = configs
+	if s.started {
+		for _, b := range old {
+			s.forget(b.name)
+		}
+		for _, b := range backends {
+			s.setHealthy(b.name)
+		}
+	}
+	for _, b := range old {
+		b.close()
+	}
+	return nil
+}
+
+// Start restores the saved state, starts the aggregators, then the admin API and finally
+// the receivers. The listeners are all open once it returns; if one of them can't be
+// opened those opened already are closed and the error returned.
+func (s *Server) Start() error {
+	defer s.mu.Unlock()
+	s.mu.Lock()
+	if s.started {
+		return errors.New("server already started")
+	}
+	cfg := s.Config
+
+	if cfg.StateFile != "" {
+		if err := s.Aggregator.LoadStateFile(cfg.StateFile); err != nil {
+			return err
+		}
+	}
+	if cfg.WALDir != "" && s.Aggregator.Journal == nil {
+		journal, err := OpenWriteAheadLog(cfg.WALDir)
+		if err != nil {
+			return err
+		}
+		s.Aggregator.Journal = journal
+		if err := s.Aggregator.ReplayJournal(); err != nil {
+			return err
+		}
+	}
+	s.quit = make(chan struct{})
+	s.aggDone = make(chan struct{})
+	s.healthMu.Lock()
+	s.health = make(map[string]*ComponentStatus)
+	s.healthMu.Unlock()
+	for _, b := range s.backends.get() {
+		s.setHealthy(b.name)
+	}
+	s.setHealthy("aggregator")
+	go s.runAggregator()
+	for _, a := range s.aggregators() {
+		go a.Aggregate()
+	}
+	s.runOnce.Do(s.run)
+
+	// Open all the listeners before starting any receiver
+	components := s.components(cfg)
+	type opened struct {
+		loop, closeFn func() error
+	}
+	var open []opened
+	var err error
+	for _, c := range components {
+		var o opened
+		if o.loop, o.closeFn, err = c.open(); err != nil {
+			err = fmt.Errorf("%s: %s", c.name, err)
+			break
+		}
+		open = append(open, o)
+	}
+	if err == nil && cfg.AdminAddr != "" {
+		var l net.Listener
+		if l, err = net.Listen("tcp", cfg.AdminAddr); err == nil {
+			s.admin = &http.Server{Handler: &AdminServer{Addr: cfg.AdminAddr, Aggregator: s.Aggregator, Health: s.Health,
+				History: cfg.History, Sources: s.sources, Config: cfg.Settings}}
+			go s.admin.Serve(l)
+		}
+	}
+	if err != nil {
+		for _, o := range open {
+			o.closeFn()
+		}
+		close(s.quit)
+		s.stopAggregators(false)
+		return err
+	}
+
+	for i, c := range components {
+		s.setHealthy(c.name)
+		s.wg.Add(1)
+		go s.supervise(c, open[i].loop, open[i].closeFn)
+	}
+	s.started = true
+	return nil
+}
+
+// aggregators returns the aggregators of the destinations and the candidate, which run
+// along with the server's
+func (s *Server) aggregators() []*MetricAggregator {
+	aggregators := s.destinations
+	if s.Config.Candidate != nil {
+		aggregators = append(aggregators[:len(aggregators):len(aggregators)], s.Config.Candidate)
+	}
+	return aggregators
+}
+
+// run starts the producers of internal metrics and the elector, which run until the
+// program exits
+func (s *Server) run() {
+	for _, run := range s.runners {
+		go run()
+	}
+	if e := s.Config.Elector; e != nil {
+		s.setHealthy("elector")
+		go func() {
+			err := e.Run()
+			s.setFailed("elector", err)
+			log.Printf("elector failed: %s", err)
+		}()
+	}
+}
+
+// components returns the receivers of cfg
+func (s *Server) components(cfg Config) []component {
+	var components []component
+	newReceiver := func(addr string, handler Handler) *MetricReceiver {
+		return &MetricReceiver{Addr: addr, Network: cfg.Network, Handler: handler, Events: cfg.Events,
+			MulticastInterface: cfg.MulticastInterface, SocketOptions: cfg.SocketOptions, KernelStatsInterval: cfg.KernelStatsInterval,
+			Tokens: cfg.Tokens, StrictFraming: cfg.StrictFraming, MaxLineLength: cfg.MaxLineLength, TruncateLongLines: cfg.TruncateLongLines,
+			Tagger: cfg.Tagger, Mirror: cfg.Mirror, Watchdog: cfg.Watchdog, Sources: s.sources, PerSender: s.accounting, SyncHandlers: true}
+	}
+	// stream returns the component receiving from the listener opened by listen on loop
+	stream := func(name string, listen func() (net.Listener, error), loop func(net.Listener) error) component {
+		return component{name, func() (func() error, func() error, error) {
+			l, err := listen()
+			if err != nil {
+				return nil, nil, err
+			}
+			return func() error { return loop(l) }, l.Close, nil
+		}}
+	}
+
+	udp := newReceiver(cfg.Addr, s.Handler)
+	components = append(components, udpComponents("udp", udp)...)
+	for _, t := range cfg.Tenants {
+		if t.Listen != "" {
+			r := newReceiver(t.Listen, s.tenants.Listener(t.Name))
+			r.Mirror = nil
+			components = append(components, udpComponents("tenant "+t.Name, r)...)
+		}
+	}
+	if cfg.DTLSAddr != "" {
+		dtls := newReceiver(cfg.DTLSAddr, s.Handler)
+		components = append(components, stream("dtls "+cfg.DTLSAddr, func() (net.Listener, error) {
+			return dtls.listenDTLS(cfg.DTLSCertFile, cfg.DTLSKeyFile)
+		}, dtls.ReceiveDTLS))
+	}
+	if cfg.TCPAddr != "" {
+		tcp := newReceiver(cfg.TCPAddr, s.Handler)
+		tcp.Queue = s.Aggregator.MetricChan
+		components = append(components, stream("tcp "+cfg.TCPAddr, func() (net.Listener, error) {
+			return net.Listen("tcp", cfg.TCPAddr)
+		}, tcp.ReceiveTCP))
+	}
+	if cfg.HTTPAddr != "" {
+		h := newReceiver(cfg.HTTPAddr, s.Handler)
+		h.Queue = s.Aggregator.MetricChan
+		components = append(components, component{"http " + cfg.HTTPAddr, func() (func() error, func() error, error) {
+			l, err := net.Listen("tcp", cfg.HTTPAddr)
+			if err != nil {
+				return nil, nil, err
+			}
+			srv := &http.Server{Handler: h}
+			loop := func() error {
+				if err := srv.Serve(l); err != http.ErrServerClosed {
+					return err
+				}
+				return nil
+			}
+			return loop, srv.Close, nil
+		}})
+	}
+	if cfg.QUICAddr != "" {
+		q := newReceiver(cfg.QUICAddr, s.Handler)
+		q.Queue = s.Aggregator.MetricChan
+		components = append(components, component{"quic " + cfg.QUICAddr, func() (func() error, func() error, error) {
+			l, err := q.listenQUIC(cfg.QUICCertFile, cfg.QUICKeyFile)
+			if err != nil {
+				return nil, nil, err
+			}
+			return func() error { return q.ReceiveQUIC(l) }, l.Close, nil
+		}})
+	}
+	if cfg.PipeName != "" {
+		pipe := newReceiver(cfg.PipeName, s.Handler)
+		pipe.Queue = s.Aggregator.MetricChan
+		components = append(components, stream("pipe "+cfg.PipeName, func() (net.Listener, error) {
+			return listenPipe(cfg.PipeName)
+		}, pipe.ReceiveTCP))
+	}
+	if cfg.CollectdAddr != "" {
+		collectd := &CollectdReceiver{Addr: cfg.CollectdAddr, Handler: s.Handler}
+		components = append(components, component{"collectd " + cfg.CollectdAddr, func() (func() error, func() error, error) {
+			c, err := net.ListenPacket("udp", cfg.CollectdAddr)
+			if err != nil {
+				return nil, nil, err
+			}
+			return func() error { return collectd.Receive(c) }, c.Close, nil
+		}})
+	}
+	return components
+}
+
+// udpComponents returns a component for each address of the UDP receiver r, monitoring
+// the kernel statistics of its socket if r asks for it
+func udpComponents(kind string, r *MetricReceiver) []component {
+	var components []component
+	for _, addr := range r.addrs() {
+		addr := addr
+		components = append(components, component{kind + " " + addr, func() (func() error, func() error, error) {
+			c, err := r.listen(addr)
+			if err != nil {
+				return nil, nil, err
+			}
+			loop := func() error { return r.Receive(c) }
+			if r.KernelStatsInterval <= 0 {
+				return loop, c.Close, nil
+			}
+			done := make(chan struct{})
+			go r.monitorKernelStats([]*net.UDPConn{c}, done)
+			var once sync.Once
+			return loop, func() error {
+				once.Do(func() { close(done) })
+				return c.Close()
+			}, nil
+		}})
+	}
+	return components
+}
+
+// supervise runs the loop of c until Stop is called, reopening c after a delay each time
+// the loop fails or returns early
+func (s *Server) supervise(c component, loop, closeFn func() error) {
+	defer s.wg.Done()
+	delay := minRestartDelay
+	for {
+		done := make(chan struct{})
+		go func(closeFn func() error) {
+			select {
+			case <-s.quit:
+				closeFn()
+			case <-done:
+			}
+		}(closeFn)
+		started := time.Now()
+		err := protect(loop)
+		close(done)
+		closeFn()
+		select {
+		case <-s.quit:
+			return
+		default:
+		}
+		if err == nil {
+			err = errors.New("stopped receiving")
+		}
+		if time.Since(started) > time.Minute {
+			delay = minRestartDelay
+		}
+
+		// Reopen it, retrying until it works
+		for {
+			s.setFailed(c.name, err)
+			log.Printf("%s failed: %s, restarting in %s", c.name, err, delay)
+			select {
+			case <-s.quit:
+				return
+			case <-time.After(delay):
+			}
+			if delay *= 2; delay > maxRestartDelay {
+				delay = maxRestartDelay
+			}
+			if loop, closeFn, err = c.open(); err == nil {
+				break
+			}
+		}
+		s.setHealthy(c.name)
+	}
+}
+
+// runAggregator runs the aggregator until it is stopped, restarting it if it panics
+func (s *Server) runAggregator() {
+	defer close(s.aggDone)
+	delay := minRestartDelay
+	for {
+		err := protect(func() error {
+			s.Aggregator.Aggregate()
+			return nil
+		})
+		if err == nil {
+			return
+		}
+		s.setFailed("aggregator", err)
+		log.Printf("aggregator failed: %s, restarting in %s", err, delay)
+		time.Sleep(delay)
+		if delay *= 2; delay > maxRestartDelay {
+			delay = maxRestartDelay
+		}
+		s.setHealthy("aggregator")
+	}
+}
+
+// protect calls f, turning a panic in to an error
+func protect(f func() error) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("panic: %v", r)
+		}
+	}()
+	return f()
+}
+
+// Stop closes the receivers and waits for their loops to return, stops the aggregator
+// once it has aggregated the metrics they queued, and closes the admin API. With a
+// StateFile the current interval is saved to it to be restored by the next Start,
+// otherwise it is flushed to the backends. Metrics still arriving on TCP connections
+// opened before Stop are dropped.
+func (s *Server) Stop() error {
+	defer s.mu.Unlock()
+	s.mu.Lock()
+	if !s.started {
+		return errors.New("server not started")
+	}
+	s.started = false
+
+	close(s.quit)
+	s.wg.Wait()
+	s.stopAggregators(s.Config.StateFile == "")
+	if s.admin != nil {
+		s.admin.Close()
+		s.admin = nil
+	}
+	if s.Config.StateFile != "" {
+		return s.Aggregator.SaveStateFile(s.Config.StateFile)
+	}
+	return nil
+}
+
+// stopAggregators stops the aggregator of the server, flushing it if flush is set, then
+// those of the destinations and the candidate, flushing them
+func (s *Server) stopAggregators(flush bool) {
+	s.Aggregator.Stop(flush)
+	<-s.aggDone
+	for _, a := range s.aggregators() {
+		a.Stop(true)
+	}
+}
+
+// Health returns the status of the receivers, the aggregator and the backends, sorted
+// by name
+func (s *Server) Health() []ComponentStatus {
+	defer s.healthMu.Unlock()
+	s.healthMu.Lock()
+	status := make([]ComponentStatus, 0, len(s.health))
+	for _, c := range s.health {
+		status = append(status, *c)
+	}
+	sort.Slice(status, func(i, j int) bool { return status[i].Name < status[j].Name })
+	return status
+}
+
+// Healthy reports whether none of the components is failing
+func (s *Server) Healthy() bool {
+	for _, c := range s.Health() {
+		if !c.Healthy {
+			return false
+		}
+	}
+	return true
+}
+
+// setHealthy marks the component name healthy
+func (s *Server) setHealthy(name string) {
+	defer s.healthMu.Unlock()
+	s.healthMu.Lock()
+	c, ok := s.health[name]
+	if !ok {
+		c = &ComponentStatus{Name: name}
+		s.health[name] = c
+	}
+	if !c.Healthy {
+		c.Healthy, c.Since = true, time.Now()
+	}
+}
+
+// forget stops reporting the health of the component name
+func (s *Server) forget(name string) {
+	defer s.healthMu.Unlock()
+	s.healthMu.Lock()
+	delete(s.health, name)
+}
+
+// setFailed records a failure of the component name
+func (s *Server) setFailed(name string, err error) {
+	defer s.healthMu.Unlock()
+	s.healthMu.Lock()
+	c, ok := s.health[name]
+	if !ok {
+		c = &ComponentStatus{Name: name}
+		s.health[name] = c
+	}
+	c.Healthy, c.Since = false, time.Now()
+	c.Failures++
+	c.LastError = err.Error()
+}
+
+// supervisedSender is a backend of a Server, whose failures show in its Health. A panic
+// while sending is turned in to an error. Once it fails the backend is due to be created
+// again, which the backendSet does between flushes.
+type supervisedSender struct {
+	name    string
+	config  BackendConfig
+	backend MetricSender // As created by its factory
+	sender  MetricSender // The backend, wrapped by the canary if there is one
+	server  *Server
+
+	mu    sync.Mutex
+	delay time.Duration // Before the backend is created again, doubling while it fails
+	retry time.Time     // When the failed backend is created again, zero unless it failed
+}
+
+// close closes the backend if it implements io.Closer
+func (b *supervisedSender) close() {
+	if c, ok := b.backend.(io.Closer); ok {
+		if err := c.Close(); err != nil {
+			log.Printf("closing %s: %s", b.name, err)
+		}
+	}
+}
+
+// SendMetrics sends metrics to the backend
+func (b *supervisedSender) SendMetrics(metrics MetricMap) error {
+	return b.record(protect(func() error { return b.sender.SendMetrics(metrics) }))
+}
+
+// SendMetricsAt sends metrics to the backend, timestamped if it supports it
+func (b *supervisedSender) SendMetricsAt(metrics MetricMap, t time.Time) error {
+	return b.record(protect(func() error { return sendMetricsAt(b.sender, metrics, t) }))
+}
+
+// record records the result of a flush to the backend
+func (b *supervisedSender) record(err error) error {
+	if err != nil {
+		b.server.setFailed(b.name, err)
+	} else {
+		b.server.setHealthy(b.name)
+	}
+
+	defer b.mu.Unlock()
+	b.mu.Lock()
+	switch {
+	case err == nil:
+		b.delay, b.retry = 0, time.Time{}
+	case b.retry.IsZero():
+		if b.delay == 0 {
+			b.delay = minRestartDelay
+		}
+		b.retry = time.Now().Add(b.delay)
+		log.Printf("%s failed: %s, restarting in %s", b.name, err, b.delay)
+	}
+	return err
+}
+
+// due reports whether the backend failed and is due to be created again at now
+func (b *supervisedSender) due(now time.Time) bool {
+	defer b.mu.Unlock()
+	b.mu.Lock()
+	return !b.retry.IsZero() && !now.Before(b.retry)
+}
+
+// restart creates the backend again through its factory and closes the failed one. If it
+// can't be created the failed one is kept until the next attempt. It must not be called
+// while flushing to the backend.
+func (b *supervisedSender) restart() {
+	backend, sender, err := b.server.newBackend(b.config)
+
+	defer b.mu.Unlock()
+	b.mu.Lock()
+	if b.delay *= 2; b.delay > maxRestartDelay {
+		b.delay = maxRestartDelay
+	}
+	if err != nil {
+		b.server.setFailed(b.name, err)
+		b.retry = time.Now().Add(b.delay)
+		log.Printf("%s failed: %s, restarting in %s", b.name, err, b.delay)
+		return
+	}
+	b.close()
+	b.backend, b.sender = backend, sender
+	b.retry = time.Time{}
+	infof("%s restarted", b.name)
+}
+
+// backendSet is the MetricSender of the aggregator of a Server, which sends each flush to
+// the current backends. They are only replaced between flushes.
+type backendSet struct {
+	mu       sync.RWMutex
+	backends []*supervisedSender
+}
+
+// get returns the current backends
+func (b *backendSet) get() []*supervisedSender {
+	defer b.mu.RUnlock()
+	b.mu.RLock()
+	return b.backends
+}
+
+// swap replaces the backends once the flush in progress is sent and returns the old ones
+func (b *backendSet) swap(backends []*supervisedSender) []*supervisedSender {
+	defer b.mu.Unlock()
+	b.mu.Lock()
+	old := b.backends
+	b.backends = backends
+	return old
+}
+
+// SendMetrics sends metrics to every backend and returns the first error
+func (b *backendSet) SendMetrics(metrics MetricMap) error {
+	return b.SendMetricsAt(metrics, time.Now())
+}
+
+// restart creates the failed backends that are due again, once the flushes in progress
+// are sent
+func (b *backendSet) restart() {
+	now := time.Now()
+	due := false
+	b.mu.RLock()
+	for _, backend := range b.backends {
+		due = due || backend.due(now)
+	}
+	b.mu.RUnlock()
+	if !due {
+		return
+	}
+
+	defer b.mu.Unlock()
+	b.mu.Lock()
+	for _, backend := range b.backends {
+		if backend.due(now) {
+			backend.restart()
+		}
+	}
+}
+
+// SendMetricsAt sends metrics to every backend, timestamped if it supports it, and returns
+// the first error. The failed backends that are due are created again first.
+func (b *backendSet) SendMetricsAt(metrics MetricMap, t time.Time) error {
+	b.restart()
+	defer b.mu.RUnlock()
+	b.mu.RLock()
+	var first error
+	for _, backend := range b.backends {
+		if err := backend.SendMetricsAt(metrics, t); err != nil && first == nil {
+			first = err
+		}
+	}
+	return first
+}
+
+// queueHandler queues the metrics for aggregation, publishing them to the stream on the
+// way if there is one
+type queueHandler struct {
+	aggregator *MetricAggregator
+	stream     *MetricStream
+}
+
+// HandleMetric queues m
+func (h queueHandler) HandleMetric(m Metric) {
+	if h.stream != nil {
+		h.stream.HandleMetric(m)
+	}
+	h.aggregator.MetricChan <- m
+}
+
+// HandleMetrics queues the metrics of a datagram at once
+func (h queueHandler) HandleMetrics(ms []Metric) {
+	if h.stream != nil {
+		for _, m := range ms {
+			h.stream.HandleMetric(m)
+		}
+	}
+	h.aggregator.BatchChan <- ms
+}
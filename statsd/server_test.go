@@ -0,0 +1,165 @@
+package statsd
+
+import (
+	"errors"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// flakySender is the backend of TestBackendRestart, which fails to send while failing is set
+type flakySender struct {
+	failing *bool
+	closed  bool
+}
+
+func (s *flakySender) SendMetrics(metrics MetricMap) error {
+	if *s.failing {
+		return errors.New("send failed")
+	}
+	return nil
+}
+
+func (s *flakySender) Close() error {
+	s.closed = true
+	return nil
+}
+
+func TestBackendRestart(t *testing.T) {
+	var created []*flakySender
+	var factoryFails, sendFails bool
+	RegisterBackend("test-flaky", func(address string, options map[string]string) (MetricSender, error) {
+		if factoryFails {
+			return nil, errors.New("create failed")
+		}
+		s := &flakySender{failing: &sendFails}
+		created = append(created, s)
+		return s, nil
+	})
+
+	s := &Server{health: make(map[string]*ComponentStatus)}
+	backends, err := s.newBackends([]BackendConfig{{Name: "test-flaky"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	set := &backendSet{backends: backends}
+	b := backends[0]
+
+	steps := []struct {
+		name         string
+		elapse       bool // whether the restart delay has passed
+		factoryFails bool
+		sendFails    bool
+		created      int
+		delay        time.Duration
+	}{
+		{name: "healthy", created: 1},
+		{name: "failing", sendFails: true, created: 1, delay: minRestartDelay},
+		{name: "failing before the delay", sendFails: true, created: 1, delay: minRestartDelay},
+		{name: "restarted and failing", elapse: true, sendFails: true, created: 2, delay: 2 * minRestartDelay},
+		{name: "restart failing", elapse: true, factoryFails: true, sendFails: true, created: 2, delay: 4 * minRestartDelay},
+		{name: "restarted", elapse: true, created: 3},
+		{name: "failing again", sendFails: true, created: 3, delay: minRestartDelay},
+	}
+	for _, step := range steps {
+		factoryFails, sendFails = step.factoryFails, step.sendFails
+		if step.elapse {
+			b.mu.Lock()
+			b.retry = time.Now()
+			b.mu.Unlock()
+		}
+		err := set.SendMetrics(MetricMap{"foo": 1})
+		if (err != nil) != step.sendFails {
+			t.Errorf("step %s: unexpected error %v", step.name, err)
+		}
+		if len(created) != step.created {
+			t.Errorf("step %s: expected %d backends created, got %d", step.name, step.created, len(created))
+		}
+		if b.delay != step.delay {
+			t.Errorf("step %s: expected a delay of %s, got %s", step.name, step.delay, b.delay)
+		}
+		for i, c := range created {
+			if c.closed != (i < len(created)-1) {
+				t.Errorf("step %s: expected only the replaced backends closed, backend %d closed: %v", step.name, i, c.closed)
+			}
+		}
+	}
+}
+
+func TestSupervise(t *testing.T) {
+	// What each run of the component does, the first one being started as is
+	runs := []struct {
+		openErr error
+		loopErr error
+		panics  bool
+	}{
+		{loopErr: errors.New("read failed")},
+		{openErr: errors.New("address in use")},
+		{panics: true},
+		{}, // runs until the server stops
+	}
+
+	s := &Server{quit: make(chan struct{}), health: make(map[string]*ComponentStatus)}
+	var opened []time.Time
+	run := 0
+	loop := func() (func() error, func() error) {
+		r := runs[run]
+		stop := make(chan struct{})
+		var once sync.Once
+		receive := func() error {
+			if r.panics {
+				panic("bad packet")
+			}
+			if r.loopErr != nil {
+				return r.loopErr
+			}
+			<-stop
+			return nil
+		}
+		closeFn := func() error {
+			once.Do(func() { close(stop) })
+			return nil
+		}
+		return receive, closeFn
+	}
+	c := component{name: "test", open: func() (func() error, func() error, error) {
+		opened = append(opened, time.Now())
+		run++
+		if err := runs[run].openErr; err != nil {
+			return nil, nil, err
+		}
+		l, closeFn := loop()
+		return l, closeFn, nil
+	}}
+
+	start := time.Now()
+	l, closeFn := loop()
+	s.wg.Add(1)
+	go s.supervise(c, l, closeFn)
+	for deadline := time.Now().Add(5 * time.Second); ; time.Sleep(10 * time.Millisecond) {
+		if s.Healthy() && len(s.Health()) == 1 && s.Health()[0].Failures == 3 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("expected the component to recover after 3 failures, got %+v", s.Health())
+		}
+	}
+	close(s.quit)
+	s.wg.Wait()
+
+	if len(opened) != 3 {
+		t.Fatalf("expected the component to be reopened 3 times, got %d", len(opened))
+	}
+	// The delay doubles with each failure
+	last := start
+	for i, delay := range []time.Duration{minRestartDelay, 2 * minRestartDelay, 4 * minRestartDelay} {
+		if gap := opened[i].Sub(last); gap < delay {
+			t.Errorf("reopening %d: expected a delay of at least %s, got %s", i+1, delay, gap)
+		}
+		last = opened[i]
+	}
+	if status := s.Health()[0]; !strings.HasPrefix(status.LastError, "panic: bad packet") {
+		t.Errorf("expected the panic as the last error, got %q", status.LastError)
+	}
+}
@@ -0,0 +1,186 @@
+package statsd
+
+import (
+	"bytes"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ServiceCheckPrefix is prepended to the name of service checks to make the bucket of
+// their heartbeat gauge
+const ServiceCheckPrefix = "service_check."
+
+// Statuses of service checks, the values of their heartbeat gauges
+const (
+	ServiceOK       = 0
+	ServiceWarning  = 1
+	ServiceCritical = 2
+	ServiceUnknown  = 3
+)
+
+// isServiceCheck reports whether line is a DogStatsD service check rather than a metric
+func isServiceCheck(line []byte) bool {
+	return bytes.HasPrefix(line, []byte("_sc|"))
+}
+
+// parseServiceCheckLine parses a service check in to its heartbeat gauge, like
+// parseTaggedLine does for metrics
+func (srv *MetricReceiver) parseServiceCheckLine(addr net.Addr, line []byte, tags []string) (Metric, bool) {
+	var metric Metric
+	var err error
+	if line, err = srv.limitLength(line); err == nil {
+		metric, err = parseServiceCheck(line)
+	}
+	if traced(addr) {
+		trace(addr, line, metric, err)
+	}
+	if err != nil {
+		if len(line) > 256 {
+			line = line[:256]
+		}
+		srv.infof("error parsing service check %q from %s: %s", line, addr, err)
+		srv.countParseError(addr, err)
+		return rejection(err), true
+	}
+	if len(tags) > 0 {
+		metric.Tags = mergeTags(metric.Tags, tags)
+	}
+	srv.countMetric(addr)
+	srv.trackSource(addr, metric)
+	srv.debugf("received %s from %s", metric, addr)
+	return metric, true
+}
+
+// parseServiceCheck parses a DogStatsD service check,
+//
+//	_sc|<name>|<status>|d:<timestamp>|h:<hostname>|#<tags>|m:<message>
+//
+// in to a gauge of its status named ServiceCheckPrefix followed by the name. The hostname,
+// if any, becomes a "host" tag unless there is one already. The message is dropped.
+func parseServiceCheck(line []byte) (Metric, error) {
+	metric := Metric{Type: GAUGE, SampleRate: 1}
+
+	fields := bytes.SplitN(line[len("_sc|"):], []byte{'|'}, 3)
+	if len(fields) < 2 || len(fields[0]) == 0 {
+		return metric, rejectf(RejectBadName, "error parsing service check: missing name or status")
+	}
+	metric.Bucket = ServiceCheckPrefix + string(fields[0])
+	status, err := strconv.Atoi(string(fields[1]))
+	if err != nil || status < ServiceOK || status > ServiceUnknown {
+		return metric, rejectf(RejectBadValue, "error converting service check status: %q", fields[1])
+	}
+	metric.Value = float64(status)
+
+	var rest, host []byte
+	if len(fields) == 3 {
+		rest = fields[2]
+	}
+	for len(rest) > 0 {
+		section := rest
+		if bytes.HasPrefix(rest, []byte("m:")) {
+			// The message comes last and may contain anything
+			rest = nil
+		} else if pipe := bytes.IndexByte(rest, '|'); pipe >= 0 {
+			section, rest = rest[:pipe], rest[pipe+1:]
+		} else {
+			rest = nil
+		}
+		switch {
+		case len(section) == 0:
+			continue
+		case section[0] == '#':
+			metric.Tags = parseTags(section[1:])
+		case bytes.HasPrefix(section, []byte("d:")):
+			metric.Timestamp, err = strconv.ParseInt(string(section[2:]), 10, 64)
+			if err != nil || metric.Timestamp <= 0 {
+				return metric, rejectf(RejectBadField, "error converting service check timestamp: %q", section[2:])
+			}
+		case bytes.HasPrefix(section, []byte("h:")):
+			host = section[2:]
+		case bytes.HasPrefix(section, []byte("m:")):
+		default:
+			return metric, rejectf(RejectBadField, "error parsing service check field %q", section)
+		}
+	}
+	if len(host) > 0 {
+		metric.Tags = mergeTags([]string{"host:" + string(host)}, metric.Tags)
+	}
+	return metric, nil
+}
+
+// HeartbeatHandler is a Handler that watches the heartbeat gauges of service checks on
+// their way to Handler. Once a check hasn't been received for Timeout its gauge is set to
+// ServiceUnknown, so emitters that died show up instead of keeping their last status.
+type HeartbeatHandler struct {
+	Timeout time.Duration
+	Handler Handler
+
+	mu     sync.Mutex
+	checks map[string]heartbeat
+}
+
+// heartbeat is the last time a service check was received
+type heartbeat struct {
+	bucket string
+	tags   []string
+	last   time.Time
+}
+
+// HandleMetric records the service checks and passes m on
+func (h *HeartbeatHandler) HandleMetric(m Metric) {
+	h.record(m)
+	h.Handler.HandleMetric(m)
+}
+
+// HandleMetrics records the service checks of a datagram and passes its metrics on at once
+func (h *HeartbeatHandler) HandleMetrics(ms []Metric) {
+	for _, m := range ms {
+		h.record(m)
+	}
+	handleMetrics(h.Handler, ms)
+}
+
+// record records m if it is a service check
+func (h *HeartbeatHandler) record(m Metric) {
+	if m.Type == GAUGE && strings.HasPrefix(m.Bucket, ServiceCheckPrefix) {
+		h.mu.Lock()
+		if h.checks == nil {
+			h.checks = make(map[string]heartbeat)
+		}
+		h.checks[m.Key()] = heartbeat{m.Bucket, m.Tags, time.Now()}
+		h.mu.Unlock()
+	}
+}
+
+// Run sets the checks that timed out to ServiceUnknown until the program exits
+func (h *HeartbeatHandler) Run() {
+	interval := h.Timeout / 4
+	if interval < time.Second {
+		interval = time.Second
+	}
+	for now := range time.Tick(interval) {
+		for _, m := range h.expire(now) {
+			infof("service check %s timed out", m.Key())
+			h.Handler.HandleMetric(m)
+		}
+	}
+}
+
+// expire forgets the checks that weren't received since Timeout before now and returns
+// their unknown gauges
+func (h *HeartbeatHandler) expire(now time.Time) []Metric {
+	defer h.mu.Unlock()
+	h.mu.Lock()
+
+	var expired []Metric
+	for key, hb := range h.checks {
+		if now.Sub(hb.last) >= h.Timeout {
+			expired = append(expired, Metric{Type: GAUGE, Bucket: hb.bucket, Value: ServiceUnknown, SampleRate: 1, Tags: hb.tags})
+			delete(h.checks, key)
+		}
+	}
+	return expired
+}
@@ -0,0 +1,81 @@
+package statsd
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DefaultSignalFxURL is the datapoint endpoint of the us0 SignalFx realm
+const DefaultSignalFxURL = "https://ingest.us0.signalfx.com/v2/datapoint"
+
+// SignalFxClient sends metrics to the SignalFx datapoint API, with their tags as dimensions.
+// Counts of counters are accumulated and sent as cumulative counters, which SignalFx can
+// turn back in to deltas whatever the resolution of the charts; everything else is a gauge.
+type SignalFxClient struct {
+	Token string // Organization access token
+	URL   string // DefaultSignalFxURL if blank
+
+	mu     sync.Mutex
+	totals map[string]float64 // cumulative counts by flushed name
+}
+
+// signalFxDatapoint is a datapoint of a datapoint API request
+type signalFxDatapoint struct {
+	Metric     string            `json:"metric"`
+	Value      float64           `json:"value"`
+	Timestamp  int64             `json:"timestamp"`
+	Dimensions map[string]string `json:"dimensions,omitempty"`
+}
+
+// SendMetrics sends the metrics in a MetricMap to SignalFx
+func (c *SignalFxClient) SendMetrics(metrics MetricMap) error {
+	return c.SendMetricsAt(metrics, time.Now())
+}
+
+// SendMetricsAt sends the metrics in a MetricMap to SignalFx with the timestamp t
+func (c *SignalFxClient) SendMetricsAt(metrics MetricMap, t time.Time) error {
+	body := make(map[string][]signalFxDatapoint)
+	c.mu.Lock()
+	if c.totals == nil {
+		c.totals = make(map[string]float64)
+	}
+	for k, v := range finiteMetrics(metrics) {
+		name, tags := SplitKey(k)
+		typ := "gauge"
+		if strings.HasPrefix(name, "stats.counters.count.") {
+			typ = "cumulative_counter"
+			c.totals[k] += v
+			v = c.totals[k]
+		}
+		dp := signalFxDatapoint{Metric: name, Value: v, Timestamp: t.UnixNano() / int64(time.Millisecond)}
+		if len(tags) > 0 {
+			dp.Dimensions = make(map[string]string, len(tags))
+			for _, tag := range tags {
+				k, v := splitTag(tag)
+				dp.Dimensions[k] = v
+			}
+		}
+		body[typ] = append(body[typ], dp)
+	}
+	c.mu.Unlock()
+
+	b, err := json.Marshal(body)
+	if err != nil {
+		return err
+	}
+	url := c.URL
+	if url == "" {
+		url = DefaultSignalFxURL
+	}
+	req, err := http.NewRequest("POST", url, bytes.NewReader(b))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-SF-Token", c.Token)
+	return doRequest(req)
+}
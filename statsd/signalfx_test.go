@@ -0,0 +1,51 @@
+package statsd
+
+import (
+	"testing"
+	"time"
+)
+
+func TestSignalFxFormat(t *testing.T) {
+	tests := map[string]string{
+		"stats.gauges.foo":           `{"gauge":[{"metric":"stats.gauges.foo","value":2,"timestamp":1500000000000}]}`,
+		"stats.gauges.foo;region:eu": `{"gauge":[{"metric":"stats.gauges.foo","value":2,"timestamp":1500000000000,"dimensions":{"region":"eu"}}]}`,
+		"stats.counters.count.foo":   `{"cumulative_counter":[{"metric":"stats.counters.count.foo","value":2,"timestamp":1500000000000}]}`,
+	}
+
+	server, requests := captureServer()
+	defer server.Close()
+
+	for key, expected := range tests {
+		c := &SignalFxClient{Token: "secret", URL: server.URL}
+		if err := c.SendMetricsAt(MetricMap{key: 2}, time.Unix(1500000000, 0)); err != nil {
+			t.Errorf("test %s error: %s", key, err)
+			continue
+		}
+		r := <-requests
+		if token := r.Header.Get("X-SF-Token"); token != "secret" {
+			t.Errorf("expected X-SF-Token secret, got %s", token)
+		}
+		if string(r.Body) != expected {
+			t.Errorf("test %s: expected %s, got %s", key, expected, r.Body)
+		}
+	}
+}
+
+func TestSignalFxCumulativeCounters(t *testing.T) {
+	server, requests := captureServer()
+	defer server.Close()
+
+	c := &SignalFxClient{URL: server.URL}
+	expected := []string{
+		`{"cumulative_counter":[{"metric":"stats.counters.count.foo","value":3,"timestamp":1500000000000}]}`,
+		`{"cumulative_counter":[{"metric":"stats.counters.count.foo","value":7,"timestamp":1500000010000}]}`,
+	}
+	for i, v := range []float64{3, 4} {
+		if err := c.SendMetricsAt(MetricMap{"stats.counters.count.foo": v}, time.Unix(1500000000+10*int64(i), 0)); err != nil {
+			t.Fatal(err)
+		}
+		if body := string((<-requests).Body); body != expected[i] {
+			t.Errorf("flush %d: expected %s, got %s", i, expected[i], body)
+		}
+	}
+}
@@ -0,0 +1,67 @@
+package statsd
+
+import (
+	"log"
+	"strings"
+)
+
+// SlackClient posts events to a Slack incoming webhook, as a message with an attachment
+// colored by the alert type of the event
+type SlackClient struct {
+	URL      string // URL of the incoming webhook
+	Channel  string // If set, overrides the channel of the webhook
+	Username string // If set, overrides the name the webhook posts as
+}
+
+// slackMessage is the body of an incoming webhook request
+type slackMessage struct {
+	Text        string            `json:"text"`
+	Channel     string            `json:"channel,omitempty"`
+	Username    string            `json:"username,omitempty"`
+	Attachments []slackAttachment `json:"attachments"`
+}
+
+// slackAttachment is an attachment of a slackMessage
+type slackAttachment struct {
+	Fallback string `json:"fallback"`
+	Color    string `json:"color"`
+	Title    string `json:"title"`
+	Text     string `json:"text,omitempty"`
+	Footer   string `json:"footer,omitempty"`
+	Ts       int64  `json:"ts,omitempty"`
+}
+
+// slackColors are the colors of the attachments by alert type
+var slackColors = map[string]string{
+	AlertError:   "danger",
+	AlertWarning: "warning",
+	AlertInfo:    "#439fe0",
+	AlertSuccess: "good",
+}
+
+// HandleEvent posts e to Slack
+func (c *SlackClient) HandleEvent(e Event) {
+	footer := e.Hostname
+	if len(e.Tags) > 0 {
+		if footer != "" {
+			footer += " "
+		}
+		footer += strings.Join(e.Tags, ", ")
+	}
+	msg := slackMessage{
+		Text:     "[" + e.AlertType + "] " + e.Title,
+		Channel:  c.Channel,
+		Username: c.Username,
+		Attachments: []slackAttachment{{
+			Fallback: e.Title,
+			Color:    slackColors[e.AlertType],
+			Title:    e.Title,
+			Text:     e.Text,
+			Footer:   footer,
+			Ts:       e.Timestamp,
+		}},
+	}
+	if err := postJSON(c.URL, msg, nil); err != nil {
+		log.Printf("error posting event %q to Slack: %s", e.Title, err)
+	}
+}
@@ -0,0 +1,27 @@
+package statsd
+
+import (
+	"net"
+)
+
+// SocketOptions holds the kernel socket options applied to a MetricReceiver's listening
+// sockets. At high packet rates UDP drops are dominated by these settings.
+type SocketOptions struct {
+	ReadBuffer int // SO_RCVBUF in bytes. If zero the system default is kept
+	BusyPoll   int // SO_BUSY_POLL in microseconds (Linux only). If zero busy polling is disabled
+	TOS        int // IP_TOS, or IPV6_TCLASS for IPv6 sockets. If zero the system default is kept
+}
+
+// apply sets the options on c and returns the values that are in effect afterwards,
+// which may differ from the requested ones (Linux for example doubles SO_RCVBUF)
+func (o SocketOptions) apply(c *net.UDPConn) (SocketOptions, error) {
+	if o.ReadBuffer > 0 {
+		if err := c.SetReadBuffer(o.ReadBuffer); err != nil {
+			return SocketOptions{}, err
+		}
+	}
+	if err := o.applySys(c); err != nil {
+		return SocketOptions{}, err
+	}
+	return effectiveSocketOptions(c)
+}
@@ -0,0 +1,73 @@
+//go:build linux
+// +build linux
+
+package statsd
+
+import (
+	"net"
+	"syscall"
+)
+
+// soBusyPoll is SO_BUSY_POLL from <asm-generic/socket.h>, which the syscall package lacks
+const soBusyPoll = 0x2e
+
+// applySys sets the options that have no equivalent in the net package
+func (o SocketOptions) applySys(c *net.UDPConn) error {
+	if o.BusyPoll == 0 && o.TOS == 0 {
+		return nil
+	}
+	level, opt := tosOption(c)
+	return control(c, func(fd int) error {
+		if o.BusyPoll > 0 {
+			if err := syscall.SetsockoptInt(fd, syscall.SOL_SOCKET, soBusyPoll, o.BusyPoll); err != nil {
+				return err
+			}
+		}
+		if o.TOS > 0 {
+			if err := syscall.SetsockoptInt(fd, level, opt, o.TOS); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// effectiveSocketOptions reads back the socket options in effect on c
+func effectiveSocketOptions(c *net.UDPConn) (o SocketOptions, err error) {
+	level, opt := tosOption(c)
+	err = control(c, func(fd int) (err error) {
+		if o.ReadBuffer, err = syscall.GetsockoptInt(fd, syscall.SOL_SOCKET, syscall.SO_RCVBUF); err != nil {
+			return err
+		}
+		if o.BusyPoll, err = syscall.GetsockoptInt(fd, syscall.SOL_SOCKET, soBusyPoll); err != nil {
+			return err
+		}
+		o.TOS, err = syscall.GetsockoptInt(fd, level, opt)
+		return err
+	})
+	return o, err
+}
+
+// tosOption returns the socket option level and name for the type of service of c
+func tosOption(c *net.UDPConn) (level, opt int) {
+	if addr, ok := c.LocalAddr().(*net.UDPAddr); ok && addr.IP.To4() == nil {
+		return syscall.IPPROTO_IPV6, syscall.IPV6_TCLASS
+	}
+	return syscall.IPPROTO_IP, syscall.IP_TOS
+}
+
+// control runs f with the file descriptor of c
+func control(c *net.UDPConn, f func(fd int) error) error {
+	raw, err := c.SyscallConn()
+	if err != nil {
+		return err
+	}
+	var ferr error
+	err = raw.Control(func(fd uintptr) {
+		ferr = f(int(fd))
+	})
+	if err != nil {
+		return err
+	}
+	return ferr
+}
@@ -0,0 +1,23 @@
+//go:build !linux
+// +build !linux
+
+package statsd
+
+import (
+	"errors"
+	"net"
+)
+
+// applySys sets the options that have no equivalent in the net package
+func (o SocketOptions) applySys(c *net.UDPConn) error {
+	if o.BusyPoll > 0 || o.TOS > 0 {
+		return errors.New("SO_BUSY_POLL and IP_TOS are only supported on Linux")
+	}
+	return nil
+}
+
+// effectiveSocketOptions reads back the socket options in effect on c. Outside of Linux
+// they can't be queried so only an error is returned.
+func effectiveSocketOptions(c *net.UDPConn) (SocketOptions, error) {
+	return SocketOptions{}, errors.New("reading socket options is only supported on Linux")
+}
@@ -0,0 +1,142 @@
+package statsd
+
+import (
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ConflictingGaugesBucket is the internal gauge of the number of gauges written by several
+// sources without a host tag during the last interval
+const ConflictingGaugesBucket = "statsd.conflicting_gauges"
+
+// SourceConflict is a gauge written by several sources without a host tag, so each write
+// overwrites the others' and the flushed value is whichever came last
+type SourceConflict struct {
+	Bucket  string   `json:"bucket"` // Key of the gauge, with its tags
+	Sources []string `json:"sources"`
+}
+
+// SourceTracker tracks which source addresses send each bucket, interval by interval, and
+// flags the gauges written by at least MinSources hosts without a host tag. That's
+// usually a misconfiguration, e.g. a fleet reporting its queue length under one name,
+// which silently flushes the value of a random host.
+//
+// Intervals are ended by Run. Newly conflicting gauges are logged, and the number of
+// conflicts of each interval is passed to Handler as ConflictingGaugesBucket.
+type SourceTracker struct {
+	MinSources int           // Sources from which a gauge is conflicting, 2 if zero
+	Interval   time.Duration // Period over which sources are tracked, usually the flush interval
+	Handler    Handler       // If set, where the internal metrics are sent
+
+	mu        sync.Mutex
+	current   map[string]map[string]bool // Sources of each bucket during the interval
+	last      map[string]map[string]bool // Sources of each bucket during the last interval
+	conflicts map[string]bool            // Conflicting gauges of the last interval
+}
+
+// Observe records that m was received from addr
+func (t *SourceTracker) Observe(addr net.Addr, m Metric) {
+	if addr == nil || m.Type == ERROR {
+		return
+	}
+	ip := addr.String()
+	if host, _, err := net.SplitHostPort(ip); err == nil {
+		ip = host
+	}
+	key := m.Key()
+	if m.Type == GAUGE && !hasTag(m.Tags, "host") {
+		key = "\x00" + key // Marks the gauges that may conflict
+	}
+
+	defer t.mu.Unlock()
+	t.mu.Lock()
+	if t.current == nil {
+		t.current = make(map[string]map[string]bool)
+	}
+	sources := t.current[key]
+	if sources == nil {
+		sources = make(map[string]bool)
+		t.current[key] = sources
+	}
+	sources[ip] = true
+}
+
+// Run starts a new interval every Interval until the program exits
+func (t *SourceTracker) Run() {
+	runIntervals(t.Interval, t.endInterval, t.Handler)
+}
+
+// endInterval starts a new interval and returns the gauge of the number of conflicts of
+// the one that ended
+func (t *SourceTracker) endInterval() []Metric {
+	defer t.mu.Unlock()
+	t.mu.Lock()
+
+	min := t.MinSources
+	if min <= 0 {
+		min = 2
+	}
+
+	conflicts := make(map[string]bool)
+	for key, sources := range t.current {
+		if key[0] != 0 || len(sources) < min {
+			continue
+		}
+		bucket := key[1:]
+		conflicts[bucket] = true
+		if !t.conflicts[bucket] {
+			infof("gauge %s is written by %d sources without a host tag, e.g. %s", bucket, len(sources), strings.Join(sortedSet(sources, 3), ", "))
+		}
+	}
+	t.last, t.current, t.conflicts = t.current, nil, conflicts
+	return []Metric{{Type: GAUGE, Bucket: ConflictingGaugesBucket, Value: float64(len(conflicts)), SampleRate: 1}}
+}
+
+// Sources returns the addresses that sent the bucket key during the last interval
+func (t *SourceTracker) Sources(key string) []string {
+	defer t.mu.Unlock()
+	t.mu.Lock()
+	sources := t.last[key]
+	if sources == nil {
+		sources = t.last["\x00"+key]
+	}
+	return sortedSet(sources, 0)
+}
+
+// Conflicts returns the conflicting gauges of the last interval, sorted by bucket
+func (t *SourceTracker) Conflicts() []SourceConflict {
+	defer t.mu.Unlock()
+	t.mu.Lock()
+	conflicts := make([]SourceConflict, 0, len(t.conflicts))
+	for bucket := range t.conflicts {
+		conflicts = append(conflicts, SourceConflict{bucket, sortedSet(t.last["\x00"+bucket], 0)})
+	}
+	sort.Slice(conflicts, func(i, j int) bool { return conflicts[i].Bucket < conflicts[j].Bucket })
+	return conflicts
+}
+
+// hasTag reports whether tags has one with the key
+func hasTag(tags []string, key string) bool {
+	for _, tag := range tags {
+		if k, _ := splitTag(tag); k == key {
+			return true
+		}
+	}
+	return false
+}
+
+// sortedSet returns the sorted members of set, at most max of them if max is positive
+func sortedSet(set map[string]bool, max int) []string {
+	members := make([]string, 0, len(set))
+	for m := range set {
+		members = append(members, m)
+	}
+	sort.Strings(members)
+	if max > 0 && len(members) > max {
+		members = members[:max]
+	}
+	return members
+}
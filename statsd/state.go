@@ -0,0 +1,238 @@
+package statsd
+
+import (
+	"bytes"
+	"encoding/gob"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// AggregatorState is the persisted and mergeable form of the metrics held by a
+// MetricAggregator. The states of several aggregators merge in to the totals a single one
+// would have held: counters add up, gauges take the last value, timers concatenate their
+// values and sets union their members, or merge their sketches.
+type AggregatorState struct {
+	Counters       MetricMap
+	Gauges         MetricMap
+	Timers         MetricListMap
+	TimersCounters MetricMap
+	CounterEvents  MetricMap
+	GaugesMin      MetricMap
+	GaugesMax      MetricMap
+	Sets           map[string][]string     // Members of exact sets
+	Sketches       map[string]*HyperLogLog // Sets estimated with SetPrecision
+}
+
+// State returns a copy of the metrics currently held by the aggregator
+func (a *MetricAggregator) State() *AggregatorState {
+	defer a.Unlock()
+	a.Lock()
+	return a.state()
+}
+
+// state returns a copy of the aggregator's state. The caller must hold the lock.
+func (a *MetricAggregator) state() *AggregatorState {
+	s := &AggregatorState{
+		Counters:       copyMetricMap(a.Counters),
+		Gauges:         copyMetricMap(a.Gauges),
+		Timers:         make(MetricListMap, len(a.Timers)),
+		TimersCounters: copyMetricMap(a.TimersCounters),
+		CounterEvents:  copyMetricMap(a.counterEvents),
+		GaugesMin:      copyMetricMap(a.gaugesMin),
+		GaugesMax:      copyMetricMap(a.gaugesMax),
+		Sets:           make(map[string][]string),
+		Sketches:       make(map[string]*HyperLogLog),
+	}
+	for k, v := range a.Timers {
+		s.Timers[k] = append([]float64(nil), v...)
+	}
+	for k, set := range a.sets {
+		switch set := set.(type) {
+		case exactSet:
+			members := make([]string, 0, len(set))
+			for m := range set {
+				members = append(members, m)
+			}
+			s.Sets[k] = members
+		case *HyperLogLog:
+			s.Sketches[k] = &HyperLogLog{append([]uint8(nil), set.Registers...)}
+		}
+	}
+	return s
+}
+
+// copyMetricMap returns a copy of m
+func copyMetricMap(m MetricMap) MetricMap {
+	c := make(MetricMap, len(m))
+	for k, v := range m {
+		c[k] = v
+	}
+	return c
+}
+
+// TakeState returns the metrics aggregated during the current interval and starts the
+// next one, as a flush would, at once so no metric falls between the two. The counters
+// and timers kept at zero since an earlier interval are left out.
+func (a *MetricAggregator) TakeState() *AggregatorState {
+	s, _ := a.takeState()
+	for k, v := range s.Counters {
+		if v == 0 {
+			delete(s.Counters, k)
+			delete(s.CounterEvents, k)
+		}
+	}
+	for k, v := range s.Timers {
+		if len(v) == 0 {
+			delete(s.Timers, k)
+			delete(s.TimersCounters, k)
+		}
+	}
+	return s
+}
+
+// takeState returns the state of the current interval along with its start, and starts
+// the next one
+func (a *MetricAggregator) takeState() (*AggregatorState, time.Time) {
+	defer a.Unlock()
+	a.Lock()
+	s, start := a.state(), a.Stats.IntervalStart
+	a.reset()
+	return s, start
+}
+
+// MergeState merges s in to the metrics held by the aggregator. Sketches can only be
+// merged in to an aggregator estimating sets with the same precision; the rest of the
+// state is merged regardless and the first such error is returned.
+func (a *MetricAggregator) MergeState(s *AggregatorState) error {
+	defer a.Unlock()
+	a.Lock()
+
+	for k, v := range s.Counters {
+		a.Counters[k] += v
+	}
+	for k, v := range s.Gauges {
+		a.Gauges[k] = v
+	}
+	for k, v := range s.Timers {
+		a.Timers[k] = append(a.Timers[k], v...)
+	}
+	for k, v := range s.TimersCounters {
+		a.TimersCounters[k] += v
+	}
+	if len(s.CounterEvents) > 0 && a.counterEvents == nil {
+		a.counterEvents = make(MetricMap)
+	}
+	for k, v := range s.CounterEvents {
+		a.counterEvents[k] += v
+	}
+	if len(s.GaugesMin) > 0 && a.gaugesMin == nil {
+		a.gaugesMin, a.gaugesMax = make(MetricMap), make(MetricMap)
+	}
+	for k, v := range s.GaugesMin {
+		if min, ok := a.gaugesMin[k]; !ok || v < min {
+			a.gaugesMin[k] = v
+		}
+	}
+	for k, v := range s.GaugesMax {
+		if max, ok := a.gaugesMax[k]; !ok || v > max {
+			a.gaugesMax[k] = v
+		}
+	}
+
+	for k, members := range s.Sets {
+		set := a.set(k)
+		for _, m := range members {
+			set.Add(m)
+		}
+	}
+	var err error
+	for k, sketch := range s.Sketches {
+		hll, ok := a.set(k).(*HyperLogLog)
+		if !ok {
+			err = fmt.Errorf("set %q: can't merge a HyperLogLog in to an exact set", k)
+			continue
+		}
+		if e := hll.Merge(sketch); e != nil && err == nil {
+			err = fmt.Errorf("set %q: %s", k, e)
+		}
+	}
+	return err
+}
+
+// SaveState writes the metrics currently held by the aggregator to w, so that they can be
+// restored with LoadState after a restart.
+func (a *MetricAggregator) SaveState(w io.Writer) error {
+	return gob.NewEncoder(w).Encode(a.State())
+}
+
+// LoadState merges metrics previously written by SaveState in to the aggregator.
+// Counters and timers are added to the current values and gauges are overwritten.
+func (a *MetricAggregator) LoadState(r io.Reader) error {
+	var state AggregatorState
+	if err := gob.NewDecoder(r).Decode(&state); err != nil {
+		return err
+	}
+	return a.MergeState(&state)
+}
+
+// StateSender is implemented by objects an aggregator can send the state of each interval
+// to, instead of flushing it, so that it's merged with the state of other aggregators
+type StateSender interface {
+	SendState(*AggregatorState) error
+}
+
+// StateClient sends aggregator states to the admin API of another server, which merges
+// them in to its own
+type StateClient struct {
+	Addr string // Address of the admin API
+}
+
+// SendState posts s to the /api/state endpoint
+func (c *StateClient) SendState(s *AggregatorState) error {
+	buf := new(bytes.Buffer)
+	if err := gob.NewEncoder(buf).Encode(s); err != nil {
+		return err
+	}
+	req, err := http.NewRequest("POST", "http://"+c.Addr+"/api/state", buf)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-gob")
+	return doRequest(req)
+}
+
+// SaveStateFile writes the aggregator's state to the named file. The file is replaced
+// atomically so a crash while saving leaves the previous state intact.
+func (a *MetricAggregator) SaveStateFile(name string) error {
+	f, err := os.CreateTemp(filepath.Dir(name), filepath.Base(name)+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	if err := a.SaveState(f); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), name)
+}
+
+// LoadStateFile restores the aggregator's state from the named file. A missing file
+// is not an error, there is simply nothing to restore.
+func (a *MetricAggregator) LoadStateFile(name string) error {
+	f, err := os.Open(name)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return a.LoadState(f)
+}
@@ -0,0 +1,129 @@
+package statsd
+
+import (
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/net/websocket"
+)
+
+// streamBuffer is the number of events buffered for each client. Events for clients that
+// can't keep up are dropped.
+const streamBuffer = 1024
+
+// StreamEvent is the JSON message sent to MetricStream clients for each metric
+type StreamEvent struct {
+	Kind       string    `json:"kind"` // "raw" for received metrics or "flushed" for aggregates
+	Name       string    `json:"name"`
+	Type       string    `json:"type,omitempty"`
+	Value      float64   `json:"value"`
+	SampleRate float64   `json:"sample_rate,omitempty"`
+	Tags       []string  `json:"tags,omitempty"`
+	Time       time.Time `json:"time"`
+}
+
+// MetricStream streams metrics as JSON to WebSocket clients. Received metrics are published
+// by calling HandleMetric, and flushed metrics by using the MetricStream as the MetricSender
+// in front of Sender.
+//
+// Clients choose what they receive with the query parameters kind ("raw" or "flushed",
+// both if omitted) and prefix, e.g. /stream?kind=raw&prefix=api.
+type MetricStream struct {
+	Sender MetricSender // The sender to which flushed metrics are passed on
+
+	mu      sync.Mutex
+	clients map[*streamClient]bool
+}
+
+// streamClient is a single subscriber of a MetricStream
+type streamClient struct {
+	kind   string
+	prefix string
+	events chan StreamEvent
+}
+
+// wants reports whether the client subscribed to e
+func (c *streamClient) wants(e StreamEvent) bool {
+	return (c.kind == "" || c.kind == e.Kind) && strings.HasPrefix(e.Name, c.prefix)
+}
+
+// publish sends e to every client that subscribed to it
+func (s *MetricStream) publish(e StreamEvent) {
+	defer s.mu.Unlock()
+	s.mu.Lock()
+
+	for c := range s.clients {
+		if !c.wants(e) {
+			continue
+		}
+		select {
+		case c.events <- e:
+		default:
+		}
+	}
+}
+
+// HandleMetric publishes a received metric
+func (s *MetricStream) HandleMetric(m Metric) {
+	s.publish(StreamEvent{"raw", m.Bucket, m.Type.String(), m.Value, m.SampleRate, m.Tags, time.Now()})
+}
+
+// SendMetrics publishes flushed metrics and sends them to s.Sender
+func (s *MetricStream) SendMetrics(metrics MetricMap) error {
+	return s.SendMetricsAt(metrics, time.Now())
+}
+
+// SendMetricsAt publishes flushed metrics and sends them to s.Sender with the timestamp t
+func (s *MetricStream) SendMetricsAt(metrics MetricMap, t time.Time) error {
+	for k, v := range metrics {
+		name, tags := SplitKey(k)
+		s.publish(StreamEvent{Kind: "flushed", Name: name, Value: v, Tags: tags, Time: t})
+	}
+	return sendMetricsAt(s.Sender, metrics, t)
+}
+
+// ServeHTTP upgrades the request to a WebSocket connection and streams metrics over it
+func (s *MetricStream) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	websocket.Handler(s.serve).ServeHTTP(w, req)
+}
+
+// serve streams metrics to ws until the client goes away
+func (s *MetricStream) serve(ws *websocket.Conn) {
+	defer ws.Close()
+
+	query := ws.Request().URL.Query()
+	c := &streamClient{query.Get("kind"), query.Get("prefix"), make(chan StreamEvent, streamBuffer)}
+	s.mu.Lock()
+	if s.clients == nil {
+		s.clients = make(map[*streamClient]bool)
+	}
+	s.clients[c] = true
+	s.mu.Unlock()
+	defer func() {
+		s.mu.Lock()
+		delete(s.clients, c)
+		s.mu.Unlock()
+	}()
+
+	// Clients aren't expected to send anything, a failed read means they are gone
+	gone := make(chan bool)
+	go func() {
+		var msg []byte
+		for websocket.Message.Receive(ws, &msg) == nil {
+		}
+		close(gone)
+	}()
+
+	for {
+		select {
+		case e := <-c.events:
+			if err := websocket.JSON.Send(ws, e); err != nil {
+				return
+			}
+		case <-gone:
+			return
+		}
+	}
+}
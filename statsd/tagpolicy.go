@@ -0,0 +1,101 @@
+package statsd
+
+import (
+	"sort"
+	"strings"
+)
+
+// TagPolicy normalizes the tags of the buckets starting with Prefix, so that clients
+// can't flood the backends with tag keys they don't expect or names they can't store
+type TagPolicy struct {
+	Prefix         string   `json:"prefix"`
+	AllowKeys      []string `json:"allow_keys"`       // Keys of the tags kept, after normalization; all if empty
+	LowercaseKeys  bool     `json:"lowercase_keys"`   // Lowercase the keys
+	SanitizeKeys   bool     `json:"sanitize_keys"`    // Replace what isn't a letter, digit or _ in keys by _
+	MaxValueLength int      `json:"max_value_length"` // Truncate longer values, unlimited if zero
+}
+
+// normalizeKey applies the key normalizations of the policy to key
+func (p *TagPolicy) normalizeKey(key string) string {
+	if p.LowercaseKeys {
+		key = strings.ToLower(key)
+	}
+	if p.SanitizeKeys {
+		key = strings.Map(func(r rune) rune {
+			if r == '_' || r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' {
+				return r
+			}
+			return '_'
+		}, key)
+		if key == "" || key[0] >= '0' && key[0] <= '9' {
+			key = "_" + key
+		}
+	}
+	return key
+}
+
+// apply returns the tags normalized by the policy, sorted
+func (p *TagPolicy) apply(tags []string) []string {
+	normalized := make([]string, 0, len(tags))
+	seen := make(map[string]bool, len(tags))
+	for _, tag := range tags {
+		k, v := splitTag(tag)
+		k = p.normalizeKey(k)
+		if seen[k] || len(p.AllowKeys) > 0 && !containsString(p.AllowKeys, k) {
+			continue
+		}
+		seen[k] = true
+		if p.MaxValueLength > 0 && len(v) > p.MaxValueLength {
+			v = v[:p.MaxValueLength]
+		}
+		if v != "" || strings.IndexByte(tag, ':') >= 0 {
+			k += ":" + v
+		}
+		normalized = append(normalized, k)
+	}
+	sort.Strings(normalized)
+	return normalized
+}
+
+// containsString reports whether s is one of list
+func containsString(list []string, s string) bool {
+	for _, e := range list {
+		if e == s {
+			return true
+		}
+	}
+	return false
+}
+
+// TagPolicyHandler is a Handler that normalizes the tags of metrics by Policies before
+// passing them on to Handler. Each metric is subject to the policy with the longest
+// matching prefix; metrics no policy matches are passed on unchanged.
+type TagPolicyHandler struct {
+	Policies []TagPolicy
+	Handler  Handler
+}
+
+// HandleMetric normalizes the tags of m and passes it on
+func (h *TagPolicyHandler) HandleMetric(m Metric) {
+	h.handle(m, h.Handler.HandleMetric)
+}
+
+// HandleMetrics normalizes the tags of the metrics of a datagram and passes them on at once
+func (h *TagPolicyHandler) HandleMetrics(ms []Metric) {
+	batchMetrics(ms, h.Handler, h.handle)
+}
+
+// handle normalizes the tags of m and emits it
+func (h *TagPolicyHandler) handle(m Metric, emit func(Metric)) {
+	var match *TagPolicy
+	for i := range h.Policies {
+		p := &h.Policies[i]
+		if strings.HasPrefix(m.Bucket, p.Prefix) && (match == nil || len(p.Prefix) > len(match.Prefix)) {
+			match = p
+		}
+	}
+	if match != nil && len(m.Tags) > 0 && m.Type != ERROR {
+		m.Tags = match.apply(m.Tags)
+	}
+	emit(m)
+}
@@ -0,0 +1,79 @@
+package statsd
+
+import (
+	"strings"
+)
+
+// TagRollup aggregates a copy of the metrics of the buckets starting with Prefix without
+// some of their tags, e.g. a fleet-wide total along with the total of each host
+type TagRollup struct {
+	Prefix string   `json:"prefix"`
+	Strip  []string `json:"strip"` // Keys of the tags the copy goes without
+}
+
+// strip returns tags without the tags stripped by the rollup, and whether any were
+func (r *TagRollup) strip(tags []string) ([]string, bool) {
+	var kept []string
+	for i, tag := range tags {
+		k, _ := splitTag(tag)
+		if !containsString(r.Strip, k) {
+			if kept != nil {
+				kept = append(kept, tag)
+			}
+			continue
+		}
+		if kept == nil {
+			kept = append(make([]string, 0, len(tags)), tags[:i]...)
+		}
+	}
+	if kept == nil {
+		return tags, false
+	}
+	return kept, true
+}
+
+// TagRollupHandler is a Handler that passes on each metric along with the copies of it
+// made by every rollup of Rules that matches it. Copies with the same tags are only passed
+// on once. Gauges aren't copied, as the last value of a gauge across its series means nothing.
+type TagRollupHandler struct {
+	Rules   []TagRollup
+	Handler Handler
+}
+
+// HandleMetric passes m and its copies on
+func (h *TagRollupHandler) HandleMetric(m Metric) {
+	h.handle(m, h.Handler.HandleMetric)
+}
+
+// HandleMetrics passes the metrics of a datagram and their copies on at once
+func (h *TagRollupHandler) HandleMetrics(ms []Metric) {
+	batchMetrics(ms, h.Handler, h.handle)
+}
+
+// handle emits m and its copies
+func (h *TagRollupHandler) handle(m Metric, emit func(Metric)) {
+	emit(m)
+	if m.Type == GAUGE || m.Type == ERROR || len(m.Tags) == 0 {
+		return
+	}
+
+	var seen []string
+	for i := range h.Rules {
+		r := &h.Rules[i]
+		if !strings.HasPrefix(m.Bucket, r.Prefix) {
+			continue
+		}
+		tags, stripped := r.strip(m.Tags)
+		if !stripped {
+			continue
+		}
+		key := strings.Join(tags, ",")
+		if containsString(seen, key) {
+			continue
+		}
+		seen = append(seen, key)
+		c := m
+		c.Tags = tags
+		emit(c)
+	}
+}
@@ -0,0 +1,55 @@
+package statsd
+
+import (
+	"net"
+	"time"
+)
+
+// ListenAndReceiveTCP listens on the TCP network address r.Addr and then calls ReceiveTCP.
+// If Addr is blank then DefaultMetricsAddr is used.
+func (r *MetricReceiver) ListenAndReceiveTCP() error {
+	addr := r.Addr
+	if addr == "" {
+		addr = DefaultMetricsAddr
+	}
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	return r.ReceiveTCP(l)
+}
+
+// ReceiveTCP accepts connections on l and calls r.Handler.HandleMetric() for each newline
+// terminated line received on them that successfully parses in to a Metric. While r.Queue
+// is full the connections aren't read, so TCP flow control slows the clients down. It
+// returns nil once l is closed.
+func (r *MetricReceiver) ReceiveTCP(l net.Listener) error {
+	defer l.Close()
+	var backoff time.Duration
+	for {
+		c, err := l.Accept()
+		if err != nil {
+			if retryRead(err, &backoff, r.logf) {
+				continue
+			}
+			return closedError(err)
+		}
+		backoff = 0
+		go func(c net.Conn) {
+			defer c.Close()
+			r.receiveStream(c.RemoteAddr(), c)
+		}(c)
+	}
+}
+
+// saturated reports whether r.Queue is full
+func (r *MetricReceiver) saturated() bool {
+	return r.Queue != nil && len(r.Queue) >= cap(r.Queue)
+}
+
+// waitQueue blocks while r.Queue is full
+func (r *MetricReceiver) waitQueue() {
+	for r.saturated() {
+		time.Sleep(10 * time.Millisecond)
+	}
+}
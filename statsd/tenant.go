@@ -0,0 +1,186 @@
+package statsd
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// TenantDroppedBucket is the internal counter of the metrics dropped by tenant quotas,
+// tagged with the name of the tenant
+const TenantDroppedBucket = "statsd.tenant_dropped"
+
+// Tenant describes one of the tenants sharing a server: the namespace its metrics are
+// aggregated in and the quotas they are subject to.
+type Tenant struct {
+	Name      string  `json:"name"`
+	Namespace string  `json:"namespace"`  // Prefix of the tenant's buckets, defaults to Name
+	MaxSeries int     `json:"max_series"` // Distinct series per interval, unlimited if zero
+	MaxRate   float64 `json:"max_rate"`   // Metrics per second, unlimited if zero
+	Listen    string  `json:"listen"`     // Address of a listener dedicated to the tenant, if any
+}
+
+// tenantState tracks the quotas of a tenant
+type tenantState struct {
+	Tenant
+	series  map[string]bool // series seen in the current interval
+	second  int64           // the second being rate limited and the metrics seen in it
+	count   float64
+	dropped float64 // metrics dropped in the current interval
+}
+
+// TenantHandler is a Handler that assigns each metric to a tenant, moves it in to the
+// tenant's namespace and enforces the tenant's quotas before passing it on to Handler.
+//
+// The tenant of a metric is the one of the listener it was received on, see Listener, or
+// otherwise the value of its TagKey tag, which is removed. Metrics that don't belong to a
+// known tenant are passed on untouched. While Run is running, the metrics dropped by the
+// quotas are counted in TenantDroppedBucket at the end of each interval.
+type TenantHandler struct {
+	Tenants  []Tenant
+	TagKey   string        // Tag whose value names the tenant, e.g. "tenant"
+	Interval time.Duration // Period over which MaxSeries applies, usually the flush interval
+	Handler  Handler
+
+	mu    sync.Mutex
+	state map[string]*tenantState
+}
+
+// HandleMetric assigns m to the tenant named by its tag
+func (h *TenantHandler) HandleMetric(m Metric) {
+	h.handle(m, "", h.Handler.HandleMetric)
+}
+
+// HandleMetrics assigns the metrics of a datagram to their tenants and passes those within
+// the quotas on at once
+func (h *TenantHandler) HandleMetrics(ms []Metric) {
+	batchMetrics(ms, h.Handler, func(m Metric, emit func(Metric)) {
+		h.handle(m, "", emit)
+	})
+}
+
+// Listener returns a Handler for a listener dedicated to the named tenant. Metrics received
+// by it belong to that tenant whatever their tags say.
+func (h *TenantHandler) Listener(tenant string) Handler {
+	return tenantListener{h, tenant}
+}
+
+// tenantListener is the Handler of a listener dedicated to a tenant
+type tenantListener struct {
+	handler *TenantHandler
+	tenant  string
+}
+
+// HandleMetric assigns m to the tenant
+func (l tenantListener) HandleMetric(m Metric) {
+	l.handler.handle(m, l.tenant, l.handler.Handler.HandleMetric)
+}
+
+// HandleMetrics assigns the metrics of a datagram to the tenant and passes those within
+// its quotas on at once
+func (l tenantListener) HandleMetrics(ms []Metric) {
+	batchMetrics(ms, l.handler.Handler, func(m Metric, emit func(Metric)) {
+		l.handler.handle(m, l.tenant, emit)
+	})
+}
+
+// handle moves m in to the namespace of its tenant, applies the tenant's quotas and emits
+// it if it is within them
+func (h *TenantHandler) handle(m Metric, tenant string, emit func(Metric)) {
+	if tenant == "" && h.TagKey != "" {
+		for _, tag := range m.Tags {
+			if k, v := splitTag(tag); k == h.TagKey {
+				tenant = v
+				break
+			}
+		}
+	}
+
+	now := time.Now()
+	h.mu.Lock()
+	t := h.tenant(tenant)
+	if t == nil {
+		h.mu.Unlock()
+		emit(m)
+		return
+	}
+	if h.TagKey != "" {
+		tags := make([]string, 0, len(m.Tags))
+		for _, tag := range m.Tags {
+			if k, _ := splitTag(tag); k != h.TagKey {
+				tags = append(tags, tag)
+			}
+		}
+		m.Tags = tags
+	}
+	m.Bucket = t.Namespace + "." + m.Bucket
+	ok := h.admit(t, m.Key(), now)
+	h.mu.Unlock()
+
+	if ok {
+		emit(m)
+	}
+}
+
+// Run starts a new interval every Interval until the program exits
+func (h *TenantHandler) Run() {
+	runIntervals(h.Interval, h.endInterval, h.Handler)
+}
+
+// tenant returns the state of the named tenant, or nil if there is no such tenant.
+// The caller must hold the lock.
+func (h *TenantHandler) tenant(name string) *tenantState {
+	if name == "" {
+		return nil
+	}
+	if h.state == nil {
+		h.state = make(map[string]*tenantState)
+		for _, t := range h.Tenants {
+			if t.Namespace == "" {
+				t.Namespace = t.Name
+			}
+			h.state[t.Name] = &tenantState{Tenant: t, series: make(map[string]bool)}
+		}
+	}
+	return h.state[name]
+}
+
+// endInterval starts a new interval and returns the counters of the metrics dropped from
+// each tenant during the one that ended
+func (h *TenantHandler) endInterval() []Metric {
+	defer h.mu.Unlock()
+	h.mu.Lock()
+
+	var dropped []Metric
+	for _, t := range h.state {
+		if t.dropped > 0 {
+			dropped = append(dropped, Metric{Type: COUNTER, Bucket: TenantDroppedBucket, Value: t.dropped, SampleRate: 1, Tags: []string{"tenant:" + t.Name}})
+		}
+		t.dropped = 0
+		t.series = make(map[string]bool)
+	}
+	sort.Slice(dropped, func(i, j int) bool { return dropped[i].Tags[0] < dropped[j].Tags[0] })
+	return dropped
+}
+
+// admit applies the quotas of t to a metric of the series key. The caller must hold the lock.
+func (h *TenantHandler) admit(t *tenantState, key string, now time.Time) bool {
+	if t.MaxRate > 0 {
+		if sec := now.Unix(); sec != t.second {
+			t.second, t.count = sec, 0
+		}
+		if t.count >= t.MaxRate {
+			t.dropped++
+			return false
+		}
+		t.count++
+	}
+	if t.MaxSeries > 0 && !t.series[key] {
+		if len(t.series) >= t.MaxSeries {
+			t.dropped++
+			return false
+		}
+		t.series[key] = true
+	}
+	return true
+}
@@ -0,0 +1,70 @@
+package statsd
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestTenantHandler(t *testing.T) {
+	tests := []struct {
+		name     string
+		listener string // Tenant of the listener the metric is received on, if any
+		tags     []string
+		bucket   string
+		expected []string // Tags passed on
+	}{
+		{"tagged", "", []string{"env:prod", "tenant:acme"}, "acme.requests", []string{"env:prod"}},
+		{"namespace", "", []string{"tenant:globex"}, "gx.requests", nil},
+		{"unknown tenant", "", []string{"tenant:initech", "env:prod"}, "requests", []string{"tenant:initech", "env:prod"}},
+		{"untagged", "", []string{"env:prod"}, "requests", []string{"env:prod"}},
+		{"listener", "globex", nil, "gx.requests", nil},
+		{"listener over tag", "globex", []string{"tenant:acme", "env:prod"}, "gx.requests", []string{"env:prod"}},
+	}
+
+	for _, tc := range tests {
+		var got []Metric
+		h := &TenantHandler{
+			Tenants:  []Tenant{{Name: "acme"}, {Name: "globex", Namespace: "gx"}},
+			TagKey:   "tenant",
+			Interval: 10 * time.Second,
+			Handler:  HandlerFunc(func(m Metric) { got = append(got, m) }),
+		}
+		var handler Handler = h
+		if tc.listener != "" {
+			handler = h.Listener(tc.listener)
+		}
+		handler.HandleMetric(Metric{Type: COUNTER, Bucket: "requests", Value: 1, SampleRate: 1, Tags: tc.tags})
+		if len(got) != 1 {
+			t.Errorf("test %s: expected the metric to be passed on, got %v", tc.name, got)
+			continue
+		}
+		if got[0].Bucket != tc.bucket {
+			t.Errorf("test %s: expected bucket %s, got %s", tc.name, tc.bucket, got[0].Bucket)
+		}
+		if strings.Join(got[0].Tags, ",") != strings.Join(tc.expected, ",") {
+			t.Errorf("test %s: expected tags %v, got %v", tc.name, tc.expected, got[0].Tags)
+		}
+	}
+}
+
+func TestTenantQuotas(t *testing.T) {
+	var got []Metric
+	h := &TenantHandler{
+		Tenants:  []Tenant{{Name: "acme", MaxSeries: 2}},
+		TagKey:   "tenant",
+		Interval: 10 * time.Second,
+		Handler:  HandlerFunc(func(m Metric) { got = append(got, m) }),
+	}
+	for _, bucket := range []string{"a", "b", "c", "a"} {
+		h.HandleMetric(Metric{Type: COUNTER, Bucket: bucket, Value: 1, SampleRate: 1, Tags: []string{"tenant:acme"}})
+	}
+	if len(got) != 3 {
+		t.Errorf("expected the third series to be dropped, got %v", got)
+	}
+
+	dropped := h.endInterval()
+	if len(dropped) != 1 || dropped[0].Value != 1 || dropped[0].Tags[0] != "tenant:acme" {
+		t.Errorf("expected one metric dropped from acme, got %v", dropped)
+	}
+}
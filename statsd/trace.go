@@ -0,0 +1,68 @@
+package statsd
+
+import (
+	"log"
+	"net"
+	"sort"
+	"sync"
+	"sync/atomic"
+)
+
+// tracedSources holds the source IPs whose metrics are logged line by line regardless
+// of the log level. numTraced lets the receivers skip the lookup while nothing is traced.
+var (
+	tracedMu      sync.RWMutex
+	tracedSources = make(map[string]bool)
+	numTraced     int32
+)
+
+// TraceSource starts logging every line received from the source IP ip
+func TraceSource(ip string) {
+	defer tracedMu.Unlock()
+	tracedMu.Lock()
+	tracedSources[ip] = true
+	atomic.StoreInt32(&numTraced, int32(len(tracedSources)))
+}
+
+// UntraceSource stops logging the lines received from the source IP ip
+func UntraceSource(ip string) {
+	defer tracedMu.Unlock()
+	tracedMu.Lock()
+	delete(tracedSources, ip)
+	atomic.StoreInt32(&numTraced, int32(len(tracedSources)))
+}
+
+// TracedSources returns the source IPs currently traced
+func TracedSources() []string {
+	defer tracedMu.RUnlock()
+	tracedMu.RLock()
+	ips := make([]string, 0, len(tracedSources))
+	for ip := range tracedSources {
+		ips = append(ips, ip)
+	}
+	sort.Strings(ips)
+	return ips
+}
+
+// traced reports whether the lines received from addr should be logged
+func traced(addr net.Addr) bool {
+	if atomic.LoadInt32(&numTraced) == 0 || addr == nil {
+		return false
+	}
+	ip, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		ip = addr.String()
+	}
+	defer tracedMu.RUnlock()
+	tracedMu.RLock()
+	return tracedSources[ip]
+}
+
+// trace logs a line received from a traced source along with the outcome of parsing it
+func trace(addr net.Addr, line []byte, m Metric, err error) {
+	if err != nil {
+		log.Printf("trace %s: %q: %s", addr, line, err)
+	} else {
+		log.Printf("trace %s: %q: %s", addr, line, m)
+	}
+}
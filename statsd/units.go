@@ -0,0 +1,69 @@
+package statsd
+
+import (
+	"fmt"
+)
+
+// TimeUnit is the unit of the values of timers. Timers are aggregated in milliseconds,
+// as the statsd protocol specifies.
+type TimeUnit string
+
+// TimeUnits understood by ParseTimeUnit
+const (
+	Seconds      TimeUnit = "s"
+	Milliseconds TimeUnit = "ms"
+	Microseconds TimeUnit = "us"
+)
+
+// ParseTimeUnit returns the TimeUnit named s, milliseconds if s is empty
+func ParseTimeUnit(s string) (TimeUnit, error) {
+	switch TimeUnit(s) {
+	case "", Milliseconds:
+		return Milliseconds, nil
+	case Seconds, Microseconds:
+		return TimeUnit(s), nil
+	}
+	return "", fmt.Errorf("unknown time unit %q, expected s, ms or us", s)
+}
+
+// Milliseconds returns the number of milliseconds in one u
+func (u TimeUnit) Milliseconds() float64 {
+	switch u {
+	case Seconds:
+		return 1000
+	case Microseconds:
+		return 0.001
+	}
+	return 1
+}
+
+// TimerUnitHandler is a Handler that converts the values of timers sent in Unit to
+// milliseconds before passing them on to Handler
+type TimerUnitHandler struct {
+	Unit    TimeUnit
+	Handler Handler
+}
+
+// HandleMetric converts m if it's a timer and passes it on
+func (h *TimerUnitHandler) HandleMetric(m Metric) {
+	if m.Type == TIMER {
+		m.Value *= h.Unit.Milliseconds()
+	}
+	h.Handler.HandleMetric(m)
+}
+
+// HandleMetrics converts the timers of a datagram and passes its metrics on at once
+func (h *TimerUnitHandler) HandleMetrics(ms []Metric) {
+	for i := range ms {
+		if ms[i].Type == TIMER {
+			ms[i].Value *= h.Unit.Milliseconds()
+		}
+	}
+	handleMetrics(h.Handler, ms)
+}
+
+// isDurationStat reports whether a flushed timer statistic, such as "mean" or "upper_95",
+// is a duration rather than a count
+func isDurationStat(stat string) bool {
+	return stat != "count" && stat != "count_ps"
+}
@@ -1,5 +1,10 @@
 package statsd
 
+import (
+	"path"
+	"strings"
+)
+
 /* import (
 	"math"
 )
@@ -29,3 +34,34 @@ func average(vals []float64) float64 {
 	}
 	return sum / float64(len(vals))
 }
+
+// percentile returns the value below which pct percent of the sorted values fall
+func percentile(sorted []float64, pct float64) float64 {
+	i := round(pct*float64(len(sorted))/100.0) - 1
+	if i < 0 {
+		i = 0
+	}
+	return sorted[i]
+}
+
+// matchPattern reports whether a dot separated metric name matches pattern. Each component
+// of the pattern is matched against the corresponding component of the name like
+// path.Match, so * never matches across dots.
+// Tags are ignored, so a pattern matches every tagged series of a name.
+func matchPattern(pattern, name string) bool {
+	if pattern == name {
+		return true
+	}
+	name, _ = SplitKey(name)
+	pp := strings.Split(pattern, ".")
+	np := strings.Split(name, ".")
+	if len(pp) != len(np) {
+		return false
+	}
+	for i := range pp {
+		if ok, _ := path.Match(pp[i], np[i]); !ok {
+			return false
+		}
+	}
+	return true
+}
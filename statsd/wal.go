@@ -0,0 +1,150 @@
+package statsd
+
+import (
+	"bufio"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// WriteAheadLog journals raw metrics to disk before they are aggregated, so that metrics
+// which were received but never successfully flushed can be replayed after a crash.
+//
+// The log is made of segment files in Dir, one per flush interval. A segment is only
+// removed once the interval it belongs to has been sent, so a failed flush is replayed
+// on the next start as well.
+//
+// Appended metrics are buffered, and written to the file by Flush or once the buffer
+// fills up, so they don't cost a write each.
+type WriteAheadLog struct {
+	sync.Mutex
+	Dir      string
+	seq      int
+	file     *os.File
+	buf      *bufio.Writer
+	segments []string // segments holding the metrics of the current interval
+	replay   []string // segments left over from a previous run
+}
+
+// OpenWriteAheadLog opens the write-ahead log in dir, creating the directory if needed.
+// Segments left over from a previous run are replayed by Replay and committed together
+// with the first interval.
+func OpenWriteAheadLog(dir string) (*WriteAheadLog, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	old, err := filepath.Glob(filepath.Join(dir, "*.wal"))
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(old)
+
+	l := &WriteAheadLog{Dir: dir, replay: old}
+	if len(old) > 0 {
+		l.seq, _ = strconv.Atoi(strings.TrimSuffix(filepath.Base(old[len(old)-1]), ".wal"))
+	}
+	if err := l.openSegment(); err != nil {
+		return nil, err
+	}
+	l.segments = append(old, l.segments...)
+	return l, nil
+}
+
+// openSegment starts a new segment file
+func (l *WriteAheadLog) openSegment() error {
+	name := filepath.Join(l.Dir, fmt.Sprintf("%020d.wal", l.seq+1))
+	f, err := os.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	l.seq++
+	l.file = f
+	l.buf = bufio.NewWriter(f)
+	l.segments = []string{name}
+	return nil
+}
+
+// Replay calls f for each metric found in the segments left over from a previous run. It
+// returns the number of lines skipped because they couldn't be parsed.
+func (l *WriteAheadLog) Replay(f func(Metric)) (skipped int, err error) {
+	for _, name := range l.replay {
+		file, err := os.Open(name)
+		if err != nil {
+			return skipped, err
+		}
+		scanner := bufio.NewScanner(file)
+		for scanner.Scan() {
+			// A crash can leave a partially written last line behind
+			m, err := parseLine(scanner.Bytes())
+			if err != nil {
+				skipped++
+				continue
+			}
+			f(m)
+		}
+		file.Close()
+		if err := scanner.Err(); err != nil {
+			return skipped, err
+		}
+	}
+	l.replay = nil
+	return skipped, nil
+}
+
+// Append journals m to the current segment. It is buffered until the next Flush.
+func (l *WriteAheadLog) Append(m Metric) error {
+	defer l.Unlock()
+	l.Lock()
+
+	_, err := l.buf.Write(formatLine(m))
+	return err
+}
+
+// Flush writes the metrics appended so far to the current segment, so they survive a
+// crash of the process
+func (l *WriteAheadLog) Flush() error {
+	defer l.Unlock()
+	l.Lock()
+	return l.buf.Flush()
+}
+
+// Rotate closes the current segment and starts a new one. It returns the segments holding
+// the metrics appended since the last rotation, which should be passed to Commit once
+// they have been flushed. If it fails the current segment is kept, so the metrics it
+// holds are committed with those of the next rotation.
+func (l *WriteAheadLog) Rotate() ([]string, error) {
+	defer l.Unlock()
+	l.Lock()
+
+	if err := l.buf.Flush(); err != nil {
+		return nil, err
+	}
+	old, segments := l.file, l.segments
+	if err := l.openSegment(); err != nil {
+		return nil, err
+	}
+	// The metrics of the old segment have been written; syncing them is only an extra
+	// safeguard against a crash of the host, so they are committed regardless
+	if err := old.Sync(); err != nil {
+		log.Printf("Syncing journal segment failed: %s", err)
+	}
+	if err := old.Close(); err != nil {
+		log.Printf("Closing journal segment failed: %s", err)
+	}
+	return segments, nil
+}
+
+// Commit removes segments whose metrics have been successfully flushed
+func (l *WriteAheadLog) Commit(segments []string) error {
+	for _, name := range segments {
+		if err := os.Remove(name); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return nil
+}
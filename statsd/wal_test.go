@@ -0,0 +1,126 @@
+package statsd
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestWriteAheadLog(t *testing.T) {
+	foo := Metric{Bucket: "foo", Value: 2, Type: COUNTER, SampleRate: 1}
+	bar := Metric{Bucket: "bar", Value: 10, Type: TIMER, SampleRate: 0.5, Tags: []string{"env:prod"}}
+
+	tests := map[string]struct {
+		append   []Metric
+		commit   bool   // whether the rotated segments are committed before reopening
+		garbage  string // appended to the last segment, as left by a crash
+		expected []Metric
+		skipped  int
+	}{
+		"uncommitted": {append: []Metric{foo, bar}, expected: []Metric{foo, bar}},
+		"committed":   {append: []Metric{foo, bar}, commit: true},
+		"partial":     {append: []Metric{foo}, garbage: "bar:1|", expected: []Metric{foo}, skipped: 1},
+		"garbage":     {append: []Metric{bar}, garbage: "not a metric\nfoo:2|c\n", expected: []Metric{bar, foo}, skipped: 1},
+	}
+
+	for name, tc := range tests {
+		dir, err := ioutil.TempDir("", "wal")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll(dir)
+
+		l, err := OpenWriteAheadLog(dir)
+		if err != nil {
+			t.Fatalf("test %s: %s", name, err)
+		}
+		for _, m := range tc.append {
+			if err := l.Append(m); err != nil {
+				t.Fatalf("test %s: %s", name, err)
+			}
+		}
+		segments, err := l.Rotate()
+		if err != nil {
+			t.Fatalf("test %s: %s", name, err)
+		}
+		if tc.commit {
+			if err := l.Commit(segments); err != nil {
+				t.Fatalf("test %s: %s", name, err)
+			}
+		}
+		if tc.garbage != "" {
+			f, err := os.OpenFile(segments[len(segments)-1], os.O_WRONLY|os.O_APPEND, 0644)
+			if err != nil {
+				t.Fatalf("test %s: %s", name, err)
+			}
+			f.WriteString(tc.garbage)
+			f.Close()
+		}
+
+		l, err = OpenWriteAheadLog(dir)
+		if err != nil {
+			t.Fatalf("test %s: %s", name, err)
+		}
+		var replayed []Metric
+		skipped, err := l.Replay(func(m Metric) { replayed = append(replayed, m) })
+		if err != nil {
+			t.Errorf("test %s: %s", name, err)
+			continue
+		}
+		if !reflect.DeepEqual(replayed, tc.expected) {
+			t.Errorf("test %s: expected %v, got %v", name, tc.expected, replayed)
+		}
+		if skipped != tc.skipped {
+			t.Errorf("test %s: expected %d skipped, got %d", name, tc.skipped, skipped)
+		}
+
+		// Committing the first interval removes the replayed segments as well
+		segments, err = l.Rotate()
+		if err != nil {
+			t.Fatalf("test %s: %s", name, err)
+		}
+		if err := l.Commit(segments); err != nil {
+			t.Fatalf("test %s: %s", name, err)
+		}
+		left, _ := filepath.Glob(filepath.Join(dir, "*.wal"))
+		if len(left) != 1 {
+			t.Errorf("test %s: expected only the current segment left, got %v", name, left)
+		}
+	}
+}
+
+func TestWriteAheadLogRotateFailure(t *testing.T) {
+	dir, err := ioutil.TempDir("", "wal")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	l, err := OpenWriteAheadLog(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	foo := Metric{Bucket: "foo", Value: 1, Type: COUNTER, SampleRate: 1}
+	l.Append(foo)
+
+	// The next segment can't be created, so the current one is kept
+	l.Dir = filepath.Join(dir, "missing")
+	if _, err := l.Rotate(); err == nil {
+		t.Fatal("expected rotating to fail")
+	}
+	l.Append(foo)
+	l.Dir = dir
+	segments, err := l.Rotate()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var replayed []Metric
+	reopened := &WriteAheadLog{replay: segments}
+	reopened.Replay(func(m Metric) { replayed = append(replayed, m) })
+	if expected := []Metric{foo, foo}; !reflect.DeepEqual(replayed, expected) {
+		t.Errorf("expected %v in the committed segments, got %v", expected, replayed)
+	}
+}
@@ -0,0 +1,102 @@
+package statsd
+
+import (
+	"runtime"
+	"sync/atomic"
+	"time"
+)
+
+// Buckets of the internal metrics reported by a Watchdog
+const (
+	WatchdogQueueBucket      = "statsd.watchdog.queue_fill"
+	WatchdogGoroutinesBucket = "statsd.watchdog.goroutines"
+	WatchdogFlushBucket      = "statsd.watchdog.flush_seconds"
+	WatchdogRejectedBucket   = "statsd.watchdog.rejected"
+)
+
+// Watchdog keeps an eye on the pressure the server is under: how full the aggregation
+// queue of Aggregator is, how many goroutines handle metrics and how long flushes take.
+// Every Interval it passes them to Handler as internal metrics and logs when one of them
+// crosses its threshold and when it is back under it.
+//
+// Receivers whose Watchdog is set also drop datagrams and turn HTTP requests away while
+// the queue is fuller than RejectQueue or there are more goroutines than RejectGoroutines,
+// which sheds load before the server runs out of memory.
+type Watchdog struct {
+	Aggregator *MetricAggregator
+	Handler    Handler       // If set, where the internal metrics are sent
+	Interval   time.Duration // How often the thresholds are checked, every 10s if zero
+
+	MaxQueue        float64       // If set, fraction of the queue capacity over which to warn
+	MaxGoroutines   int           // If set, number of goroutines over which to warn
+	MaxFlushLatency time.Duration // If set, flush duration over which to warn
+
+	RejectQueue      float64 // If set, fraction of the queue capacity over which to reject metrics
+	RejectGoroutines int     // If set, number of goroutines over which to reject metrics
+
+	rejected int64
+}
+
+// Rejecting reports whether the server is under so much pressure that new metrics should
+// be rejected, and counts the rejection if so
+func (w *Watchdog) Rejecting() bool {
+	if w.RejectQueue > 0 && w.Aggregator.queueFill() >= w.RejectQueue ||
+		w.RejectGoroutines > 0 && runtime.NumGoroutine() >= w.RejectGoroutines {
+		atomic.AddInt64(&w.rejected, 1)
+		return true
+	}
+	return false
+}
+
+// Rejected returns the number of datagrams and requests rejected so far
+func (w *Watchdog) Rejected() int64 {
+	return atomic.LoadInt64(&w.rejected)
+}
+
+// Run checks the thresholds every Interval until the program exits
+func (w *Watchdog) Run() {
+	interval := w.Interval
+	if interval <= 0 {
+		interval = 10 * time.Second
+	}
+	var queueHigh, goroutinesHigh, flushHigh bool
+	var lastRejected int64
+	for _ = range time.Tick(interval) {
+		fill := w.Aggregator.queueFill()
+		goroutines := runtime.NumGoroutine()
+		w.Aggregator.Lock()
+		flush := w.Aggregator.Stats.FlushDuration
+		w.Aggregator.Unlock()
+		rejected := w.Rejected()
+
+		queueHigh = w.check(queueHigh, w.MaxQueue > 0 && fill > w.MaxQueue,
+			"aggregation queue %.0f%% full", fill*100)
+		goroutinesHigh = w.check(goroutinesHigh, w.MaxGoroutines > 0 && goroutines > w.MaxGoroutines,
+			"%d goroutines running", goroutines)
+		flushHigh = w.check(flushHigh, w.MaxFlushLatency > 0 && flush > w.MaxFlushLatency,
+			"last flush took %s", flush)
+		if rejected > lastRejected {
+			infof("watchdog: rejected %d datagrams or requests under pressure", rejected-lastRejected)
+		}
+
+		if w.Handler != nil {
+			w.Handler.HandleMetric(Metric{Type: GAUGE, Bucket: WatchdogQueueBucket, Value: fill, SampleRate: 1})
+			w.Handler.HandleMetric(Metric{Type: GAUGE, Bucket: WatchdogGoroutinesBucket, Value: float64(goroutines), SampleRate: 1})
+			w.Handler.HandleMetric(Metric{Type: GAUGE, Bucket: WatchdogFlushBucket, Value: flush.Seconds(), SampleRate: 1})
+			w.Handler.HandleMetric(Metric{Type: COUNTER, Bucket: WatchdogRejectedBucket, Value: float64(rejected - lastRejected), SampleRate: 1})
+		}
+		lastRejected = rejected
+	}
+}
+
+// check logs when a threshold is crossed, whose state was high before, and returns its
+// new state
+func (w *Watchdog) check(high, over bool, format string, v ...interface{}) bool {
+	switch {
+	case over && !high:
+		infof("watchdog: "+format, v...)
+	case !over && high:
+		infof("watchdog: back to normal, "+format, v...)
+	}
+	return over
+}
@@ -0,0 +1,68 @@
+package statsd
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+// WavefrontClient sends metrics in the Wavefront data format, either to a Wavefront proxy
+// over TCP or directly to the ingestion API of a Wavefront instance
+type WavefrontClient struct {
+	ProxyAddr string // Address of the proxy, usually port 2878
+	URL       string // If ProxyAddr is blank, URL of the instance, e.g. "https://example.wavefront.com"
+	Token     string // API token for direct ingestion
+	Source    string // Source of the points, the host name if blank
+}
+
+// SendMetrics sends the metrics in a MetricMap to Wavefront
+func (c *WavefrontClient) SendMetrics(metrics MetricMap) error {
+	return c.SendMetricsAt(metrics, time.Now())
+}
+
+// SendMetricsAt sends the metrics in a MetricMap to Wavefront with the timestamp t
+func (c *WavefrontClient) SendMetricsAt(metrics MetricMap, t time.Time) error {
+	source := c.Source
+	if source == "" {
+		source, _ = os.Hostname()
+	}
+	buf := new(bytes.Buffer)
+	for k, v := range metrics {
+		name, tags := SplitKey(k)
+		fmt.Fprintf(buf, "%s %f %d source=%s", wavefrontQuote(name), v, t.Unix(), wavefrontQuote(source))
+		for _, tag := range tags {
+			k, v := splitTag(tag)
+			if v == "" {
+				v = "true"
+			}
+			fmt.Fprintf(buf, " %s=%s", wavefrontQuote(k), wavefrontQuote(v))
+		}
+		buf.WriteByte('\n')
+	}
+
+	if c.ProxyAddr != "" {
+		conn, err := dialer.Dial("tcp", c.ProxyAddr)
+		if err != nil {
+			return err
+		}
+		defer conn.Close()
+		_, err = buf.WriteTo(conn)
+		return err
+	}
+
+	req, err := http.NewRequest("POST", strings.TrimSuffix(c.URL, "/")+"/report?f=wavefront", buf)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "text/plain")
+	req.Header.Set("Authorization", "Bearer "+c.Token)
+	return doRequest(req)
+}
+
+// wavefrontQuote quotes s as Wavefront expects metric names, sources and point tags
+func wavefrontQuote(s string) string {
+	return `"` + strings.Replace(s, `"`, `\"`, -1) + `"`
+}
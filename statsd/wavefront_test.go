@@ -0,0 +1,91 @@
+package statsd
+
+import (
+	"bufio"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// capturedRequest is a request received by a server of captureServer
+type capturedRequest struct {
+	Method string
+	URL    string
+	Header http.Header
+	Body   []byte
+}
+
+// captureServer starts an HTTP server answering every request with 200 and sending it on
+// the returned channel
+func captureServer() (*httptest.Server, chan capturedRequest) {
+	requests := make(chan capturedRequest, 16)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		requests <- capturedRequest{r.Method, r.URL.String(), r.Header, body}
+	}))
+	return server, requests
+}
+
+func TestWavefrontFormat(t *testing.T) {
+	tests := map[string]string{
+		"stats.gauges.foo":                 `"stats.gauges.foo" 1.500000 1500000000 source="web1"`,
+		"stats.counters.foo;region:eu":     `"stats.counters.foo" 1.500000 1500000000 source="web1" "region"="eu"`,
+		"stats.counters.foo;canary;host:a": `"stats.counters.foo" 1.500000 1500000000 source="web1" "canary"="true" "host"="a"`,
+		`stats.gauges.say;quote:"hi"`:      `"stats.gauges.say" 1.500000 1500000000 source="web1" "quote"="\"hi\""`,
+	}
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	lines := make(chan string, len(tests))
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			s := bufio.NewScanner(conn)
+			for s.Scan() {
+				lines <- s.Text()
+			}
+			conn.Close()
+		}
+	}()
+
+	c := &WavefrontClient{ProxyAddr: l.Addr().String(), Source: "web1"}
+	for key, expected := range tests {
+		if err := c.SendMetricsAt(MetricMap{key: 1.5}, time.Unix(1500000000, 0)); err != nil {
+			t.Errorf("test %s error: %s", key, err)
+			continue
+		}
+		if result := <-lines; result != expected {
+			t.Errorf("test %s: expected %s, got %s", key, expected, result)
+		}
+	}
+}
+
+func TestWavefrontDirectIngestion(t *testing.T) {
+	server, requests := captureServer()
+	defer server.Close()
+
+	c := &WavefrontClient{URL: server.URL + "/", Token: "secret", Source: "web1"}
+	if err := c.SendMetricsAt(MetricMap{"stats.gauges.foo": 2}, time.Unix(1500000000, 0)); err != nil {
+		t.Fatal(err)
+	}
+	r := <-requests
+	if r.Method != "POST" || r.URL != "/report?f=wavefront" {
+		t.Errorf("expected POST /report?f=wavefront, got %s %s", r.Method, r.URL)
+	}
+	if auth := r.Header.Get("Authorization"); auth != "Bearer secret" {
+		t.Errorf("expected Bearer secret, got %s", auth)
+	}
+	expected := "\"stats.gauges.foo\" 2.000000 1500000000 source=\"web1\"\n"
+	if string(r.Body) != expected {
+		t.Errorf("expected %q, got %q", expected, r.Body)
+	}
+}
@@ -10,6 +10,7 @@ import (
 type WebConsoleServer struct {
 	Addr       string
 	Aggregator *MetricAggregator
+	Stream     *MetricStream // If set, served as a WebSocket stream at /stream
 }
 
 const tempText = `
@@ -60,6 +61,10 @@ table, th, td {
 var temp = template.Must(template.New("temp").Parse(tempText))
 
 func (s *WebConsoleServer) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if req.URL.Path == "/stream" && s.Stream != nil {
+		s.Stream.ServeHTTP(w, req)
+		return
+	}
 	defer s.Aggregator.Unlock()
 	s.Aggregator.Lock()
 	err := temp.Execute(w, s.Aggregator)
@@ -0,0 +1,99 @@
+package statsd
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"text/template"
+	"time"
+)
+
+// DefaultWebhookTemplate is the body posted by a WebhookClient without a template, the
+// same JSON snapshot as the message queue backends
+const DefaultWebhookTemplate = `{"time": {{.Time.Unix}}, "metrics": {{json .Metrics}}}`
+
+// webhookFuncs are the functions available to webhook templates besides the builtin ones
+var webhookFuncs = template.FuncMap{
+	// json encodes a value as JSON
+	"json": func(v interface{}) (string, error) {
+		b, err := json.Marshal(v)
+		return string(b), err
+	},
+	// name returns the name of a flushed metric without its tags
+	"name": func(key string) string {
+		name, _ := SplitKey(key)
+		return name
+	},
+	// tags returns the tags of a flushed metric as a map of their keys to their values
+	"tags": func(key string) map[string]string {
+		_, tags := SplitKey(key)
+		m := make(map[string]string, len(tags))
+		for _, tag := range tags {
+			k, v := splitTag(tag)
+			m[k] = v
+		}
+		return m
+	},
+}
+
+// WebhookData is the data a webhook template is executed with
+type WebhookData struct {
+	Time    time.Time
+	Metrics MetricMap
+}
+
+// WebhookClient posts each flush to an HTTP endpoint with a body rendered by a Go text
+// template from a WebhookData. Templates can use the functions json, name and tags, e.g.
+//
+//	{{range $k, $v := .Metrics}}{{name $k}} {{$v}}{{"\n"}}{{end}}
+type WebhookClient struct {
+	URL         string
+	Method      string            // "POST" if blank
+	ContentType string            // "application/json" if blank
+	Headers     map[string]string // e.g. an Authorization header
+
+	template *template.Template
+}
+
+// NewWebhookClient returns a WebhookClient for url rendering bodies with text, or with
+// DefaultWebhookTemplate if text is blank
+func NewWebhookClient(url, text string) (*WebhookClient, error) {
+	if text == "" {
+		text = DefaultWebhookTemplate
+	}
+	t, err := template.New("webhook").Funcs(webhookFuncs).Parse(text)
+	if err != nil {
+		return nil, err
+	}
+	return &WebhookClient{URL: url, template: t}, nil
+}
+
+// SendMetrics sends the metrics in a MetricMap to the webhook
+func (c *WebhookClient) SendMetrics(metrics MetricMap) error {
+	return c.SendMetricsAt(metrics, time.Now())
+}
+
+// SendMetricsAt sends the metrics in a MetricMap to the webhook with the timestamp t
+func (c *WebhookClient) SendMetricsAt(metrics MetricMap, t time.Time) error {
+	body := new(bytes.Buffer)
+	if err := c.template.Execute(body, WebhookData{t, finiteMetrics(metrics)}); err != nil {
+		return err
+	}
+	method := c.Method
+	if method == "" {
+		method = "POST"
+	}
+	req, err := http.NewRequest(method, c.URL, body)
+	if err != nil {
+		return err
+	}
+	contentType := c.ContentType
+	if contentType == "" {
+		contentType = "application/json"
+	}
+	req.Header.Set("Content-Type", contentType)
+	for k, v := range c.Headers {
+		req.Header.Set(k, v)
+	}
+	return doRequest(req)
+}
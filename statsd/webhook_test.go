@@ -0,0 +1,64 @@
+package statsd
+
+import (
+	"testing"
+	"time"
+)
+
+func TestWebhookTemplates(t *testing.T) {
+	tests := map[string]string{
+		"": `{"time": 1500000000, "metrics": {"stats.gauges.foo;host:a":1.5}}`,
+		`{{range $k, $v := .Metrics}}{{name $k}} {{$v}}{{"\n"}}{{end}}`:                "stats.gauges.foo 1.5\n",
+		`{{range $k, $v := .Metrics}}{{(tags $k).host}} {{$.Time.Unix}}{{end}}`:        "a 1500000000",
+		`{{range $k, $v := .Metrics}}{{json (tags $k)}}{{end}}`:                        `{"host":"a"}`,
+		`{{$t := .Time}}{{range $k, $v := .Metrics}}{{$t.Format "2006-01-02"}}{{end}}`: "2017-07-14",
+	}
+
+	server, requests := captureServer()
+	defer server.Close()
+
+	for text, expected := range tests {
+		c, err := NewWebhookClient(server.URL+"/hook", text)
+		if err != nil {
+			t.Errorf("test %s error: %s", text, err)
+			continue
+		}
+		if err := c.SendMetricsAt(MetricMap{"stats.gauges.foo;host:a": 1.5}, time.Unix(1500000000, 0).UTC()); err != nil {
+			t.Errorf("test %s error: %s", text, err)
+			continue
+		}
+		if body := string((<-requests).Body); body != expected {
+			t.Errorf("test %s: expected %s, got %s", text, expected, body)
+		}
+	}
+
+	if _, err := NewWebhookClient(server.URL, "{{.Missing"); err == nil {
+		t.Errorf("expected error for an invalid template")
+	}
+}
+
+func TestWebhookRequest(t *testing.T) {
+	server, requests := captureServer()
+	defer server.Close()
+
+	c, err := NewWebhookClient(server.URL+"/hook", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.Method = "PUT"
+	c.ContentType = "text/plain"
+	c.Headers = map[string]string{"Authorization": "Bearer secret"}
+	if err := c.SendMetricsAt(MetricMap{}, time.Unix(1500000000, 0)); err != nil {
+		t.Fatal(err)
+	}
+	r := <-requests
+	if r.Method != "PUT" || r.URL != "/hook" {
+		t.Errorf("expected PUT /hook, got %s %s", r.Method, r.URL)
+	}
+	if typ := r.Header.Get("Content-Type"); typ != "text/plain" {
+		t.Errorf("expected Content-Type text/plain, got %s", typ)
+	}
+	if auth := r.Header.Get("Authorization"); auth != "Bearer secret" {
+		t.Errorf("expected Authorization Bearer secret, got %s", auth)
+	}
+}